@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/qga"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// NewExecCmd creates the `exec` subcommand, which runs a command in a VM
+// through the guest agent.
+func NewExecCmd() *cobra.Command {
+	var stdin bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "exec [name] -- command [args...]",
+		Short: "Run a command in a VM through the guest agent",
+		Long: `Run a command in a VM started with --guest-agent, without SSH or networking.
+The guest needs qemu-guest-agent running. The command is not run by a shell;
+its output is printed once it exits, and its exit status becomes q2boot's.
+The name can be left out when only one VM is running.`,
+		Example: `  q2boot exec web -- systemctl --failed
+  q2boot exec web -- sh -c 'journalctl -b | tail'
+  echo hello | q2boot exec web --stdin -- tee /tmp/hello`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			names, command := splitCommand(cmd, args)
+			if len(names) > 1 || len(command) == 0 {
+				return fmt.Errorf("expected [name] -- command [args...]")
+			}
+			var input []byte
+			if stdin {
+				var err error
+				if input, err = io.ReadAll(os.Stdin); err != nil {
+					return fmt.Errorf("failed to read standard input: %w", err)
+				}
+			}
+
+			rec, err := findRunningVM(names)
+			if err != nil {
+				return err
+			}
+			client, err := dialAgent(rec)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			status, err := client.Run(ctx, command[0], command[1:], input)
+			if err != nil {
+				return fmt.Errorf("failed to run '%s' in VM '%s': %w", strings.Join(command, " "), rec.Name, err)
+			}
+
+			os.Stdout.Write(status.Stdout)
+			os.Stderr.Write(status.Stderr)
+			if status.StdoutTruncated || status.StderrTruncated {
+				fmt.Fprintln(os.Stderr, "Warning: the guest agent truncated the output")
+			}
+			switch {
+			case status.Signal != 0:
+				os.Exit(128 + status.Signal)
+			case status.ExitCode != 0:
+				os.Exit(status.ExitCode)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&stdin, "stdin", false, "Pass q2boot's standard input to the command")
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", 0, "Give up waiting for the command after this long (default: no limit)")
+	return cmd
+}
+
+// NewIPCmd creates the `ip` subcommand, which shows the network interfaces of
+// a VM as seen by the guest agent.
+func NewIPCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ip [name]",
+		Short: "Show the network interfaces of a VM through the guest agent",
+		Long: `Show the network interfaces and addresses of a VM started with --guest-agent.
+The guest needs qemu-guest-agent running. The name can be left out when only
+one VM is running.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rec, err := findRunningVM(args)
+			if err != nil {
+				return err
+			}
+			client, err := dialAgent(rec)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+			defer cancel()
+			interfaces, err := client.NetworkInterfaces(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to query the network interfaces of VM '%s': %w", rec.Name, err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "INTERFACE\tMAC\tADDRESSES")
+			for _, iface := range interfaces {
+				var addrs []string
+				for _, addr := range iface.IPAddresses {
+					addrs = append(addrs, addr.String())
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", iface.Name, iface.HardwareAddress, strings.Join(addrs, " "))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// splitCommand splits the arguments of a command taking [name] -- command.
+func splitCommand(cmd *cobra.Command, args []string) (names, command []string) {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		return args[:dash], args[dash:]
+	}
+	return args, nil
+}
+
+// dialAgent connects to the guest agent of a running VM.
+func dialAgent(rec *state.Record) (*qga.Client, error) {
+	if rec.AgentSocket == "" {
+		return nil, fmt.Errorf("VM '%s' was not started with --guest-agent", rec.Name)
+	}
+	client, err := qga.Dial(rec.AgentSocket, qga.DefaultDialTimeout)
+	if errors.Is(err, qga.ErrNotResponding) {
+		return nil, fmt.Errorf("the guest agent of VM '%s' is not responding; is qemu-guest-agent running in the guest?", rec.Name)
+	}
+	return client, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/console"
+)
+
+// NewConsoleCmd creates the `console` subcommand, which attaches the terminal
+// to the serial console of a detached VM.
+func NewConsoleCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "console <name>",
+		Short: "Attach to the serial console of a detached VM",
+		Long: `Attach the terminal to the serial console of a VM started with --detach.
+Press ` + console.EscapeKeyName + ` to detach again; the VM keeps running.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rec, err := loadRunningVM(args[0])
+			if err != nil {
+				return err
+			}
+			if rec.ConsoleSocket == "" {
+				return fmt.Errorf("VM '%s' was not started with --detach; its console is attached to the terminal that launched it", rec.Name)
+			}
+
+			conn, err := console.Dial(rec.ConsoleSocket, qmpCommandTimeout)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Connected to the console of '%s'. Press %s to detach.\n", rec.Name, console.EscapeKeyName)
+			restore, err := console.MakeRaw()
+			if err != nil {
+				conn.Close()
+				return err
+			}
+			err = console.Attach(conn, os.Stdin, os.Stdout)
+			restore()
+
+			switch {
+			case errors.Is(err, console.ErrDetached):
+				fmt.Printf("\nDetached from '%s'. It is still running.\n", rec.Name)
+				return nil
+			case err != nil:
+				return err
+			default:
+				fmt.Printf("\nConsole of '%s' closed.\n", rec.Name)
+				return nil
+			}
+		},
+	}
+}
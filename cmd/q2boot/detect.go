@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/detector"
+)
+
+// detectOptions holds the flags of the `detect` subcommand.
+type detectOptions struct {
+	jsonPath   string
+	strategies []string
+}
+
+// NewDetectCmd creates the `detect` subcommand, which shows the verdict of
+// every architecture detection strategy on a disk image.
+func NewDetectCmd() *cobra.Command {
+	opts := &detectOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "detect [flags] <image>",
+		Short: "Show what each architecture detection strategy finds in a disk image",
+		Long: `Run every architecture detection strategy on a disk image and show the
+architecture each one found, or why it failed, with its cost, confidence and
+time taken, and the operating system of the image. q2boot tries the
+strategies in the order of "detect.strategies" in the configuration file,
+and boots with the architecture of the most confident one that succeeds:
+
+  "detect": {"strategies": ["gpt", "esp", "elf", "virtcat", "filename"]}
+
+The strategies are gpt, elf, iso, virtcat, esp and filename; all of them are
+tried, in that order, when none are configured.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDetect(args[0], cfg, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.jsonPath, "json", "", "Write the verdicts as JSON to this file ('-' or no value for stdout)")
+	cmd.Flags().Lookup("json").NoOptDefVal = "-"
+	cmd.Flags().StringSliceVar(&opts.strategies, "strategies", nil, "Strategies to run, in order (default: detect.strategies of the configuration file)")
+	return cmd
+}
+
+// detectVerdict is the verdict of one strategy in a detect report.
+type detectVerdict struct {
+	Strategy        string        `json:"strategy"`
+	Cost            detector.Cost `json:"cost"`
+	Confidence      float64       `json:"confidence"`
+	Arch            string        `json:"arch,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	Duration        time.Duration `json:"-"`
+	DurationSeconds float64       `json:"duration_seconds"`
+}
+
+// detectReport is the outcome of all the strategies on an image.
+type detectReport struct {
+	Image string `json:"image"`
+	// Arch is the architecture q2boot boots with, found by Strategy
+	Arch     string          `json:"arch,omitempty"`
+	Strategy string          `json:"strategy,omitempty"`
+	Verdicts []detectVerdict `json:"verdicts"`
+	// OS is the operating system of the image, if identified
+	OS *detector.OSInfo `json:"os,omitempty"`
+	// Cached is the result a boot would use, if the image has one
+	Cached *detector.Result `json:"cached,omitempty"`
+}
+
+// newDetectReport summarizes the verdicts of the strategies on image.
+func newDetectReport(image string, verdicts []detector.Verdict) *detectReport {
+	report := &detectReport{Image: image, Verdicts: []detectVerdict{}}
+	for _, v := range verdicts {
+		dv := detectVerdict{
+			Strategy:        v.Strategy.Name(),
+			Cost:            v.Strategy.Cost(),
+			Confidence:      v.Strategy.Confidence(),
+			Duration:        v.Duration,
+			DurationSeconds: v.Duration.Seconds(),
+		}
+		if v.Err != nil {
+			dv.Error = v.Err.Error()
+		} else {
+			dv.Arch = v.Arch
+		}
+		report.Verdicts = append(report.Verdicts, dv)
+	}
+	if v := detector.Decide(verdicts); v != nil {
+		report.Arch, report.Strategy = v.Arch, v.Strategy.Name()
+	}
+	return report
+}
+
+// conflicts returns the architectures found by the strategies, if they
+// found more than one.
+func (r *detectReport) conflicts() []string {
+	var arches []string
+	for _, v := range r.Verdicts {
+		if v.Arch != "" && !slices.Contains(arches, v.Arch) {
+			arches = append(arches, v.Arch)
+		}
+	}
+	if len(arches) < 2 {
+		return nil
+	}
+	return arches
+}
+
+func (r *detectReport) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// print writes the verdicts as a table, followed by the result.
+func (r *detectReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Image: %s\n", r.Image)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STRATEGY\tCOST\tCONFIDENCE\tTIME\tVERDICT")
+	for _, v := range r.Verdicts {
+		verdict := v.Arch
+		if v.Error != "" {
+			verdict = "failed: " + v.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%s\t%s\n", v.Strategy, v.Cost, v.Confidence, v.Duration.Round(time.Microsecond), verdict)
+	}
+	tw.Flush()
+
+	if r.Arch == "" {
+		fmt.Fprintln(w, "Architecture: not detected")
+	} else {
+		fmt.Fprintf(w, "Architecture: %s (from %s)\n", r.Arch, r.Strategy)
+	}
+	if r.OS != nil {
+		fmt.Fprintf(w, "OS: %s\n", r.OS)
+	}
+	if arches := r.conflicts(); arches != nil {
+		fmt.Fprintf(w, "Warning: the strategies disagree: %s\n", strings.Join(arches, ", "))
+	}
+	if c := r.Cached; c != nil && c.Arch != "" {
+		details := []string{"from " + c.Strategy}
+		if c.OS != nil {
+			details = append(details, c.OS.String())
+		}
+		for _, d := range []string{c.Firmware, c.Format} {
+			if d != "" {
+				details = append(details, d)
+			}
+		}
+		fmt.Fprintf(w, "Cached: %s (%s), detected %s\n", c.Arch, strings.Join(details, ", "), c.DetectedAt.Local().Format(time.DateTime))
+	}
+}
+
+// runDetect runs the detection strategies on the disk image at path and
+// reports their verdicts.
+func runDetect(path string, cfg *config.VMConfig, opts *detectOptions) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("disk image not found at '%s'", path)
+	}
+	names := opts.strategies
+	if len(names) == 0 && cfg != nil {
+		names = cfg.Detect.Strategies
+	}
+	chain, err := detector.Chain(names)
+	if err != nil {
+		return err
+	}
+
+	report := newDetectReport(path, detector.Run(chain, path, true))
+	if key, err := detector.Fingerprint(path); err == nil {
+		report.Cached = detector.LoadResult(key)
+	}
+	// Unlike a boot, detect leaves the cache alone, and doesn't run virt-cat
+	// once more for the operating system
+	if c := report.Cached; c != nil && c.OS != nil && !detector.NoCache {
+		report.OS = c.OS
+	} else {
+		report.OS, _ = detector.ReadOS(path)
+	}
+	if opts.jsonPath != "-" {
+		report.print(os.Stdout)
+	}
+	if opts.jsonPath != "" {
+		if err := writeReportFile(opts.jsonPath, report.writeJSON); err != nil {
+			return fmt.Errorf("failed to write JSON report: %w", err)
+		}
+	}
+	if report.Arch == "" {
+		return fmt.Errorf("no strategy detected the architecture of '%s'", path)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/detector"
+)
+
+func TestDetectReport(t *testing.T) {
+	chain, err := detector.Chain([]string{"gpt", "elf", "filename"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newDetectReport("sle-ppc64le.qcow2", []detector.Verdict{
+		{Strategy: chain[0], Err: errors.New("no partition table"), Duration: time.Millisecond},
+		{Strategy: chain[1], Arch: "x86_64", Duration: 20 * time.Millisecond},
+		{Strategy: chain[2], Arch: "ppc64le"},
+	})
+	if report.Arch != "x86_64" || report.Strategy != "elf" {
+		t.Errorf("report picked %s from %s, want x86_64 from elf", report.Arch, report.Strategy)
+	}
+	if got := report.conflicts(); len(got) != 2 {
+		t.Errorf("conflicts() = %v, want x86_64 and ppc64le", got)
+	}
+
+	report.Cached = &detector.Result{Arch: "x86_64", Strategy: "virtcat", Firmware: detector.FirmwareUEFI, Format: "qcow2"}
+	var out bytes.Buffer
+	report.print(&out)
+	for _, want := range []string{"failed: no partition table", "Architecture: x86_64 (from elf)", "disagree: x86_64, ppc64le", "Cached: x86_64 (from virtcat, uefi, qcow2)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("print() output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := report.writeJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Arch     string
+		Verdicts []map[string]any
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Arch != "x86_64" || len(decoded.Verdicts) != 3 || decoded.Verdicts[1]["cost"] != "medium" || decoded.Verdicts[1]["duration_seconds"] != 0.02 {
+		t.Errorf("writeJSON() = %s", out.String())
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ilmanzo/q2boot/internal/qmp"
 )
 
 // TestE2E is the main end-to-end test for q2boot. It builds the binary,
@@ -61,7 +63,7 @@ func TestE2E(t *testing.T) {
 }
 
 // runQ2BootAndCheck starts q2boot, waits for a login prompt in the logs,
-// and then shuts down the VM via the QEMU monitor.
+// and then shuts down the VM via QMP.
 func runQ2BootAndCheck(t *testing.T, q2bootPath string, arch string, diskImage string) {
 	// Overall timeout for the entire test run for this architecture
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -83,12 +85,16 @@ func runQ2BootAndCheck(t *testing.T, q2bootPath string, arch string, diskImage s
 		t.Fatalf("Failed to find a free SSH port: %v", err)
 	}
 
+	// QMP socket used to shut the VM down once it has booted
+	qmpSocket := filepath.Join(t.TempDir(), "qmp.sock")
+
 	// Prepare the q2boot command
 	cmd := exec.CommandContext(ctx, q2bootPath,
 		diskImage,
 		"-a", arch,
 		"--monitor-port", fmt.Sprintf("%d", monitorPort),
 		"--ssh-port", fmt.Sprintf("%d", sshPort),
+		"--qmp-socket", qmpSocket,
 		"--confirm=false", // Ensure we don't wait for user input
 	)
 
@@ -135,10 +141,10 @@ func runQ2BootAndCheck(t *testing.T, q2bootPath string, arch string, diskImage s
 	// Wait for boot, command exit, or timeout
 	select {
 	case <-loginFound:
-		// Boot successful, now quit via monitor
-		t.Logf("Attempting to quit VM via monitor on port %d", monitorPort)
-		if err := quitViaMonitor(monitorPort); err != nil {
-			t.Errorf("Failed to send quit command via monitor: %v", err)
+		// Boot successful, now quit via QMP
+		t.Logf("Attempting to quit VM via QMP socket %s", qmpSocket)
+		if err := quitViaQMP(qmpSocket); err != nil {
+			t.Errorf("Failed to send quit command via QMP: %v", err)
 			// If we can't quit gracefully, we have to be more forceful
 			if cmd.Process != nil {
 				cmd.Process.Kill()
@@ -161,9 +167,9 @@ func runQ2BootAndCheck(t *testing.T, q2bootPath string, arch string, diskImage s
 	select {
 	case err := <-cmdDone:
 		if err != nil {
-			// QEMU often exits with a non-zero status when quitting via monitor,
+			// QEMU often exits with a non-zero status when quitting via QMP,
 			// which is expected. We just log it.
-			t.Logf("q2boot exited with: %v. This is often expected after quitting via monitor.", err)
+			t.Logf("q2boot exited with: %v. This is often expected after quitting via QMP.", err)
 		} else {
 			t.Log("q2boot exited gracefully.")
 		}
@@ -175,26 +181,17 @@ func runQ2BootAndCheck(t *testing.T, q2bootPath string, arch string, diskImage s
 	}
 }
 
-// quitViaMonitor connects to the QEMU monitor and sends the quit command.
-func quitViaMonitor(port int) error {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+// quitViaQMP connects to the QMP socket and sends the quit command.
+func quitViaQMP(socketPath string) error {
+	client, err := qmp.Dial(socketPath, 5*time.Second)
 	if err != nil {
-		return fmt.Errorf("could not connect to monitor: %w", err)
+		return err
 	}
-	defer conn.Close()
+	defer client.Close()
 
-	// QEMU monitor might send a welcome message, read it to clear buffer
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n')
-
-	// Send the quit command
-	_, err = conn.Write([]byte("quit\n"))
-	if err != nil {
-		return fmt.Errorf("could not send quit command: %w", err)
-	}
-
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return client.Quit(ctx)
 }
 
 // getFreePort asks the kernel for a free open port that is ready to use.
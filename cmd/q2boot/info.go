@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/image"
+)
+
+// NewInfoCmd creates the `info` subcommand, which describes a disk image and
+// its backing chain.
+func NewInfoCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "info <image>",
+		Short: "Show the format, size and backing chain of a disk image",
+		Long: `Show the format, virtual size, cluster size, backing file, internal snapshots
+and dirty or corrupt state of a disk image, followed by the images it is
+backed by. qcow2, VMDK, VHDX, VDI and raw images are read directly; qemu-img
+is not needed.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chain, err := image.Chain(args[0])
+			for i, info := range chain {
+				if i > 0 {
+					fmt.Println()
+				}
+				printImageInfo(info)
+			}
+			return err
+		},
+	}
+}
+
+// printImageInfo prints the description of one image.
+func printImageInfo(info *image.Info) {
+	format := info.Format
+	if info.Version > 0 {
+		format += fmt.Sprintf(" (version %d)", info.Version)
+	}
+	fmt.Printf("Image:        %s\n", info.Path)
+	fmt.Printf("Format:       %s\n", format)
+	if info.VirtualSize > 0 {
+		fmt.Printf("Virtual size: %s (%d bytes)\n", formatSize(info.VirtualSize), info.VirtualSize)
+	}
+	fmt.Printf("File size:    %s\n", formatSize(info.FileSize))
+	if info.ClusterSize > 0 {
+		fmt.Printf("Cluster size: %s\n", formatSize(info.ClusterSize))
+	}
+	if info.BackingFile != "" {
+		backing := info.BackingFile
+		if info.BackingFormat != "" {
+			backing += " (" + info.BackingFormat + ")"
+		}
+		fmt.Printf("Backing file: %s\n", backing)
+	}
+
+	var flags []string
+	if info.Dirty {
+		flags = append(flags, "dirty")
+	}
+	if info.Corrupt {
+		flags = append(flags, "corrupt")
+	}
+	if info.Encrypted {
+		flags = append(flags, "encrypted")
+	}
+	if len(flags) > 0 {
+		fmt.Printf("State:        %s\n", strings.Join(flags, ", "))
+	}
+
+	if len(info.Snapshots) > 0 {
+		fmt.Println("Snapshots:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  ID\tNAME\tDATE\tVM CLOCK\tVM STATE")
+		for _, s := range info.Snapshots {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n",
+				s.ID, s.Name, s.Date.Local().Format(time.DateTime), s.VMClock.Round(time.Millisecond), formatSize(s.VMStateSize))
+		}
+		w.Flush()
+	}
+}
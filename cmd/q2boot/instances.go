@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/qmp"
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/vm"
+)
+
+// qmpCommandTimeout bounds the time spent talking to a running VM
+const qmpCommandTimeout = 5 * time.Second
+
+// NewListCmd creates the `list` subcommand, which shows the running VMs.
+func NewListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls", "ps"},
+		Short:   "List running VMs",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			records, err := state.List()
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				fmt.Println("No running VMs.")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPID\tARCH\tSSH\tMONITOR\tUPTIME\tDISK")
+			for _, rec := range records {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\n",
+					rec.Name, rec.PID, rec.Arch, rec.SSHPort, formatPort(rec.MonitorPort), rec.Uptime(), rec.DiskPath)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// NewStatusCmd creates the `status` subcommand, which shows details about a running VM.
+func NewStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status <name>",
+		Short: "Show the status of a running VM",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rec, err := loadRunningVM(args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Name:         %s\n", rec.Name)
+			fmt.Printf("PID:          %d\n", rec.PID)
+			fmt.Printf("Architecture: %s\n", rec.Arch)
+			fmt.Printf("Disk:         %s\n", rec.DiskPath)
+			fmt.Printf("SSH port:     %d\n", rec.SSHPort)
+			fmt.Printf("Monitor port: %s\n", formatPort(rec.MonitorPort))
+			fmt.Printf("QMP socket:   %s\n", rec.QMPSocket)
+			if rec.AgentSocket != "" {
+				fmt.Printf("Guest agent:  %s\n", rec.AgentSocket)
+			}
+			fmt.Printf("Started:      %s (up %s)\n", rec.StartedAt.Format(time.RFC3339), rec.Uptime())
+			if rec.Config != nil {
+				fmt.Printf("Resources:    %d CPU, %d GB RAM\n", rec.Config.CPU, rec.Config.RAMGb)
+				if len(rec.Config.Forwards) > 0 {
+					fmt.Printf("Forwards:     %s\n", strings.Join(rec.Config.Forwards, ", "))
+				}
+				if len(rec.Config.Shares) > 0 {
+					fmt.Printf("Shares:       %s\n", strings.Join(rec.Config.Shares, ", "))
+				}
+				if rec.Config.Overlay != "" {
+					fmt.Printf("Overlay:      %s\n", rec.Config.Overlay)
+				}
+			}
+
+			client, err := qmp.Dial(rec.QMPSocket, qmpCommandTimeout)
+			if err != nil {
+				fmt.Printf("Run state:    unknown (%v)\n", err)
+				return nil
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), qmpCommandTimeout)
+			defer cancel()
+			status, err := client.QueryStatus(ctx)
+			if err != nil {
+				fmt.Printf("Run state:    unknown (%v)\n", err)
+				return nil
+			}
+			fmt.Printf("Run state:    %s\n", status.Status)
+			return nil
+		},
+	}
+}
+
+// NewStopCmd creates the `stop` subcommand, which shuts down a running VM.
+func NewStopCmd() *cobra.Command {
+	var force bool
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "stop <name>",
+		Short: "Stop a running VM",
+		Long: `Stop a running VM. An ACPI powerdown is requested first so the guest can
+shut down cleanly. If it does not power off within --timeout, QEMU is told to
+quit, and as a last resort it is killed. Use --force to skip the powerdown.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rec, err := loadRunningVM(args[0])
+			if err != nil {
+				return err
+			}
+
+			stage, err := vm.ShutdownRecord(rec, timeout, force)
+			if err != nil {
+				return fmt.Errorf("failed to stop VM '%s': %w", rec.Name, err)
+			}
+			state.Remove(rec.Name)
+			fmt.Printf("VM '%s' stopped by %s.\n", rec.Name, stage)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Tell QEMU to quit immediately instead of requesting a guest powerdown")
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", vm.DefaultShutdownTimeout, "How long the guest gets to power off")
+	return cmd
+}
+
+// loadRunningVM returns the record of a running VM, cleaning up stale records.
+func loadRunningVM(name string) (*state.Record, error) {
+	rec, err := state.Load(name)
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			return nil, fmt.Errorf("no running VM named '%s' (see 'q2boot list')", name)
+		}
+		return nil, err
+	}
+	if !rec.Alive() {
+		state.Remove(name)
+		return nil, fmt.Errorf("VM '%s' is no longer running (PID %d); removed stale state", name, rec.PID)
+	}
+	return rec, nil
+}
+
+// formatPort renders a port number, showing 0 as disabled.
+func formatPort(port uint16) string {
+	if port == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", port)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/downloader"
+	"github.com/ilmanzo/q2boot/internal/library"
+	"github.com/ilmanzo/q2boot/internal/overlay"
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/vm"
+)
+
+// NewCloneCmd creates the `clone` subcommand, which adds a linked clone of an
+// image to the VM library.
+func NewCloneCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "clone <image|vm> <name>",
+		Short: "Create a linked clone of an image in the VM library",
+		Long: `Create a linked clone of a disk image, or of a VM of the library, and store it
+in the library under the given name together with its configuration. The
+configuration is the one the image would boot with now, including the given
+flags and the detected architecture, and is reused by 'q2boot start'.
+The clone is a qcow2 image backed by the original, which must not change
+afterwards.`,
+		Example: `  q2boot clone sle16.qcow2 web --ram 4 --forward 8080-80
+  q2boot start web
+  q2boot clone web web-test`,
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source, name := args[0], args[1]
+			if _, err := library.Load(name); err == nil {
+				return fmt.Errorf("the library already has a VM named '%s'", name)
+			}
+
+			base, c, isImage, err := cloneSource(source)
+			if err != nil {
+				return err
+			}
+			applyFlagOverrides(cmd, flags, c, base)
+			if isImage && !cmd.Flags().Changed("arch") {
+				arch, err := detectArchitecture(base, os.Stdout)
+				if err != nil {
+					return fmt.Errorf("architecture not specified and automatic detection failed: %w", err)
+				}
+				c.Arch = arch
+			}
+			if isImage {
+				c.OS = detectOS(c, base, os.Stdout)
+			}
+
+			// A clone keeps its changes itself
+			c.Overlay = ""
+			c.WriteMode = true
+			if err := c.Validate(); err != nil {
+				return fmt.Errorf("configuration validation failed: %w", err)
+			}
+			if !vm.IsArchSupported(c.Arch) {
+				return fmt.Errorf("invalid architecture '%s'. Valid options: %v", c.Arch, vm.SupportedArchitectures())
+			}
+			// The clone may be started from any directory
+			if err := absolutePaths(c); err != nil {
+				return err
+			}
+
+			v, err := library.Create(name, base, c)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Cloned %s as '%s' (%s, %d CPU, %d GB RAM)\n", v.Base, v.Name, c.Arch, c.CPU, c.RAMGb)
+			fmt.Printf("  Start it: q2boot start %s\n", v.Name)
+			return nil
+		},
+	}
+}
+
+// cloneSource resolves the source of a clone to its disk image and a copy
+// of the configuration the clone starts from: the source's own for a VM of
+// the library, the configuration file's for an image. isImage reports the
+// latter, whose architecture is yet to be detected.
+func cloneSource(source string) (base string, c *config.VMConfig, isImage bool, err error) {
+	if _, statErr := os.Stat(source); statErr == nil {
+		c := *cfg
+		return source, &c, true, nil
+	}
+	v, err := library.Load(source)
+	if err == nil {
+		c := *v.Config
+		return v.DiskPath(), &c, false, nil
+	}
+	if downloader.IsRemote(source) {
+		return "", nil, false, fmt.Errorf("clones need a local base image, but %s would be downloaded to a temporary file", source)
+	}
+	if errors.Is(err, library.ErrNotFound) || state.ValidateName(source) != nil {
+		return "", nil, false, fmt.Errorf("%s is neither a disk image nor a VM of the library", source)
+	}
+	return "", nil, false, err
+}
+
+// absolutePaths makes the paths of the files and folders c refers to
+// absolute.
+func absolutePaths(c *config.VMConfig) error {
+	for _, path := range []*string{&c.LogFile, &c.SerialLogPath, &c.QMPSocket, &c.ExpectScript, &c.CloudInit, &c.SSHKey, &c.Ignition, &c.Combustion} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return err
+		}
+		*path = abs
+	}
+
+	// c.Shares may still be the configuration file's
+	var shares []string
+	for _, spec := range c.Shares {
+		share, err := config.ParseShare(spec)
+		if err != nil {
+			return err
+		}
+		if share.HostPath, err = filepath.Abs(share.HostPath); err != nil {
+			return err
+		}
+		shares = append(shares, share.String())
+	}
+	c.Shares = shares
+	return nil
+}
+
+// NewStartCmd creates the `start` subcommand, which boots a VM of the library.
+func NewStartCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "start <name>",
+		Short: "Boot a VM of the library",
+		Long: `Boot a VM created with 'q2boot clone' with the configuration stored for it.
+Flags given to start override the stored configuration for this boot only.
+Changes are written to the clone unless --overlay or --write-mode=false is
+given.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v, err := library.Load(args[0])
+			if err != nil {
+				return err
+			}
+
+			c := v.Config
+			applyFlagOverrides(cmd, flags, c, v.DiskPath())
+			if c.Overlay != "" && !cmd.Flags().Changed("write-mode") {
+				c.WriteMode = false
+			}
+			if err := finishConfig(c); err != nil {
+				return err
+			}
+
+			virtualMachine, err := newVM(c)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Starting VM", "name", v.Name, "arch", c.Arch)
+			return virtualMachine.Run()
+		},
+	}
+}
+
+// NewRmCmd creates the `rm` subcommand, which removes a VM from the library.
+func NewRmCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rm <name>",
+		Short: "Remove a VM from the library",
+		Long: `Remove a VM created with 'q2boot clone' and its disk. VMs that are running, or
+that other clones or overlays are based on, are not removed.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v, err := library.Load(args[0])
+			if err != nil {
+				return err
+			}
+			if rec := libraryUser(v); rec != nil {
+				return fmt.Errorf("VM '%s' is running as '%s'; stop it first", v.Name, rec.Name)
+			}
+			overlays, err := overlay.List()
+			if err != nil {
+				return err
+			}
+			var names []string
+			for _, o := range overlays {
+				if o.Base == v.DiskPath() {
+					names = append(names, o.Name)
+				}
+			}
+			if len(names) > 0 {
+				return fmt.Errorf("VM '%s' is the base of overlays %s; discard them first", v.Name, strings.Join(names, ", "))
+			}
+
+			if err := v.Remove(); err != nil {
+				return err
+			}
+			fmt.Printf("VM '%s' removed.\n", v.Name)
+			return nil
+		},
+	}
+}
+
+// libraryUser returns the running VM booted from the disk of v, if any.
+func libraryUser(v *library.VM) *state.Record {
+	records, _ := state.List()
+	for _, rec := range records {
+		if rec.DiskPath == v.DiskPath() {
+			return rec
+		}
+	}
+	return nil
+}
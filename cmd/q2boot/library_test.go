@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/detector"
+	"github.com/ilmanzo/q2boot/internal/library"
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+	"github.com/ilmanzo/q2boot/internal/vm"
+)
+
+func TestCloneSource(t *testing.T) {
+	dir := t.TempDir()
+	originalDir, originalRun, originalCfg := library.Dir, qemuimg.Run, cfg
+	defer func() { library.Dir, qemuimg.Run, cfg = originalDir, originalRun, originalCfg }()
+	library.Dir = func() string { return filepath.Join(dir, library.DirName) }
+	qemuimg.Run = func(args ...string) ([]byte, error) {
+		if args[0] == "info" {
+			return []byte(`{"format": "raw"}`), nil
+		}
+		return nil, os.WriteFile(args[len(args)-1], nil, 0600)
+	}
+	cfg = config.DefaultConfig()
+
+	image := filepath.Join(dir, "sle16.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	base, c, isImage, err := cloneSource(image)
+	if err != nil || base != image || !isImage || c == cfg || c.CPU != cfg.CPU {
+		t.Errorf("cloneSource(image) = %q, %+v, %t, %v, want a copy of the configuration file's", base, c, isImage, err)
+	}
+
+	stored := config.DefaultConfig()
+	stored.Arch, stored.RAMGb = "ppc64le", 8
+	web, err := library.Create("web", image, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, c, isImage, err = cloneSource("web")
+	if err != nil || base != web.DiskPath() || isImage || c.Arch != "ppc64le" || c.RAMGb != 8 {
+		t.Errorf("cloneSource(web) = %q, %+v, %t, %v, want the library VM's disk and configuration", base, c, isImage, err)
+	}
+
+	if _, _, _, err := cloneSource("missing"); err == nil {
+		t.Error("cloneSource() accepted a source that is neither an image nor a library VM")
+	}
+}
+
+func TestStartCloneFromAnotherDirectory(t *testing.T) {
+	setupTest()
+	rootCmd.AddCommand(NewCloneCmd(), NewStartCmd())
+	dir := t.TempDir()
+	originalDir, originalRun, originalCreator, originalOSDetector := library.Dir, qemuimg.Run, vm.CreateVM, detector.DetectOS
+	defer func() {
+		library.Dir, qemuimg.Run, vm.CreateVM, detector.DetectOS = originalDir, originalRun, originalCreator, originalOSDetector
+	}()
+	library.Dir = func() string { return filepath.Join(dir, library.DirName) }
+	qemuimg.Run = func(args ...string) ([]byte, error) {
+		if args[0] == "info" {
+			return []byte(`{"format": "raw"}`), nil
+		}
+		return nil, os.WriteFile(args[len(args)-1], nil, 0600)
+	}
+	var started *vm.MockVM
+	vm.CreateVM = func(arch string) (vm.VM, error) {
+		mock := vm.NewMockVM()
+		mock.ValidateFunc = func() error { return nil }
+		mock.RunFunc = func() error {
+			started = mock
+			return nil
+		}
+		return mock, nil
+	}
+	detector.DetectOS = func(diskPath string) (*detector.OSInfo, error) {
+		return nil, errors.New("no OS")
+	}
+
+	// Clone with paths relative to the image's directory
+	imageDir := filepath.Join(dir, "images")
+	if err := os.MkdirAll(filepath.Join(imageDir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"sle16.img": "", "config.ign": "{}", "user-data": "#cloud-config\n"} {
+		if err := os.WriteFile(filepath.Join(imageDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.Chdir(imageDir); err != nil {
+		t.Fatal(err)
+	}
+	rootCmd.SetArgs([]string{"clone", "sle16.img", "web", "--arch", "x86_64", "--ignition", "config.ign", "--cloud-init", "user-data", "--share", "src:src"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	setupTest()
+	rootCmd.AddCommand(NewCloneCmd(), NewStartCmd())
+	rootCmd.SetArgs([]string{"start", "web", "--ssh-port", "auto"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("start from another directory failed: %v", err)
+	}
+	if started == nil || len(started.Shares) != 1 || started.Shares[0].HostPath != filepath.Join(imageDir, "src") {
+		t.Fatalf("start booted %+v, want the shared folder in %s", started, imageDir)
+	}
+	if v, err := library.Load("web"); err != nil || v.Config.Ignition != filepath.Join(imageDir, "config.ign") || v.Config.CloudInit != filepath.Join(imageDir, "user-data") {
+		t.Errorf("library.Load() = %+v, %v, want absolute paths into %s", v, err, imageDir)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,6 +13,7 @@ import (
 	"github.com/ilmanzo/q2boot/internal/config"
 	"github.com/ilmanzo/q2boot/internal/detector"
 	"github.com/ilmanzo/q2boot/internal/downloader"
+	"github.com/ilmanzo/q2boot/internal/ssh"
 	"github.com/ilmanzo/q2boot/internal/vm"
 )
 
@@ -26,16 +28,35 @@ const (
 
 // Flags holds all command-line flag values
 type Flags struct {
-	CPU           int
-	RAM           int
-	Arch          string
-	SSHPort       uint16
-	MonitorPort   uint16
-	LogFile       string
-	Graphical     bool
-	WriteMode     bool
-	Confirm       bool
-	ExtraQemuArgs []string
+	Name            string
+	CPU             int
+	RAM             int
+	Arch            string
+	NoCache         bool
+	SSHPort         portFlag
+	MonitorPort     portFlag
+	QMPSocket       string
+	LogFile         string
+	Graphical       bool
+	WriteMode       bool
+	Overlay         string
+	Confirm         bool
+	Detach          bool
+	GuestAgent      bool
+	ShutdownTimeout int
+	WaitFor         string
+	WaitSSH         bool
+	WaitTimeout     int
+	ExpectScript    string
+	CloudInit       string
+	SSHKey          string
+	SSHUser         string
+	Hostname        string
+	Ignition        string
+	Combustion      string
+	Forwards        []string
+	Shares          []string
+	ExtraQemuArgs   []string
 }
 
 var (
@@ -116,28 +137,79 @@ func init() {
 func setupFlags() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(NewCheckCmd())
-
+	rootCmd.AddCommand(NewListCmd())
+	rootCmd.AddCommand(NewStatusCmd())
+	rootCmd.AddCommand(NewStopCmd())
+	rootCmd.AddCommand(NewConsoleCmd())
+	rootCmd.AddCommand(NewSSHCmd())
+	rootCmd.AddCommand(NewCopyCmd())
+	rootCmd.AddCommand(NewExecCmd())
+	rootCmd.AddCommand(NewIPCmd())
+	rootCmd.AddCommand(NewOverlayCmd())
+	rootCmd.AddCommand(NewCloneCmd())
+	rootCmd.AddCommand(NewStartCmd())
+	rootCmd.AddCommand(NewRmCmd())
+	rootCmd.AddCommand(NewInfoCmd())
+	rootCmd.AddCommand(NewDetectCmd())
+	rootCmd.AddCommand(NewTestCmd())
+	rootCmd.AddCommand(NewMatrixCmd())
+
+	rootCmd.PersistentFlags().StringVarP(&flags.Name, "name", "n", "", "Name of the VM, used by list/status/stop (default: derived from the disk image)")
 	rootCmd.PersistentFlags().IntVarP(&flags.CPU, "cpu", "c", 0, "Number of CPU cores (default: 2)")
 	rootCmd.PersistentFlags().IntVarP(&flags.RAM, "ram", "r", 0, "Amount of RAM in GB (default: 2)")
 	rootCmd.PersistentFlags().StringVarP(&flags.Arch, "arch", "a", "", "CPU architecture (x86_64, aarch64, ppc64le, s390x). Auto-detected from disk image if not specified")
-	rootCmd.PersistentFlags().Uint16VarP(&flags.SSHPort, "ssh-port", "p", 0, "Host port for SSH forwarding (default: 2222)")
+	rootCmd.PersistentFlags().BoolVar(&flags.NoCache, "no-cache", false, "Detect the architecture afresh instead of using the cached result (default: false)")
+	rootCmd.PersistentFlags().VarP(&flags.SSHPort, "ssh-port", "p", "Host port for SSH forwarding, or 'auto' to pick a free one (default: 2222)")
 	rootCmd.PersistentFlags().StringVarP(&flags.LogFile, "log-file", "l", "", "Path to the log file (default: q2boot.log)")
 	rootCmd.PersistentFlags().BoolVarP(&flags.Graphical, "graphical", "g", false, "Enable graphical console (default: false)")
 	rootCmd.PersistentFlags().BoolVarP(&flags.WriteMode, "write-mode", "w", false, "Enable write mode (changes are saved to disk) (default: false)")
 	rootCmd.PersistentFlags().BoolVar(&flags.Confirm, "confirm", false, "Show command and wait for keypress before starting (default: false)")
-	rootCmd.PersistentFlags().Uint16VarP(&flags.MonitorPort, "monitor-port", "m", 0, "Port for the QEMU monitor (telnet)")
+	rootCmd.PersistentFlags().BoolVar(&flags.Detach, "detach", false, "Run the VM in the background; attach later with 'q2boot console' (default: false)")
+	rootCmd.PersistentFlags().IntVar(&flags.ShutdownTimeout, "shutdown-timeout", 0, "Seconds the guest gets to power off on SIGINT/SIGTERM before QEMU is told to quit (default: 60)")
+	rootCmd.PersistentFlags().StringVar(&flags.WaitFor, "wait-for", "", "Wait until the serial console output matches this regular expression (e.g. 'login:')")
+	rootCmd.PersistentFlags().BoolVar(&flags.WaitSSH, "wait-ssh", false, "Wait until the forwarded SSH port answers with an SSH banner (default: false)")
+	rootCmd.PersistentFlags().IntVar(&flags.WaitTimeout, "wait-timeout", 0, "Seconds to wait for --wait-for/--wait-ssh before giving up and stopping the VM, 0 for no limit (default: 300)")
+	rootCmd.PersistentFlags().StringVar(&flags.ExpectScript, "expect", "", "Run an expect/send script (YAML) on the serial console once the VM starts")
+	rootCmd.PersistentFlags().StringVar(&flags.CloudInit, "cloud-init", "", "Pass this user-data file to cloud-init on a NoCloud seed CD-ROM")
+	rootCmd.PersistentFlags().StringVar(&flags.SSHKey, "ssh-key", "", "SSH key (.pub or the private key next to it) to authorize via cloud-init and to log in with")
+	rootCmd.PersistentFlags().StringVar(&flags.SSHUser, "ssh-user", "", "User to log in as over SSH (default: root)")
+	rootCmd.PersistentFlags().StringVar(&flags.Hostname, "hostname", "", "Hostname to set via cloud-init")
+	rootCmd.PersistentFlags().StringVar(&flags.Ignition, "ignition", "", "Pass this Ignition config (JSON) via fw_cfg, or on a config drive where unsupported")
+	rootCmd.PersistentFlags().StringVar(&flags.Combustion, "combustion", "", "Pass this Combustion script via fw_cfg, or on a config drive where unsupported")
+	rootCmd.PersistentFlags().VarP(&flags.MonitorPort, "monitor-port", "m", "Port for the QEMU monitor (telnet), or 'auto' to pick a free one")
+	rootCmd.PersistentFlags().StringArrayVar(&flags.Forwards, "forward", []string{}, "Forward a host port to the guest as [tcp|udp:][hostaddr:]hostport-guestport, e.g. 8080-80 (can be specified multiple times)")
+	rootCmd.PersistentFlags().StringArrayVar(&flags.Shares, "share", []string{}, "Share a host folder with the guest as hostdir[:tag], via virtiofs or 9p without virtiofsd (can be specified multiple times)")
+	rootCmd.PersistentFlags().BoolVar(&flags.GuestAgent, "guest-agent", false, "Add a channel for the QEMU guest agent, used by 'q2boot exec' and 'q2boot ip' (default: false)")
+	rootCmd.PersistentFlags().StringVar(&flags.Overlay, "overlay", "", "Boot from this named overlay on top of the disk image, created on first use (see 'q2boot overlay')")
+	rootCmd.PersistentFlags().StringVar(&flags.QMPSocket, "qmp-socket", "", "Path of the QMP unix socket (default: temporary socket)")
 	rootCmd.PersistentFlags().StringSliceVarP(&flags.ExtraQemuArgs, "qemu-extra", "e", []string{}, "Extra arguments to pass to QEMU (can be specified multiple times)")
 
-	// Bind flags to viper
+	// Bind flags to viper. The port flags accept "auto" and are applied in
+	// applyFlagOverrides instead.
 	viper.BindPFlag("cpu", rootCmd.PersistentFlags().Lookup("cpu"))
 	viper.BindPFlag("ram", rootCmd.PersistentFlags().Lookup("ram"))
 	viper.BindPFlag("arch", rootCmd.PersistentFlags().Lookup("arch"))
-	viper.BindPFlag("ssh_port", rootCmd.PersistentFlags().Lookup("ssh-port"))
 	viper.BindPFlag("log_file", rootCmd.PersistentFlags().Lookup("log-file"))
 	viper.BindPFlag("graphical", rootCmd.PersistentFlags().Lookup("graphical"))
 	viper.BindPFlag("write_mode", rootCmd.PersistentFlags().Lookup("write-mode"))
 	viper.BindPFlag("confirm", rootCmd.PersistentFlags().Lookup("confirm"))
-	viper.BindPFlag("monitor_port", rootCmd.PersistentFlags().Lookup("monitor-port"))
+	viper.BindPFlag("detach", rootCmd.PersistentFlags().Lookup("detach"))
+	viper.BindPFlag("shutdown_timeout", rootCmd.PersistentFlags().Lookup("shutdown-timeout"))
+	viper.BindPFlag("wait_for", rootCmd.PersistentFlags().Lookup("wait-for"))
+	viper.BindPFlag("wait_ssh", rootCmd.PersistentFlags().Lookup("wait-ssh"))
+	viper.BindPFlag("wait_timeout", rootCmd.PersistentFlags().Lookup("wait-timeout"))
+	viper.BindPFlag("expect_script", rootCmd.PersistentFlags().Lookup("expect"))
+	viper.BindPFlag("cloud_init", rootCmd.PersistentFlags().Lookup("cloud-init"))
+	viper.BindPFlag("ssh_key", rootCmd.PersistentFlags().Lookup("ssh-key"))
+	viper.BindPFlag("ssh_user", rootCmd.PersistentFlags().Lookup("ssh-user"))
+	viper.BindPFlag("hostname", rootCmd.PersistentFlags().Lookup("hostname"))
+	viper.BindPFlag("ignition", rootCmd.PersistentFlags().Lookup("ignition"))
+	viper.BindPFlag("combustion", rootCmd.PersistentFlags().Lookup("combustion"))
+	viper.BindPFlag("forwards", rootCmd.PersistentFlags().Lookup("forward"))
+	viper.BindPFlag("shares", rootCmd.PersistentFlags().Lookup("share"))
+	viper.BindPFlag("guest_agent", rootCmd.PersistentFlags().Lookup("guest-agent"))
+	viper.BindPFlag("overlay", rootCmd.PersistentFlags().Lookup("overlay"))
+	viper.BindPFlag("qmp_socket", rootCmd.PersistentFlags().Lookup("qmp-socket"))
 	viper.BindPFlag("extra_qemu_args", rootCmd.PersistentFlags().Lookup("qemu-extra"))
 }
 
@@ -174,11 +246,24 @@ func initConfig() {
 	viper.SetDefault("cpu", config.DefaultCPU)
 	viper.SetDefault("ram_gb", config.DefaultRAMGb)
 	viper.SetDefault("ssh_port", config.DefaultSSHPort)
+	viper.SetDefault("ssh_port_auto", false)
+	viper.SetDefault("monitor_port_auto", false)
 	viper.SetDefault("log_file", config.DefaultLogFile)
 	viper.SetDefault("graphical", false)
 	viper.SetDefault("write_mode", false)
 	viper.SetDefault("confirm", false)
+	viper.SetDefault("detach", false)
+	viper.SetDefault("guest_agent", false)
+	viper.SetDefault("shutdown_timeout", config.DefaultShutdownSec)
+	viper.SetDefault("wait_ssh", false)
+	viper.SetDefault("wait_timeout", config.DefaultWaitSec)
+	viper.SetDefault("cpu_budget", 0)
+	viper.SetDefault("ram_budget_gb", 0)
+	viper.SetDefault("forwards", []string{})
+	viper.SetDefault("shares", []string{})
+	viper.SetDefault("ssh_user", ssh.DefaultUser)
 	viper.SetDefault("extra_qemu_args", []string{})
+	viper.SetDefault("detect.strategies", []string{})
 
 	// Read config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -199,6 +284,14 @@ func initConfig() {
 		fmt.Println("Error unmarshaling config", "error", err)
 		cfg = config.DefaultConfig()
 	}
+
+	// Detect architectures with the configured chain of strategies
+	if chain, err := detector.Chain(cfg.Detect.Strategies); err != nil {
+		fmt.Println("Error in detect.strategies, using the default order", "error", err)
+	} else {
+		detector.Strategies = chain
+	}
+	detector.NoCache = flags.NoCache
 }
 
 func runQ2Boot(cmd *cobra.Command, args []string) error {
@@ -209,6 +302,9 @@ func runQ2Boot(cmd *cobra.Command, args []string) error {
 // It checks which flags were explicitly set and overwrites the corresponding config values.
 func applyFlagOverrides(cmd *cobra.Command, f *Flags, cfg *config.VMConfig, diskPath string) {
 	cfg.DiskPath = diskPath
+	if f.Name != "" {
+		cfg.Name = f.Name
+	}
 	if f.CPU > 0 {
 		cfg.CPU = f.CPU
 	}
@@ -218,8 +314,8 @@ func applyFlagOverrides(cmd *cobra.Command, f *Flags, cfg *config.VMConfig, disk
 	if f.Arch != "" {
 		cfg.Arch = f.Arch
 	}
-	if f.SSHPort > 0 {
-		cfg.SSHPort = f.SSHPort
+	if f.SSHPort.Auto || f.SSHPort.Port > 0 {
+		cfg.SSHPort, cfg.SSHPortAuto = f.SSHPort.Port, f.SSHPort.Auto
 	}
 	if f.LogFile != "" {
 		cfg.LogFile = f.LogFile
@@ -230,40 +326,131 @@ func applyFlagOverrides(cmd *cobra.Command, f *Flags, cfg *config.VMConfig, disk
 	if cmd.Flags().Changed("write-mode") {
 		cfg.WriteMode = f.WriteMode
 	}
+	if f.Overlay != "" {
+		cfg.Overlay = f.Overlay
+	}
 	if cmd.Flags().Changed("confirm") {
 		cfg.Confirm = f.Confirm
 	}
+	if cmd.Flags().Changed("detach") {
+		cfg.Detach = f.Detach
+	}
+	if cmd.Flags().Changed("guest-agent") {
+		cfg.GuestAgent = f.GuestAgent
+	}
+	if cmd.Flags().Changed("shutdown-timeout") {
+		cfg.ShutdownTimeout = f.ShutdownTimeout
+	}
+	if f.WaitFor != "" {
+		cfg.WaitFor = f.WaitFor
+	}
+	if cmd.Flags().Changed("wait-ssh") {
+		cfg.WaitSSH = f.WaitSSH
+	}
+	if cmd.Flags().Changed("wait-timeout") {
+		cfg.WaitTimeout = f.WaitTimeout
+	}
+	if f.ExpectScript != "" {
+		cfg.ExpectScript = f.ExpectScript
+	}
 	if cmd.Flags().Changed("monitor-port") {
-		cfg.MonitorPort = f.MonitorPort
+		cfg.MonitorPort, cfg.MonitorPortAuto = f.MonitorPort.Port, f.MonitorPort.Auto
+	}
+	if f.QMPSocket != "" {
+		cfg.QMPSocket = f.QMPSocket
+	}
+	if f.CloudInit != "" {
+		cfg.CloudInit = f.CloudInit
+	}
+	if f.SSHKey != "" {
+		cfg.SSHKey = f.SSHKey
+	}
+	if f.SSHUser != "" {
+		cfg.SSHUser = f.SSHUser
+	}
+	if f.Hostname != "" {
+		cfg.Hostname = f.Hostname
+	}
+	if f.Ignition != "" {
+		cfg.Ignition = f.Ignition
+	}
+	if f.Combustion != "" {
+		cfg.Combustion = f.Combustion
+	}
+	if len(f.Forwards) > 0 {
+		cfg.Forwards = f.Forwards
+	}
+	if len(f.Shares) > 0 {
+		cfg.Shares = f.Shares
 	}
 	if len(f.ExtraQemuArgs) > 0 {
 		cfg.ExtraQemuArgs = f.ExtraQemuArgs
 	}
 }
 
-// detectArchitecture automatically detects the architecture from the disk image.
+// detectArchitecture automatically detects the architecture from the disk image,
+// writing its progress to out.
 // This is called when no explicit architecture was provided via flag.
-func detectArchitecture(diskPath string) (string, error) {
-	fmt.Println("Attempting to detect architecture from disk image", "disk", diskPath)
+func detectArchitecture(diskPath string, out io.Writer) (string, error) {
+	fmt.Fprintln(out, "Attempting to detect architecture from disk image", "disk", diskPath)
 	arch, err := detector.DetectArchitecture(diskPath)
 	if err != nil {
 		return "", err
 	}
-	fmt.Println("Successfully detected architecture", "arch", arch)
+	fmt.Fprintln(out, "Successfully detected architecture", "arch", arch)
 	return arch, nil
 }
 
+// detectOS identifies the operating system of the disk image of cfg, which
+// some guests need tuning for, unless it makes no difference to the VM, and
+// writes it to out. It returns nil if it doesn't or can't.
+func detectOS(cfg *config.VMConfig, diskPath string, out io.Writer) *detector.OSInfo {
+	if !vm.OSMatters(cfg.Arch, cfg.Confirm) {
+		return nil
+	}
+	info, err := detector.DetectOS(diskPath)
+	if err != nil {
+		return nil
+	}
+	fmt.Fprintln(out, "Detected operating system", "os", info)
+	return info
+}
+
 // runQ2BootE contains the core logic for running the VM, making it testable.
 func runQ2BootE(cmd *cobra.Command, args []string, cfg *config.VMConfig) error {
-	diskPath := args[0]
+	cleanup, err := prepareConfig(cmd, args[0], cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	virtualMachine, err := newVM(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Run the VM
+	fmt.Println("Starting VM", "arch", cfg.Arch)
+	return virtualMachine.Run()
+}
+
+// prepareConfig completes cfg for the disk image at diskPath: it downloads
+// remote images, applies flag overrides, detects the architecture and
+// validates the result. The returned cleanup function removes downloaded
+// images and must be called once the VM is done.
+func prepareConfig(cmd *cobra.Command, diskPath string, cfg *config.VMConfig) (func(), error) {
+	cleanup := func() {}
 
 	// Handle remote images
 	if downloader.IsRemote(diskPath) {
-		localPath, cleanup, err := downloader.Download(diskPath)
+		if flags.Overlay != "" || cfg.Overlay != "" {
+			return cleanup, fmt.Errorf("overlays need a local base image, but %s is downloaded to a temporary file", diskPath)
+		}
+		localPath, downloadCleanup, err := downloader.Download(diskPath)
 		if err != nil {
-			return fmt.Errorf("failed to download image: %w", err)
+			return cleanup, fmt.Errorf("failed to download image: %w", err)
 		}
-		defer cleanup()
+		cleanup = downloadCleanup
 		diskPath = localPath
 	}
 
@@ -273,19 +460,29 @@ func runQ2BootE(cmd *cobra.Command, args []string, cfg *config.VMConfig) error {
 	// If architecture was not explicitly provided via the command-line flag,
 	// attempt automatic detection. This correctly ignores any 'arch' from the config file.
 	if !cmd.Flags().Changed("arch") {
-		detectedArch, err := detectArchitecture(cfg.DiskPath)
+		detectedArch, err := detectArchitecture(cfg.DiskPath, os.Stdout)
 		if err != nil {
-			return fmt.Errorf("architecture not specified and automatic detection failed: %w", err)
+			return cleanup, fmt.Errorf("architecture not specified and automatic detection failed: %w", err)
 		}
 		cfg.Arch = detectedArch
 	}
+	cfg.OS = detectOS(cfg, cfg.DiskPath, os.Stdout)
 
+	return cleanup, finishConfig(cfg)
+}
+
+// finishConfig validates cfg once its disk image and architecture are known,
+// picks its ports and sets up its overlay.
+func finishConfig(cfg *config.VMConfig) error {
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
 		return fmt.Errorf("configuration validation failed: %w", err)
 	}
 
-	// Validate port availability
+	// Pick free ports where requested, then validate port availability
+	if err := allocatePorts(cfg); err != nil {
+		return err
+	}
 	if err := vm.ValidatePortsAvailable(cfg.SSHPort, cfg.MonitorPort); err != nil {
 		return err
 	}
@@ -295,10 +492,22 @@ func runQ2BootE(cmd *cobra.Command, args []string, cfg *config.VMConfig) error {
 		return fmt.Errorf("invalid architecture '%s'. Valid options: %v", cfg.Arch, vm.SupportedArchitectures())
 	}
 
+	// Boot the named overlay, which keeps the changes, instead of a
+	// snapshot of the disk image
+	if cfg.Overlay != "" {
+		if err := useOverlay(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newVM creates the VM for cfg's architecture, configures and validates it.
+func newVM(cfg *config.VMConfig) (vm.VM, error) {
 	// Create VM based on architecture
 	virtualMachine, err := vm.CreateVM(cfg.Arch)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Configure the VM
@@ -306,12 +515,9 @@ func runQ2BootE(cmd *cobra.Command, args []string, cfg *config.VMConfig) error {
 
 	// Validate the configured VM (this will include QEMU binary checks)
 	if err := virtualMachine.Validate(); err != nil {
-		return fmt.Errorf("VM validation failed: %w", err)
+		return nil, fmt.Errorf("VM validation failed: %w", err)
 	}
-
-	// Run the VM
-	fmt.Println("Starting VM", "arch", cfg.Arch)
-	return virtualMachine.Run()
+	return virtualMachine, nil
 }
 
 func main() {
@@ -4,11 +4,13 @@ package main
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/ilmanzo/q2boot/internal/config"
 	"github.com/ilmanzo/q2boot/internal/detector"
 	"github.com/ilmanzo/q2boot/internal/vm"
 	"github.com/spf13/cobra"
@@ -109,6 +111,13 @@ func TestFlagOverridesConfig(t *testing.T) {
 	}
 	defer func() { vm.CreateVM = originalCreator }()
 
+	// Mock OS detection to avoid probing the disk and caching the result
+	originalOSDetector := detector.DetectOS
+	detector.DetectOS = func(diskPath string) (*detector.OSInfo, error) {
+		return &detector.OSInfo{ID: "sles", Version: "15.6"}, nil
+	}
+	defer func() { detector.DetectOS = originalOSDetector }()
+
 	// 2. Setup the test run
 	testRunE := func(cmd *cobra.Command, args []string) error {
 		// Manually call initConfig to load from our temp file
@@ -151,4 +160,57 @@ func TestFlagOverridesConfig(t *testing.T) {
 	if cfg.Graphical != false {
 		t.Errorf("Expected graphical to be false from flag, but got %t", cfg.Graphical)
 	}
+	// No s390x guest is tuned, so the OS is only detected for --confirm
+	if cfg.OS != nil {
+		t.Errorf("Expected no OS detection for s390x, but got %v", cfg.OS)
+	}
+}
+
+func TestDetectOSOnlyWhenItMatters(t *testing.T) {
+	calls := 0
+	originalOSDetector := detector.DetectOS
+	detector.DetectOS = func(diskPath string) (*detector.OSInfo, error) {
+		calls++
+		return &detector.OSInfo{ID: "sles", Version: "15.3"}, nil
+	}
+	defer func() { detector.DetectOS = originalOSDetector }()
+
+	if info := detectOS(&config.VMConfig{Arch: "ppc64le"}, "disk.qcow2", io.Discard); info == nil || info.ID != "sles" {
+		t.Errorf("detectOS(ppc64le) = %v, want the detected OS", info)
+	}
+	if info := detectOS(&config.VMConfig{Arch: "s390x", Confirm: true}, "disk.qcow2", io.Discard); info == nil {
+		t.Error("detectOS(s390x, confirm) = nil, want the detected OS")
+	}
+	if info := detectOS(&config.VMConfig{Arch: "s390x"}, "disk.qcow2", io.Discard); info != nil || calls != 2 {
+		t.Errorf("detectOS(s390x) = %v after %d detections, want no detection", info, calls)
+	}
+}
+
+func TestPortFlag(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantPort uint16
+		wantAuto bool
+		wantErr  bool
+	}{
+		{"2222", 2222, false, false},
+		{"auto", 0, true, false},
+		{"0", 0, false, false},
+		{"65536", 0, false, true},
+		{"ssh", 0, false, true},
+	}
+	for _, tt := range tests {
+		var p portFlag
+		err := p.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (p.Port != tt.wantPort || p.Auto != tt.wantAuto) {
+			t.Errorf("Set(%q) = {%d, %t}, want {%d, %t}", tt.value, p.Port, p.Auto, tt.wantPort, tt.wantAuto)
+		}
+		if err == nil && p.Port != 0 && p.String() != tt.value {
+			t.Errorf("Set(%q).String() = %q", tt.value, p.String())
+		}
+	}
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/downloader"
+	"github.com/ilmanzo/q2boot/internal/matrix"
+	"github.com/ilmanzo/q2boot/internal/ports"
+	"github.com/ilmanzo/q2boot/internal/smoke"
+)
+
+// matrixOptions holds the flags of the `matrix` subcommand.
+type matrixOptions struct {
+	cpuBudget int
+	ramBudget int
+	logDir    string
+	junitPath string
+	jsonPath  string
+}
+
+// NewMatrixCmd creates the `matrix` subcommand, which boots a list of images in parallel.
+func NewMatrixCmd() *cobra.Command {
+	opts := &matrixOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "matrix [flags] <images.yaml>",
+		Short: "Boot a list of images in parallel and report which ones pass",
+		Long: `Boot every image listed in a YAML file concurrently, each with its own
+SSH port, wait for the images to become ready, run their checks and print a
+pass/fail table. The number of VMs running at the same time is limited by a
+CPU and RAM budget.
+
+Each image may set disk, name, arch, cpu, ram_gb, wait_for, wait_ssh,
+wait_timeout, expect, via and checks; "defaults" applies to all of them:
+
+  defaults:
+    wait_ssh: true
+    checks:
+      - run: systemctl is-system-running --wait
+  images:
+    - disk: sle16-x86_64.qcow2
+    - disk: sle16-aarch64.qcow2
+    - disk: sle16-s390x.qcow2
+      wait_timeout: 900
+
+q2boot exits with a non-zero status unless every image passed.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMatrix(cmd, args[0], cfg, opts)
+		},
+	}
+
+	cmd.Flags().IntVar(&opts.cpuBudget, "cpu-budget", 0, "CPUs the running VMs may use in total (default: number of host CPUs)")
+	cmd.Flags().IntVar(&opts.ramBudget, "ram-budget", 0, "GB of RAM the running VMs may use in total (default: unlimited)")
+	cmd.Flags().StringVar(&opts.logDir, "log-dir", ".", "Directory for the serial console logs, one <name>.log per image")
+	cmd.Flags().StringVar(&opts.junitPath, "junit", "", "Write the results as JUnit XML to this file")
+	cmd.Flags().StringVar(&opts.jsonPath, "json", "", "Write a JSON summary to this file ('-' for stdout)")
+	return cmd
+}
+
+// runMatrix boots the images of the matrix file and reports the results.
+func runMatrix(cmd *cobra.Command, path string, cfg *config.VMConfig, opts *matrixOptions) error {
+	images, err := matrix.Load(path)
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("cpu-budget") {
+		cfg.CPUBudget = opts.cpuBudget
+	}
+	if cmd.Flags().Changed("ram-budget") {
+		cfg.RAMBudgetGb = opts.ramBudget
+	}
+	if cfg.CPUBudget < 0 || cfg.RAMBudgetGb < 0 {
+		return fmt.Errorf("CPU and RAM budgets must be >= 0")
+	}
+	cpuBudget := cfg.CPUBudget
+	if cpuBudget == 0 {
+		cpuBudget = runtime.NumCPU()
+	}
+	budget := matrix.NewBudget(cpuBudget, cfg.RAMBudgetGb)
+
+	// Resolve the resources now, as the budget is enforced before booting
+	for i := range images {
+		if images[i].CPU == 0 {
+			images[i].CPU = cfg.CPU
+		}
+		if images[i].RAMGb == 0 {
+			images[i].RAMGb = cfg.RAMGb
+		}
+	}
+	if err := os.MkdirAll(opts.logDir, 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	// Interrupting the matrix stops all its VMs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	restoreStdout := progressToStderr(opts.junitPath, opts.jsonPath)
+	defer restoreStdout()
+	fmt.Printf("Booting %d images (budget: %d CPUs, %s RAM)\n", len(images), cpuBudget, formatRAMBudget(cfg.RAMBudgetGb))
+	out := &lockedWriter{w: os.Stdout}
+	reports := matrix.Run(ctx, images, budget, func(ctx context.Context, img matrix.Image) *smoke.Report {
+		return bootMatrixImage(ctx, cfg, img, opts, out)
+	})
+
+	fmt.Println()
+	matrix.WriteTable(os.Stdout, reports)
+	restoreStdout()
+
+	if opts.junitPath != "" {
+		if err := writeReportFile(opts.junitPath, func(w io.Writer) error { return smoke.WriteJUnitReports(w, reports) }); err != nil {
+			return fmt.Errorf("failed to write JUnit report: %w", err)
+		}
+	}
+	if opts.jsonPath != "" {
+		if err := writeReportFile(opts.jsonPath, func(w io.Writer) error { return smoke.WriteJSONReports(w, reports) }); err != nil {
+			return fmt.Errorf("failed to write JSON summary: %w", err)
+		}
+	}
+
+	failed := 0
+	for _, r := range reports {
+		if !r.Passed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(reports))
+	}
+	return nil
+}
+
+// bootMatrixImage derives the configuration of one image from the base
+// configuration, then boots and checks it. Its progress is prefixed with the
+// image name.
+func bootMatrixImage(ctx context.Context, base *config.VMConfig, img matrix.Image, opts *matrixOptions, out io.Writer) *smoke.Report {
+	log := &prefixWriter{prefix: fmt.Sprintf("[%s] ", img.Name), w: out}
+	failed := func(err error) *smoke.Report {
+		fmt.Fprintln(log, "Error:", err)
+		return &smoke.Report{
+			Name:      img.Name,
+			Image:     img.Disk,
+			Arch:      img.Arch,
+			StartedAt: time.Now(),
+			BootError: err.Error(),
+			Checks:    smoke.SkipChecks(img.Checks, "VM did not boot"),
+		}
+	}
+
+	c := *base
+	c.Name = img.Name
+	c.DiskPath = img.Disk
+	c.Arch = img.Arch
+	c.CPU = img.CPU
+	c.RAMGb = img.RAMGb
+	c.LogFile = filepath.Join(opts.logDir, img.Name+".log")
+	c.QMPSocket = ""
+	c.MonitorPort = 0
+	c.MonitorPortAuto = false
+	c.Forwards = nil
+	c.Overlay = ""
+	c.Confirm = false
+	c.Graphical = false
+	c.WaitFor = img.WaitFor
+	c.WaitSSH = img.WaitSSH != nil && *img.WaitSSH
+	if img.WaitTimeout > 0 {
+		c.WaitTimeout = img.WaitTimeout
+	}
+	c.ExpectScript = img.Expect
+
+	suite := &smoke.Suite{Via: img.Via, Checks: img.Checks}
+	if len(suite.Checks) > 0 && suite.Via == smoke.ViaSSH {
+		c.WaitSSH = true
+	}
+
+	port, err := ports.Allocate(config.DefaultSSHPort)
+	if err != nil {
+		return failed(fmt.Errorf("failed to allocate an SSH port: %w", err))
+	}
+	defer ports.Release(port)
+	c.SSHPort = port
+	c.SSHPortAuto = true
+
+	if downloader.IsRemote(c.DiskPath) {
+		localPath, cleanup, err := downloader.Download(c.DiskPath)
+		if err != nil {
+			return failed(fmt.Errorf("failed to download image: %w", err))
+		}
+		defer cleanup()
+		c.DiskPath = localPath
+	}
+	if c.Arch == "" {
+		arch, err := detectArchitecture(c.DiskPath, log)
+		if err != nil {
+			return failed(fmt.Errorf("architecture not specified and automatic detection failed: %w", err))
+		}
+		c.Arch = arch
+	}
+	c.OS = detectOS(&c, c.DiskPath, log)
+	if err := c.Validate(); err != nil {
+		return failed(fmt.Errorf("configuration validation failed: %w", err))
+	}
+
+	virtualMachine, err := newVM(&c)
+	if err != nil {
+		return failed(err)
+	}
+	fmt.Fprintln(log, "Starting VM", "arch", c.Arch, "ssh_port", c.SSHPort)
+	report := bootAndCheck(ctx, virtualMachine, &c, suite, log)
+	report.Image = img.Disk
+	return report
+}
+
+// formatRAMBudget renders a RAM budget in GB, showing 0 as unlimited.
+func formatRAMBudget(gb int) string {
+	if gb == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d GB", gb)
+}
+
+// lockedWriter serializes writes from concurrent VMs.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// prefixWriter prefixes every line written to it.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) > 0 {
+			buf.WriteString(p.prefix)
+			buf.Write(line)
+		}
+	}
+	if _, err := p.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
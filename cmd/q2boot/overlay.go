@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/library"
+	"github.com/ilmanzo/q2boot/internal/overlay"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// NewOverlayCmd creates the `overlay` subcommand, which manages the named
+// overlays created by --overlay.
+func NewOverlayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "overlay",
+		Short: "Manage named overlays on top of disk images",
+		Long: `Manage the named overlays created by --overlay. An overlay keeps the changes
+a VM makes across boots without touching its base image, so several people
+can keep their own changes on top of one shared image.`,
+	}
+	cmd.AddCommand(newOverlayListCmd(), newOverlayCommitCmd(), newOverlayDiscardCmd(), newOverlayResetCmd())
+	return cmd
+}
+
+func newOverlayListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the overlays",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			overlays, err := overlay.List()
+			if err != nil {
+				return err
+			}
+			if len(overlays) == 0 {
+				fmt.Println("No overlays.")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSIZE\tCREATED\tVM\tBASE")
+			for _, o := range overlays {
+				vmName := "-"
+				if rec := overlayUser(o.Name); rec != nil {
+					vmName = rec.Name
+				}
+				base := o.Base
+				if o.BaseChanged() {
+					base += " (changed since)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					o.Name, formatSize(o.Size()), o.CreatedAt.Format(time.DateTime), vmName, base)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newOverlayCommitCmd() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "commit <name>",
+		Short: "Write the changes of an overlay into its base image",
+		Long: `Write the changes of an overlay into its base image and empty the overlay.
+This modifies the base image, which makes other overlays and the clones of the
+library on the same base inconsistent; commit refuses to do that unless
+--force is given. It always refuses while a VM runs on the base image or an
+overlay on it.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			o, err := loadIdleOverlay(args[0])
+			if err != nil {
+				return err
+			}
+			others, err := o.SharingBase()
+			if err != nil {
+				return err
+			}
+			if len(others) > 0 {
+				var names []string
+				for _, other := range others {
+					names = append(names, other.Name)
+				}
+				if !force {
+					return fmt.Errorf("overlays %s share the base image %s and would become inconsistent; reset or discard them afterwards, and use --force to commit anyway", strings.Join(names, ", "), o.Base)
+				}
+				fmt.Printf("Warning: overlays %s are now inconsistent; reset or discard them.\n", strings.Join(names, ", "))
+			}
+			clones, err := library.ClonesOf(o.Base)
+			if err != nil {
+				return err
+			}
+			if len(clones) > 0 {
+				var names []string
+				for _, clone := range clones {
+					names = append(names, clone.Name)
+				}
+				if !force {
+					return fmt.Errorf("VMs %s of the library are clones of the base image %s and would become inconsistent; remove them afterwards, and use --force to commit anyway", strings.Join(names, ", "), o.Base)
+				}
+				fmt.Printf("Warning: VMs %s of the library are now inconsistent; remove them.\n", strings.Join(names, ", "))
+			}
+
+			// Not even --force helps a VM reading the base as it changes
+			if rec, err := baseUser(o); err != nil {
+				return err
+			} else if rec != nil {
+				return fmt.Errorf("VM '%s' is running on %s; stop it first", rec.Name, o.Base)
+			}
+
+			fmt.Printf("Committing overlay '%s' into %s...\n", o.Name, o.Base)
+			if err := o.Commit(); err != nil {
+				return fmt.Errorf("failed to commit overlay '%s': %w", o.Name, err)
+			}
+			fmt.Printf("Overlay '%s' committed.\n", o.Name)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Commit even though other overlays or clones share the base image")
+	return cmd
+}
+
+func newOverlayDiscardCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "discard <name>",
+		Aliases:      []string{"rm"},
+		Short:        "Delete an overlay and its changes",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			o, err := loadIdleOverlay(args[0])
+			if err != nil {
+				return err
+			}
+			if err := o.Discard(); err != nil {
+				return err
+			}
+			fmt.Printf("Overlay '%s' discarded.\n", o.Name)
+			return nil
+		},
+	}
+}
+
+func newOverlayResetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "reset <name>",
+		Short:        "Throw away the changes of an overlay, keeping the overlay",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			o, err := loadIdleOverlay(args[0])
+			if err != nil {
+				return err
+			}
+			if err := o.Reset(); err != nil {
+				return fmt.Errorf("failed to reset overlay '%s': %w", o.Name, err)
+			}
+			fmt.Printf("Overlay '%s' reset to %s.\n", o.Name, o.Base)
+			return nil
+		},
+	}
+}
+
+// useOverlay opens the overlay configured in cfg on top of its disk image,
+// creating it on first use, and makes the VM boot from it with its changes
+// kept.
+func useOverlay(cfg *config.VMConfig) error {
+	if rec := overlayUser(cfg.Overlay); rec != nil {
+		return fmt.Errorf("overlay '%s' is in use by VM '%s'", cfg.Overlay, rec.Name)
+	}
+	o, created, err := overlay.Open(cfg.Overlay, cfg.DiskPath)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Printf("Created overlay '%s' on %s\n", o.Name, o.Base)
+	} else {
+		fmt.Printf("Using overlay '%s' (%s of changes)\n", o.Name, formatSize(o.Size()))
+		if o.BaseChanged() {
+			fmt.Printf("Warning: %s changed since overlay '%s' was created; reset it with 'q2boot overlay reset %s' if the guest misbehaves\n", o.Base, o.Name, o.Name)
+		}
+	}
+	cfg.DiskPath = o.Path()
+	cfg.WriteMode = true
+	return nil
+}
+
+// loadIdleOverlay loads an overlay that no running VM uses.
+func loadIdleOverlay(name string) (*overlay.Overlay, error) {
+	o, err := overlay.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	if rec := overlayUser(name); rec != nil {
+		return nil, fmt.Errorf("overlay '%s' is in use by VM '%s'; stop it first", name, rec.Name)
+	}
+	return o, nil
+}
+
+// overlayUser returns the running VM using the named overlay, if any.
+func overlayUser(name string) *state.Record {
+	records, _ := state.List()
+	for _, rec := range records {
+		if rec.Config != nil && rec.Config.Overlay == name {
+			return rec
+		}
+	}
+	return nil
+}
+
+// baseUser returns the running VM booted from the base image of o, or from
+// an overlay on it, if any.
+func baseUser(o *overlay.Overlay) (*state.Record, error) {
+	overlays, err := overlay.List()
+	if err != nil {
+		return nil, err
+	}
+	disks := map[string]bool{o.Base: true}
+	for _, other := range overlays {
+		if other.Base == o.Base {
+			disks[other.Path()] = true
+		}
+	}
+	records, _ := state.List()
+	for _, rec := range records {
+		if disks[rec.DiskPath] {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+// formatSize renders a size in bytes with a binary unit.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/library"
+	"github.com/ilmanzo/q2boot/internal/overlay"
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{200 << 20, "200.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatSize(tt.size); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestOverlayInUse(t *testing.T) {
+	original := state.Dir
+	defer func() { state.Dir = original }()
+	dir := t.TempDir()
+	state.Dir = func() string { return dir }
+
+	rec := &state.Record{
+		Name:      "web",
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+		Config:    &config.VMConfig{Overlay: "alice"},
+	}
+	if err := state.Save(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := overlayUser("alice"); got == nil || got.Name != "web" {
+		t.Errorf("overlayUser(alice) = %v, want VM web", got)
+	}
+	if got := overlayUser("bob"); got != nil {
+		t.Errorf("overlayUser(bob) = %v, want none", got.Name)
+	}
+	if err := useOverlay(&config.VMConfig{Overlay: "alice", DiskPath: "base.qcow2"}); err == nil {
+		t.Error("useOverlay() accepted an overlay used by a running VM")
+	}
+}
+
+func TestBaseInUse(t *testing.T) {
+	originalState, originalOverlays := state.Dir, overlay.Dir
+	defer func() { state.Dir, overlay.Dir = originalState, originalOverlays }()
+	dir := t.TempDir()
+	state.Dir = func() string { return filepath.Join(dir, "run") }
+	overlay.Dir = func() string { return filepath.Join(dir, overlay.DirName) }
+
+	base := filepath.Join(dir, "base.qcow2")
+	if err := os.MkdirAll(overlay.Dir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(overlay.Dir(), "bob"+overlay.SidecarExt), []byte(`{"base": "`+base+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	alice := &overlay.Overlay{Name: "alice", Base: base}
+
+	if rec, err := baseUser(alice); rec != nil || err != nil {
+		t.Errorf("baseUser() = %v, %v, want none", rec, err)
+	}
+	bob := &overlay.Overlay{Name: "bob", Base: base}
+	for _, disk := range []string{base, bob.Path()} {
+		rec := &state.Record{Name: "web", PID: os.Getpid(), DiskPath: disk, StartedAt: time.Now()}
+		if err := state.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := baseUser(alice); got == nil || got.Name != "web" {
+			t.Errorf("baseUser() with a VM on %s = %v, %v, want VM web", disk, got, err)
+		}
+	}
+}
+
+func TestCommitWithClones(t *testing.T) {
+	originalState, originalOverlays, originalLibrary, originalRun := state.Dir, overlay.Dir, library.Dir, qemuimg.Run
+	defer func() {
+		state.Dir, overlay.Dir, library.Dir, qemuimg.Run = originalState, originalOverlays, originalLibrary, originalRun
+	}()
+	dir := t.TempDir()
+	state.Dir = func() string { return filepath.Join(dir, "run") }
+	overlay.Dir = func() string { return filepath.Join(dir, overlay.DirName) }
+	library.Dir = func() string { return filepath.Join(dir, library.DirName) }
+	var commits int
+	qemuimg.Run = func(args ...string) ([]byte, error) {
+		switch args[0] {
+		case "info":
+			return []byte(`{"format": "raw"}`), nil
+		case "commit":
+			commits++
+			return nil, nil
+		}
+		return nil, os.WriteFile(args[len(args)-1], nil, 0600)
+	}
+
+	base := filepath.Join(dir, "base.img")
+	if err := os.WriteFile(base, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overlay.Create("alice", base); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Create("web", base, config.DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newOverlayCommitCmd()
+	cmd.SetArgs([]string{"alice"})
+	if err := cmd.Execute(); err == nil || commits != 0 {
+		t.Errorf("commit with a clone on the base = %v after %d commits, want a refusal", err, commits)
+	}
+	cmd.SetArgs([]string{"alice", "--force"})
+	if err := cmd.Execute(); err != nil || commits != 1 {
+		t.Errorf("commit --force = %v after %d commits, want it committed", err, commits)
+	}
+}
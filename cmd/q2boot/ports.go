@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/ports"
+)
+
+// PortAuto is the port flag value asking q2boot to pick a free port.
+const PortAuto = "auto"
+
+// portFlag is a port number flag that also accepts "auto".
+type portFlag struct {
+	Port uint16
+	Auto bool
+}
+
+func (p *portFlag) String() string {
+	if p.Auto {
+		return PortAuto
+	}
+	if p.Port == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(p.Port))
+}
+
+func (p *portFlag) Set(value string) error {
+	if value == PortAuto {
+		p.Port, p.Auto = 0, true
+		return nil
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("must be a port number or '%s'", PortAuto)
+	}
+	p.Port, p.Auto = uint16(port), false
+	return nil
+}
+
+func (p *portFlag) Type() string {
+	return "port"
+}
+
+// allocatePorts picks free ports for the ports configured as automatic,
+// avoiding the host ports of the port forwards. The ports stay reserved for
+// as long as this process runs.
+func allocatePorts(cfg *config.VMConfig) error {
+	forwards, err := cfg.PortForwards()
+	if err != nil {
+		return err
+	}
+	var skip []uint16
+	for _, f := range forwards {
+		skip = append(skip, f.HostPort)
+	}
+
+	if cfg.SSHPortAuto {
+		port, err := ports.Allocate(config.DefaultSSHPort, skip...)
+		if err != nil {
+			return fmt.Errorf("failed to allocate an SSH port: %w", err)
+		}
+		cfg.SSHPort = port
+		fmt.Printf("Using SSH port %d\n", port)
+	}
+	if cfg.MonitorPortAuto {
+		port, err := ports.Allocate(config.FirstMonitorPort, append(skip, cfg.SSHPort)...)
+		if err != nil {
+			return fmt.Errorf("failed to allocate a monitor port: %w", err)
+		}
+		cfg.MonitorPort = port
+		fmt.Printf("Using monitor port %d\n", port)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/ssh"
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/vm"
+)
+
+// NewSSHCmd creates the `ssh` subcommand, which logs in to a running VM.
+func NewSSHCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ssh [name] [-- command...]",
+		Short: "Log in to a running VM over SSH",
+		Long: `Log in to a running VM through its forwarded SSH port, or run a command
+there. The name can be left out when only one VM is running.
+
+The user and key default to the ones the VM was started with (--ssh-user,
+--ssh-key or ssh_user/ssh_key in the config file). Host keys are recorded in
+the VM's state directory, not in ~/.ssh/known_hosts, and are forgotten when
+the VM stops.`,
+		Example: `  q2boot ssh
+  q2boot ssh web -- systemctl status nginx`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			names, command := splitCommand(cmd, args)
+			if len(names) > 1 {
+				return fmt.Errorf("expected at most one VM name, got %d (put the command after --)", len(names))
+			}
+
+			rec, err := findRunningVM(names)
+			if err != nil {
+				return err
+			}
+			target := loginTarget(cmd, rec)
+			return runAttached(target.Command(context.Background(), command...))
+		},
+	}
+}
+
+// NewCopyCmd creates the `cp` subcommand, which copies files to and from a
+// running VM.
+func NewCopyCmd() *cobra.Command {
+	var recursive bool
+
+	cmd := &cobra.Command{
+		Use:   "cp <source>... <destination>",
+		Short: "Copy files to or from a running VM over SSH",
+		Long: `Copy files between the host and a running VM with scp. Paths in the VM are
+written as name:path; the user, key and host key handling are the same as
+for 'q2boot ssh'.`,
+		Example: `  q2boot cp ./app.tar.gz web:/tmp/
+  q2boot cp --recursive web:/var/log/nginx ./logs`,
+		Args:         cobra.MinimumNArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, err := copyVM(args)
+			if err != nil {
+				return err
+			}
+			rec, err := loadRunningVM(name)
+			if err != nil {
+				return err
+			}
+
+			target := loginTarget(cmd, rec)
+			operands := make([]string, len(args))
+			for i, arg := range args {
+				if _, path, ok := splitRemote(arg); ok {
+					arg = target.Remote(path)
+				}
+				operands[i] = arg
+			}
+			last := len(operands) - 1
+			return runAttached(target.CopyCommand(context.Background(), recursive, operands[:last], operands[last]))
+		},
+	}
+
+	cmd.Flags().BoolVar(&recursive, "recursive", false, "Copy directories recursively")
+	return cmd
+}
+
+// findRunningVM returns the record of the named VM, or of the only running
+// VM if names is empty.
+func findRunningVM(names []string) (*state.Record, error) {
+	if len(names) == 1 {
+		return loadRunningVM(names[0])
+	}
+
+	records, err := state.List()
+	if err != nil {
+		return nil, err
+	}
+	switch len(records) {
+	case 0:
+		return nil, fmt.Errorf("no running VMs")
+	case 1:
+		return records[0], nil
+	default:
+		var running []string
+		for _, rec := range records {
+			running = append(running, rec.Name)
+		}
+		return nil, fmt.Errorf("several VMs are running (%s); name one", strings.Join(running, ", "))
+	}
+}
+
+// splitRemote splits an scp operand of the form name:path. Operands whose
+// part before the colon is not a valid VM name, e.g. "./a:b", are local.
+func splitRemote(arg string) (name, path string, ok bool) {
+	name, path, found := strings.Cut(arg, ":")
+	if !found || state.ValidateName(name) != nil {
+		return "", "", false
+	}
+	return name, path, true
+}
+
+// copyVM returns the VM the cp operands refer to, which must be one.
+func copyVM(args []string) (string, error) {
+	var vmName string
+	for _, arg := range args {
+		name, _, ok := splitRemote(arg)
+		if !ok {
+			continue
+		}
+		if vmName != "" && name != vmName {
+			return "", fmt.Errorf("cannot copy between VMs '%s' and '%s'", vmName, name)
+		}
+		vmName = name
+	}
+	if vmName == "" {
+		return "", fmt.Errorf("no path in a VM given; write it as name:path")
+	}
+	return vmName, nil
+}
+
+// loginTarget returns the SSH target of a running VM. The user and key
+// default to those the VM was started with, which is the key cloud-init
+// authorized, unless they are given on the command line.
+func loginTarget(cmd *cobra.Command, rec *state.Record) ssh.Target {
+	user, key := cfg.SSHUser, cfg.SSHKey
+	if rec.Config != nil {
+		if !cmd.Flags().Changed("ssh-user") && rec.Config.SSHUser != "" {
+			user = rec.Config.SSHUser
+		}
+		if !cmd.Flags().Changed("ssh-key") && rec.Config.SSHKey != "" {
+			key = rec.Config.SSHKey
+		}
+	}
+	return ssh.Target{
+		Host:           vm.LocalhostAddress,
+		Port:           rec.SSHPort,
+		User:           user,
+		KeyFile:        loginKey(key),
+		KnownHostsFile: state.KnownHostsFile(rec.Name),
+	}
+}
+
+// runAttached runs an ssh or scp command on the terminal. Its exit status
+// becomes q2boot's, so scripts can tell a failed remote command apart.
+func runAttached(c *exec.Cmd) error {
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", c.Args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+func TestSplitRemote(t *testing.T) {
+	tests := []struct {
+		arg        string
+		name, path string
+		ok         bool
+	}{
+		{arg: "web:/tmp/", name: "web", path: "/tmp/", ok: true},
+		{arg: "sle16.qcow2:notes.txt", name: "sle16.qcow2", path: "notes.txt", ok: true},
+		{arg: "web:", name: "web", path: "", ok: true},
+		{arg: "./app.tar.gz"},
+		{arg: "./a:b"},
+		{arg: "/var/log:x"},
+		{arg: ":path"},
+	}
+
+	for _, tt := range tests {
+		name, path, ok := splitRemote(tt.arg)
+		if name != tt.name || path != tt.path || ok != tt.ok {
+			t.Errorf("splitRemote(%q) = %q, %q, %t, want %q, %q, %t", tt.arg, name, path, ok, tt.name, tt.path, tt.ok)
+		}
+	}
+}
+
+func TestCopyVM(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: []string{"a.txt", "b.txt", "web:/tmp/"}, want: "web"},
+		{args: []string{"web:/etc/os-release", "."}, want: "web"},
+		{args: []string{"a.txt", "b.txt"}, wantErr: true},
+		{args: []string{"web:/etc/hosts", "db:/tmp/"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := copyVM(tt.args)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("copyVM(%q) = %q, %v, want %q (error %t)", tt.args, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFindRunningVM(t *testing.T) {
+	original := state.Dir
+	defer func() { state.Dir = original }()
+	dir := t.TempDir()
+	state.Dir = func() string { return dir }
+
+	if _, err := findRunningVM(nil); err == nil {
+		t.Error("findRunningVM() found a VM although none is running")
+	}
+
+	// Records of this test process count as running VMs.
+	save := func(name string) {
+		rec := &state.Record{Name: name, PID: os.Getpid(), SSHPort: 2222, StartedAt: time.Now()}
+		if err := state.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("web")
+	rec, err := findRunningVM(nil)
+	if err != nil || rec.Name != "web" {
+		t.Errorf("findRunningVM() = %v, %v, want the only running VM", rec, err)
+	}
+
+	save("db")
+	if _, err := findRunningVM(nil); err == nil {
+		t.Error("findRunningVM() picked a VM although several are running")
+	}
+	if rec, err := findRunningVM([]string{"db"}); err != nil || rec.Name != "db" {
+		t.Errorf("findRunningVM(db) = %v, %v", rec, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/expect"
+	"github.com/ilmanzo/q2boot/internal/smoke"
+	"github.com/ilmanzo/q2boot/internal/ssh"
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/vm"
+)
+
+// testOptions holds the flags of the `test` subcommand.
+type testOptions struct {
+	checksFile string
+	checks     []string
+	via        string
+	junitPath  string
+	jsonPath   string
+}
+
+// NewTestCmd creates the `test` subcommand, which smoke-tests an image.
+func NewTestCmd() *cobra.Command {
+	opts := &testOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "test [flags] <disk_image_path>",
+		Short: "Boot an image, run smoke checks and report the results",
+		Long: `Boot an image in the background, wait until it is ready, run shell checks
+over SSH or on the serial console, then power it off and report the results.
+
+Checks come from a YAML file (--checks) and/or --check flags. Checking over
+SSH waits for the SSH port. Checking on the serial console needs a logged-in
+shell there; use --expect with a login script to get one. All the flags used
+to run a VM (--arch, --cpu, --wait-for, --expect, ...) apply.
+
+q2boot exits with a non-zero status unless the VM booted and every check passed.`,
+		Example: `  q2boot test sle16.qcow2 --check 'systemctl is-system-running --wait' --junit results.xml
+  q2boot test sle16.qcow2 --checks checks.yaml --via serial --expect login.yaml --json summary.json`,
+		Args: cobra.ExactArgs(1),
+		// Failing checks are not a usage error
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSmokeTest(cmd, args[0], cfg, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.checksFile, "checks", "", "YAML file with the checks to run")
+	cmd.Flags().StringArrayVar(&opts.checks, "check", nil, "Shell command that must succeed in the guest (can be specified multiple times)")
+	cmd.Flags().StringVar(&opts.via, "via", "", "Run checks over 'ssh' or on the 'serial' console (default: ssh)")
+	cmd.Flags().StringVar(&opts.junitPath, "junit", "", "Write the results as JUnit XML to this file")
+	cmd.Flags().StringVar(&opts.jsonPath, "json", "", "Write a JSON summary to this file ('-' for stdout)")
+	return cmd
+}
+
+// loadSuite builds the suite from the checks file and --check flags.
+func (opts *testOptions) loadSuite() (*smoke.Suite, error) {
+	suite := &smoke.Suite{}
+	if opts.checksFile != "" {
+		loaded, err := smoke.LoadSuite(opts.checksFile)
+		if err != nil {
+			return nil, err
+		}
+		suite = loaded
+	}
+	for _, command := range opts.checks {
+		suite.Checks = append(suite.Checks, smoke.Check{Run: command})
+	}
+	if opts.via != "" {
+		suite.Via = opts.via
+	}
+	if len(suite.Checks) == 0 {
+		return nil, fmt.Errorf("no checks to run (use --checks or --check)")
+	}
+	if err := suite.Validate(); err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// runSmokeTest boots the image, runs the checks and writes the reports.
+func runSmokeTest(cmd *cobra.Command, diskPath string, cfg *config.VMConfig, opts *testOptions) error {
+	suite, err := opts.loadSuite()
+	if err != nil {
+		return err
+	}
+	restoreStdout := progressToStderr(opts.junitPath, opts.jsonPath)
+	defer restoreStdout()
+
+	cleanup, err := prepareConfig(cmd, diskPath, cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if suite.Via == smoke.ViaSSH {
+		cfg.WaitSSH = true
+	}
+	virtualMachine, err := newVM(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Interrupting the test stops the VM instead of leaving it behind
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("Starting VM", "arch", cfg.Arch)
+	report := bootAndCheck(ctx, virtualMachine, cfg, suite, os.Stdout)
+
+	printReport(report)
+	restoreStdout()
+	if err := writeReports(report, opts); err != nil {
+		return err
+	}
+	switch {
+	case !report.Booted:
+		return fmt.Errorf("VM did not boot: %s", report.BootError)
+	case !report.Passed():
+		return fmt.Errorf("%d of %d checks failed", report.Failures(), len(report.Checks))
+	}
+	return nil
+}
+
+// bootAndCheck starts virtualMachine in the background, runs the checks of
+// suite on it and shuts it down. Progress is written to log.
+func bootAndCheck(ctx context.Context, virtualMachine vm.VM, cfg *config.VMConfig, suite *smoke.Suite, log io.Writer) *smoke.Report {
+	report := &smoke.Report{
+		Name:      cfg.Name,
+		Image:     cfg.DiskPath,
+		Arch:      cfg.Arch,
+		StartedAt: time.Now(),
+	}
+	if report.Name == "" {
+		report.Name = state.NameFromDisk(cfg.DiskPath)
+	}
+	defer func() { report.Duration = time.Since(report.StartedAt) }()
+
+	inst, err := virtualMachine.Start(ctx)
+	report.BootDuration = time.Since(report.StartedAt)
+	if err != nil {
+		report.BootError = err.Error()
+		report.Checks = smoke.SkipChecks(suite.Checks, "VM did not boot")
+		return report
+	}
+	report.Name = inst.Name
+	report.Booted = true
+	fmt.Fprintf(log, "VM '%s' booted in %s\n", inst.Name, report.BootDuration.Round(time.Second))
+
+	if len(suite.Checks) > 0 {
+		runner, closeRunner, err := newCheckRunner(inst, suite.Via, cfg.SSHUser, loginKey(cfg.SSHKey))
+		if err != nil {
+			report.Checks = smoke.SkipChecks(suite.Checks, err.Error())
+		} else {
+			report.Checks = smoke.RunChecks(ctx, runner, suite.Checks, log)
+			closeRunner()
+		}
+	}
+
+	grace := time.Duration(cfg.ShutdownTimeout) * time.Second
+	if ctx.Err() != nil {
+		grace = 0
+	}
+	if stage, err := inst.Shutdown(grace, nil); err != nil {
+		fmt.Fprintln(log, "Failed to shut down VM", "name", inst.Name, "error", err)
+	} else {
+		fmt.Fprintf(log, "VM '%s' stopped by %s.\n", inst.Name, stage)
+	}
+	inst.Wait()
+	return report
+}
+
+// loginKey returns the private key file to log in with for the configured
+// SSH key, or "" to leave the choice to ssh (e.g. when the key is only in
+// the agent).
+func loginKey(sshKey string) string {
+	private, _ := ssh.KeyFiles(sshKey)
+	if _, err := os.Stat(private); err != nil {
+		return ""
+	}
+	return private
+}
+
+// newCheckRunner returns a runner for checks over SSH or on the serial
+// console of inst, and a function releasing it.
+func newCheckRunner(inst *vm.Instance, via, sshUser, sshKey string) (smoke.Runner, func(), error) {
+	if via == smoke.ViaSerial {
+		conn, err := inst.DialConsole()
+		if err != nil {
+			return nil, nil, err
+		}
+		session := expect.NewSession(conn, nil)
+		// Get a fresh prompt, in case something was typed already
+		session.Send("\r")
+		return &smoke.SerialRunner{Session: session}, func() { session.Close() }, nil
+	}
+
+	runner := &smoke.SSHRunner{Target: ssh.Target{
+		Host:      vm.LocalhostAddress,
+		Port:      inst.Record.SSHPort,
+		User:      sshUser,
+		KeyFile:   sshKey,
+		BatchMode: true,
+	}}
+	return runner, func() {}, nil
+}
+
+// printReport prints a one-line result per check.
+func printReport(report *smoke.Report) {
+	fmt.Println()
+	for _, check := range report.Checks {
+		status := "PASS"
+		switch {
+		case check.Skipped:
+			status = "SKIP"
+		case !check.Passed:
+			status = "FAIL"
+		}
+		fmt.Printf("%s  %s (%s)\n", status, check.Name, check.Duration.Round(time.Millisecond))
+		if !check.Passed && check.Error != "" {
+			fmt.Printf("      %s\n", check.Error)
+		}
+	}
+}
+
+// writeReports writes the JUnit XML and JSON reports requested by the flags.
+func writeReports(report *smoke.Report, opts *testOptions) error {
+	if opts.junitPath != "" {
+		if err := writeReportFile(opts.junitPath, report.WriteJUnit); err != nil {
+			return fmt.Errorf("failed to write JUnit report: %w", err)
+		}
+	}
+	if opts.jsonPath != "" {
+		if err := writeReportFile(opts.jsonPath, report.WriteJSON); err != nil {
+			return fmt.Errorf("failed to write JSON summary: %w", err)
+		}
+	}
+	return nil
+}
+
+// progressToStderr sends what would go to stdout to stderr instead when
+// one of the report paths is "-", so that the report written to stdout can
+// be parsed. The returned function points stdout back to where it was.
+func progressToStderr(reportPaths ...string) func() {
+	stdout := os.Stdout
+	if slices.Contains(reportPaths, "-") {
+		os.Stdout = os.Stderr
+	}
+	return func() { os.Stdout = stdout }
+}
+
+// writeReportFile writes a report to path, or to stdout if path is "-".
+func writeReportFile(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,148 @@
+// Package cloudinit builds NoCloud seeds, which configure cloud images on
+// their first boot. A seed is an ISO 9660 volume labelled "cidata" holding a
+// user-data and a meta-data file; cloud-init in the guest finds it by label.
+//
+// The user-data comes from a file, from shortcuts (SSH keys and a hostname)
+// or from both, in which case the shortcuts are merged into the file's
+// #cloud-config document.
+package cloudinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilmanzo/q2boot/internal/iso9660"
+)
+
+// Seed volume constants
+const (
+	VolumeLabel       = "cidata"
+	UserDataName      = "user-data"
+	MetaDataName      = "meta-data"
+	CloudConfigHeader = "#cloud-config"
+	FilePermissions   = 0600
+)
+
+// Seed describes the data passed to cloud-init.
+type Seed struct {
+	// UserDataFile is a user-data file, e.g. a #cloud-config document or a script
+	UserDataFile string
+	// SSHKeys are public keys authorized for the default user and root
+	SSHKeys []string
+	// Hostname is the guest's hostname
+	Hostname string
+}
+
+// Enabled reports whether there is anything to pass to cloud-init.
+func (s *Seed) Enabled() bool {
+	return s.UserDataFile != "" || len(s.SSHKeys) > 0 || s.Hostname != ""
+}
+
+// UserData returns the user-data. A user-data file is passed on unchanged
+// unless there are shortcuts to merge into it, which requires it to be a
+// #cloud-config document.
+func (s *Seed) UserData() ([]byte, error) {
+	var data []byte
+	if s.UserDataFile != "" {
+		var err error
+		if data, err = os.ReadFile(s.UserDataFile); err != nil {
+			return nil, fmt.Errorf("failed to read cloud-init user-data: %w", err)
+		}
+		if len(s.SSHKeys) == 0 && s.Hostname == "" {
+			return data, nil
+		}
+		if !bytes.HasPrefix(data, []byte(CloudConfigHeader)) {
+			return nil, fmt.Errorf("SSH keys and a hostname can only be added to %s user-data, but %s starts differently", CloudConfigHeader, s.UserDataFile)
+		}
+	}
+
+	config := make(map[string]any)
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid cloud-init user-data in %s: %w", s.UserDataFile, err)
+	}
+	if s.Hostname != "" {
+		config["hostname"] = s.Hostname
+	}
+	if len(s.SSHKeys) > 0 {
+		keys, _ := config["ssh_authorized_keys"].([]any)
+		for _, key := range s.SSHKeys {
+			keys = append(keys, key)
+		}
+		config["ssh_authorized_keys"] = keys
+		// Let the keys log in as root too, which is what q2boot's ssh uses
+		// by default, unless the user-data says otherwise.
+		if _, ok := config["disable_root"]; !ok {
+			config["disable_root"] = false
+		}
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(CloudConfigHeader+"\n"), out...), nil
+}
+
+// MetaData returns the meta-data for the given user-data. The instance ID
+// is derived from the seed's content, so changing it makes cloud-init run
+// again on a persistent disk.
+func (s *Seed) MetaData(userData []byte) []byte {
+	sum := sha256.Sum256(append(userData, s.Hostname...))
+	var b strings.Builder
+	fmt.Fprintf(&b, "instance-id: iid-q2boot-%s\n", hex.EncodeToString(sum[:6]))
+	if s.Hostname != "" {
+		fmt.Fprintf(&b, "local-hostname: %s\n", s.Hostname)
+	}
+	return []byte(b.String())
+}
+
+// Image returns the seed volume.
+func (s *Seed) Image() (*iso9660.Image, error) {
+	userData, err := s.UserData()
+	if err != nil {
+		return nil, err
+	}
+	img := iso9660.New(VolumeLabel)
+	if err := img.AddFile(UserDataName, userData); err != nil {
+		return nil, err
+	}
+	if err := img.AddFile(MetaDataName, s.MetaData(userData)); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// WriteISO writes the seed volume to path.
+func (s *Seed) WriteISO(path string) error {
+	img, err := s.Image()
+	if err != nil {
+		return err
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, FilePermissions); err != nil {
+		return fmt.Errorf("failed to write cloud-init seed: %w", err)
+	}
+	return nil
+}
+
+// ReadPublicKey reads an OpenSSH public key file, rejecting private keys.
+func ReadPublicKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SSH public key: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if strings.Contains(key, "PRIVATE KEY") || !strings.HasPrefix(key, "ssh-") && !strings.HasPrefix(key, "ecdsa-") && !strings.HasPrefix(key, "sk-") {
+		return "", fmt.Errorf("%s is not an SSH public key", path)
+	}
+	return key, nil
+}
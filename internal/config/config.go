@@ -3,6 +3,12 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
+
+	"github.com/ilmanzo/q2boot/internal/configdrive"
+	"github.com/ilmanzo/q2boot/internal/detector"
+	"github.com/ilmanzo/q2boot/internal/overlay"
+	"github.com/ilmanzo/q2boot/internal/ssh"
 )
 
 // Validation constants
@@ -15,24 +21,60 @@ const (
 	DefaultCPU         = 2
 	DefaultRAMGb       = 2
 	DefaultSSHPort     = 2222
-	DefaultMonitorPort = 0 // 0 means disabled
+	DefaultMonitorPort = 0    // 0 means disabled
+	FirstMonitorPort   = 4444 // First port tried for an automatic monitor port
 	DefaultLogFile     = "q2boot.log"
+	DefaultShutdownSec = 60  // Grace period for an ACPI powerdown, in seconds
+	DefaultWaitSec     = 300 // Time limit for --wait-for/--wait-ssh, in seconds
 )
 
 // VMConfig holds the configuration settings for the VM
 type VMConfig struct {
-	Arch          string   `json:"arch" mapstructure:"arch"`
-	CPU           int      `json:"cpu" mapstructure:"cpu"`
-	RAMGb         int      `json:"ram_gb" mapstructure:"ram_gb"`
-	SSHPort       uint16   `json:"ssh_port" mapstructure:"ssh_port"`
-	MonitorPort   uint16   `json:"monitor_port" mapstructure:"monitor_port"`
-	LogFile       string   `json:"log_file" mapstructure:"log_file"`
-	SerialLogPath string   `json:"serial_log_path" mapstructure:"serial_log_path"`
-	WriteMode     bool     `json:"write_mode" mapstructure:"write_mode"`
-	Graphical     bool     `json:"graphical" mapstructure:"graphical"`
-	Confirm       bool     `json:"confirm" mapstructure:"confirm"`
-	DiskPath      string   `json:"disk_path,omitempty" mapstructure:"disk_path"`
-	ExtraQemuArgs []string `json:"extra_qemu_args,omitempty" mapstructure:"extra_qemu_args"`
+	Name            string   `json:"name,omitempty" mapstructure:"name"`
+	Arch            string   `json:"arch" mapstructure:"arch"`
+	CPU             int      `json:"cpu" mapstructure:"cpu"`
+	RAMGb           int      `json:"ram_gb" mapstructure:"ram_gb"`
+	SSHPort         uint16   `json:"ssh_port" mapstructure:"ssh_port"`
+	MonitorPort     uint16   `json:"monitor_port" mapstructure:"monitor_port"`
+	SSHPortAuto     bool     `json:"ssh_port_auto" mapstructure:"ssh_port_auto"`
+	MonitorPortAuto bool     `json:"monitor_port_auto" mapstructure:"monitor_port_auto"`
+	Forwards        []string `json:"forwards,omitempty" mapstructure:"forwards"`
+	Shares          []string `json:"shares,omitempty" mapstructure:"shares"`
+	QMPSocket       string   `json:"qmp_socket,omitempty" mapstructure:"qmp_socket"`
+	GuestAgent      bool     `json:"guest_agent" mapstructure:"guest_agent"`
+	LogFile         string   `json:"log_file" mapstructure:"log_file"`
+	SerialLogPath   string   `json:"serial_log_path" mapstructure:"serial_log_path"`
+	WriteMode       bool     `json:"write_mode" mapstructure:"write_mode"`
+	Overlay         string   `json:"overlay,omitempty" mapstructure:"overlay"`
+	Graphical       bool     `json:"graphical" mapstructure:"graphical"`
+	Confirm         bool     `json:"confirm" mapstructure:"confirm"`
+	Detach          bool     `json:"detach" mapstructure:"detach"`
+	ShutdownTimeout int      `json:"shutdown_timeout" mapstructure:"shutdown_timeout"`
+	WaitFor         string   `json:"wait_for,omitempty" mapstructure:"wait_for"`
+	WaitSSH         bool     `json:"wait_ssh" mapstructure:"wait_ssh"`
+	WaitTimeout     int      `json:"wait_timeout" mapstructure:"wait_timeout"`
+	ExpectScript    string   `json:"expect_script,omitempty" mapstructure:"expect_script"`
+	CloudInit       string   `json:"cloud_init,omitempty" mapstructure:"cloud_init"`
+	SSHKey          string   `json:"ssh_key,omitempty" mapstructure:"ssh_key"`
+	SSHUser         string   `json:"ssh_user,omitempty" mapstructure:"ssh_user"`
+	Hostname        string   `json:"hostname,omitempty" mapstructure:"hostname"`
+	Ignition        string   `json:"ignition,omitempty" mapstructure:"ignition"`
+	Combustion      string   `json:"combustion,omitempty" mapstructure:"combustion"`
+	CPUBudget       int      `json:"cpu_budget" mapstructure:"cpu_budget"`
+	RAMBudgetGb     int      `json:"ram_budget_gb" mapstructure:"ram_budget_gb"`
+	DiskPath        string   `json:"disk_path,omitempty" mapstructure:"disk_path"`
+	ExtraQemuArgs   []string `json:"extra_qemu_args,omitempty" mapstructure:"extra_qemu_args"`
+	Detect          Detect   `json:"detect" mapstructure:"detect"`
+
+	// OS is the detected guest operating system, not a setting
+	OS *detector.OSInfo `json:"os,omitempty" mapstructure:"-"`
+}
+
+// Detect holds the settings of the architecture detection
+type Detect struct {
+	// Strategies are the detection strategies tried, in order; empty means
+	// all of them in their default order
+	Strategies []string `json:"strategies" mapstructure:"strategies"`
 }
 
 // DefaultConfig creates a default configuration
@@ -49,9 +91,21 @@ func DefaultConfig() *VMConfig {
 		WriteMode:     false,
 		Graphical:     false,
 		Confirm:       false,
+
+		ShutdownTimeout: DefaultShutdownSec,
+		WaitTimeout:     DefaultWaitSec,
 	}
 }
 
+// validHostname matches RFC 1123 host names.
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 // Validate validates the configuration values
 // This provides domain-specific validation logic that Viper doesn't handle
 func (c *VMConfig) Validate() error {
@@ -63,14 +117,85 @@ func (c *VMConfig) Validate() error {
 		return fmt.Errorf("RAM must be between %d and %d GB, got %d", MinRAM, MaxRAM, c.RAMGb)
 	}
 
-	if c.SSHPort < MinPrivilegedPort {
+	if !c.SSHPortAuto && c.SSHPort < MinPrivilegedPort {
 		return fmt.Errorf("SSH port must be >= %d, got %d", MinPrivilegedPort, c.SSHPort)
 	}
 
-	if c.MonitorPort != 0 && c.MonitorPort < MinPrivilegedPort {
+	if !c.MonitorPortAuto && c.MonitorPort != 0 && c.MonitorPort < MinPrivilegedPort {
 		return fmt.Errorf("monitor port must be >= %d, got %d", MinPrivilegedPort, c.MonitorPort)
 	}
 
+	if err := c.validateForwards(); err != nil {
+		return err
+	}
+
+	if err := c.validateShares(); err != nil {
+		return err
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must be >= 0 seconds, got %d", c.ShutdownTimeout)
+	}
+
+	if c.WaitTimeout < 0 {
+		return fmt.Errorf("wait timeout must be >= 0 seconds, got %d", c.WaitTimeout)
+	}
+
+	if c.WaitFor != "" {
+		if _, err := regexp.Compile(c.WaitFor); err != nil {
+			return fmt.Errorf("invalid wait-for pattern: %w", err)
+		}
+		if c.LogFile == "" {
+			return fmt.Errorf("waiting for a serial pattern requires a log file")
+		}
+	}
+
+	if c.CPUBudget < 0 || c.RAMBudgetGb < 0 {
+		return fmt.Errorf("CPU and RAM budgets must be >= 0, got %d CPUs and %d GB", c.CPUBudget, c.RAMBudgetGb)
+	}
+
+	if c.Overlay != "" {
+		if err := overlay.ValidateName(c.Overlay); err != nil {
+			return err
+		}
+		if c.WriteMode {
+			return fmt.Errorf("an overlay already keeps the changes; it cannot be combined with write mode")
+		}
+	}
+
+	if c.Detach && c.Graphical {
+		return fmt.Errorf("detached mode cannot be combined with graphical mode")
+	}
+
+	if c.ExpectScript != "" && c.Graphical {
+		return fmt.Errorf("expect scripts need the serial console and cannot be combined with graphical mode")
+	}
+
+	if c.CloudInit != "" {
+		if _, err := os.Stat(c.CloudInit); err != nil {
+			return fmt.Errorf("cloud-init user-data not found at '%s'", c.CloudInit)
+		}
+	}
+
+	if c.SSHKey != "" {
+		if _, public := ssh.KeyFiles(c.SSHKey); !fileExists(public) {
+			return fmt.Errorf("SSH public key not found at '%s'", public)
+		}
+	}
+
+	if c.Hostname != "" && !validHostname.MatchString(c.Hostname) {
+		return fmt.Errorf("invalid hostname '%s'", c.Hostname)
+	}
+
+	if _, err := detector.Chain(c.Detect.Strategies); err != nil {
+		return fmt.Errorf("invalid detect.strategies: %w", err)
+	}
+
+	drive := &configdrive.Drive{IgnitionFile: c.Ignition, CombustionFile: c.Combustion}
+	if err := drive.Validate(); err != nil {
+		return err
+	}
+
 	if c.DiskPath == "" {
 		return fmt.Errorf("disk path is required (use -d or --disk)")
 	}
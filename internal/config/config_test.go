@@ -50,6 +50,10 @@ func TestValidate(t *testing.T) {
 	if err := os.WriteFile(tempFile, []byte("test"), 0644); err != nil {
 		t.Fatalf("Failed to create temp file for testing: %v", err)
 	}
+	keyFile := filepath.Join(tempDir, "id_ed25519")
+	if err := os.WriteFile(keyFile+".pub", []byte("ssh-ed25519 AAAA test"), 0644); err != nil {
+		t.Fatalf("Failed to create temp key for testing: %v", err)
+	}
 
 	tests := []struct {
 		name    string
@@ -169,6 +173,167 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid automatic ports",
+			config: &VMConfig{
+				Arch:            "x86_64",
+				CPU:             2,
+				RAMGb:           4,
+				SSHPortAuto:     true,
+				MonitorPortAuto: true,
+				DiskPath:        tempFile,
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid overlay with write mode",
+			config: &VMConfig{
+				Arch:      "x86_64",
+				CPU:       2,
+				RAMGb:     4,
+				SSHPort:   2222,
+				Overlay:   "alice",
+				WriteMode: true,
+				DiskPath:  tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid detection strategies",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				Detect:   Detect{Strategies: []string{"gpt", "esp", "elf", "virtcat", "filename"}},
+				DiskPath: tempFile,
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid detection strategy",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				Detect:   Detect{Strategies: []string{"gpt", "magic"}},
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid detached graphical mode",
+			config: &VMConfig{
+				Arch:      "x86_64",
+				CPU:       2,
+				RAMGb:     4,
+				SSHPort:   2222,
+				Detach:    true,
+				Graphical: true,
+				DiskPath:  tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid cloud-init shortcuts",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				SSHKey:   keyFile, // Only the public key next to it must exist
+				Hostname: "web1.example.com",
+				DiskPath: tempFile,
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid missing cloud-init user-data",
+			config: &VMConfig{
+				Arch:      "x86_64",
+				CPU:       2,
+				RAMGb:     4,
+				SSHPort:   2222,
+				CloudInit: filepath.Join(tempDir, "missing.yaml"),
+				DiskPath:  tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid missing SSH public key",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				SSHKey:   filepath.Join(tempDir, "id_missing"),
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid hostname",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				Hostname: "web_1",
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid Ignition config",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				Ignition: tempFile, // Not JSON
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid expect script in graphical mode",
+			config: &VMConfig{
+				Arch:         "x86_64",
+				CPU:          2,
+				RAMGb:        4,
+				SSHPort:      2222,
+				Graphical:    true,
+				ExpectScript: "login.yaml",
+				DiskPath:     tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid wait-for pattern",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				LogFile:  "q2boot.log",
+				WaitFor:  "login[",
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid wait-for without log file",
+			config: &VMConfig{
+				Arch:     "x86_64",
+				CPU:      2,
+				RAMGb:    4,
+				SSHPort:  2222,
+				WaitFor:  "login:",
+				DiskPath: tempFile,
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid disk path - empty",
 			config: &VMConfig{
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Port forward protocols
+const (
+	ForwardTCP = "tcp"
+	ForwardUDP = "udp"
+)
+
+// Forward is a port forward from the host to the guest.
+type Forward struct {
+	Proto     string
+	HostAddr  string // Empty means all host addresses
+	HostPort  uint16
+	GuestPort uint16
+}
+
+// ParseForward parses a port forward of the form
+// [tcp|udp:][hostaddr:]hostport-guestport, e.g. "8080-80", "udp:5353-53" or
+// "tcp:127.0.0.1:5432-5432". IPv6 host addresses are written in brackets, as
+// in "[::1]:5432-5432". The protocol defaults to tcp.
+func ParseForward(spec string) (Forward, error) {
+	f := Forward{Proto: ForwardTCP}
+
+	host, guest, ok := strings.Cut(spec, "-")
+	if !ok {
+		return f, fmt.Errorf("invalid port forward '%s': expected [tcp|udp:][hostaddr:]hostport-guestport", spec)
+	}
+
+	if proto, rest, ok := strings.Cut(host, ":"); ok && (proto == ForwardTCP || proto == ForwardUDP) {
+		f.Proto, host = proto, rest
+	}
+	hostPort := host
+	if strings.Contains(host, ":") {
+		addr, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return f, fmt.Errorf("invalid port forward '%s': expected [tcp|udp:][hostaddr:]hostport-guestport, with IPv6 addresses in brackets", spec)
+		}
+		if addr != "" && net.ParseIP(addr) == nil {
+			return f, fmt.Errorf("invalid port forward '%s': '%s' is not an IP address", spec, addr)
+		}
+		f.HostAddr, hostPort = addr, port
+	}
+
+	var err error
+	if f.HostPort, err = parseForwardPort(hostPort); err != nil {
+		return f, fmt.Errorf("invalid port forward '%s': host %w", spec, err)
+	}
+	if f.GuestPort, err = parseForwardPort(guest); err != nil {
+		return f, fmt.Errorf("invalid port forward '%s': guest %w", spec, err)
+	}
+	return f, nil
+}
+
+// parseForwardPort parses a non-zero port number.
+func parseForwardPort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("port '%s' must be a number between 1 and 65535", s)
+	}
+	return uint16(port), nil
+}
+
+// HostAddress returns the host address and port of the forward, e.g.
+// "127.0.0.1:5432", "[::1]:5432" or ":8080" for all host addresses.
+func (f Forward) HostAddress() string {
+	return net.JoinHostPort(f.HostAddr, strconv.Itoa(int(f.HostPort)))
+}
+
+// String returns the forward in the form accepted by ParseForward.
+func (f Forward) String() string {
+	if f.HostAddr != "" {
+		return fmt.Sprintf("%s:%s-%d", f.Proto, f.HostAddress(), f.GuestPort)
+	}
+	return fmt.Sprintf("%s:%d-%d", f.Proto, f.HostPort, f.GuestPort)
+}
+
+// PortForwards parses the configured port forwards.
+func (c *VMConfig) PortForwards() ([]Forward, error) {
+	var forwards []Forward
+	for _, spec := range c.Forwards {
+		f, err := ParseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// validateForwards checks the port forwards and that no two of them, or a
+// forward and the SSH forward, use the same host port.
+func (c *VMConfig) validateForwards() error {
+	forwards, err := c.PortForwards()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]string)
+	if !c.SSHPortAuto {
+		used[fmt.Sprintf("%s:%d", ForwardTCP, c.SSHPort)] = "the SSH port"
+	}
+	for _, f := range forwards {
+		key := fmt.Sprintf("%s:%d", f.Proto, f.HostPort)
+		if other, ok := used[key]; ok {
+			return fmt.Errorf("port forward '%s' uses the same host port as %s", f, other)
+		}
+		used[key] = fmt.Sprintf("'%s'", f)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Forward
+		wantErr bool
+	}{
+		{spec: "8080-80", want: Forward{Proto: "tcp", HostPort: 8080, GuestPort: 80}},
+		{spec: "tcp:8443-443", want: Forward{Proto: "tcp", HostPort: 8443, GuestPort: 443}},
+		{spec: "udp:5353-53", want: Forward{Proto: "udp", HostPort: 5353, GuestPort: 53}},
+		{spec: "127.0.0.1:5432-5432", want: Forward{Proto: "tcp", HostAddr: "127.0.0.1", HostPort: 5432, GuestPort: 5432}},
+		{spec: "udp:0.0.0.0:6000-6000", want: Forward{Proto: "udp", HostAddr: "0.0.0.0", HostPort: 6000, GuestPort: 6000}},
+		{spec: "tcp::8080-80", want: Forward{Proto: "tcp", HostPort: 8080, GuestPort: 80}},
+		{spec: "[::1]:5432-5432", want: Forward{Proto: "tcp", HostAddr: "::1", HostPort: 5432, GuestPort: 5432}},
+		{spec: "udp:[fd00::2]:5353-53", want: Forward{Proto: "udp", HostAddr: "fd00::2", HostPort: 5353, GuestPort: 53}},
+		{spec: "::1:5432-5432", wantErr: true},
+		{spec: "[::1:5432-5432", wantErr: true},
+		{spec: "8080", wantErr: true},
+		{spec: "8080-", wantErr: true},
+		{spec: "0-80", wantErr: true},
+		{spec: "8080-70000", wantErr: true},
+		{spec: "sctp:8080-80", wantErr: true},
+		{spec: "localhost:8080-80", wantErr: true},
+		{spec: "tcp:1.2.3.4:5:8080-80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseForward(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseForward(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseForward(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardStringRoundTrip(t *testing.T) {
+	for _, spec := range []string{"tcp:8080-80", "udp:127.0.0.1:5353-53", "tcp:[::1]:5432-5432"} {
+		f, err := ParseForward(spec)
+		if err != nil {
+			t.Fatalf("ParseForward(%q) failed: %v", spec, err)
+		}
+		if got := f.String(); got != spec {
+			t.Errorf("ParseForward(%q).String() = %q", spec, got)
+		}
+	}
+}
+
+func TestValidateForwards(t *testing.T) {
+	tests := []struct {
+		name     string
+		forwards []string
+		sshAuto  bool
+		wantErr  bool
+	}{
+		{name: "distinct ports", forwards: []string{"8080-80", "8443-443", "5432-5432"}},
+		{name: "same port, different protocols", forwards: []string{"tcp:5353-53", "udp:5353-53"}},
+		{name: "duplicate host port", forwards: []string{"8080-80", "8080-8080"}, wantErr: true},
+		{name: "clash with SSH port", forwards: []string{"2222-22"}, wantErr: true},
+		{name: "SSH port allocated later", forwards: []string{"2222-22"}, sshAuto: true},
+		{name: "invalid forward", forwards: []string{"http"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &VMConfig{SSHPort: DefaultSSHPort, SSHPortAuto: tt.sshAuto, Forwards: tt.forwards}
+			if err := c.validateForwards(); (err != nil) != tt.wantErr {
+				t.Errorf("validateForwards() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxShareTagLength is the longest mount tag virtio-fs accepts.
+const MaxShareTagLength = 36
+
+// Share is a host directory shared with the guest.
+type Share struct {
+	HostPath string
+	Tag      string // The guest mounts the share by this tag
+}
+
+// ParseShare parses a shared folder of the form hostdir[:tag], e.g.
+// "./src:hostsrc". The tag defaults to the directory's base name.
+func ParseShare(spec string) (Share, error) {
+	var s Share
+	// Split at the last colon, leaving colons in the directory alone.
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		s.HostPath, s.Tag = spec[:i], spec[i+1:]
+		if s.Tag == "" {
+			return s, fmt.Errorf("invalid shared folder '%s': empty tag", spec)
+		}
+	} else {
+		s.HostPath = spec
+	}
+	if s.HostPath == "" {
+		return s, fmt.Errorf("invalid shared folder '%s': expected hostdir[:tag]", spec)
+	}
+	if s.Tag == "" {
+		s.Tag = filepath.Base(filepath.Clean(s.HostPath))
+	}
+	if len(s.Tag) > MaxShareTagLength || strings.ContainsAny(s.Tag, ",/ ") {
+		return s, fmt.Errorf("invalid shared folder '%s': tag '%s' must be at most %d characters without commas, slashes or spaces", spec, s.Tag, MaxShareTagLength)
+	}
+	return s, nil
+}
+
+// String returns the share in the form accepted by ParseShare.
+func (s Share) String() string {
+	return s.HostPath + ":" + s.Tag
+}
+
+// SharedFolders parses the configured shared folders.
+func (c *VMConfig) SharedFolders() ([]Share, error) {
+	var shares []Share
+	for _, spec := range c.Shares {
+		s, err := ParseShare(spec)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+// validateShares checks that the shared folders are directories and that
+// their tags are unique.
+func (c *VMConfig) validateShares() error {
+	shares, err := c.SharedFolders()
+	if err != nil {
+		return err
+	}
+
+	tags := make(map[string]bool)
+	for _, s := range shares {
+		info, err := os.Stat(s.HostPath)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("shared folder '%s' is not a directory", s.HostPath)
+		}
+		if tags[s.Tag] {
+			return fmt.Errorf("shared folder tag '%s' is used more than once", s.Tag)
+		}
+		tags[s.Tag] = true
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseShare(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Share
+		wantErr bool
+	}{
+		{spec: "./src:hostsrc", want: Share{HostPath: "./src", Tag: "hostsrc"}},
+		{spec: "/home/user/project", want: Share{HostPath: "/home/user/project", Tag: "project"}},
+		{spec: "/srv/data/", want: Share{HostPath: "/srv/data/", Tag: "data"}},
+		{spec: "/a:b/dir:tag", want: Share{HostPath: "/a:b/dir", Tag: "tag"}},
+		{spec: "", wantErr: true},
+		{spec: ":tag", wantErr: true},
+		{spec: "./src:", wantErr: true},
+		{spec: "./src:a,b", wantErr: true},
+		{spec: "./src:" + strings.Repeat("t", 37), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseShare(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseShare(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseShare(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateShares(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		shares  []string
+		wantErr bool
+	}{
+		{name: "directories", shares: []string{dir + ":one", dir + ":two"}},
+		{name: "duplicate tag", shares: []string{dir + ":src", dir + ":src"}, wantErr: true},
+		{name: "missing directory", shares: []string{filepath.Join(dir, "missing") + ":src"}, wantErr: true},
+		{name: "file", shares: []string{file + ":src"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &VMConfig{Shares: tt.shares}
+			if err := c.validateShares(); (err != nil) != tt.wantErr {
+				t.Errorf("validateShares() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Package configdrive builds the config volumes that Ignition and Combustion
+// read on the first boot of SUSE and Fedora CoreOS style images.
+//
+// Where QEMU offers fw_cfg, the configuration is passed that way instead
+// (see FwCfgArgs); the volume is the fallback for the other architectures.
+// Both tools accept a volume labelled "ignition", so a single volume can carry
+// an Ignition config and a Combustion script:
+//
+//	ignition/config.ign
+//	combustion/script
+package configdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ilmanzo/q2boot/internal/iso9660"
+)
+
+// Config volume constants
+const (
+	IgnitionLabel   = "ignition"
+	CombustionLabel = "combustion"
+	IgnitionPath    = "ignition/config.ign"
+	CombustionPath  = "combustion/script"
+	FilePermissions = 0600
+)
+
+// fw_cfg entry names read by Ignition and Combustion
+const (
+	IgnitionFwCfgName   = "opt/com.coreos/config"
+	CombustionFwCfgName = "opt/org.opensuse.combustion/script"
+)
+
+// Drive describes the first-boot configuration of a guest.
+type Drive struct {
+	// IgnitionFile is an Ignition config (JSON)
+	IgnitionFile string
+	// CombustionFile is a Combustion script
+	CombustionFile string
+}
+
+// Enabled reports whether there is any configuration to pass.
+func (d *Drive) Enabled() bool {
+	return d.IgnitionFile != "" || d.CombustionFile != ""
+}
+
+// Validate checks that the files exist and the Ignition config is JSON,
+// which catches passing a Butane YAML file by mistake.
+func (d *Drive) Validate() error {
+	if d.IgnitionFile != "" {
+		data, err := os.ReadFile(d.IgnitionFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Ignition config: %w", err)
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("Ignition config %s is not JSON (Butane configs must be converted with butane first)", d.IgnitionFile)
+		}
+	}
+	if d.CombustionFile != "" {
+		if _, err := os.Stat(d.CombustionFile); err != nil {
+			return fmt.Errorf("Combustion script not found at '%s'", d.CombustionFile)
+		}
+	}
+	return nil
+}
+
+// Label returns the volume label: "ignition" if there is an Ignition config,
+// which Combustion accepts as well, otherwise "combustion".
+func (d *Drive) Label() string {
+	if d.IgnitionFile != "" {
+		return IgnitionLabel
+	}
+	return CombustionLabel
+}
+
+// FwCfgArgs returns the QEMU arguments passing the configuration via fw_cfg.
+func (d *Drive) FwCfgArgs() ([]string, error) {
+	var args []string
+	for _, entry := range []struct{ name, file string }{
+		{IgnitionFwCfgName, d.IgnitionFile},
+		{CombustionFwCfgName, d.CombustionFile},
+	} {
+		if entry.file == "" {
+			continue
+		}
+		path, err := filepath.Abs(entry.file)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-fw_cfg", fmt.Sprintf("name=%s,file=%s", entry.name, path))
+	}
+	return args, nil
+}
+
+// Image returns the config volume.
+func (d *Drive) Image() (*iso9660.Image, error) {
+	img := iso9660.New(d.Label())
+	for _, entry := range []struct{ name, file string }{
+		{IgnitionPath, d.IgnitionFile},
+		{CombustionPath, d.CombustionFile},
+	} {
+		if entry.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(entry.file)
+		if err != nil {
+			return nil, err
+		}
+		if err := img.AddFile(entry.name, data); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// WriteISO writes the config volume to path.
+func (d *Drive) WriteISO(path string) error {
+	img, err := d.Image()
+	if err != nil {
+		return err
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, FilePermissions); err != nil {
+		return fmt.Errorf("failed to write config drive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package configdrive
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to a file in a temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	ignition := writeFile(t, "config.ign", `{"ignition": {"version": "3.4.0"}}`)
+	butane := writeFile(t, "config.bu", "variant: fcos\nversion: 1.5.0\n")
+	script := writeFile(t, "script", "#!/bin/bash\n# combustion: network\necho root:linux | chpasswd\n")
+
+	tests := []struct {
+		name    string
+		drive   Drive
+		wantErr bool
+	}{
+		{"empty", Drive{}, false},
+		{"ignition and combustion", Drive{IgnitionFile: ignition, CombustionFile: script}, false},
+		{"butane instead of ignition", Drive{IgnitionFile: butane}, true},
+		{"missing ignition", Drive{IgnitionFile: filepath.Join(t.TempDir(), "missing.ign")}, true},
+		{"missing combustion", Drive{CombustionFile: filepath.Join(t.TempDir(), "script")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.drive.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLabel(t *testing.T) {
+	if got := (&Drive{IgnitionFile: "a", CombustionFile: "b"}).Label(); got != IgnitionLabel {
+		t.Errorf("Label() = %q, want %q", got, IgnitionLabel)
+	}
+	if got := (&Drive{CombustionFile: "b"}).Label(); got != CombustionLabel {
+		t.Errorf("Label() = %q, want %q", got, CombustionLabel)
+	}
+}
+
+func TestFwCfgArgs(t *testing.T) {
+	ignition := writeFile(t, "config.ign", "{}")
+	script := writeFile(t, "script", "#!/bin/bash\n")
+
+	args, err := (&Drive{IgnitionFile: ignition, CombustionFile: script}).FwCfgArgs()
+	if err != nil {
+		t.Fatalf("FwCfgArgs() failed: %v", err)
+	}
+	want := []string{
+		"-fw_cfg", "name=opt/com.coreos/config,file=" + ignition,
+		"-fw_cfg", "name=opt/org.opensuse.combustion/script,file=" + script,
+	}
+	if !slices.Equal(args, want) {
+		t.Errorf("FwCfgArgs() = %v, want %v", args, want)
+	}
+}
+
+func TestWriteISO(t *testing.T) {
+	script := writeFile(t, "script", "#!/bin/bash\necho configured > /etc/issue.d/q2boot\n")
+	path := filepath.Join(t.TempDir(), "config.iso")
+	if err := (&Drive{CombustionFile: script}).WriteISO(path); err != nil {
+		t.Fatalf("WriteISO() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label := string(data[16*2048+40 : 16*2048+50]); label != CombustionLabel {
+		t.Errorf("volume label = %q, want %q", label, CombustionLabel)
+	}
+	if !strings.Contains(string(data), "echo configured") {
+		t.Error("config drive does not contain the Combustion script")
+	}
+}
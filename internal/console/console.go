@@ -0,0 +1,123 @@
+// Package console attaches the local terminal to a VM serial console exposed
+// on a unix socket.
+package console
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// EscapeKey detaches from the console (Ctrl-]).
+const EscapeKey = 0x1d
+
+// EscapeKeyName is the human readable name of EscapeKey.
+const EscapeKeyName = "Ctrl-]"
+
+// ErrDetached is returned by Attach when the user pressed the escape key.
+var ErrDetached = errors.New("detached from console")
+
+// Dial connects to a console socket.
+func Dial(socketPath string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to console socket '%s': %w", socketPath, err)
+	}
+	return conn, nil
+}
+
+// Attach copies in to conn and conn to out until the escape key is read from
+// in, in reaches EOF or conn is closed by the VM. It returns ErrDetached when
+// the user detached, and nil when the console was closed by the other side.
+func Attach(conn io.ReadWriteCloser, in io.Reader, out io.Writer) error {
+	remoteDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		remoteDone <- err
+	}()
+
+	localDone := make(chan error, 1)
+	go func() {
+		localDone <- copyUntilEscape(conn, in)
+	}()
+
+	select {
+	case err := <-localDone:
+		conn.Close()
+		return err
+	case err := <-remoteDone:
+		conn.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// copyUntilEscape forwards input to the console, stopping at the escape key.
+func copyUntilEscape(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if i := bytes.IndexByte(chunk, EscapeKey); i >= 0 {
+				if _, werr := dst.Write(chunk[:i]); werr != nil {
+					return werr
+				}
+				return ErrDetached
+			}
+			if _, werr := dst.Write(chunk); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return ErrDetached
+			}
+			return err
+		}
+	}
+}
+
+// MakeRaw puts the terminal connected to stdin into raw mode, so that every
+// key press is forwarded to the guest. It returns a function restoring the
+// previous terminal settings. If stdin is not a terminal, it does nothing.
+func MakeRaw() (restore func(), err error) {
+	noop := func() {}
+	if !IsTerminal(os.Stdin) {
+		return noop, nil
+	}
+
+	saved, err := stty("-g")
+	if err != nil {
+		return noop, fmt.Errorf("failed to read terminal settings: %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return noop, fmt.Errorf("failed to set terminal to raw mode: %w", err)
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+// IsTerminal reports whether f is connected to a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty on the terminal connected to stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
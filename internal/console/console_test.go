@@ -0,0 +1,81 @@
+package console
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttachDetachesOnEscapeKey(t *testing.T) {
+	client, vmSide := net.Pipe()
+	defer vmSide.Close()
+
+	// The fake VM echoes everything it receives back to the console.
+	received := make(chan string, 1)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(io.MultiWriter(&buf, vmSide), vmSide)
+		received <- buf.String()
+	}()
+
+	in := strings.NewReader("root\r" + string(rune(EscapeKey)) + "ignored")
+	var out safeBuffer
+
+	err := Attach(client, in, &out)
+	if !errors.Is(err, ErrDetached) {
+		t.Fatalf("Attach() error = %v, want ErrDetached", err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "root\r" {
+			t.Errorf("VM received %q, want %q", got, "root\r")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("console connection was not closed after detaching")
+	}
+}
+
+func TestAttachReturnsWhenVMCloses(t *testing.T) {
+	client, vmSide := net.Pipe()
+
+	go func() {
+		vmSide.Write([]byte("Welcome to openSUSE\r\nlogin: "))
+		vmSide.Close()
+	}()
+
+	// Stdin that never delivers data, like an idle terminal.
+	in, inWriter := io.Pipe()
+	defer inWriter.Close()
+	var out safeBuffer
+
+	if err := Attach(client, in, &out); err != nil {
+		t.Fatalf("Attach() error = %v, want nil", err)
+	}
+	if !strings.Contains(out.String(), "login: ") {
+		t.Errorf("console output = %q, want it to contain the login prompt", out.String())
+	}
+}
+
+// safeBuffer is a bytes.Buffer safe for use from the copy goroutine.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,204 @@
+package detector
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/image"
+	"github.com/ilmanzo/q2boot/internal/partition"
+	"github.com/ilmanzo/q2boot/internal/xdg"
+)
+
+// Cache constants
+const (
+	CacheDirPermissions = 0700
+	// fingerprintChunk is how much of each end of an image is hashed
+	fingerprintChunk = 1 << 20
+)
+
+// Firmware types of disk images
+const (
+	FirmwareUEFI = "uefi"
+	FirmwareBIOS = "bios"
+)
+
+// Result is what detection found out about a disk image, as cached.
+type Result struct {
+	// Arch is "" for images whose OS was looked up, but not the architecture
+	Arch string `json:"arch"`
+	// Strategy is the name of the strategy that detected Arch
+	Strategy string `json:"strategy"`
+	// OS is the operating system of the guest, when known
+	OS *OSInfo `json:"os,omitempty"`
+	// Firmware is FirmwareUEFI or FirmwareBIOS, when known
+	Firmware   string    `json:"firmware,omitempty"`
+	Format     string    `json:"format,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// CacheDir returns the directory of the cached detection results.
+var CacheDir = func() string {
+	return filepath.Join(xdg.CacheHome(), "detect")
+}
+
+// NoCache makes DetectArchitecture and DetectOS ignore the cached results,
+// and replace them with what they detect.
+var NoCache = false
+
+// probed holds the results of the images probed by this process, which
+// NoCache doesn't discard.
+var probed = &sync.Map{}
+
+// Fingerprint identifies the image file at path by its size, modification
+// time and a hash of its first and last MiB, rather than by its name, so
+// that cached results survive renames.
+func Fingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	var meta [16]byte
+	binary.LittleEndian.PutUint64(meta[:], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(meta[8:], uint64(info.ModTime().UnixNano()))
+	h.Write(meta[:])
+	for _, off := range []int64{0, max(0, info.Size()-fingerprintChunk)} {
+		if _, err := io.Copy(h, io.NewSectionReader(f, off, fingerprintChunk)); err != nil {
+			return "", fmt.Errorf("failed to read '%s': %w", path, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LoadResult returns the cached result of the image with the given
+// fingerprint, or nil if there is none.
+func LoadResult(key string) *Result {
+	data, err := os.ReadFile(filepath.Join(CacheDir(), key+".json"))
+	if err != nil {
+		return nil
+	}
+	r := &Result{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil
+	}
+	return r
+}
+
+// cachedResult returns the result of the image with the given fingerprint
+// found in the cache, or probed earlier by this process.
+func cachedResult(key string) *Result {
+	if !NoCache {
+		if r := LoadResult(key); r != nil {
+			return r
+		}
+	}
+	if r, ok := probed.Load(key); ok {
+		return r.(*Result)
+	}
+	return nil
+}
+
+// storeResult records the result of the image with the given fingerprint,
+// for this process and in the cache.
+func storeResult(key string, r *Result) {
+	probed.Store(key, r)
+	if err := SaveResult(key, r); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: failed to cache the detection result:", err)
+	}
+}
+
+// storeOS records the operating system info of the image at diskPath, with
+// the given fingerprint, in a copy of its result r, or in a new result if it
+// has none yet.
+func storeOS(key, diskPath string, r *Result, info *OSInfo) {
+	updated := &Result{}
+	if r != nil {
+		*updated = *r
+	} else {
+		describe(diskPath, updated)
+	}
+	updated.OS = info
+	storeResult(key, updated)
+}
+
+// SaveResult caches the result of the image with the given fingerprint.
+func SaveResult(key string, r *Result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := CacheDir()
+	if err := os.MkdirAll(dir, CacheDirPermissions); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, key+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, key+".json"))
+}
+
+// describe completes the result r of the image at diskPath with its format
+// and firmware type. The operating system is left to DetectOS, which is only
+// called when it's needed.
+func describe(diskPath string, r *Result) {
+	r.DetectedAt = time.Now()
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		r.Format, _ = image.DetectFormat(diskPath)
+		return
+	}
+	defer disk.Close()
+	r.Format = disk.Info().Format
+	r.Firmware = firmwareOf(disk, disk.Size())
+}
+
+// firmwareOf tells how the disk r of the given size boots: with UEFI if it
+// has an EFI System Partition or an El Torito EFI boot image, with a BIOS if
+// it has a BIOS boot partition or an El Torito x86 boot image. It returns ""
+// if it can't tell.
+func firmwareOf(r io.ReaderAt, size int64) string {
+	bios := false
+	if table, err := partition.Read(r, size); err == nil {
+		for _, p := range table.Partitions {
+			if p.IsESP() {
+				return FirmwareUEFI
+			}
+			bios = bios || p.Type == biosBootType
+		}
+	}
+	if images, err := readBootCatalog(r); err == nil {
+		for _, img := range images {
+			if img.platform == elToritoEFI {
+				return FirmwareUEFI
+			}
+			bios = bios || img.platform == elToritoX86
+		}
+	}
+	if bios {
+		return FirmwareBIOS
+	}
+	return ""
+}
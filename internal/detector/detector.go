@@ -8,31 +8,55 @@ import (
 	"os/exec"
 	"slices"
 	"strings"
+	"time"
 )
 
 // SupportedArchitectures lists all architectures that can be detected
 var SupportedArchitectures = []string{"x86_64", "aarch64", "ppc64le", "s390x"}
 
 // DetectArchitecture attempts to detect the architecture from a disk image.
-// It tries multiple detection methods in order of reliability.
-// Returns the detected architecture or an error if detection fails.
+// It tries the detection strategies of Strategies in order, and returns the
+// architecture found by the most confident one that succeeds, as decided by
+// Run and Decide. If none does, the error tells why each of them failed.
+// Results are cached in CacheDir, unless NoCache is set.
 var DetectArchitecture = func(diskPath string) (string, error) {
 	if diskPath == "" {
 		return "", fmt.Errorf("disk path is empty")
 	}
 
-	// Method 1: Use virt-cat (most reliable when available)
-	if arch, err := detectByVirtCat(diskPath); err == nil {
-		return arch, nil
+	// Results are cached by fingerprint, and only used if the strategy
+	// that found them is still in the chain
+	var cached *Result
+	key, keyErr := Fingerprint(diskPath)
+	if keyErr == nil {
+		cached = cachedResult(key)
+		if cached != nil && cached.Arch != "" && inChain(Strategies, cached.Strategy) {
+			fmt.Fprintln(os.Stderr, "Using the cached architecture detected by", cached.Strategy, "(use --no-cache to detect it again)")
+			return cached.Arch, nil
+		}
 	}
-	// If virt-cat fails, we log it but don't error out, allowing fallback.
 
-	// Method 2: Fallback to filename inspection
-	if arch, err := detectByFilename(diskPath); err == nil {
-		return arch, nil
+	verdicts := Run(Strategies, diskPath, false)
+	if v := Decide(verdicts); v != nil {
+		// The file name doesn't survive renames
+		if keyErr == nil && v.Strategy.Name() != "filename" {
+			// The rest of the result doesn't depend on the strategies
+			r := cached
+			if r == nil {
+				r = &Result{}
+				describe(diskPath, r)
+			}
+			r.Arch, r.Strategy, r.DetectedAt = v.Arch, v.Strategy.Name(), time.Now()
+			storeResult(key, r)
+		}
+		return v.Arch, nil
 	}
 
-	return "", fmt.Errorf("could not detect architecture from disk image '%s'. Please specify it explicitly with --arch flag", diskPath)
+	var reasons []string
+	for _, v := range verdicts {
+		reasons = append(reasons, fmt.Sprintf("%s: %v", v.Strategy.Name(), v.Err))
+	}
+	return "", fmt.Errorf("could not detect architecture from disk image '%s' (%s). Please specify it explicitly with --arch flag", diskPath, strings.Join(reasons, "; "))
 }
 
 func detectByFilename(diskPath string) (string, error) {
@@ -59,6 +83,7 @@ func detectByVirtCat(diskPath string) (string, error) {
 
 	// Inform the user this may take some time
 	fmt.Fprintln(os.Stderr, "Detecting architecture using virt-cat (this may take a while)...")
+	virtCatRuns.Store(diskPath, true)
 
 	// Prepare commands: virt-cat <disk> /bin/sh  | file -
 	cmdVirt := exec.Command("virt-cat", diskPath, "/bin/sh")
@@ -115,6 +140,16 @@ func detectByVirtCat(diskPath string) (string, error) {
 	return "", fmt.Errorf("virt-cat/file did not reveal a clear ELF architecture for '%s'; output: %s", diskPath, strings.TrimSpace(output))
 }
 
+// inChain reports whether the strategy named name is in chain.
+func inChain(chain []Strategy, name string) bool {
+	for _, s := range chain {
+		if s.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
 // IsArchSupported checks if the given architecture is supported
 func IsArchSupported(arch string) bool {
 	return slices.Contains(SupportedArchitectures, arch)
@@ -0,0 +1,573 @@
+package detector
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+	"github.com/ilmanzo/q2boot/internal/iso9660"
+)
+
+// gptDisk builds a 64 KiB disk with 512-byte sectors whose GPT holds
+// partitions of the given types.
+func gptDisk(types ...string) []byte {
+	le := binary.LittleEndian
+	disk := make([]byte, 128*512)
+	entries := make([]byte, 128*128)
+	for i, typ := range types {
+		g := guid.MustParse(typ)
+		e := entries[128*i:]
+		copy(e, g[:])
+		le.PutUint64(e[32:], uint64(40+i))
+		le.PutUint64(e[40:], uint64(40+i))
+	}
+	h := disk[512 : 512+92]
+	copy(h, "EFI PART")
+	le.PutUint32(h[12:], 92)
+	le.PutUint64(h[72:], 2)
+	le.PutUint32(h[80:], 128)
+	le.PutUint32(h[84:], 128)
+	le.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+	le.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+	copy(disk[2*512:], entries)
+	return disk
+}
+
+// qcow2Disk wraps a disk of at most 64 KiB in a qcow2 v2 image with 64 KiB
+// clusters: the header, the L1 table, the L2 table, then the data cluster.
+func qcow2Disk(disk []byte) []byte {
+	const cs = 64 * 1024
+	be := binary.BigEndian
+	img := make([]byte, 4*cs)
+	copy(img, "QFI\xfb")
+	be.PutUint32(img[4:], 2)
+	be.PutUint32(img[20:], 16)
+	be.PutUint64(img[24:], uint64(len(disk)))
+	be.PutUint32(img[36:], 1)
+	be.PutUint64(img[40:], cs)
+	be.PutUint64(img[cs:], 2*cs)
+	be.PutUint64(img[2*cs:], 3*cs)
+	copy(img[3*cs:], disk)
+	return img
+}
+
+func writeDisk(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectByPartitionTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		types   []string
+		want    string
+		wantErr bool
+	}{
+		{"x86_64 root", []string{"C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"}, "x86_64", false},
+		{"aarch64 root", []string{"B921B045-1DF0-41C3-AF44-4C6F280D3FAE"}, "aarch64", false},
+		{"s390x usr", []string{"8A4F5770-50AA-4ED3-874A-99B710DB6FEA"}, "s390x", false},
+		{"root wins over usr", []string{"B0E01050-EE5F-4390-949A-9101B17104E9", "C31C45E6-3F39-412E-80FB-4809C4980599"}, "ppc64le", false},
+		{"PReP boot", []string{"9E1A2D38-C612-4316-AA26-8B49521E5A8B", "0FC63DAF-8483-4772-8E79-3D69D8477DE4"}, "ppc64le", false},
+		{"unsupported arch", []string{"912ADE1D-A839-4913-8964-A10EEE08FBD2"}, "", true},
+		{"generic Linux data", []string{"0FC63DAF-8483-4772-8E79-3D69D8477DE4"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := gptDisk(tt.types...)
+			for _, path := range []string{writeDisk(t, "disk.raw", disk), writeDisk(t, "disk.qcow2", qcow2Disk(disk))} {
+				arch, err := detectByPartitionTable(path)
+				if (err != nil) != tt.wantErr || arch != tt.want {
+					t.Errorf("detectByPartitionTable(%s) = %q, %v, want %q", filepath.Base(path), arch, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectByPartitionTableNoGPT(t *testing.T) {
+	if _, err := detectByPartitionTable(writeDisk(t, "disk.raw", make([]byte, 64*1024))); err == nil {
+		t.Error("detectByPartitionTable() succeeded without a partition table")
+	}
+	if _, err := detectByPartitionTable(filepath.Join(t.TempDir(), "missing.raw")); err == nil {
+		t.Error("detectByPartitionTable() succeeded for a missing image")
+	}
+}
+
+func TestDetectByFilename(t *testing.T) {
+	tests := map[string]string{
+		"/images/openSUSE-Tumbleweed-aarch64.qcow2": "aarch64",
+		"sles_s390x.raw":    "s390x",
+		"fedora@x86_64.img": "x86_64",
+	}
+	for path, want := range tests {
+		if arch, err := detectByFilename(path); err != nil || arch != want {
+			t.Errorf("detectByFilename(%q) = %q, %v, want %q", path, arch, err, want)
+		}
+	}
+	if _, err := detectByFilename("/images/disk.qcow2"); err == nil {
+		t.Error("detectByFilename() guessed an architecture for a generic name")
+	}
+}
+
+// peImage returns a minimal PE image for the given machine type.
+func peImage(machine uint16) string {
+	b := make([]byte, 512)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3c:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(b[0x44:], machine)
+	return string(b)
+}
+
+func TestArchFromESP(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"machine type", map[string]string{"EFI/BOOT/BOOTAA64.EFI": peImage(pe.IMAGE_FILE_MACHINE_ARM64)}, "aarch64", false},
+		{"machine type wins over the name", map[string]string{"EFI/BOOT/BOOTX64.EFI": peImage(pe.IMAGE_FILE_MACHINE_ARM64)}, "aarch64", false},
+		{"name of an invalid image", map[string]string{"EFI/BOOT/bootx64.efi": "not a PE image"}, "x86_64", false},
+		{"unsupported loaders ignored", map[string]string{
+			"EFI/BOOT/BOOTX64.EFI":  peImage(pe.IMAGE_FILE_MACHINE_AMD64),
+			"EFI/BOOT/BOOTIA32.EFI": peImage(pe.IMAGE_FILE_MACHINE_I386),
+		}, "x86_64", false},
+		{"vendor directory", map[string]string{"EFI/opensuse/shim.efi": peImage(pe.IMAGE_FILE_MACHINE_AMD64)}, "x86_64", false},
+		{"several architectures", map[string]string{
+			"EFI/BOOT/BOOTX64.EFI":  peImage(pe.IMAGE_FILE_MACHINE_AMD64),
+			"EFI/BOOT/BOOTAA64.EFI": peImage(pe.IMAGE_FILE_MACHINE_ARM64),
+		}, "", true},
+		{"unsupported architecture", map[string]string{"EFI/BOOT/BOOTRISCV64.EFI": "stub"}, "", true},
+		{"no boot loader", map[string]string{"EFI/BOOT/grub.cfg": ""}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for name, data := range tt.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(data)}
+			}
+			arch, err := archFromESP(fsys)
+			if (err != nil) != tt.wantErr || arch != tt.want {
+				t.Errorf("archFromESP() = %q, %v, want %q", arch, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectByESPWithoutESP(t *testing.T) {
+	path := writeDisk(t, "disk.raw", gptDisk("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"))
+	if _, err := detectByESP(path); err == nil {
+		t.Error("detectByESP() succeeded without an EFI System Partition")
+	}
+}
+
+// elfImage returns the ELF header of an executable for the given machine.
+func elfImage(machine elf.Machine, class elf.Class, order binary.ByteOrder) string {
+	b := make([]byte, 64)
+	copy(b, elf.ELFMAG)
+	b[elf.EI_CLASS], b[elf.EI_VERSION] = byte(class), byte(elf.EV_CURRENT)
+	b[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	if order == binary.LittleEndian {
+		b[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	}
+	order.PutUint16(b[16:], uint16(elf.ET_EXEC))
+	order.PutUint16(b[18:], uint16(machine))
+	order.PutUint32(b[20:], uint32(elf.EV_CURRENT))
+	return string(b)
+}
+
+func TestShellArch(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"x86_64", map[string]string{"usr/bin/sh": elfImage(elf.EM_X86_64, elf.ELFCLASS64, le)}, "x86_64"},
+		{"aarch64 /bin", map[string]string{"bin/sh": elfImage(elf.EM_AARCH64, elf.ELFCLASS64, le)}, "aarch64"},
+		{"ppc64le", map[string]string{"usr/bin/sh": elfImage(elf.EM_PPC64, elf.ELFCLASS64, le)}, "ppc64le"},
+		{"ppc64 big-endian", map[string]string{"usr/bin/sh": elfImage(elf.EM_PPC64, elf.ELFCLASS64, be)}, "ppc64"},
+		{"s390x", map[string]string{"usr/bin/sh": elfImage(elf.EM_S390, elf.ELFCLASS64, be)}, "s390x"},
+		{"31-bit s390", map[string]string{"usr/bin/sh": elfImage(elf.EM_S390, elf.ELFCLASS32, be)}, "s390"},
+		{"Fedora Btrfs subvolume", map[string]string{"root/usr/bin/sh": elfImage(elf.EM_X86_64, elf.ELFCLASS64, le)}, "x86_64"},
+		{"not an ELF file", map[string]string{"usr/bin/sh": "#!/bin/busybox"}, ""},
+		{"no shell", map[string]string{"etc/os-release": "ID=sles"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for name, data := range tt.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(data)}
+			}
+			if arch := shellArch(fsys); arch != tt.want {
+				t.Errorf("shellArch() = %q, want %q", arch, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectByELFWithoutFilesystem(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"disk.raw":  gptDisk("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"),
+		"blank.raw": make([]byte, 1<<20),
+	} {
+		if _, err := detectByELF(writeDisk(t, name, data)); err == nil {
+			t.Errorf("detectByELF(%s) succeeded without filesystems", name)
+		}
+	}
+}
+
+// isoImage builds a minimal ISO 9660 image with an empty root directory and
+// an El Torito boot catalog holding boot images for the given platforms, the
+// first one as default entry.
+func isoImage(platforms ...byte) []byte {
+	le := binary.LittleEndian
+	img := make([]byte, 24*isoSectorSize)
+	sector := func(n int) []byte { return img[n*isoSectorSize:] }
+
+	pvd := sector(16)
+	copy(pvd, "\x01CD001\x01")
+	le.PutUint32(pvd[80:], 24)
+	root := pvd[156:]
+	root[0] = 34
+	le.PutUint32(root[2:], 20)
+	le.PutUint32(root[10:], isoSectorSize)
+	root[25], root[32] = 2, 1
+
+	boot := sector(17)
+	copy(boot, "\x00CD001\x01"+elToritoSystemID)
+	le.PutUint32(boot[0x47:], 19)
+	copy(sector(18), "\xffCD001\x01")
+
+	catalog := sector(19)
+	catalog[0], catalog[1], catalog[30], catalog[31] = 1, platforms[0], 0x55, 0xaa
+	for i, p := range platforms {
+		e := catalog[32:]
+		if i > 0 {
+			// A section header, then its one entry
+			h := catalog[64*i:]
+			h[0], h[1], h[3] = elToritoSectionHeader, p, 1
+			if i == len(platforms)-1 {
+				h[0] = elToritoFinalHeader
+			}
+			e = h[32:]
+		}
+		e[0] = elToritoBootable
+		le.PutUint32(e[8:], uint32(21+i))
+	}
+	return img
+}
+
+func TestReadBootCatalog(t *testing.T) {
+	images, err := readBootCatalog(bytes.NewReader(isoImage(elToritoX86, elToritoEFI)))
+	if err != nil || len(images) != 2 || images[0] != (bootImage{elToritoX86, 21}) || images[1] != (bootImage{elToritoEFI, 22}) {
+		t.Errorf("readBootCatalog() = %v, %v", images, err)
+	}
+	if _, err := readBootCatalog(bytes.NewReader(make([]byte, 20*isoSectorSize))); err == nil {
+		t.Error("readBootCatalog() succeeded without ISO 9660 volume")
+	}
+}
+
+func TestDetectByISO(t *testing.T) {
+	tree := func(files ...string) []byte {
+		img := iso9660.New("INSTALL")
+		for _, f := range files {
+			if err := img.AddFile(f, []byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := img.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		iso     []byte
+		want    string
+		wantErr bool
+	}{
+		{"SUSE aarch64", tree("boot/aarch64/loader/linux", "media.1/products"), "aarch64", false},
+		{"SUSE ppc64le", tree("boot/ppc64le/linux", "ppc/bootinfo.txt", "suseboot/os-chooser"), "ppc64le", false},
+		{"Red Hat s390x", tree("generic.ins", "images/kernel.img"), "s390x", false},
+		{"several trees", tree("boot/x86_64/loader/linux", "boot/s390x/linux"), "", true},
+		{"BIOS boot image", isoImage(elToritoX86), "x86_64", false},
+		{"unreadable EFI boot image", isoImage(elToritoEFI), "", true},
+		{"no boot tree", tree("README"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arch, err := detectByISO(writeDisk(t, "install.iso", tt.iso))
+			if (err != nil) != tt.wantErr || arch != tt.want {
+				t.Errorf("detectByISO() = %q, %v, want %q", arch, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	chain, err := Chain(nil)
+	if err != nil || len(chain) != len(StrategyNames()) || chain[0].Name() != "gpt" {
+		t.Fatalf("Chain(nil) = %v, %v, want the default chain", chain, err)
+	}
+	chain, err = Chain([]string{"ESP", " filename"})
+	if err != nil || len(chain) != 2 || chain[0].Name() != "esp" || chain[1].Name() != "filename" {
+		t.Errorf("Chain(esp, filename) = %v, %v", chain, err)
+	}
+	for _, names := range [][]string{{"gpt", "magic"}, {"elf", "elf"}} {
+		if _, err := Chain(names); err == nil {
+			t.Errorf("Chain(%q) succeeded", names)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := writeDisk(t, "sles-s390x.raw", make([]byte, 64*512))
+	chain, err := Chain([]string{"gpt", "filename", "esp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The more confident esp strategy runs after the filename one
+	verdicts := Run(chain, path, false)
+	if len(verdicts) != 3 || verdicts[0].Err == nil || verdicts[1].Arch != "s390x" || verdicts[2].Err == nil {
+		t.Errorf("Run() = %v, want gpt and esp failures and the filename verdict", verdicts)
+	}
+	if v := Decide(verdicts); v == nil || v.Strategy.Name() != "filename" {
+		t.Errorf("Decide() = %v, want the filename verdict", v)
+	}
+	if verdicts := Run(chain, path, true); len(verdicts) != 3 || Decide(verdicts[2:]) != nil {
+		t.Errorf("Run(all) = %v, want 3 verdicts", verdicts)
+	}
+}
+
+func TestDetectArchitectureReasons(t *testing.T) {
+	original, originalDir := Strategies, CacheDir
+	defer func() { Strategies, CacheDir = original, originalDir }()
+	Strategies, _ = Chain([]string{"gpt", "filename"})
+	dir := t.TempDir()
+	CacheDir = func() string { return dir }
+
+	path := writeDisk(t, "disk.raw", make([]byte, 64*512))
+	_, err := DetectArchitecture(path)
+	if err == nil || !strings.Contains(err.Error(), "gpt: ") || !strings.Contains(err.Error(), "filename: ") {
+		t.Errorf("DetectArchitecture() = %v, want the reason of every strategy", err)
+	}
+}
+
+func TestDetectArchitectureCache(t *testing.T) {
+	original, originalDir := Strategies, CacheDir
+	defer func() { Strategies, CacheDir, NoCache = original, originalDir, false }()
+	Strategies, _ = Chain([]string{"gpt", "filename"})
+	dir := t.TempDir()
+	CacheDir = func() string { return dir }
+
+	path := writeDisk(t, "disk.qcow2", qcow2Disk(gptDisk("C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")))
+	if arch, err := DetectArchitecture(path); err != nil || arch != "x86_64" {
+		t.Fatalf("DetectArchitecture() = %q, %v, want x86_64", arch, err)
+	}
+
+	// The result is found again after a rename
+	renamed := filepath.Join(filepath.Dir(path), "renamed.qcow2")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	key, err := Fingerprint(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := LoadResult(key)
+	if r == nil || r.Arch != "x86_64" || r.Strategy != "gpt" || r.Format != "qcow2" || r.Firmware != FirmwareUEFI {
+		t.Fatalf("LoadResult() = %+v", r)
+	}
+
+	// Cached results win, unless their strategy left the chain or NoCache
+	// is set
+	r.Arch = "aarch64"
+	if err := SaveResult(key, r); err != nil {
+		t.Fatal(err)
+	}
+	if arch, _ := DetectArchitecture(renamed); arch != "aarch64" {
+		t.Errorf("DetectArchitecture() = %q, want the cached aarch64", arch)
+	}
+	Strategies, _ = Chain([]string{"elf", "filename"})
+	if _, err := DetectArchitecture(renamed); err == nil {
+		t.Error("DetectArchitecture() used a result of a strategy not in the chain")
+	}
+	// NoCache only trusts what this process probed
+	Strategies, _ = Chain([]string{"gpt"})
+	NoCache = true
+	if arch, _ := DetectArchitecture(renamed); arch != "x86_64" {
+		t.Errorf("DetectArchitecture() = %q with NoCache, want x86_64 probed earlier", arch)
+	}
+	probed = &sync.Map{}
+	if arch, _ := DetectArchitecture(renamed); arch != "x86_64" {
+		t.Errorf("DetectArchitecture() = %q with NoCache, want x86_64", arch)
+	}
+	if r := LoadResult(key); r == nil || r.Arch != "x86_64" {
+		t.Errorf("NoCache didn't replace the cached result: %+v", r)
+	}
+
+	// Changing the content changes the fingerprint
+	if err := os.WriteFile(renamed, gptDisk("B921B045-1DF0-41C3-AF44-4C6F280D3FAE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := Fingerprint(renamed); err != nil || other == key {
+		t.Errorf("Fingerprint() = %s, %v after a change", other, err)
+	}
+}
+
+func TestFirmwareOf(t *testing.T) {
+	tests := []struct {
+		name string
+		disk []byte
+		want string
+	}{
+		{"ESP", gptDisk("21686148-6449-6E6F-744E-656564454649", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"), FirmwareUEFI},
+		{"BIOS boot partition", gptDisk("21686148-6449-6E6F-744E-656564454649", "0FC63DAF-8483-4772-8E79-3D69D8477DE4"), FirmwareBIOS},
+		{"PReP boot", gptDisk("9E1A2D38-C612-4316-AA26-8B49521E5A8B"), ""},
+		{"El Torito EFI", isoImage(elToritoX86, elToritoEFI), FirmwareUEFI},
+		{"El Torito x86", isoImage(elToritoX86), FirmwareBIOS},
+		{"nothing", make([]byte, 64*512), ""},
+	}
+	for _, tt := range tests {
+		if got := firmwareOf(bytes.NewReader(tt.disk), int64(len(tt.disk))); got != tt.want {
+			t.Errorf("firmwareOf(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	data := `NAME="SLES"
+VERSION="15-SP2"
+# A comment
+VERSION_ID='15.2'
+PRETTY_NAME="SUSE Linux Enterprise Server 15 SP2 \"GA\""
+ID=sles
+VARIANT_ID=server
+
+`
+	want := OSInfo{ID: "sles", Name: `SUSE Linux Enterprise Server 15 SP2 "GA"`, Version: "15.2", Variant: "server"}
+	if got := parseOSRelease([]byte(data)); got == nil || *got != want {
+		t.Errorf("parseOSRelease() = %+v, want %+v", got, want)
+	}
+	if got := parseOSRelease([]byte("NAME=Linux\n")); got != nil {
+		t.Errorf("parseOSRelease() = %+v without an ID", got)
+	}
+	if got := (&OSInfo{ID: "opensuse-leap", Version: "15.6"}).String(); got != "opensuse-leap 15.6" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestOSOf(t *testing.T) {
+	windowsESP := fstest.MapFS{"EFI/Microsoft/Boot/bootmgfw.efi": {Data: []byte(peImage(pe.IMAGE_FILE_MACHINE_AMD64))}}
+	tests := []struct {
+		name        string
+		filesystems []fs.FS
+		want        string
+	}{
+		{"/etc", []fs.FS{fstest.MapFS{"etc/os-release": {Data: []byte("ID=fedora\nVERSION_ID=41")}}}, "fedora"},
+		{"/usr partition", []fs.FS{fstest.MapFS{"lib/os-release": {Data: []byte("ID=opensuse-microos")}}}, "opensuse-microos"},
+		{"Btrfs subvolume", []fs.FS{fstest.MapFS{"@/etc/os-release": {Data: []byte("ID=ubuntu")}}}, "ubuntu"},
+		{"Windows", []fs.FS{windowsESP, fstest.MapFS{}}, OSWindows},
+		{"dual boot", []fs.FS{windowsESP, fstest.MapFS{"etc/os-release": {Data: []byte("ID=sles")}}}, "sles"},
+		{"huge os-release", []fs.FS{fstest.MapFS{"etc/os-release": {Data: []byte("ID=sles\n" + strings.Repeat("#", 1<<20))}}}, "sles"},
+	}
+	for _, tt := range tests {
+		if got := osOf(tt.filesystems); got == nil || got.ID != tt.want {
+			t.Errorf("osOf(%s) = %+v, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got := osOf([]fs.FS{fstest.MapFS{"usr/bin/sh": {}}}); got != nil {
+		t.Errorf("osOf() = %+v without os-release", got)
+	}
+}
+
+func TestDetectOS(t *testing.T) {
+	originalDir := CacheDir
+	defer func() { CacheDir = originalDir }()
+	dir := t.TempDir()
+	CacheDir = func() string { return dir }
+
+	img := iso9660.New("SLE")
+	if err := img.AddFile("etc/os-release", []byte("ID=sles\nVERSION_ID=15.3\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeDisk(t, "root.iso", data)
+	if info, err := DetectOS(path); err != nil || info.ID != "sles" || info.Version != "15.3" {
+		t.Fatalf("DetectOS() = %+v, %v", info, err)
+	}
+
+	// The result is cached, without an architecture
+	key, _ := Fingerprint(path)
+	if r := LoadResult(key); r == nil || r.OS == nil || r.Arch != "" || r.Format != "raw" {
+		t.Errorf("LoadResult() = %+v", r)
+	}
+	if _, err := DetectOS(writeDisk(t, "blank.raw", make([]byte, 1<<20))); err == nil {
+		t.Error("DetectOS() succeeded without filesystems")
+	}
+
+	// The operating system is added to a cached architecture
+	path = writeDisk(t, "s390x.iso", data)
+	key, _ = Fingerprint(path)
+	if err := SaveResult(key, &Result{Arch: "s390x", Strategy: "iso"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := DetectOS(path); err != nil || info.ID != "sles" {
+		t.Fatalf("DetectOS() = %+v, %v", info, err)
+	}
+	if r := LoadResult(key); r == nil || r.OS == nil || r.Arch != "s390x" || r.Strategy != "iso" {
+		t.Errorf("LoadResult() = %+v, want the architecture and the operating system", r)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	verdict := func(name, arch string) Verdict {
+		chain, err := Chain([]string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Verdict{Strategy: chain[0], Arch: arch}
+	}
+	failed := verdict("gpt", "")
+	failed.Err = errors.New("no GPT")
+
+	tests := []struct {
+		name     string
+		verdicts []Verdict
+		want     string
+	}{
+		{"none", []Verdict{failed}, ""},
+		{"more confident later", []Verdict{failed, verdict("filename", "x86_64"), verdict("elf", "aarch64")}, "elf"},
+		{"equally confident", []Verdict{verdict("iso", "s390x"), verdict("virtcat", "x86_64")}, "iso"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Decide(tt.verdicts)
+			if (got == nil) != (tt.want == "") || (got != nil && got.Strategy.Name() != tt.want) {
+				t.Errorf("Decide() = %v, want the %q verdict", got, tt.want)
+			}
+		})
+	}
+}
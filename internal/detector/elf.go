@@ -0,0 +1,133 @@
+package detector
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/ilmanzo/q2boot/internal/guestfs"
+	"github.com/ilmanzo/q2boot/internal/image"
+	"github.com/ilmanzo/q2boot/internal/partition"
+)
+
+// shellPaths are where the shell is looked for in a filesystem: on a root
+// filesystem, on the top level subvolume of Fedora and Ubuntu Btrfs layouts,
+// and on a /usr filesystem.
+var shellPaths = []string{
+	"usr/bin/sh",
+	"bin/sh",
+	"root/usr/bin/sh",
+	"@/usr/bin/sh",
+}
+
+// detectByELF reads the filesystems of a raw or qcow2 image, ext2/3/4, XFS
+// or Btrfs, and infers the architecture from the ELF header of the shell.
+// Unlike virt-cat, it needs no external tool and starts no appliance.
+func detectByELF(diskPath string) (string, error) {
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer disk.Close()
+
+	filesystems, err := guestFilesystems(disk, diskPath)
+	if err != nil {
+		return "", err
+	}
+	arches := map[string]bool{}
+	for _, fsys := range filesystems {
+		if arch := shellArch(fsys); arch != "" {
+			arches[arch] = true
+		}
+	}
+	return pickArch(arches, "shell", fmt.Sprintf("the filesystems of '%s'", diskPath))
+}
+
+// guestFilesystems returns the filesystems q2boot can read on the partitions
+// of disk, or on the whole disk if it has no partition table.
+func guestFilesystems(disk *image.Disk, diskPath string) ([]fs.FS, error) {
+	volumes := []*io.SectionReader{io.NewSectionReader(disk, 0, disk.Size())}
+	table, err := partition.Read(disk, disk.Size())
+	switch {
+	case err == nil:
+		volumes = volumes[:0]
+		for _, p := range table.Partitions {
+			volumes = append(volumes, p.Section(disk))
+		}
+	case !errors.Is(err, partition.ErrNoTable):
+		return nil, fmt.Errorf("failed to read the partition table of '%s': %w", diskPath, err)
+	}
+
+	var filesystems []fs.FS
+	for _, v := range volumes {
+		if fsys, err := guestfs.Open(v, v.Size()); err == nil {
+			filesystems = append(filesystems, fsys)
+		}
+	}
+	return filesystems, nil
+}
+
+// shellArch returns the architecture of the first shell found in fsys, or
+// "" if there's none.
+func shellArch(fsys fs.FS) string {
+	for _, name := range shellPaths {
+		if arch := elfArch(fsys, name); arch != "" {
+			return arch
+		}
+	}
+	return ""
+}
+
+// elfArch returns the architecture of the ELF executable at name, or "" if
+// it's not an ELF file.
+func elfArch(fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		return ""
+	}
+	e, err := elf.NewFile(r)
+	if err != nil {
+		return ""
+	}
+	return elfMachineArch(e.Machine, e.Class, e.ByteOrder)
+}
+
+// elfMachineArch maps the machine, class and byte order of an ELF file to
+// an architecture. The byte order tells ppc64le from big-endian ppc64, the
+// class s390x from 31-bit s390.
+func elfMachineArch(machine elf.Machine, class elf.Class, order binary.ByteOrder) string {
+	is64 := class == elf.ELFCLASS64
+	switch {
+	case machine == elf.EM_X86_64:
+		return "x86_64"
+	case machine == elf.EM_AARCH64:
+		return "aarch64"
+	case machine == elf.EM_PPC64 && order == binary.LittleEndian:
+		return "ppc64le"
+	case machine == elf.EM_PPC64:
+		return "ppc64"
+	case machine == elf.EM_S390 && is64:
+		return "s390x"
+	case machine == elf.EM_S390:
+		return "s390"
+	case machine == elf.EM_386:
+		return "x86"
+	case machine == elf.EM_ARM:
+		return "arm"
+	case machine == elf.EM_PPC:
+		return "ppc"
+	case machine == elf.EM_RISCV && is64:
+		return "riscv64"
+	case machine == elf.EM_LOONGARCH && is64:
+		return "loongarch64"
+	}
+	return machine.String()
+}
@@ -0,0 +1,155 @@
+package detector
+
+import (
+	"debug/pe"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ilmanzo/q2boot/internal/guestfs"
+	"github.com/ilmanzo/q2boot/internal/image"
+	"github.com/ilmanzo/q2boot/internal/partition"
+)
+
+// efiBootDir holds the default boot loaders of removable media, which
+// firmware looks for under architecture-specific names.
+const efiBootDir = "EFI/BOOT"
+
+// efiBootLoaders maps the default boot loader names to architectures.
+var efiBootLoaders = map[string]string{
+	"BOOTX64.EFI":         "x86_64",
+	"BOOTAA64.EFI":        "aarch64",
+	"BOOTIA32.EFI":        "x86",
+	"BOOTARM.EFI":         "arm",
+	"BOOTRISCV64.EFI":     "riscv64",
+	"BOOTLOONGARCH64.EFI": "loongarch64",
+}
+
+// peMachines maps the machine types of PE images to architectures.
+var peMachines = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64:       "x86_64",
+	pe.IMAGE_FILE_MACHINE_ARM64:       "aarch64",
+	pe.IMAGE_FILE_MACHINE_I386:        "x86",
+	pe.IMAGE_FILE_MACHINE_ARMNT:       "arm",
+	pe.IMAGE_FILE_MACHINE_RISCV64:     "riscv64",
+	pe.IMAGE_FILE_MACHINE_LOONGARCH64: "loongarch64",
+}
+
+// detectByESP looks for the EFI System Partition of a raw or qcow2 image and
+// infers the architecture from the UEFI boot loaders it holds.
+func detectByESP(diskPath string) (string, error) {
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer disk.Close()
+
+	table, err := partition.Read(disk, disk.Size())
+	if err != nil {
+		return "", fmt.Errorf("failed to read the partition table of '%s': %w", diskPath, err)
+	}
+	err = fmt.Errorf("no EFI System Partition in '%s'", diskPath)
+	for _, p := range table.Partitions {
+		if !p.IsESP() {
+			continue
+		}
+		fsys, ferr := guestfs.Open(p.Section(disk), p.Size)
+		if ferr != nil {
+			err = fmt.Errorf("failed to read the EFI System Partition of '%s': %w", diskPath, ferr)
+			continue
+		}
+		arch, aerr := archFromESP(fsys)
+		if aerr == nil {
+			return arch, nil
+		}
+		err = aerr
+	}
+	return "", err
+}
+
+// archFromESP infers the architecture from the boot loaders of an EFI System
+// Partition: the machine type of the default boot loaders, or their names
+// if they're not valid PE images. Without default boot loaders, the ones
+// installed in vendor directories, e.g. EFI/opensuse, are looked at.
+func archFromESP(fsys fs.FS) (string, error) {
+	arches := map[string]bool{}
+	entries, _ := fs.ReadDir(fsys, efiBootDir)
+	for _, e := range entries {
+		name := strings.ToUpper(e.Name())
+		if e.IsDir() || path.Ext(name) != ".EFI" {
+			continue
+		}
+		arch := peArch(fsys, path.Join(efiBootDir, e.Name()))
+		if arch == "" {
+			arch = efiBootLoaders[name]
+		}
+		if arch != "" {
+			arches[arch] = true
+		}
+	}
+
+	if len(arches) == 0 {
+		vendors, _ := fs.ReadDir(fsys, "EFI")
+		for _, v := range vendors {
+			if !v.IsDir() || strings.EqualFold(v.Name(), "BOOT") {
+				continue
+			}
+			dir := path.Join("EFI", v.Name())
+			files, _ := fs.ReadDir(fsys, dir)
+			for _, f := range files {
+				if f.IsDir() || !strings.EqualFold(path.Ext(f.Name()), ".efi") {
+					continue
+				}
+				if arch := peArch(fsys, path.Join(dir, f.Name())); arch != "" {
+					arches[arch] = true
+				}
+			}
+		}
+	}
+	return pickArch(arches, "boot loader", "the EFI System Partition")
+}
+
+// peArch returns the architecture of the PE image at name, or "" if it's not
+// a PE image of a known machine type.
+func peArch(fsys fs.FS, name string) string {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		return ""
+	}
+	p, err := pe.NewFile(r)
+	if err != nil {
+		return ""
+	}
+	return peMachines[p.Machine]
+}
+
+// pickArch returns the one supported architecture among the ones of the
+// binaries of the given kind found in what, both described for errors.
+func pickArch(arches map[string]bool, kind, what string) (string, error) {
+	var found, supported []string
+	for arch := range arches {
+		found = append(found, arch)
+		if IsArchSupported(arch) {
+			supported = append(supported, arch)
+		}
+	}
+	slices.Sort(found)
+	slices.Sort(supported)
+	switch {
+	case len(found) == 0:
+		return "", fmt.Errorf("no %s found in %s", kind, what)
+	case len(supported) == 0:
+		return "", fmt.Errorf("%s is for the unsupported %s architecture", what, strings.Join(found, ", "))
+	case len(supported) > 1:
+		return "", fmt.Errorf("%s has %ss for several architectures: %s", what, kind, strings.Join(supported, ", "))
+	}
+	return supported[0], nil
+}
@@ -0,0 +1,174 @@
+package detector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/ilmanzo/q2boot/internal/guestfs"
+	"github.com/ilmanzo/q2boot/internal/image"
+)
+
+// ISO 9660 and El Torito layout, see ECMA-119 and the "El Torito" Bootable
+// CD-ROM Format Specification
+const (
+	isoSectorSize      = 2048
+	isoDescriptorStart = 16
+	isoMaxDescriptors  = 32
+	isoMagic           = "CD001"
+	elToritoSystemID   = "EL TORITO SPECIFICATION"
+
+	isoDescriptorBootRecord = 0
+	isoDescriptorTerminator = 255
+
+	elToritoBootable      = 0x88
+	elToritoSectionHeader = 0x90
+	elToritoFinalHeader   = 0x91
+	elToritoExtension     = 0x44
+
+	// Platform IDs of the boot catalog
+	elToritoX86 = 0x00
+	elToritoEFI = 0xef
+)
+
+// installTrees maps files and directories of installation media to the
+// architecture they boot: the SUSE boot directories, the PowerPC boot
+// files of SUSE and Red Hat, and the s390x parameter files.
+var installTrees = []struct {
+	path, arch string
+}{
+	{"boot/x86_64", "x86_64"},
+	{"boot/aarch64", "aarch64"},
+	{"boot/ppc64le", "ppc64le"},
+	{"boot/s390x", "s390x"},
+	{"boot/i386", "x86"},
+	{"boot/riscv64", "riscv64"},
+	{"ppc", "ppc64le"},
+	{"suseboot", "ppc64le"},
+	{"generic.ins", "s390x"},
+	{"suse.ins", "s390x"},
+}
+
+// bootImage is an entry of an El Torito boot catalog.
+type bootImage struct {
+	platform byte
+	// sector is where the image starts, in 2048-byte sectors
+	sector int64
+}
+
+// detectByISO infers the architecture of an ISO 9660 image, such as an
+// installer, from the UEFI boot loaders of its El Torito EFI boot image,
+// from the boot trees it holds, or from a BIOS boot image, in that order.
+func detectByISO(diskPath string) (string, error) {
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer disk.Close()
+	return archFromISO(disk, disk.Size(), diskPath)
+}
+
+// archFromISO infers the architecture of the ISO 9660 image r, whose name is
+// used in errors.
+func archFromISO(r io.ReaderAt, size int64, name string) (string, error) {
+	images, err := readBootCatalog(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s' as an ISO 9660 image: %w", name, err)
+	}
+
+	// EFI boot images are FAT filesystems laid out like an EFI System
+	// Partition; their size in the catalog is often wrong
+	for _, img := range images {
+		if img.platform != elToritoEFI || img.sector*isoSectorSize >= size {
+			continue
+		}
+		start := img.sector * isoSectorSize
+		if esp, err := guestfs.Open(io.NewSectionReader(r, start, size-start), size-start); err == nil {
+			if arch, err := archFromESP(esp); err == nil {
+				return arch, nil
+			}
+		}
+	}
+
+	fsys, err := guestfs.Open(r, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the ISO 9660 filesystem of '%s': %w", name, err)
+	}
+	arch, treeErr := archFromInstallTree(fsys, fmt.Sprintf("'%s'", name))
+	if treeErr == nil {
+		return arch, nil
+	}
+
+	// BIOS boot images only exist on x86
+	for _, img := range images {
+		if img.platform == elToritoX86 {
+			return "x86_64", nil
+		}
+	}
+	return "", treeErr
+}
+
+// archFromInstallTree infers the architecture from the known boot trees of
+// installation media found in fsys, described as what for errors.
+func archFromInstallTree(fsys fs.FS, what string) (string, error) {
+	arches := map[string]bool{}
+	for _, t := range installTrees {
+		if _, err := fs.Stat(fsys, t.path); err == nil {
+			arches[t.arch] = true
+		}
+	}
+	return pickArch(arches, "boot tree", what)
+}
+
+// readBootCatalog returns the bootable entries of the El Torito boot
+// catalog of an ISO 9660 image, or none if it isn't bootable.
+func readBootCatalog(r io.ReaderAt) ([]bootImage, error) {
+	le := binary.LittleEndian
+	catalog := int64(-1)
+	d := make([]byte, isoSectorSize)
+	for i := int64(0); i < isoMaxDescriptors; i++ {
+		if _, err := r.ReadAt(d, (isoDescriptorStart+i)*isoSectorSize); err != nil || string(d[1:6]) != isoMagic {
+			if i == 0 {
+				return nil, fmt.Errorf("no ISO 9660 volume descriptor")
+			}
+			break
+		}
+		if d[0] == isoDescriptorTerminator {
+			break
+		}
+		if d[0] == isoDescriptorBootRecord && string(d[7:7+len(elToritoSystemID)]) == elToritoSystemID {
+			catalog = int64(le.Uint32(d[0x47:]))
+		}
+	}
+	if catalog < 0 {
+		return nil, nil
+	}
+
+	c := make([]byte, isoSectorSize)
+	if _, err := r.ReadAt(c, catalog*isoSectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read the boot catalog: %w", err)
+	}
+	// The validation entry sets the platform of the default entry
+	if c[0] != 1 || c[30] != 0x55 || c[31] != 0xaa {
+		return nil, fmt.Errorf("invalid boot catalog")
+	}
+	platform := c[1]
+	var images []bootImage
+	for off := 32; off+32 <= len(c); off += 32 {
+		e := c[off : off+32]
+		switch e[0] {
+		case elToritoSectionHeader, elToritoFinalHeader:
+			platform = e[1]
+		case elToritoBootable:
+			images = append(images, bootImage{platform: platform, sector: int64(le.Uint32(e[8:]))})
+		case elToritoExtension:
+		case 0:
+			// Entries that aren't bootable, or the end of the catalog
+			if e[1] == 0 && le.Uint32(e[8:]) == 0 {
+				return images, nil
+			}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,214 @@
+package detector
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/ilmanzo/q2boot/internal/image"
+)
+
+// OSWindows is the ID of Windows guests, which have no os-release.
+const OSWindows = "windows"
+
+// osReleasePaths are where os-release is looked for in a filesystem: on a
+// root filesystem, on the top level subvolume of Fedora and Ubuntu Btrfs
+// layouts, and on a /usr filesystem.
+var osReleasePaths = []string{
+	"etc/os-release",
+	"usr/lib/os-release",
+	"root/etc/os-release",
+	"@/etc/os-release",
+	"lib/os-release",
+}
+
+// maxOSReleaseSize bounds how much of an os-release file is read, so that a
+// corrupt image can't make it huge.
+const maxOSReleaseSize = 64 << 10
+
+// windowsBootLoader is the boot manager Windows installs on the EFI System
+// Partition.
+const windowsBootLoader = "EFI/Microsoft/Boot/bootmgfw.efi"
+
+// OSInfo identifies the operating system of a guest, from its os-release.
+type OSInfo struct {
+	// ID is the distribution, e.g. "sles" or "opensuse-tumbleweed", or
+	// OSWindows
+	ID string `json:"id"`
+	// Name is the name to show, e.g. "SUSE Linux Enterprise Server 15 SP6"
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Variant string `json:"variant,omitempty"`
+}
+
+func (o *OSInfo) String() string {
+	name := o.Name
+	if name == "" {
+		name = strings.TrimSpace(o.ID + " " + o.Version)
+	}
+	if o.Variant != "" {
+		name += " (" + o.Variant + ")"
+	}
+	return name
+}
+
+// DetectOS identifies the operating system of a disk image from the
+// os-release of its filesystems, read directly, or from the boot manager of
+// Windows. virt-cat is only used for the images the virtcat strategy
+// already ran on, which q2boot can't read itself. Results are cached with
+// the detected architecture; images whose operating system wasn't found
+// are probed again.
+var DetectOS = func(diskPath string) (*OSInfo, error) {
+	key, err := Fingerprint(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	r := cachedResult(key)
+	if r != nil && r.OS != nil {
+		return r.OS, nil
+	}
+	_, virtCat := virtCatRuns.Load(diskPath)
+	info := probeOS(diskPath, virtCat)
+	if info == nil {
+		return nil, fmt.Errorf("could not identify the operating system of '%s'", diskPath)
+	}
+	storeOS(key, diskPath, r, info)
+	return info, nil
+}
+
+// virtCatRuns holds the paths of the images the virtcat strategy ran on.
+var virtCatRuns = &sync.Map{}
+
+// probeOS identifies the operating system of the image at diskPath, with
+// the native filesystem readers or else, if virtCat is set, virt-cat. It
+// returns nil if it can't.
+func probeOS(diskPath string, virtCat bool) *OSInfo {
+	if info, err := ReadOS(diskPath); err == nil {
+		return info
+	}
+	if !virtCat {
+		return nil
+	}
+	if info, err := osFromVirtCat(diskPath); err == nil {
+		return info
+	}
+	return nil
+}
+
+// ReadOS identifies the operating system of a raw or qcow2 image from the
+// os-release of its filesystems, read directly. Unlike DetectOS, it never
+// runs virt-cat nor touches the cache.
+func ReadOS(diskPath string) (*OSInfo, error) {
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+
+	filesystems, err := guestFilesystems(disk, diskPath)
+	if err != nil {
+		return nil, err
+	}
+	if info := osOf(filesystems); info != nil {
+		return info, nil
+	}
+	return nil, fmt.Errorf("no os-release found in the filesystems of '%s'", diskPath)
+}
+
+// osOf identifies the operating system from the first os-release found in
+// filesystems, or else from the Windows boot manager: Linux wins on images
+// booting both.
+func osOf(filesystems []fs.FS) *OSInfo {
+	windows := false
+	for _, fsys := range filesystems {
+		for _, name := range osReleasePaths {
+			if data, err := readOSRelease(fsys, name); err == nil {
+				if info := parseOSRelease(data); info != nil {
+					return info
+				}
+			}
+		}
+		if _, err := fs.Stat(fsys, windowsBootLoader); err == nil {
+			windows = true
+		}
+	}
+	if windows {
+		return &OSInfo{ID: OSWindows, Name: "Windows"}
+	}
+	return nil
+}
+
+// readOSRelease reads up to maxOSReleaseSize bytes of the os-release file
+// name of fsys.
+func readOSRelease(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxOSReleaseSize))
+}
+
+// osFromVirtCat reads the os-release of an image with virt-cat, for the
+// filesystems q2boot can't read itself.
+func osFromVirtCat(diskPath string) (*OSInfo, error) {
+	if _, err := exec.LookPath("virt-cat"); err != nil {
+		return nil, fmt.Errorf("virt-cat not found")
+	}
+	out, err := exec.Command("virt-cat", diskPath, "/etc/os-release").Output()
+	if err != nil {
+		return nil, fmt.Errorf("virt-cat failed: %w", err)
+	}
+	if info := parseOSRelease(out); info != nil {
+		return info, nil
+	}
+	return nil, fmt.Errorf("invalid os-release in '%s'", diskPath)
+}
+
+// parseOSRelease reads the ID, PRETTY_NAME, VERSION_ID and VARIANT_ID of an
+// os-release file, or returns nil if it has no ID.
+func parseOSRelease(data []byte) *OSInfo {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		values[key] = unquoteShell(value)
+	}
+	if values["ID"] == "" {
+		return nil
+	}
+	return &OSInfo{
+		ID:      values["ID"],
+		Name:    values["PRETTY_NAME"],
+		Version: values["VERSION_ID"],
+		Variant: values["VARIANT_ID"],
+	}
+}
+
+// unquoteShell removes the quotes and backslash escapes of a shell-style
+// value, as allowed in os-release.
+func unquoteShell(s string) string {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return s
+	}
+	quote, s := s[0], s[1:len(s)-1]
+	if quote == '\'' {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package detector
+
+import (
+	"fmt"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+	"github.com/ilmanzo/q2boot/internal/image"
+	"github.com/ilmanzo/q2boot/internal/partition"
+)
+
+// Partition type GUIDs of the Discoverable Partitions Specification
+// (https://uapi-group.org/specifications/specs/discoverable_partitions_specification/).
+// Root and /usr partitions have a type per architecture. Architectures
+// q2boot can't boot are listed too, so that their images are reported
+// rather than left to the slower methods.
+var (
+	rootPartitionTypes = map[guid.GUID]string{
+		guid.MustParse("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"): "x86_64",
+		guid.MustParse("B921B045-1DF0-41C3-AF44-4C6F280D3FAE"): "aarch64",
+		guid.MustParse("C31C45E6-3F39-412E-80FB-4809C4980599"): "ppc64le",
+		guid.MustParse("5EEAD9A9-FE09-4A1E-A1D7-520D00531306"): "s390x",
+		guid.MustParse("912ADE1D-A839-4913-8964-A10EEE08FBD2"): "ppc64",
+		guid.MustParse("44479540-F297-41B2-9AF7-D131D5F0458A"): "x86",
+		guid.MustParse("69DAD710-2CE4-4E3C-B16C-21A1D49ABED3"): "arm",
+		guid.MustParse("72EC70A6-CF74-40E6-BD49-4BDA08E8F224"): "riscv64",
+	}
+	usrPartitionTypes = map[guid.GUID]string{
+		guid.MustParse("8484680C-9521-48C6-9C11-B0720656F69E"): "x86_64",
+		guid.MustParse("B0E01050-EE5F-4390-949A-9101B17104E9"): "aarch64",
+		guid.MustParse("15BB03AF-77E7-4D4A-B12B-C0D084F7491C"): "ppc64le",
+		guid.MustParse("8A4F5770-50AA-4ED3-874A-99B710DB6FEA"): "s390x",
+	}
+	// prepBootType is the PowerPC PReP boot partition, found on ppc64le
+	// images that don't follow the specification
+	prepBootType = guid.MustParse("9E1A2D38-C612-4316-AA26-8B49521E5A8B")
+	// biosBootType is the BIOS boot partition holding GRUB on GPT disks
+	biosBootType = guid.MustParse("21686148-6449-6E6F-744E-656564454649")
+)
+
+// detectByPartitionTable reads the GPT of a raw or qcow2 image and maps the
+// Discoverable Partitions types it finds to an architecture. It needs no
+// external tool and reads only a few sectors of the image.
+func detectByPartitionTable(diskPath string) (string, error) {
+	disk, err := image.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer disk.Close()
+
+	table, err := partition.Read(disk, disk.Size())
+	if err != nil {
+		return "", fmt.Errorf("failed to read the partition table of '%s': %w", diskPath, err)
+	}
+	return archFromPartitions(table.Partitions)
+}
+
+// archFromPartitions returns the architecture indicated by partition types:
+// a root partition wins over a /usr partition, a PReP boot partition is
+// only a hint.
+func archFromPartitions(parts []partition.Partition) (string, error) {
+	var arch string
+	for _, types := range []map[guid.GUID]string{rootPartitionTypes, usrPartitionTypes} {
+		for _, p := range parts {
+			if arch = types[p.Type]; arch != "" {
+				break
+			}
+		}
+		if arch != "" {
+			break
+		}
+	}
+	if arch == "" {
+		for _, p := range parts {
+			if p.Type == prepBootType {
+				arch = "ppc64le"
+			}
+		}
+	}
+
+	switch {
+	case arch == "":
+		return "", fmt.Errorf("no partition type tells the architecture")
+	case !IsArchSupported(arch):
+		return "", fmt.Errorf("the partitions are for the unsupported %s architecture", arch)
+	}
+	return arch, nil
+}
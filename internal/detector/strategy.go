@@ -0,0 +1,172 @@
+package detector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Cost tells how expensive a strategy is to run.
+type Cost int
+
+const (
+	// CostLow strategies read a few sectors of the image, or none
+	CostLow Cost = iota
+	// CostMedium strategies walk the filesystems of the image
+	CostMedium
+	// CostHigh strategies run external tools
+	CostHigh
+)
+
+func (c Cost) String() string {
+	switch c {
+	case CostLow:
+		return "low"
+	case CostMedium:
+		return "medium"
+	case CostHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Cost(%d)", int(c))
+}
+
+// MarshalText implements encoding.TextMarshaler, for JSON reports.
+func (c Cost) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// Strategy is a way of detecting the architecture of a disk image.
+type Strategy interface {
+	// Name identifies the strategy, e.g. in the detect.strategies setting.
+	Name() string
+	// Cost tells how expensive the strategy is.
+	Cost() Cost
+	// Confidence is how far an architecture the strategy detects can be
+	// trusted, from 0 to 1.
+	Confidence() float64
+	// Detect returns the architecture of the disk image at diskPath.
+	Detect(diskPath string) (string, error)
+}
+
+// strategy is a Strategy backed by a detection function.
+type strategy struct {
+	name       string
+	cost       Cost
+	confidence float64
+	detect     func(diskPath string) (string, error)
+}
+
+func (s *strategy) Name() string                           { return s.name }
+func (s *strategy) Cost() Cost                             { return s.cost }
+func (s *strategy) Confidence() float64                    { return s.confidence }
+func (s *strategy) Detect(diskPath string) (string, error) { return s.detect(diskPath) }
+
+// builtinStrategies are the strategies q2boot has, in their default order:
+// from the most reliable to the least, the cheap ones first.
+var builtinStrategies = []Strategy{
+	// The partition types of the GPT
+	&strategy{"gpt", CostLow, 0.9, detectByPartitionTable},
+	// The ELF header of the shell of the guest filesystems
+	&strategy{"elf", CostMedium, 0.99, detectByELF},
+	// The boot catalog and the boot trees of ISO images
+	&strategy{"iso", CostMedium, 0.9, detectByISO},
+	// virt-cat, for the filesystems read by libguestfs only
+	&strategy{"virtcat", CostHigh, 0.9, detectByVirtCat},
+	// The UEFI boot loaders of the EFI System Partition
+	&strategy{"esp", CostMedium, 0.8, detectByESP},
+	// The name of the image file
+	&strategy{"filename", CostLow, 0.5, detectByFilename},
+}
+
+// Strategies is the chain DetectArchitecture tries, in order.
+var Strategies = builtinStrategies
+
+// StrategyNames returns the names of all the strategies, in their default
+// order.
+func StrategyNames() []string {
+	names := make([]string, len(builtinStrategies))
+	for i, s := range builtinStrategies {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Chain returns the strategies with the given names, in that order. No names
+// means all the strategies in their default order.
+func Chain(names []string) ([]Strategy, error) {
+	if len(names) == 0 {
+		return builtinStrategies, nil
+	}
+	chain := make([]Strategy, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		var found Strategy
+		for _, s := range builtinStrategies {
+			if s.Name() == name {
+				found = s
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("unknown detection strategy '%s', valid strategies are: %s", name, strings.Join(StrategyNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("detection strategy '%s' is listed twice", name)
+		}
+		seen[name] = true
+		chain = append(chain, found)
+	}
+	return chain, nil
+}
+
+// Verdict is the outcome of a strategy on a disk image.
+type Verdict struct {
+	Strategy Strategy
+	// Arch is the architecture detected, if Err is nil
+	Arch     string
+	Err      error
+	Duration time.Duration
+}
+
+// Run tries the strategies of chain in order on the disk image at diskPath,
+// and returns their verdicts. Unless all is set, it stops once an
+// architecture is detected and no strategy left could overrule it: one
+// with a higher confidence, that doesn't run external tools.
+func Run(chain []Strategy, diskPath string, all bool) []Verdict {
+	var verdicts []Verdict
+	for i, s := range chain {
+		start := time.Now()
+		arch, err := s.Detect(diskPath)
+		verdicts = append(verdicts, Verdict{Strategy: s, Arch: arch, Err: err, Duration: time.Since(start)})
+		if best := Decide(verdicts); best != nil && !all && !overrulable(best, chain[i+1:]) {
+			break
+		}
+	}
+	return verdicts
+}
+
+// overrulable reports whether a strategy of rest could overrule the verdict
+// v, without being costly.
+func overrulable(v *Verdict, rest []Strategy) bool {
+	for _, s := range rest {
+		if s.Cost() < CostHigh && s.Confidence() > v.Strategy.Confidence() {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide returns the verdict of the most confident strategy that detected
+// an architecture, which settles disagreements between strategies; the
+// first one in the chain wins among equally confident ones. It returns nil
+// if none detected an architecture.
+func Decide(verdicts []Verdict) *Verdict {
+	var best *Verdict
+	for i := range verdicts {
+		v := &verdicts[i]
+		if v.Err == nil && (best == nil || v.Strategy.Confidence() > best.Strategy.Confidence()) {
+			best = v
+		}
+	}
+	return best
+}
@@ -0,0 +1,245 @@
+// Package expect drives a VM serial console with small expect/send scripts,
+// e.g. to log in or to answer first-boot wizards without SSH.
+//
+// A script is a YAML list of steps. Each step waits for its `expect` regular
+// expression to match the console output, then writes `send` to the console.
+// Either may be omitted, and `timeout` overrides DefaultTimeout for the step:
+//
+//	# login.yaml
+//	- expect: "login:"
+//	  send: "root\r"
+//	- expect: "Password:"
+//	  send: "${ROOT_PASSWORD}\r"
+//	  timeout: 30s
+//
+// ${NAME} references in `send` are replaced with environment variables when
+// the script is loaded. They are never printed, so secrets stay out of logs.
+package expect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultTimeout is how long a step waits for its pattern unless it sets its own timeout.
+const DefaultTimeout = 2 * time.Minute
+
+// maxBufferSize bounds the unmatched console output kept for matching.
+const maxBufferSize = 1024 * 1024
+
+// envRefPattern matches ${NAME} references to environment variables.
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Step is a single expect/send exchange.
+type Step struct {
+	Expect  string        `yaml:"expect,omitempty"`
+	Send    string        `yaml:"send,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	pattern *regexp.Regexp
+	data    string // Send with environment variables expanded
+}
+
+// Script is a parsed expect script.
+type Script struct {
+	Steps []Step
+}
+
+// Load reads and parses the script at path.
+func Load(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expect script: %w", err)
+	}
+	script, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expect script '%s': %w", path, err)
+	}
+	return script, nil
+}
+
+// Parse parses a script, compiling its patterns and expanding environment
+// variables, so that mistakes are reported before the VM boots.
+func Parse(data []byte) (*Script, error) {
+	var steps []Step
+	if err := yaml.Unmarshal(data, &steps); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("script has no steps")
+	}
+
+	for i := range steps {
+		step := &steps[i]
+		if step.Expect == "" && step.Send == "" {
+			return nil, fmt.Errorf("step %d: needs 'expect' and/or 'send'", i+1)
+		}
+		if step.Timeout < 0 {
+			return nil, fmt.Errorf("step %d: timeout must not be negative", i+1)
+		}
+		if step.Expect != "" {
+			re, err := regexp.Compile(step.Expect)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: invalid pattern: %w", i+1, err)
+			}
+			step.pattern = re
+		}
+
+		var missing []string
+		step.data = envRefPattern.ReplaceAllStringFunc(step.Send, func(ref string) string {
+			name := envRefPattern.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("step %d: environment variable %s is not set", i+1, missing[0])
+		}
+	}
+	return &Script{Steps: steps}, nil
+}
+
+// Run executes the script against a serial console connection, which it
+// closes when done. Console output is copied to out and progress messages
+// are written to log; either may be nil.
+func (s *Script) Run(ctx context.Context, conn io.ReadWriteCloser, out, log io.Writer) error {
+	if log == nil {
+		log = io.Discard
+	}
+	session := NewSession(conn, out)
+	defer session.Close()
+
+	for i, step := range s.Steps {
+		if step.pattern != nil {
+			fmt.Fprintf(log, "[%d/%d] expect %q\n", i+1, len(s.Steps), step.Expect)
+			timeout := step.Timeout
+			if timeout == 0 {
+				timeout = DefaultTimeout
+			}
+			if _, _, err := session.Expect(ctx, step.pattern, timeout); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+		if step.data != "" {
+			// Log the unexpanded text, so secrets are not shown
+			fmt.Fprintf(log, "[%d/%d] send %q\n", i+1, len(s.Steps), step.Send)
+			if err := session.Send(step.data); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Session is a serial console connection whose output is collected in the
+// background, so that it can be matched against patterns.
+type Session struct {
+	conn io.ReadWriteCloser
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error         // read error that stopped the reader
+	notify chan struct{} // signalled when buf or err changes
+}
+
+// NewSession starts reading from conn. Everything read is also copied to out,
+// which may be nil.
+func NewSession(conn io.ReadWriteCloser, out io.Writer) *Session {
+	if out == nil {
+		out = io.Discard
+	}
+	s := &Session{conn: conn, notify: make(chan struct{}, 1)}
+	go func() {
+		chunk := make([]byte, 4096)
+		for {
+			n, err := conn.Read(chunk)
+			s.mu.Lock()
+			if n > 0 {
+				out.Write(chunk[:n])
+				s.buf = append(s.buf, chunk[:n]...)
+				if len(s.buf) > maxBufferSize {
+					s.buf = s.buf[len(s.buf)-maxBufferSize/2:]
+				}
+			}
+			if err != nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Expect waits until re matches the output received since the previous match,
+// and consumes the output up to the end of the match. It returns the output
+// preceding the match and the matched text followed by its submatches.
+func (s *Session) Expect(ctx context.Context, re *regexp.Regexp, timeout time.Duration) (string, []string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		loc := re.FindSubmatchIndex(s.buf)
+		var before string
+		var match []string
+		if loc != nil {
+			before = string(s.buf[:loc[0]])
+			for i := 0; i < len(loc); i += 2 {
+				if loc[i] >= 0 {
+					match = append(match, string(s.buf[loc[i]:loc[i+1]]))
+				} else {
+					match = append(match, "")
+				}
+			}
+			s.buf = s.buf[loc[1]:]
+		}
+		readErr := s.err
+		s.mu.Unlock()
+
+		if loc != nil {
+			return before, match, nil
+		}
+		if readErr != nil {
+			return "", nil, fmt.Errorf("console closed while waiting for %q: %w", re.String(), readErr)
+		}
+
+		select {
+		case <-s.notify:
+		case <-timer.C:
+			return "", nil, fmt.Errorf("timed out after %s waiting for %q", timeout, re.String())
+		case <-ctx.Done():
+			return "", nil, fmt.Errorf("interrupted while waiting for %q: %w", re.String(), ctx.Err())
+		}
+	}
+}
+
+// Send writes text to the console.
+func (s *Session) Send(text string) error {
+	if _, err := io.WriteString(s.conn, text); err != nil {
+		return fmt.Errorf("failed to write to console: %w", err)
+	}
+	return nil
+}
+
+// Close closes the console connection.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
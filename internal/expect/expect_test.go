@@ -0,0 +1,164 @@
+package expect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGuest serves a console socket that behaves like a guest login prompt
+// behind a QEMU socket chardev: typed input is echoed, except passwords.
+// It returns the socket path and a channel receiving each line typed.
+func fakeGuest(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "console.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		conn.Write([]byte("Welcome to openSUSE Tumbleweed\r\n\r\nlocalhost login: "))
+		user, _ := reader.ReadString('\r')
+		conn.Write([]byte(user + "\nPassword: "))
+		password, _ := reader.ReadString('\r')
+		conn.Write([]byte("\r\nHave a lot of fun...\r\nlocalhost:~ # "))
+		lines <- strings.TrimSuffix(user, "\r")
+		lines <- strings.TrimSuffix(password, "\r")
+		reader.ReadByte() // wait for the client to go away
+	}()
+	return socketPath, lines
+}
+
+func TestRunLogin(t *testing.T) {
+	t.Setenv("Q2BOOT_TEST_PASSWORD", "s3cr3t")
+	script, err := Parse([]byte(`
+- expect: "login:\\s*$"
+  send: "root\r"
+- expect: "Password:"
+  send: "${Q2BOOT_TEST_PASSWORD}\r"
+  timeout: 5s
+- expect: ":~ #"
+`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	socketPath, lines := fakeGuest(t)
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	var out, log bytes.Buffer
+	if err := script.Run(context.Background(), conn, &out, &log); err != nil {
+		t.Fatalf("Run() failed: %v\nconsole output:\n%s", err, out.String())
+	}
+
+	if user := <-lines; user != "root" {
+		t.Errorf("guest received user %q, want root", user)
+	}
+	if password := <-lines; password != "s3cr3t" {
+		t.Errorf("guest received password %q, want the value of the environment variable", password)
+	}
+	if strings.Contains(log.String(), "s3cr3t") {
+		t.Errorf("progress log leaks the secret:\n%s", log.String())
+	}
+	if !strings.Contains(log.String(), "${Q2BOOT_TEST_PASSWORD}") {
+		t.Errorf("progress log should show the variable reference:\n%s", log.String())
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	script, err := Parse([]byte(`
+- expect: "this never appears"
+  timeout: 100ms
+`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	socketPath, _ := fakeGuest(t)
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	start := time.Now()
+	err = script.Run(context.Background(), conn, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run() took %s, expected the step timeout to apply", elapsed)
+	}
+}
+
+func TestRunConsoleClosed(t *testing.T) {
+	script, err := Parse([]byte(`- expect: "login:"`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+	if err := script.Run(context.Background(), client, nil, nil); err == nil {
+		t.Error("Run() should fail when the console is closed")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"empty script", ``},
+		{"not a list", `expect: "login:"`},
+		{"empty step", `- timeout: 5s`},
+		{"invalid pattern", `- expect: "login["`},
+		{"invalid timeout", `- {expect: "login:", timeout: soon}`},
+		{"missing environment variable", `- send: "${Q2BOOT_TEST_UNSET_VARIABLE}"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.script)); err == nil {
+				t.Errorf("Parse(%q) should fail", tt.script)
+			}
+		})
+	}
+}
+
+func TestSessionExpect(t *testing.T) {
+	client, server := net.Pipe()
+	session := NewSession(client, nil)
+	defer session.Close()
+
+	go server.Write([]byte("uname -r\r\n6.4.0-150600.23-default\r\nQ2BOOT_END:0\r\n"))
+
+	before, match, err := session.Expect(context.Background(), regexp.MustCompile(`Q2BOOT_END:(\d+)`), time.Second)
+	if err != nil {
+		t.Fatalf("Expect() failed: %v", err)
+	}
+	if !strings.Contains(before, "6.4.0-150600.23-default") {
+		t.Errorf("Expect() output before match = %q", before)
+	}
+	if len(match) != 2 || match[1] != "0" {
+		t.Errorf("Expect() match = %q, want submatch 0", match)
+	}
+}
@@ -0,0 +1,560 @@
+package guestfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"time"
+)
+
+// Btrfs layout, see the on-disk format documentation of Btrfs
+const (
+	btrfsSuperblockOffset = 0x10000
+	btrfsMagic            = "_BHRfS_M"
+	btrfsSysChunkArrayMax = 2048
+
+	btrfsHeaderSize       = 101
+	btrfsKeySize          = 17
+	btrfsItemSize         = 25
+	btrfsKeyPtrSize       = 33
+	btrfsMaxLevel         = 8
+	btrfsChunkItemSize    = 48
+	btrfsStripeSize       = 32
+	btrfsInodeItemSize    = 160
+	btrfsDirItemSize      = 30
+	btrfsFileExtentHeader = 21
+	btrfsFileExtentSize   = 53
+	btrfsRootItemMinSize  = 239
+	btrfsMaxUncompressed  = 128 << 10
+
+	btrfsFSTree         = 5
+	btrfsRootTreeDir    = 6
+	btrfsEmptySubvolDir = 2
+
+	btrfsInodeItemKey  = 1
+	btrfsDirItemKey    = 84
+	btrfsDirIndexKey   = 96
+	btrfsExtentDataKey = 108
+	btrfsRootItemKey   = 132
+	btrfsChunkItemKey  = 228
+
+	btrfsExtentInline   = 0
+	btrfsExtentPrealloc = 2
+
+	btrfsCompressNone = 0
+	btrfsCompressZlib = 1
+
+	// Chunks striped over several devices can't be read from one
+	btrfsBlockGroupStriped = 0x8 | 0x40 | 0x80 | 0x100
+)
+
+// btrfsCompressions names the compression types of file extents.
+var btrfsCompressions = map[byte]string{1: "zlib", 2: "lzo", 3: "zstd"}
+
+// btrfsFS is a Btrfs filesystem. Nodes are identified by their inode number
+// and the tree of their subvolume.
+type btrfsFS struct {
+	r        io.ReaderAt
+	size     int64
+	nodeSize int64
+	devID    uint64
+	// chunks map logical addresses to this device, sorted
+	chunks      []btrfsChunk
+	rootTree    btrfsRoot
+	defaultTree uint64
+	// subvolumes caches the roots of the subvolume trees
+	subvolumes map[uint64]*btrfsRoot
+}
+
+type btrfsChunk struct {
+	logical, length, physical int64
+}
+
+// btrfsRoot is the root node of a tree, and for subvolumes the inode of
+// their top directory.
+type btrfsRoot struct {
+	bytenr int64
+	level  int
+	dirID  uint64
+}
+
+type btrfsKey struct {
+	objectID uint64
+	typ      uint8
+	offset   uint64
+}
+
+func parseBtrfsKey(b []byte) btrfsKey {
+	le := binary.LittleEndian
+	return btrfsKey{objectID: le.Uint64(b), typ: b[8], offset: le.Uint64(b[9:])}
+}
+
+func (k btrfsKey) less(o btrfsKey) bool {
+	if k.objectID != o.objectID {
+		return k.objectID < o.objectID
+	}
+	if k.typ != o.typ {
+		return k.typ < o.typ
+	}
+	return k.offset < o.offset
+}
+
+// openBtrfs reads the superblock and the chunk tree of a Btrfs volume, and
+// finds its default subvolume.
+func openBtrfs(r io.ReaderAt, size int64) (fs.FS, error) {
+	sb := make([]byte, 4096)
+	if readAt(r, sb, btrfsSuperblockOffset) != nil || string(sb[0x40:0x48]) != btrfsMagic {
+		return nil, ErrUnknown
+	}
+	le := binary.LittleEndian
+	f := &btrfsFS{
+		r:          r,
+		size:       size,
+		nodeSize:   int64(le.Uint32(sb[0x94:])),
+		devID:      le.Uint64(sb[0xc9:]),
+		subvolumes: map[uint64]*btrfsRoot{},
+	}
+	if f.nodeSize < 4096 || f.nodeSize > 65536 {
+		return nil, fmt.Errorf("invalid Btrfs superblock")
+	}
+	if devSize := int64(le.Uint64(sb[0xd1:])); devSize > size {
+		return nil, fmt.Errorf("Btrfs device of %d bytes on a volume of %d bytes", devSize, size)
+	}
+
+	// The system chunks, holding the chunk tree, are in the superblock
+	array := sb[0x32b:][:min(btrfsSysChunkArrayMax, le.Uint32(sb[0xa0:]))]
+	for len(array) > 0 {
+		if len(array) < btrfsKeySize+btrfsChunkItemSize {
+			return nil, fmt.Errorf("invalid Btrfs system chunk array")
+		}
+		key := parseBtrfsKey(array)
+		itemSize := btrfsChunkItemSize + btrfsStripeSize*int(le.Uint16(array[btrfsKeySize+44:]))
+		if key.typ != btrfsChunkItemKey || btrfsKeySize+itemSize > len(array) {
+			return nil, fmt.Errorf("invalid Btrfs system chunk array")
+		}
+		f.addChunk(key, array[btrfsKeySize:btrfsKeySize+itemSize])
+		array = array[btrfsKeySize+itemSize:]
+	}
+	chunkTree := btrfsRoot{bytenr: int64(le.Uint64(sb[0x58:])), level: int(sb[0xc7])}
+	err := f.search(chunkTree, 0, math.MaxUint64, btrfsChunkItemKey, func(key btrfsKey, data []byte) error {
+		if len(data) < btrfsChunkItemSize ||
+			len(data) < btrfsChunkItemSize+btrfsStripeSize*int(le.Uint16(data[44:])) {
+			return fmt.Errorf("invalid chunk item")
+		}
+		f.addChunk(key, data)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Btrfs chunk tree: %w", err)
+	}
+
+	f.rootTree = btrfsRoot{bytenr: int64(le.Uint64(sb[0x50:])), level: int(sb[0xc6])}
+	f.defaultTree = btrfsFSTree
+	err = f.search(f.rootTree, btrfsRootTreeDir, btrfsRootTreeDir, btrfsDirItemKey, func(_ btrfsKey, data []byte) error {
+		for _, e := range parseBtrfsDirItems(data) {
+			if e.name == "default" {
+				f.defaultTree = e.location.objectID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Btrfs root tree: %w", err)
+	}
+	return &tree{v: f, size: size}, nil
+}
+
+// addChunk records where the chunk item data, of the chunk starting at the
+// offset of key, lives on this device. Chunks without a stripe on it, or
+// striped over several devices, are left unmapped.
+func (f *btrfsFS) addChunk(key btrfsKey, data []byte) {
+	le := binary.LittleEndian
+	if le.Uint64(data[24:])&btrfsBlockGroupStriped != 0 {
+		return
+	}
+	for i := 0; i < int(le.Uint16(data[44:])); i++ {
+		stripe := data[btrfsChunkItemSize+btrfsStripeSize*i:]
+		if le.Uint64(stripe) != f.devID {
+			continue
+		}
+		c := btrfsChunk{logical: int64(key.offset), length: int64(le.Uint64(data)), physical: int64(le.Uint64(stripe[8:]))}
+		j := sort.Search(len(f.chunks), func(j int) bool { return f.chunks[j].logical >= c.logical })
+		if j == len(f.chunks) || f.chunks[j].logical != c.logical {
+			f.chunks = append(f.chunks, btrfsChunk{})
+			copy(f.chunks[j+1:], f.chunks[j:])
+			f.chunks[j] = c
+		}
+		return
+	}
+}
+
+// physical converts a logical address to a byte offset on the volume.
+func (f *btrfsFS) physical(logical int64) (int64, error) {
+	i := sort.Search(len(f.chunks), func(i int) bool { return f.chunks[i].logical+f.chunks[i].length > logical })
+	if i == len(f.chunks) || f.chunks[i].logical > logical {
+		return 0, fmt.Errorf("logical address %d is not mapped on this device", logical)
+	}
+	return f.chunks[i].physical + logical - f.chunks[i].logical, nil
+}
+
+// search calls fn, in key order, for the items of the tree below root with
+// an object id between first and last and the given type.
+func (f *btrfsFS) search(root btrfsRoot, first, last uint64, typ uint8, fn func(key btrfsKey, data []byte) error) error {
+	if root.level >= btrfsMaxLevel {
+		return fmt.Errorf("invalid tree level %d", root.level)
+	}
+	off, err := f.physical(root.bytenr)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, f.nodeSize)
+	if err := readAt(f.r, b, off); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	count := int(le.Uint32(b[0x60:]))
+	if int64(le.Uint64(b[0x30:])) != root.bytenr || int(b[0x64]) != root.level {
+		return fmt.Errorf("invalid tree node at %d", root.bytenr)
+	}
+	lo, hi := btrfsKey{first, typ, 0}, btrfsKey{last, typ, math.MaxUint64}
+
+	if root.level == 0 {
+		if btrfsHeaderSize+count*btrfsItemSize > len(b) {
+			return fmt.Errorf("invalid tree node at %d", root.bytenr)
+		}
+		for i := 0; i < count; i++ {
+			item := b[btrfsHeaderSize+btrfsItemSize*i:]
+			key := parseBtrfsKey(item)
+			if hi.less(key) {
+				break
+			}
+			if key.less(lo) || key.typ != typ {
+				continue
+			}
+			start, size := btrfsHeaderSize+int(le.Uint32(item[17:])), int(le.Uint32(item[21:]))
+			if start+size > len(b) {
+				return fmt.Errorf("invalid tree node at %d", root.bytenr)
+			}
+			if err := fn(key, b[start:start+size]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if btrfsHeaderSize+count*btrfsKeyPtrSize > len(b) {
+		return fmt.Errorf("invalid tree node at %d", root.bytenr)
+	}
+	for i := 0; i < count; i++ {
+		ptr := b[btrfsHeaderSize+btrfsKeyPtrSize*i:]
+		if hi.less(parseBtrfsKey(ptr)) {
+			break
+		}
+		// The keys of a child are below the first key of the next one
+		if i+1 < count && !lo.less(parseBtrfsKey(ptr[btrfsKeyPtrSize:])) {
+			continue
+		}
+		child := btrfsRoot{bytenr: int64(le.Uint64(ptr[btrfsKeySize:])), level: root.level - 1}
+		if err := f.search(child, first, last, typ, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subvolume returns the root of the tree of a subvolume, or nil if there is
+// no such subvolume.
+func (f *btrfsFS) subvolume(id uint64) (*btrfsRoot, error) {
+	if root, ok := f.subvolumes[id]; ok {
+		return root, nil
+	}
+	var root *btrfsRoot
+	err := f.search(f.rootTree, id, id, btrfsRootItemKey, func(_ btrfsKey, data []byte) error {
+		if len(data) < btrfsRootItemMinSize {
+			return fmt.Errorf("invalid root item of tree %d", id)
+		}
+		le := binary.LittleEndian
+		root = &btrfsRoot{bytenr: int64(le.Uint64(data[176:])), level: int(data[238]), dirID: le.Uint64(data[168:])}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.subvolumes[id] = root
+	return root, nil
+}
+
+// subvolumeTree returns the root of the tree of an existing subvolume.
+func (f *btrfsFS) subvolumeTree(id uint64) (btrfsRoot, error) {
+	root, err := f.subvolume(id)
+	if err == nil && root == nil {
+		err = fmt.Errorf("no subvolume %d", id)
+	}
+	if err != nil {
+		return btrfsRoot{}, err
+	}
+	return *root, nil
+}
+
+func (f *btrfsFS) root() (*node, error) {
+	n, err := f.inode(f.defaultTree, 0)
+	if n != nil {
+		n.name = "."
+	}
+	return n, err
+}
+
+// inode reads inode ino of a subvolume, or its top directory if ino is 0.
+func (f *btrfsFS) inode(tree, ino uint64) (*node, error) {
+	root, err := f.subvolumeTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	if ino == 0 {
+		ino = root.dirID
+	}
+	n := &node{id: ino, tree: tree}
+	var item []byte
+	err = f.search(root, ino, ino, btrfsInodeItemKey, func(_ btrfsKey, data []byte) error {
+		item = data
+		return nil
+	})
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("failed to read inode %d of subvolume %d: %w", ino, tree, err)
+	case item == nil && ino == btrfsEmptySubvolDir:
+		// Snapshots show the subvolumes nested in the original one as
+		// empty directories
+		n.mode = fs.ModeDir | 0o755
+		return n, nil
+	case len(item) < btrfsInodeItemSize:
+		return nil, fmt.Errorf("invalid inode %d of subvolume %d", ino, tree)
+	}
+	le := binary.LittleEndian
+	n.size = int64(le.Uint64(item[16:]))
+	n.mode = unixMode(le.Uint32(item[52:]))
+	n.modTime = time.Unix(int64(le.Uint64(item[136:])), int64(le.Uint32(item[144:])))
+	return n, nil
+}
+
+type btrfsDirEntry struct {
+	name     string
+	location btrfsKey
+}
+
+// parseBtrfsDirItems parses the entries of a directory item. Names with
+// the same hash share an item.
+func parseBtrfsDirItems(b []byte) []btrfsDirEntry {
+	le := binary.LittleEndian
+	var entries []btrfsDirEntry
+	for len(b) >= btrfsDirItemSize {
+		dataLen, nameLen := int(le.Uint16(b[25:])), int(le.Uint16(b[27:]))
+		if btrfsDirItemSize+nameLen+dataLen > len(b) {
+			break
+		}
+		entries = append(entries, btrfsDirEntry{
+			name:     string(b[btrfsDirItemSize : btrfsDirItemSize+nameLen]),
+			location: parseBtrfsKey(b),
+		})
+		b = b[btrfsDirItemSize+nameLen+dataLen:]
+	}
+	return entries
+}
+
+func (f *btrfsFS) readDir(dir *node) ([]*node, error) {
+	root, err := f.subvolumeTree(dir.tree)
+	if err != nil {
+		return nil, err
+	}
+	var entries []btrfsDirEntry
+	err = f.search(root, dir.id, dir.id, btrfsDirIndexKey, func(_ btrfsKey, data []byte) error {
+		entries = append(entries, parseBtrfsDirItems(data)...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %d of subvolume %d: %w", dir.id, dir.tree, err)
+	}
+
+	var nodes []*node
+	for _, e := range entries {
+		var n *node
+		switch e.location.typ {
+		case btrfsInodeItemKey:
+			n, err = f.inode(dir.tree, e.location.objectID)
+		case btrfsRootItemKey:
+			// Subvolumes are entered at their top directory; deleted
+			// ones may linger
+			sub, serr := f.subvolume(e.location.objectID)
+			if serr != nil || sub == nil {
+				continue
+			}
+			n, err = f.inode(e.location.objectID, 0)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.name = e.name
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (f *btrfsFS) content(n *node) (io.ReaderAt, error) {
+	root, err := f.subvolumeTree(n.tree)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	r := &btrfsReader{f: f, size: n.size}
+	err = f.search(root, n.id, n.id, btrfsExtentDataKey, func(key btrfsKey, data []byte) error {
+		if len(data) < btrfsFileExtentHeader {
+			return fmt.Errorf("invalid file extent")
+		}
+		e := &btrfsExtent{offset: int64(key.offset), compression: data[16], ramBytes: int64(le.Uint64(data[8:]))}
+		if _, ok := btrfsCompressions[e.compression]; !ok && e.compression != btrfsCompressNone {
+			return fmt.Errorf("unknown compression %d", e.compression)
+		}
+		if data[20] == btrfsExtentInline {
+			e.raw = data[btrfsFileExtentHeader:]
+			e.length = e.ramBytes
+			if e.compression == btrfsCompressNone {
+				e.data, e.length = e.raw, int64(len(e.raw))
+			}
+			r.extents = append(r.extents, e)
+			return nil
+		}
+
+		if len(data) < btrfsFileExtentSize {
+			return fmt.Errorf("invalid file extent")
+		}
+		diskStart, diskLength := int64(le.Uint64(data[21:])), int64(le.Uint64(data[29:]))
+		e.dataOffset, e.length = int64(le.Uint64(data[37:])), int64(le.Uint64(data[45:]))
+		if diskStart == 0 || data[20] == btrfsExtentPrealloc {
+			// Holes, and preallocated extents, read as zeros
+			return nil
+		}
+		physical, err := f.physical(diskStart)
+		if err != nil {
+			return err
+		}
+		e.physical = physical
+		end := e.dataOffset + e.length
+		if e.compression != btrfsCompressNone {
+			e.diskLength, end = diskLength, diskLength
+		}
+		if physical < 0 || e.dataOffset < 0 || e.length < 0 || end < 0 || physical > f.size-end {
+			return fmt.Errorf("file extent at byte %d is past the end of the volume", physical)
+		}
+		r.extents = append(r.extents, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the extents of inode %d of subvolume %d: %w", n.id, n.tree, err)
+	}
+	return r, nil
+}
+
+// btrfsExtent is a file extent: data inline in its item, or in blocks which
+// may be compressed.
+type btrfsExtent struct {
+	// offset is where the extent starts in the file, length its size there
+	offset, length int64
+	compression    byte
+	// raw is inline data, as stored
+	raw []byte
+	// physical is where the blocks are on the volume, diskLength their
+	// size if compressed
+	physical, diskLength int64
+	// dataOffset is where the file data starts in the uncompressed extent,
+	// of ramBytes bytes
+	dataOffset, ramBytes int64
+	// data is the uncompressed content of inline or compressed extents
+	data []byte
+}
+
+// btrfsReader reads a file made of extents, sorted by offset. Compressed
+// extents are decompressed when first read.
+type btrfsReader struct {
+	f       *btrfsFS
+	extents []*btrfsExtent
+	size    int64
+}
+
+func (r *btrfsReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		// The extent holding off, or the data up to the next one is a hole
+		i := sort.Search(len(r.extents), func(i int) bool {
+			return r.extents[i].offset+r.extents[i].length > off
+		})
+		end := r.size
+		var e *btrfsExtent
+		if i < len(r.extents) {
+			if r.extents[i].offset <= off {
+				e = r.extents[i]
+				end = min(end, e.offset+e.length)
+			} else {
+				end = min(end, r.extents[i].offset)
+			}
+		}
+		chunk := p[n:min(len(p), n+int(end-off))]
+		switch {
+		case e == nil:
+			clear(chunk)
+		case e.raw == nil && e.diskLength == 0:
+			if err := readAt(r.f.r, chunk, e.physical+e.dataOffset+off-e.offset); err != nil {
+				return n, err
+			}
+		default:
+			if err := r.decompress(e); err != nil {
+				return n, err
+			}
+			// Data past the end of the uncompressed extent reads as zeros
+			pos := e.dataOffset + off - e.offset
+			clear(chunk[copy(chunk, e.data[min(pos, int64(len(e.data))):]):])
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, nil
+}
+
+// decompress fills the data of an inline or compressed extent.
+func (r *btrfsReader) decompress(e *btrfsExtent) error {
+	if e.data != nil {
+		return nil
+	}
+	if e.compression != btrfsCompressZlib {
+		return fmt.Errorf("%s compressed extents are not supported", btrfsCompressions[e.compression])
+	}
+	if e.ramBytes > btrfsMaxUncompressed || e.diskLength > btrfsMaxUncompressed {
+		return fmt.Errorf("compressed extent of %d bytes", e.ramBytes)
+	}
+	compressed := e.raw
+	if compressed == nil {
+		compressed = make([]byte, e.diskLength)
+		if err := readAt(r.f.r, compressed, e.physical); err != nil {
+			return err
+		}
+	}
+	z, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("invalid compressed extent: %w", err)
+	}
+	data := make([]byte, e.ramBytes)
+	if _, err := io.ReadFull(z, data); err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("invalid compressed extent: %w", err)
+	}
+	e.data = data
+	return nil
+}
@@ -0,0 +1,334 @@
+package guestfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The test Btrfs volumes have a system chunk mapped to itself, and a chunk
+// for everything else mapped elsewhere, to check address translation.
+const (
+	btrfsTestSector     = 4096
+	btrfsTestSysChunk   = 1 << 20
+	btrfsTestMainChunk  = 32 << 20
+	btrfsTestMainOffset = 2 << 20
+	btrfsTestChunkSize  = 1 << 20
+)
+
+type btrfsBuilder struct {
+	img           []byte
+	sysNext, next int64
+}
+
+type btrfsTestItem struct {
+	key  btrfsKey
+	data []byte
+}
+
+// btrfsTestNode is a tree node, with the first key it holds.
+type btrfsTestNode struct {
+	bytenr int64
+	level  int
+	first  btrfsKey
+}
+
+// btrfsTestInode describes an inode: its directory entries or its file
+// extents, keyed by file offset.
+type btrfsTestInode struct {
+	mode    uint32
+	size    int
+	entries []btrfsDirEntry
+	extents []btrfsTestItem
+}
+
+func putBtrfsKey(b []byte, k btrfsKey) {
+	binary.LittleEndian.PutUint64(b, k.objectID)
+	b[8] = k.typ
+	binary.LittleEndian.PutUint64(b[9:], k.offset)
+}
+
+// at returns the image from logical address.
+func (b *btrfsBuilder) at(logical int64) []byte {
+	if logical >= btrfsTestMainChunk {
+		return b.img[logical-btrfsTestMainChunk+btrfsTestMainOffset:]
+	}
+	return b.img[logical:]
+}
+
+// alloc stores data in new sectors of the system or main chunk and returns
+// its logical address.
+func (b *btrfsBuilder) alloc(sys bool, data []byte) int64 {
+	next := &b.next
+	if sys {
+		next = &b.sysNext
+	}
+	logical := *next
+	copy(b.at(logical), data)
+	*next += int64(max(1, (len(data)+btrfsTestSector-1)/btrfsTestSector)) * btrfsTestSector
+	return logical
+}
+
+// leaf writes a leaf node of items, sorted by key.
+func (b *btrfsBuilder) leaf(sys bool, items []btrfsTestItem) btrfsTestNode {
+	sort.Slice(items, func(i, j int) bool { return items[i].key.less(items[j].key) })
+	le := binary.LittleEndian
+	node := make([]byte, btrfsTestSector)
+	end := len(node)
+	for i, item := range items {
+		end -= len(item.data)
+		copy(node[end:], item.data)
+		raw := node[btrfsHeaderSize+btrfsItemSize*i:]
+		putBtrfsKey(raw, item.key)
+		le.PutUint32(raw[17:], uint32(end-btrfsHeaderSize))
+		le.PutUint32(raw[21:], uint32(len(item.data)))
+	}
+	le.PutUint32(node[0x60:], uint32(len(items)))
+	n := btrfsTestNode{bytenr: b.alloc(sys, node), first: items[0].key}
+	le.PutUint64(b.at(n.bytenr)[0x30:], uint64(n.bytenr))
+	return n
+}
+
+// tree writes a tree of items: a leaf, or leaves of a few items below a
+// node.
+func (b *btrfsBuilder) tree(items []btrfsTestItem) btrfsTestNode {
+	if len(items) <= 4 {
+		return b.leaf(false, items)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key.less(items[j].key) })
+	le := binary.LittleEndian
+	node := make([]byte, btrfsTestSector)
+	count := 0
+	for ; len(items) > 0; count++ {
+		child := b.leaf(false, items[:min(4, len(items))])
+		items = items[min(4, len(items)):]
+		ptr := node[btrfsHeaderSize+btrfsKeyPtrSize*count:]
+		putBtrfsKey(ptr, child.first)
+		le.PutUint64(ptr[btrfsKeySize:], uint64(child.bytenr))
+	}
+	le.PutUint32(node[0x60:], uint32(count))
+	node[0x64] = 1
+	n := btrfsTestNode{bytenr: b.alloc(false, node), level: 1, first: parseBtrfsKey(node[btrfsHeaderSize:])}
+	le.PutUint64(b.at(n.bytenr)[0x30:], uint64(n.bytenr))
+	return n
+}
+
+// fsTree writes the tree of a subvolume made of inodes.
+func (b *btrfsBuilder) fsTree(inodes map[uint64]btrfsTestInode) btrfsTestNode {
+	le := binary.LittleEndian
+	var items []btrfsTestItem
+	for ino, in := range inodes {
+		item := make([]byte, btrfsInodeItemSize)
+		le.PutUint64(item[16:], uint64(in.size))
+		le.PutUint32(item[52:], in.mode)
+		le.PutUint64(item[136:], 1700000000)
+		items = append(items, btrfsTestItem{btrfsKey{ino, btrfsInodeItemKey, 0}, item})
+		for i, e := range in.entries {
+			items = append(items, btrfsTestItem{btrfsKey{ino, btrfsDirIndexKey, uint64(2 + i)}, btrfsDirItem(e)})
+		}
+		for _, e := range in.extents {
+			items = append(items, btrfsTestItem{btrfsKey{ino, btrfsExtentDataKey, e.key.offset}, e.data})
+		}
+	}
+	return b.tree(items)
+}
+
+func btrfsDirItem(e btrfsDirEntry) []byte {
+	item := make([]byte, btrfsDirItemSize+len(e.name))
+	putBtrfsKey(item, e.location)
+	binary.LittleEndian.PutUint16(item[27:], uint16(len(e.name)))
+	copy(item[btrfsDirItemSize:], e.name)
+	return item
+}
+
+func btrfsInlineExtent(offset uint64, data []byte, compression byte, ramBytes int) btrfsTestItem {
+	item := make([]byte, btrfsFileExtentHeader, btrfsFileExtentHeader+len(data))
+	binary.LittleEndian.PutUint64(item[8:], uint64(ramBytes))
+	item[16], item[20] = compression, btrfsExtentInline
+	return btrfsTestItem{btrfsKey{offset: offset}, append(item, data...)}
+}
+
+func btrfsRegularExtent(offset uint64, typ, compression byte, disk, diskLength, dataOffset, length, ramBytes int64) btrfsTestItem {
+	le := binary.LittleEndian
+	item := make([]byte, btrfsFileExtentSize)
+	le.PutUint64(item[8:], uint64(ramBytes))
+	item[16], item[20] = compression, typ
+	le.PutUint64(item[21:], uint64(disk))
+	le.PutUint64(item[29:], uint64(diskLength))
+	le.PutUint64(item[37:], uint64(dataOffset))
+	le.PutUint64(item[45:], uint64(length))
+	return btrfsTestItem{btrfsKey{offset: offset}, item}
+}
+
+func btrfsChunkItem(logical, physical, length int64, typ uint64) btrfsTestItem {
+	le := binary.LittleEndian
+	item := make([]byte, btrfsChunkItemSize+btrfsStripeSize)
+	le.PutUint64(item[0:], uint64(length))
+	le.PutUint64(item[24:], typ)
+	le.PutUint16(item[44:], 1)
+	le.PutUint64(item[btrfsChunkItemSize:], 1)
+	le.PutUint64(item[btrfsChunkItemSize+8:], uint64(physical))
+	return btrfsTestItem{btrfsKey{256, btrfsChunkItemKey, uint64(logical)}, item}
+}
+
+func btrfsRootItem(id uint64, root btrfsTestNode) btrfsTestItem {
+	le := binary.LittleEndian
+	item := make([]byte, 439)
+	le.PutUint64(item[168:], 256)
+	le.PutUint64(item[176:], uint64(root.bytenr))
+	item[238] = byte(root.level)
+	return btrfsTestItem{btrfsKey{id, btrfsRootItemKey, 0}, item}
+}
+
+func zlibCompress(data string) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write([]byte(data))
+	z.Close()
+	return buf.Bytes()
+}
+
+// btrfsImage builds a Btrfs volume whose top level subvolume holds the
+// "root" subvolume 256 and the missing "home" subvolume 257, and, if
+// defaultRoot is set, makes "root" the default subvolume. It has:
+//
+//	usr/bin/bash                two extents, a hole and a preallocated one
+//	usr/bin/sh -> bash
+//	usr/lib/os-release          zlib compressed
+//	usr/lib/zstd                zstd compressed, inline
+//	etc/os-release -> ../usr/lib/os-release
+//	.snapshots/                 placeholder of a nested subvolume
+//	srv/                        subvolume 258
+//	srv/hello                   zlib compressed, inline
+func btrfsImage(defaultRoot bool, bashA, bashB []byte, osRelease string) []byte {
+	b := &btrfsBuilder{
+		img:     make([]byte, btrfsTestMainOffset+btrfsTestChunkSize),
+		sysNext: btrfsTestSysChunk,
+		next:    btrfsTestMainChunk,
+	}
+	const (
+		dirMode  = 0o040755
+		fileMode = 0o100755
+		linkMode = 0o120777
+	)
+	inode := func(ino uint64) btrfsKey { return btrfsKey{ino, btrfsInodeItemKey, 0} }
+	subvol := func(id uint64) btrfsKey { return btrfsKey{id, btrfsRootItemKey, math.MaxUint64} }
+
+	a, bb := b.alloc(false, bashA), b.alloc(false, bashB)
+	compressed := zlibCompress(osRelease)
+	osRel := b.alloc(false, compressed)
+	prealloc := b.alloc(false, nil)
+	root := b.fsTree(map[uint64]btrfsTestInode{
+		256: {mode: dirMode, entries: []btrfsDirEntry{
+			{"usr", inode(257)}, {"etc", inode(261)}, {"srv", subvol(258)}, {".snapshots", inode(btrfsEmptySubvolDir)},
+		}},
+		257: {mode: dirMode, entries: []btrfsDirEntry{{"bin", inode(258)}, {"lib", inode(263)}}},
+		258: {mode: dirMode, entries: []btrfsDirEntry{{"bash", inode(259)}, {"sh", inode(260)}}},
+		259: {mode: fileMode, size: 4*btrfsTestSector + 2000, extents: []btrfsTestItem{
+			btrfsRegularExtent(0, 1, btrfsCompressNone, a, 2*btrfsTestSector, 0, 2*btrfsTestSector, 2*btrfsTestSector),
+			btrfsRegularExtent(2*btrfsTestSector, btrfsExtentPrealloc, btrfsCompressNone, prealloc, btrfsTestSector, 0, btrfsTestSector, btrfsTestSector),
+			btrfsRegularExtent(4*btrfsTestSector, 1, btrfsCompressNone, bb, 2*btrfsTestSector, btrfsTestSector, btrfsTestSector, 2*btrfsTestSector),
+		}},
+		260: {mode: linkMode, size: 4, extents: []btrfsTestItem{btrfsInlineExtent(0, []byte("bash"), btrfsCompressNone, 4)}},
+		261: {mode: dirMode, entries: []btrfsDirEntry{{"os-release", inode(262)}}},
+		262: {mode: linkMode, size: 21, extents: []btrfsTestItem{btrfsInlineExtent(0, []byte("../usr/lib/os-release"), btrfsCompressNone, 21)}},
+		263: {mode: dirMode, entries: []btrfsDirEntry{{"os-release", inode(264)}, {"zstd", inode(265)}}},
+		264: {mode: 0o100644, size: len(osRelease), extents: []btrfsTestItem{
+			btrfsRegularExtent(0, 1, btrfsCompressZlib, osRel, btrfsTestSector, 0, btrfsTestSector, btrfsTestSector),
+		}},
+		265: {mode: 0o100644, size: 10, extents: []btrfsTestItem{btrfsInlineExtent(0, []byte("(\xb5/\xfd"), 3, 10)}},
+	})
+	srv := b.fsTree(map[uint64]btrfsTestInode{
+		256: {mode: dirMode, entries: []btrfsDirEntry{{"hello", inode(257)}}},
+		257: {mode: 0o100644, size: 6, extents: []btrfsTestItem{btrfsInlineExtent(0, zlibCompress("hello\n"), btrfsCompressZlib, 6)}},
+	})
+	top := b.fsTree(map[uint64]btrfsTestInode{
+		256: {mode: dirMode, entries: []btrfsDirEntry{{"root", subvol(256)}, {"home", subvol(257)}}},
+	})
+
+	rootItems := []btrfsTestItem{btrfsRootItem(btrfsFSTree, top), btrfsRootItem(256, root), btrfsRootItem(258, srv)}
+	if defaultRoot {
+		rootItems = append(rootItems, btrfsTestItem{
+			btrfsKey{btrfsRootTreeDir, btrfsDirItemKey, 0x8dbfc2d2},
+			btrfsDirItem(btrfsDirEntry{"default", subvol(256)}),
+		})
+	}
+	rootTree := b.leaf(false, rootItems)
+
+	sysChunk := btrfsChunkItem(btrfsTestSysChunk, btrfsTestSysChunk, btrfsTestChunkSize, 2)
+	chunkTree := b.leaf(true, []btrfsTestItem{
+		sysChunk,
+		btrfsChunkItem(btrfsTestMainChunk, btrfsTestMainOffset, btrfsTestChunkSize, 1|4),
+		// Striped chunks are ignored
+		btrfsChunkItem(64<<20, 0, btrfsTestChunkSize, 1|8),
+	})
+
+	le := binary.LittleEndian
+	sb := b.img[btrfsSuperblockOffset:]
+	copy(sb[0x40:], btrfsMagic)
+	le.PutUint64(sb[0x50:], uint64(rootTree.bytenr))
+	le.PutUint64(sb[0x58:], uint64(chunkTree.bytenr))
+	le.PutUint32(sb[0x90:], btrfsTestSector)
+	le.PutUint32(sb[0x94:], btrfsTestSector)
+	le.PutUint64(sb[0xc9:], 1)
+	le.PutUint64(sb[0xd1:], uint64(len(b.img)))
+	array := sb[0x32b:]
+	putBtrfsKey(array, sysChunk.key)
+	copy(array[btrfsKeySize:], sysChunk.data)
+	le.PutUint32(sb[0xa0:], uint32(btrfsKeySize+len(sysChunk.data)))
+	return b.img
+}
+
+func TestBtrfs(t *testing.T) {
+	bashA := bytes.Repeat([]byte("\x7fELF bash "), 2*btrfsTestSector/10+1)[:2*btrfsTestSector]
+	bashB := bytes.Repeat([]byte("more bash "), 2*btrfsTestSector/10+1)[:2*btrfsTestSector]
+	osRelease := "NAME=\"Fedora Linux\"\nVERSION_ID=41\n"
+	// The preallocated extent and the hole read as zeros, and only a part
+	// of the last extent is used
+	wantBash := string(bashA) + string(make([]byte, 2*btrfsTestSector)) + string(bashB[btrfsTestSector:btrfsTestSector+2000])
+
+	for _, defaultRoot := range []bool{true, false} {
+		img := btrfsImage(defaultRoot, bashA, bashB, osRelease)
+		fsys, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("default %t: Open() failed: %v", defaultRoot, err)
+		}
+		prefix := ""
+		if !defaultRoot {
+			prefix = "root/"
+		}
+		for name, want := range map[string]string{
+			"usr/bin/bash":       wantBash,
+			"usr/bin/sh":         wantBash,
+			"usr/lib/os-release": osRelease,
+			"etc/os-release":     osRelease,
+			"srv/hello":          "hello\n",
+		} {
+			got, err := fs.ReadFile(fsys, prefix+name)
+			if err != nil || string(got) != want {
+				t.Errorf("default %t: ReadFile(%s) = %d bytes, %v, want %d bytes", defaultRoot, prefix+name, len(got), err, len(want))
+			}
+		}
+
+		if _, err := fs.ReadFile(fsys, prefix+"usr/lib/zstd"); err == nil || !strings.Contains(err.Error(), "zstd") {
+			t.Errorf("default %t: ReadFile() of a zstd file = %v", defaultRoot, err)
+		}
+		entries, err := fs.ReadDir(fsys, prefix+".snapshots")
+		if err != nil || len(entries) != 0 {
+			t.Errorf("default %t: ReadDir(.snapshots) = %v, %v", defaultRoot, entries, err)
+		}
+	}
+
+	// The missing subvolume is left out of the top level
+	img := btrfsImage(false, bashA, bashB, osRelease)
+	fsys, _ := Open(bytes.NewReader(img), int64(len(img)))
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "root" || !entries[0].IsDir() {
+		t.Errorf("ReadDir(.) = %v, %v", entries, err)
+	}
+}
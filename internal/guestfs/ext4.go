@@ -0,0 +1,334 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// ext2, ext3 and ext4 layout, see Documentation/filesystems/ext4 in the
+// Linux sources
+const (
+	extSuperblockOffset = 1024
+	extMagic            = 0xef53
+	extRootInode        = 2
+	extBlockSlots       = 15
+	extDirectBlocks     = 12
+	extMaxExtentDepth   = 5
+	extMaxDirSize       = 64 << 20
+
+	extIncompatMetaBG = 0x10
+	extIncompat64Bit  = 0x80
+
+	extFlagExtents    = 0x80000
+	extFlagInlineData = 0x10000000
+
+	extExtentMagic     = 0xf30a
+	extExtentInitMax   = 32768
+	extExtentEntrySize = 12
+)
+
+// extFS is an ext2, ext3 or ext4 filesystem.
+type extFS struct {
+	r              io.ReaderAt
+	size           int64
+	blockSize      int64
+	inodeSize      int64
+	inodesCount    uint32
+	inodesPerGroup uint32
+	descSize       int64
+	descOffset     int64
+	// inodeTables caches the location of the inode table of groups
+	inodeTables map[uint32]int64
+}
+
+// openExt reads the superblock of an ext2, ext3 or ext4 volume.
+func openExt(r io.ReaderAt, size int64) (fs.FS, error) {
+	sb := make([]byte, 1024)
+	if readAt(r, sb, extSuperblockOffset) != nil {
+		return nil, ErrUnknown
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[0x38:]) != extMagic {
+		return nil, ErrUnknown
+	}
+
+	logBlockSize := le.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid ext4 block size 2^%d", 10+logBlockSize)
+	}
+	f := &extFS{
+		r:              r,
+		size:           size,
+		blockSize:      1024 << logBlockSize,
+		inodeSize:      128,
+		inodesCount:    le.Uint32(sb[0:]),
+		inodesPerGroup: le.Uint32(sb[0x28:]),
+		descSize:       32,
+		inodeTables:    map[uint32]int64{},
+	}
+	if le.Uint32(sb[0x4c:]) >= 1 {
+		f.inodeSize = int64(le.Uint16(sb[0x58:]))
+	}
+	if f.inodeSize < 128 || f.inodeSize > f.blockSize || f.inodeSize&(f.inodeSize-1) != 0 || f.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid ext4 superblock")
+	}
+
+	incompat := le.Uint32(sb[0x60:])
+	if incompat&extIncompatMetaBG != 0 {
+		return nil, fmt.Errorf("ext4 meta_bg is not supported")
+	}
+	blocks := int64(le.Uint32(sb[4:]))
+	if incompat&extIncompat64Bit != 0 {
+		blocks |= int64(le.Uint32(sb[0x150:])) << 32
+		f.descSize = max(32, int64(le.Uint16(sb[0xfe:])))
+	}
+	if blocks*f.blockSize > size {
+		return nil, fmt.Errorf("ext4 filesystem of %d bytes on a volume of %d bytes", blocks*f.blockSize, size)
+	}
+	// The group descriptors follow the block holding the superblock
+	f.descOffset = (int64(le.Uint32(sb[0x14:])) + 1) * f.blockSize
+	return &tree{v: f, size: size}, nil
+}
+
+func (f *extFS) root() (*node, error) {
+	n, _, err := f.inode(extRootInode)
+	if n != nil {
+		n.name = "."
+	}
+	return n, err
+}
+
+// inode reads inode ino.
+func (f *extFS) inode(ino uint32) (*node, []byte, error) {
+	if ino == 0 || ino > f.inodesCount {
+		return nil, nil, fmt.Errorf("invalid inode %d", ino)
+	}
+	le := binary.LittleEndian
+	group, index := (ino-1)/f.inodesPerGroup, (ino-1)%f.inodesPerGroup
+	table, ok := f.inodeTables[group]
+	if !ok {
+		desc := make([]byte, f.descSize)
+		if err := readAt(f.r, desc, f.descOffset+int64(group)*f.descSize); err != nil {
+			return nil, nil, fmt.Errorf("failed to read the descriptor of group %d: %w", group, err)
+		}
+		table = int64(le.Uint32(desc[8:]))
+		if f.descSize >= 64 {
+			table |= int64(le.Uint32(desc[0x28:])) << 32
+		}
+		table *= f.blockSize
+		f.inodeTables[group] = table
+	}
+
+	raw := make([]byte, f.inodeSize)
+	if err := readAt(f.r, raw, table+int64(index)*f.inodeSize); err != nil {
+		return nil, nil, fmt.Errorf("failed to read inode %d: %w", ino, err)
+	}
+	n := &node{
+		fileInfo: fileInfo{
+			size:    int64(le.Uint32(raw[4:])) | int64(le.Uint32(raw[0x6c:]))<<32,
+			mode:    unixMode(uint32(le.Uint16(raw[0:]))),
+			modTime: time.Unix(int64(int32(le.Uint32(raw[0x10:]))), 0),
+		},
+		id: uint64(ino),
+	}
+	return n, raw, nil
+}
+
+func (f *extFS) readDir(dir *node) ([]*node, error) {
+	_, raw, err := f.inode(uint32(dir.id))
+	if err != nil {
+		return nil, err
+	}
+	if dir.size > extMaxDirSize {
+		return nil, fmt.Errorf("directory of %d bytes", dir.size)
+	}
+	content, err := f.data(dir, raw)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, dir.size)
+	if err := readAt(content, data, 0); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	blockSize := f.blockSize
+	if le.Uint32(raw[0x20:])&extFlagInlineData != 0 {
+		// Inline directories start with the inode of their parent, and
+		// have no "." and ".." entries
+		if len(data) < 4 {
+			return nil, fmt.Errorf("corrupt inline directory in inode %d", dir.id)
+		}
+		data = data[4:]
+		blockSize = int64(len(data))
+	}
+
+	var nodes []*node
+	for block := int64(0); block < int64(len(data)); block += blockSize {
+		b := data[block:min(int64(len(data)), block+blockSize)]
+		for pos := 0; pos+8 <= len(b); {
+			ino := le.Uint32(b[pos:])
+			recLen := int(le.Uint16(b[pos+4:]))
+			nameLen := int(b[pos+6])
+			if recLen < 8 || pos+recLen > len(b) || 8+nameLen > recLen {
+				return nil, fmt.Errorf("corrupt directory entry in inode %d", dir.id)
+			}
+			name := string(b[pos+8 : pos+8+nameLen])
+			pos += recLen
+			// Unused entries, and the checksum tail, have no inode
+			if ino == 0 || name == "." || name == ".." {
+				continue
+			}
+			n, _, err := f.inode(ino)
+			if err != nil {
+				return nil, err
+			}
+			n.name = name
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func (f *extFS) content(n *node) (io.ReaderAt, error) {
+	_, raw, err := f.inode(uint32(n.id))
+	if err != nil {
+		return nil, err
+	}
+	return f.data(n, raw)
+}
+
+// data returns the content of the inode raw.
+func (f *extFS) data(n *node, raw []byte) (io.ReaderAt, error) {
+	le := binary.LittleEndian
+	flags := le.Uint32(raw[0x20:])
+	blocks := raw[0x28 : 0x28+4*extBlockSlots]
+	switch {
+	case flags&extFlagInlineData != 0:
+		// Data beyond the block slots lives in an extended attribute
+		if n.size > int64(len(blocks)) {
+			return nil, fmt.Errorf("inline data of %d bytes is not supported", n.size)
+		}
+		return bytes.NewReader(blocks[:n.size]), nil
+	case n.mode&fs.ModeSymlink != 0 && flags&extFlagExtents == 0 && n.size < int64(len(blocks)):
+		// Fast symbolic links keep their target in the block slots
+		return bytes.NewReader(blocks[:n.size]), nil
+	}
+
+	var extents []extent
+	if flags&extFlagExtents != 0 {
+		if err := f.extentTree(blocks, extMaxExtentDepth, &extents); err != nil {
+			return nil, fmt.Errorf("invalid extent tree in inode %d: %w", n.id, err)
+		}
+		sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+	} else {
+		var err error
+		if extents, err = f.blockMap(blocks, (n.size+f.blockSize-1)/f.blockSize); err != nil {
+			return nil, fmt.Errorf("invalid block map in inode %d: %w", n.id, err)
+		}
+	}
+	if err := checkExtents(extents, f.blockSize, f.size); err != nil {
+		return nil, fmt.Errorf("invalid inode %d: %w", n.id, err)
+	}
+	return &extentReader{r: f.r, blockSize: f.blockSize, extents: extents, size: n.size}, nil
+}
+
+// extentTree collects the extents of the extent tree node b, allowing depth
+// more levels below it.
+func (f *extFS) extentTree(b []byte, depth int, extents *[]extent) error {
+	le := binary.LittleEndian
+	if len(b) < extExtentEntrySize || le.Uint16(b) != extExtentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+	entries, level := int(le.Uint16(b[2:])), int(le.Uint16(b[6:]))
+	if level > depth || extExtentEntrySize*(entries+1) > len(b) {
+		return fmt.Errorf("bad extent header")
+	}
+	for i := 1; i <= entries; i++ {
+		e := b[extExtentEntrySize*i:]
+		if level == 0 {
+			length, unwritten := int64(le.Uint16(e[4:])), false
+			if length > extExtentInitMax {
+				length, unwritten = length-extExtentInitMax, true
+			}
+			start := int64(le.Uint16(e[6:]))<<32 | int64(le.Uint32(e[8:]))
+			*extents = append(*extents, extent{
+				logical:   int64(le.Uint32(e[0:])),
+				length:    length,
+				physical:  start * f.blockSize,
+				unwritten: unwritten,
+			})
+			continue
+		}
+		child := make([]byte, f.blockSize)
+		leaf := int64(le.Uint32(e[4:])) | int64(le.Uint16(e[8:]))<<32
+		if err := readAt(f.r, child, leaf*f.blockSize); err != nil {
+			return err
+		}
+		if err := f.extentTree(child, level-1, extents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockMap converts the first count blocks of an ext2/ext3 block map, with
+// its direct blocks and single, double and triple indirect blocks, to
+// extents.
+func (f *extFS) blockMap(slots []byte, count int64) ([]extent, error) {
+	le := binary.LittleEndian
+	var extents []extent
+	logical := int64(0)
+	add := func(block int64) {
+		if block != 0 {
+			if n := len(extents); n > 0 && extents[n-1].logical+extents[n-1].length == logical &&
+				extents[n-1].physical+extents[n-1].length*f.blockSize == block*f.blockSize {
+				extents[n-1].length++
+			} else {
+				extents = append(extents, extent{logical: logical, length: 1, physical: block * f.blockSize})
+			}
+		}
+		logical++
+	}
+
+	var indirect func(block int64, level int) error
+	indirect = func(block int64, level int) error {
+		perBlock := f.blockSize / 4
+		if block == 0 {
+			// A hole covering all the blocks mapped below
+			span := int64(1)
+			for i := 0; i <= level; i++ {
+				span *= perBlock
+			}
+			logical += span
+			return nil
+		}
+		b := make([]byte, f.blockSize)
+		if err := readAt(f.r, b, block*f.blockSize); err != nil {
+			return err
+		}
+		for i := int64(0); i < perBlock && logical < count; i++ {
+			entry := int64(le.Uint32(b[4*i:]))
+			if level == 0 {
+				add(entry)
+			} else if err := indirect(entry, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < extBlockSlots && logical < count; i++ {
+		block := int64(le.Uint32(slots[4*i:]))
+		if i < extDirectBlocks {
+			add(block)
+		} else if err := indirect(block, i-extDirectBlocks); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
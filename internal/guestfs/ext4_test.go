@@ -0,0 +1,267 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// The test ext volumes have 1 KiB blocks and two groups of 16 inodes, with
+// their inode tables from block 3.
+const (
+	extTestBlock     = 1024
+	extTestBlocks    = 1024
+	extTestGroupInos = 16
+	extTestTables    = 3
+)
+
+type extBuilder struct {
+	img       []byte
+	ext4      bool
+	inodeSize int
+	next      uint32
+}
+
+func newExtBuilder(ext4 bool) *extBuilder {
+	b := &extBuilder{img: make([]byte, extTestBlocks*extTestBlock), ext4: ext4, inodeSize: 128}
+	le := binary.LittleEndian
+	sb := b.img[extSuperblockOffset:]
+	le.PutUint32(sb[0:], 2*extTestGroupInos)
+	le.PutUint32(sb[4:], extTestBlocks)
+	le.PutUint32(sb[0x14:], 1)
+	le.PutUint32(sb[0x28:], extTestGroupInos)
+	le.PutUint16(sb[0x38:], extMagic)
+	le.PutUint32(sb[0x4c:], 1)
+	descSize := 32
+	if ext4 {
+		b.inodeSize, descSize = 256, 64
+		le.PutUint32(sb[0x60:], extIncompat64Bit)
+		le.PutUint16(sb[0xfe:], uint16(descSize))
+	}
+	le.PutUint16(sb[0x58:], uint16(b.inodeSize))
+
+	tableBlocks := uint32(extTestGroupInos * b.inodeSize / extTestBlock)
+	for group := uint32(0); group < 2; group++ {
+		le.PutUint32(b.img[2*extTestBlock+descSize*int(group)+8:], extTestTables+group*tableBlocks)
+	}
+	b.next = extTestTables + 2*tableBlocks
+	return b
+}
+
+// alloc stores data in new blocks and returns the first one.
+func (b *extBuilder) alloc(data []byte) uint32 {
+	first := b.next
+	copy(b.img[int(first)*extTestBlock:], data)
+	b.next += uint32(max(1, (len(data)+extTestBlock-1)/extTestBlock))
+	return first
+}
+
+// inode writes inode ino and returns its block slots.
+func (b *extBuilder) inode(ino uint32, mode uint16, flags uint32, size int) []byte {
+	le := binary.LittleEndian
+	tableBlocks := uint32(extTestGroupInos * b.inodeSize / extTestBlock)
+	group, index := (ino-1)/extTestGroupInos, (ino-1)%extTestGroupInos
+	raw := b.img[int(extTestTables+group*tableBlocks)*extTestBlock+int(index)*b.inodeSize:][:b.inodeSize]
+	le.PutUint16(raw[0:], mode)
+	le.PutUint32(raw[4:], uint32(size))
+	le.PutUint32(raw[0x10:], 1700000000)
+	le.PutUint32(raw[0x20:], flags)
+	return raw[0x28 : 0x28+4*extBlockSlots]
+}
+
+type extTestEntry struct {
+	name string
+	ino  uint32
+}
+
+// extDirBlock encodes directory entries, the last one taking the rest of the
+// block.
+func extDirBlock(entries []extTestEntry, size int) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, size)
+	pos := 0
+	for i, e := range entries {
+		recLen := (8 + len(e.name) + 3) &^ 3
+		if i == len(entries)-1 {
+			recLen = size - pos
+		}
+		le.PutUint32(b[pos:], e.ino)
+		le.PutUint16(b[pos+4:], uint16(recLen))
+		b[pos+6] = byte(len(e.name))
+		copy(b[pos+8:], e.name)
+		pos += recLen
+	}
+	return b
+}
+
+// dir writes a directory of one block.
+func (b *extBuilder) dir(ino, parent uint32, entries []extTestEntry) {
+	block := b.alloc(extDirBlock(append([]extTestEntry{{".", ino}, {"..", parent}}, entries...), extTestBlock))
+	b.mapBlocks(ino, 0o040755, extTestBlock, [][3]uint32{{0, block, 1}})
+}
+
+// mapBlocks writes a file of size bytes, made of runs of file block, volume
+// block and length triples, with an extent tree with an index node on ext4
+// or a block map on ext2. Runs longer than extExtentInitMax are unwritten,
+// and holes on ext2.
+func (b *extBuilder) mapBlocks(ino uint32, mode uint16, size int, runs [][3]uint32) {
+	le := binary.LittleEndian
+	if b.ext4 {
+		leaf := make([]byte, extTestBlock)
+		le.PutUint16(leaf[0:], extExtentMagic)
+		le.PutUint16(leaf[2:], uint16(len(runs)))
+		for i, r := range runs {
+			e := leaf[extExtentEntrySize*(i+1):]
+			le.PutUint32(e[0:], r[0])
+			le.PutUint16(e[4:], uint16(r[2]))
+			le.PutUint32(e[8:], r[1])
+		}
+		slots := b.inode(ino, mode, extFlagExtents, size)
+		le.PutUint16(slots[0:], extExtentMagic)
+		le.PutUint16(slots[2:], 1)
+		le.PutUint16(slots[6:], 1)
+		le.PutUint32(slots[extExtentEntrySize+4:], b.alloc(leaf))
+		return
+	}
+
+	var blocks []uint32
+	for _, r := range runs {
+		for len(blocks) < int(r[0]) {
+			blocks = append(blocks, 0)
+		}
+		for i := uint32(0); i < r[2]&^extExtentInitMax; i++ {
+			block := r[1] + i
+			if r[2] > extExtentInitMax {
+				block = 0
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	perBlock := extTestBlock / 4
+	indirect := func(blocks []uint32) uint32 {
+		b2 := make([]byte, extTestBlock)
+		for i, block := range blocks {
+			le.PutUint32(b2[4*i:], block)
+		}
+		return b.alloc(b2)
+	}
+	slots := b.inode(ino, mode, 0, size)
+	for i := 0; i < len(blocks) && i < extDirectBlocks; i++ {
+		le.PutUint32(slots[4*i:], blocks[i])
+	}
+	if len(blocks) > extDirectBlocks {
+		single := blocks[extDirectBlocks:min(len(blocks), extDirectBlocks+perBlock)]
+		le.PutUint32(slots[4*extDirectBlocks:], indirect(single))
+	}
+	if len(blocks) > extDirectBlocks+perBlock {
+		var singles []uint32
+		rest := blocks[extDirectBlocks+perBlock:]
+		for len(rest) > 0 {
+			singles = append(singles, indirect(rest[:min(len(rest), perBlock)]))
+			rest = rest[min(len(rest), perBlock):]
+		}
+		le.PutUint32(slots[4*(extDirectBlocks+1):], indirect(singles))
+	}
+}
+
+// extImage builds an ext4 volume, or an ext2 one, with:
+//
+//	/bin -> usr/bin             fast symbolic link
+//	/etc/                       inline directory on ext4
+//	/etc/hostname               inline data on ext4
+//	/etc/os-release -> ./././.../usr/lib/os-release, a slow symbolic link
+//	/usr/bin/bash               in the second group, with unmapped blocks
+//	/usr/bin/sh -> bash
+//	/usr/lib/os-release
+//
+// bash is long enough for double indirect blocks on ext2.
+func extImage(ext4 bool, bash []byte, osRelease, hostname, linkTarget string) []byte {
+	b := newExtBuilder(ext4)
+	const (
+		root, usr, bin, etc, usrBin, usrLib   = extRootInode, 11, 12, 13, 14, 15
+		sh, osRel, link, hostnameIno, bashIno = 16, 17, 18, 19, 20
+	)
+	b.dir(root, root, []extTestEntry{{"bin", bin}, {"etc", etc}, {"usr", usr}})
+	b.dir(usr, root, []extTestEntry{{"bin", usrBin}, {"lib", usrLib}})
+	b.dir(usrBin, usr, []extTestEntry{{"bash", bashIno}, {"sh", sh}})
+	b.dir(usrLib, usr, []extTestEntry{{"os-release", osRel}})
+	copy(b.inode(bin, 0o120777, 0, 7), "usr/bin")
+	copy(b.inode(sh, 0o120777, 0, 4), "bash")
+
+	b.mapBlocks(link, 0o120777, len(linkTarget), [][3]uint32{{0, b.alloc([]byte(linkTarget)), 1}})
+	b.mapBlocks(osRel, 0o100644, len(osRelease), [][3]uint32{{0, b.alloc([]byte(osRelease)), 1}})
+	etcEntries := []extTestEntry{{"os-release", link}, {"hostname", hostnameIno}}
+	if ext4 {
+		// The inode of the parent, then entries up to the end of the slots
+		slots := b.inode(etc, 0o040755, extFlagInlineData, 4*extBlockSlots)
+		binary.LittleEndian.PutUint32(slots, root)
+		copy(slots[4:], extDirBlock(etcEntries, len(slots)-4))
+		copy(b.inode(hostnameIno, 0o100644, extFlagInlineData, len(hostname)), hostname)
+	} else {
+		b.dir(etc, root, etcEntries)
+		b.mapBlocks(hostnameIno, 0o100644, len(hostname), [][3]uint32{{0, b.alloc([]byte(hostname)), 1}})
+	}
+
+	// Blocks 4 to 7 of bash are unwritten or a hole
+	blocks := uint32((len(bash) + extTestBlock - 1) / extTestBlock)
+	first := b.alloc(bash[:4*extTestBlock])
+	unwritten := b.alloc(bytes.Repeat([]byte("stale"), 2*extTestBlock/5))
+	rest := b.alloc(bash[8*extTestBlock:])
+	b.mapBlocks(bashIno, 0o100755, len(bash), [][3]uint32{
+		{0, first, 4}, {4, unwritten, 2 + extExtentInitMax}, {8, rest, blocks - 8},
+	})
+	return b.img
+}
+
+func TestExt(t *testing.T) {
+	bash := bytes.Repeat([]byte("\x7fELF bash "), 30000)
+	copy(bash[4*extTestBlock:], make([]byte, 4*extTestBlock))
+	osRelease := "NAME=\"SLES\"\nVERSION_ID=\"15.6\"\n"
+	hostname := "q2boot\n"
+	linkTarget := strings.Repeat("./", 40) + "../usr/lib/os-release"
+
+	for _, ext4 := range []bool{true, false} {
+		img := extImage(ext4, bash, osRelease, hostname, linkTarget)
+		fsys, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("ext4 %t: Open() failed: %v", ext4, err)
+		}
+		for name, want := range map[string]string{
+			"usr/bin/bash":   string(bash),
+			"bin/sh":         string(bash),
+			"etc/os-release": osRelease,
+			"etc/hostname":   hostname,
+		} {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil || string(got) != want {
+				t.Errorf("ext4 %t: ReadFile(%s) = %d bytes, %v, want %d bytes", ext4, name, len(got), err, len(want))
+			}
+		}
+
+		entries, err := fs.ReadDir(fsys, "etc")
+		if err != nil || len(entries) != 2 || entries[0].Name() != "hostname" || entries[1].Type() != fs.ModeSymlink {
+			t.Errorf("ext4 %t: ReadDir(etc) = %v, %v", ext4, entries, err)
+		}
+	}
+}
+
+func TestExtRejectsFilesPastTheVolume(t *testing.T) {
+	b := newExtBuilder(true)
+	const big, far = 11, 12
+	b.dir(extRootInode, extRootInode, []extTestEntry{{"big", big}, {"far", far}})
+	// A size larger than the volume, and an extent starting past its end
+	b.mapBlocks(big, 0o100644, 1<<31, [][3]uint32{{0, b.alloc([]byte("ID=sles\n")), 1}})
+	b.mapBlocks(far, 0o100644, 8, [][3]uint32{{0, 4 * extTestBlocks, 1}})
+
+	fsys, err := Open(bytes.NewReader(b.img), int64(len(b.img)))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for _, name := range []string{"big", "far"} {
+		if data, err := fs.ReadFile(fsys, name); err == nil {
+			t.Errorf("ReadFile(%s) = %d bytes, want an error", name, len(data))
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package guestfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT layout, see Microsoft's FAT specification (fatgen103)
+const (
+	fatDirEntrySize  = 32
+	fatMaxDirEntries = 65536
+	fatAttrReadOnly  = 0x01
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrLongName  = 0x0f
+	fatLastLongEntry = 0x40
+	fatLongNameChars = 13
+	fatDeleted       = 0xe5
+	fatKanjiE5       = 0x05
+	fatLowerBase     = 0x08
+	fatLowerExt      = 0x10
+
+	// The FAT type follows from the number of clusters only
+	fat12MaxClusters = 4085
+	fat16MaxClusters = 65525
+)
+
+// fatFS is a FAT12, FAT16 or FAT32 filesystem.
+type fatFS struct {
+	r           io.ReaderAt
+	bits        int
+	clusterSize int64
+	clusters    uint32
+	fatOffset   int64
+	dataOffset  int64
+	// The root directory is a fixed area on FAT12 and FAT16, and a
+	// cluster chain on FAT32
+	rootOffset  int64
+	rootSize    int64
+	rootCluster uint32
+}
+
+// fatEntry is a directory entry.
+type fatEntry struct {
+	name      string
+	shortName string
+	attr      byte
+	cluster   uint32
+	size      int64
+	modTime   time.Time
+}
+
+// openFAT reads the boot sector of a FAT volume.
+func openFAT(r io.ReaderAt, size int64) (fs.FS, error) {
+	b := make([]byte, 512)
+	if readAt(r, b, 0) != nil || b[510] != 0x55 || b[511] != 0xaa || (b[0] != 0xeb && b[0] != 0xe9) {
+		return nil, ErrUnknown
+	}
+	le := binary.LittleEndian
+	bytesPerSector := int64(le.Uint16(b[11:]))
+	sectorsPerCluster := int64(b[13])
+	reserved := int64(le.Uint16(b[14:]))
+	fats := int64(b[16])
+	rootEntries := int64(le.Uint16(b[17:]))
+	total := int64(le.Uint16(b[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(b[32:]))
+	}
+	fatSize := int64(le.Uint16(b[22:]))
+	if fatSize == 0 {
+		fatSize = int64(le.Uint32(b[36:]))
+	}
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 ||
+		sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 ||
+		reserved == 0 || fats == 0 || fatSize == 0 {
+		return nil, ErrUnknown
+	}
+
+	rootSectors := (rootEntries*fatDirEntrySize + bytesPerSector - 1) / bytesPerSector
+	dataSector := reserved + fats*fatSize + rootSectors
+	if dataSector >= total || total*bytesPerSector > size {
+		return nil, fmt.Errorf("invalid FAT volume: %d sectors, data at sector %d, volume of %d bytes", total, dataSector, size)
+	}
+	f := &fatFS{
+		r:           r,
+		clusterSize: sectorsPerCluster * bytesPerSector,
+		clusters:    uint32((total - dataSector) / sectorsPerCluster),
+		fatOffset:   reserved * bytesPerSector,
+		dataOffset:  dataSector * bytesPerSector,
+	}
+	switch {
+	case f.clusters < fat12MaxClusters:
+		f.bits = 12
+	case f.clusters < fat16MaxClusters:
+		f.bits = 16
+	default:
+		f.bits = 32
+	}
+	if f.bits == 32 {
+		f.rootCluster = le.Uint32(b[44:])
+	} else {
+		f.rootOffset = (reserved + fats*fatSize) * bytesPerSector
+		f.rootSize = rootEntries * fatDirEntrySize
+	}
+	return &tree{v: f, size: size, fold: true}, nil
+}
+
+func (f *fatFS) root() (*node, error) {
+	return &node{fileInfo: fileInfo{name: ".", mode: fs.ModeDir | 0755}, id: uint64(f.rootCluster)}, nil
+}
+
+// readDir reads the entries of a directory. Cluster 0 stands for the root
+// directory of FAT12 and FAT16.
+func (f *fatFS) readDir(dir *node) ([]*node, error) {
+	var data []byte
+	if dir.id == 0 && f.bits != 32 {
+		data = make([]byte, f.rootSize)
+		if err := readAt(f.r, data, f.rootOffset); err != nil {
+			return nil, err
+		}
+	} else {
+		content, err := f.chain(uint32(dir.id), fatMaxDirEntries*fatDirEntrySize)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, content.size())
+		if err := readAt(content, data, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	var nodes []*node
+	for _, e := range parseFATDir(data) {
+		n := &node{
+			fileInfo: fileInfo{name: e.name, size: e.size, mode: 0644, modTime: e.modTime},
+			alias:    e.shortName,
+			id:       uint64(e.cluster),
+		}
+		if e.attr&fatAttrReadOnly != 0 {
+			n.mode = 0444
+		}
+		if e.attr&fatAttrDirectory != 0 {
+			n.mode, n.size = fs.ModeDir|0755, 0
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (f *fatFS) content(n *node) (io.ReaderAt, error) {
+	content, err := f.chain(uint32(n.id), n.size)
+	if err == nil && content.size() < n.size {
+		err = fmt.Errorf("FAT chain shorter than the file")
+	}
+	return content, err
+}
+
+// parseFATDir parses the entries of a directory, joining long names to the
+// short entries they precede.
+func parseFATDir(data []byte) []fatEntry {
+	le := binary.LittleEndian
+	var entries []fatEntry
+	var long []uint16
+	var longSum byte
+	var longNext int
+	for i := 0; i+fatDirEntrySize <= len(data); i += fatDirEntrySize {
+		d := data[i : i+fatDirEntrySize]
+		switch {
+		case d[0] == 0:
+			return entries
+		case d[0] == fatDeleted:
+			long = nil
+			continue
+		case d[11]&0x3f == fatAttrLongName:
+			// Long name entries come in reverse order, the last one first
+			seq := int(d[0] & 0x1f)
+			if d[0]&fatLastLongEntry != 0 {
+				long, longSum, longNext = make([]uint16, fatLongNameChars*seq), d[13], seq
+			}
+			if long == nil || seq == 0 || seq != longNext || d[13] != longSum {
+				long = nil
+				continue
+			}
+			chars := long[(seq-1)*fatLongNameChars:]
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[j] = le.Uint16(d[off:])
+			}
+			longNext--
+			continue
+		case d[11]&fatAttrVolumeID != 0:
+			long = nil
+			continue
+		}
+
+		e := fatEntry{
+			shortName: fatShortName(d),
+			attr:      d[11],
+			cluster:   uint32(le.Uint16(d[20:]))<<16 | uint32(le.Uint16(d[26:])),
+			size:      int64(le.Uint32(d[28:])),
+			modTime:   fatTime(le.Uint16(d[24:]), le.Uint16(d[22:])),
+		}
+		e.name = e.shortName
+		if long != nil && longNext == 0 && fatChecksum(d[:11]) == longSum {
+			e.name = fatLongName(long)
+		}
+		long = nil
+		if e.shortName != "." && e.shortName != ".." {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// fatShortName returns the 8.3 name of a directory entry, lowercased as
+// Windows NT records it.
+func fatShortName(d []byte) string {
+	base := []byte(strings.TrimRight(string(d[:8]), " "))
+	ext := strings.TrimRight(string(d[8:11]), " ")
+	if len(base) > 0 && base[0] == fatKanjiE5 {
+		base[0] = fatDeleted
+	}
+	name := string(base)
+	if d[12]&fatLowerBase != 0 {
+		name = strings.ToLower(name)
+	}
+	if d[12]&fatLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// fatLongName decodes a long name, terminated by a NUL if shorter than its
+// entries.
+func fatLongName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// fatChecksum is the checksum of a short name that its long name entries
+// record.
+func fatChecksum(name []byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatTime converts a FAT date and time, in local time, to a time.Time.
+func fatTime(date, tod uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xf), int(date&0x1f),
+		int(tod>>11), int(tod>>5&0x3f), 2*int(tod&0x1f), 0, time.Local)
+}
+
+// next returns the FAT entry of cluster c, i.e. the next cluster of its
+// chain.
+func (f *fatFS) next(c uint32) (uint32, error) {
+	le := binary.LittleEndian
+	var b [4]byte
+	switch f.bits {
+	case 12:
+		if err := readAt(f.r, b[:2], f.fatOffset+int64(c+c/2)); err != nil {
+			return 0, err
+		}
+		v := uint32(le.Uint16(b[:]))
+		if c&1 != 0 {
+			return v >> 4, nil
+		}
+		return v & 0xfff, nil
+	case 16:
+		err := readAt(f.r, b[:2], f.fatOffset+2*int64(c))
+		return uint32(le.Uint16(b[:])), err
+	default:
+		err := readAt(f.r, b[:], f.fatOffset+4*int64(c))
+		return le.Uint32(b[:]) & 0x0fffffff, err
+	}
+}
+
+// chain returns the content of the cluster chain starting at start,
+// limited to size bytes.
+func (f *fatFS) chain(start uint32, size int64) (*fatContent, error) {
+	endOfChain := uint32(1)<<f.bits - 8
+	if f.bits == 32 {
+		endOfChain = 0x0ffffff8
+	}
+	c := &fatContent{f: f, limit: size}
+	for cluster := start; cluster != 0 && cluster < endOfChain && int64(len(c.clusters))*f.clusterSize < size; {
+		if cluster < 2 || cluster >= f.clusters+2 {
+			return nil, fmt.Errorf("invalid cluster %d in a FAT chain", cluster)
+		}
+		if len(c.clusters) > int(f.clusters) {
+			return nil, fmt.Errorf("FAT chain loops")
+		}
+		c.clusters = append(c.clusters, cluster)
+		next, err := f.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		cluster = next
+	}
+	return c, nil
+}
+
+// fatContent reads the clusters of a chain as one.
+type fatContent struct {
+	f        *fatFS
+	clusters []uint32
+	limit    int64
+}
+
+// size returns the amount of data in the chain, up to its limit.
+func (c *fatContent) size() int64 {
+	return min(int64(len(c.clusters))*c.f.clusterSize, c.limit)
+}
+
+func (c *fatContent) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= c.size() {
+			return n, io.EOF
+		}
+		index, in := off/c.f.clusterSize, off%c.f.clusterSize
+		chunk := p[n:min(len(p), n+int(c.f.clusterSize-in))]
+		chunk = chunk[:min(int64(len(chunk)), c.size()-off)]
+		if err := readAt(c.f.r, chunk, c.f.dataOffset+int64(c.clusters[index]-2)*c.f.clusterSize+in); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, nil
+}
@@ -0,0 +1,286 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// fatBuilder lays out a FAT volume with 512-byte sectors and clusters.
+type fatBuilder struct {
+	img         []byte
+	bits        int
+	fatOffset   int
+	dataOffset  int
+	nextCluster uint32
+}
+
+// fatImage builds a FAT volume of the given type holding files, keyed by
+// slash-separated paths. Directories are created as needed.
+func fatImage(t *testing.T, bits int, files map[string]string) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+	// The number of clusters decides the FAT type
+	sectors, fatSectors, reserved, rootEntries := 2048, 8, 1, 64
+	switch bits {
+	case 16:
+		sectors, fatSectors = 8192, 40
+	case 32:
+		sectors, fatSectors, reserved, rootEntries = 70000, 560, 32, 0
+	}
+	b := &fatBuilder{img: make([]byte, sectors*512), bits: bits, nextCluster: 2}
+	b.fatOffset = reserved * 512
+	rootOffset := b.fatOffset + 2*fatSectors*512
+	b.dataOffset = rootOffset + rootEntries*32
+
+	boot := b.img
+	copy(boot, "\xeb\x3c\x90mkfs.fat")
+	le.PutUint16(boot[11:], 512)
+	boot[13] = 1
+	le.PutUint16(boot[14:], uint16(reserved))
+	boot[16] = 2
+	le.PutUint16(boot[17:], uint16(rootEntries))
+	if sectors < 65536 {
+		le.PutUint16(boot[19:], uint16(sectors))
+	} else {
+		le.PutUint32(boot[32:], uint32(sectors))
+	}
+	boot[21] = 0xf8
+	boot[510], boot[511] = 0x55, 0xaa
+	b.setFAT(0, 0xffffff8)
+	b.setFAT(1, 0xfffffff)
+
+	// Build the directory tree
+	tree := map[string][]string{"": nil}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		for dir, name := parentOf(p); ; dir, name = parentOf(dir) {
+			if _, ok := tree[dir]; !ok {
+				tree[dir] = nil
+			}
+			if !slices.Contains(tree[dir], name) {
+				tree[dir] = append(tree[dir], name)
+			}
+			if dir == "" {
+				break
+			}
+		}
+	}
+
+	var place func(dir string) []byte
+	place = func(dir string) []byte {
+		var entries []byte
+		for _, name := range tree[dir] {
+			p := strings.TrimPrefix(dir+"/"+name, "/")
+			var cluster uint32
+			var size int
+			attr := byte(0x20)
+			if _, isDir := tree[p]; isDir {
+				attr = fatAttrDirectory
+				cluster = b.write(append(fatRawEntry(".          ", fatAttrDirectory, 0), place(p)...), true)
+			} else {
+				cluster, size = b.write([]byte(files[p]), false), len(files[p])
+			}
+			entries = append(entries, fatNamedEntry(name, attr, cluster, size)...)
+		}
+		return entries
+	}
+	root := place("")
+	if bits == 32 {
+		le.PutUint32(boot[36:], uint32(fatSectors))
+		le.PutUint32(boot[44:], b.write(root, true))
+	} else {
+		le.PutUint16(boot[22:], uint16(fatSectors))
+		copy(b.img[rootOffset:], root)
+	}
+	return b.img
+}
+
+func parentOf(p string) (dir, name string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// write stores data in a new cluster chain and returns its first cluster.
+// Directories get a cluster for their end marker at least.
+func (b *fatBuilder) write(data []byte, isDir bool) uint32 {
+	n := (len(data) + 511) / 512
+	if isDir && len(data)%512 == 0 {
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	first := b.nextCluster
+	for i := 0; i < n; i++ {
+		c := b.nextCluster
+		b.nextCluster++
+		copy(b.img[b.dataOffset+int(c-2)*512:], data[min(len(data), i*512):])
+		next := uint32(0xffffff8)
+		if i < n-1 {
+			next = c + 1
+		}
+		b.setFAT(c, next)
+	}
+	return first
+}
+
+func (b *fatBuilder) setFAT(c, v uint32) {
+	le := binary.LittleEndian
+	fat := b.img[b.fatOffset:]
+	switch b.bits {
+	case 12:
+		v &= 0xfff
+		off := int(c + c/2)
+		if c&1 != 0 {
+			fat[off] = fat[off]&0x0f | byte(v<<4)
+			fat[off+1] = byte(v >> 4)
+		} else {
+			fat[off] = byte(v)
+			fat[off+1] = fat[off+1]&0xf0 | byte(v>>8)
+		}
+	case 16:
+		le.PutUint16(fat[2*c:], uint16(v))
+	default:
+		le.PutUint32(fat[4*c:], v&0x0fffffff)
+	}
+}
+
+// fatRawEntry returns a short directory entry with an 11-byte name.
+func fatRawEntry(name string, attr byte, cluster uint32) []byte {
+	e := make([]byte, 32)
+	copy(e, name)
+	e[11] = attr
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	return e
+}
+
+// fatNamedEntry returns the directory entries of name: a short entry with
+// the lowercase flags for lowercase 8.3 names, preceded by long name entries
+// for other names.
+func fatNamedEntry(name string, attr byte, cluster uint32, size int) []byte {
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) <= 8 && len(ext) <= 3 && !strings.ContainsAny(name, " +") &&
+		(name == strings.ToUpper(name) || name == strings.ToLower(name)) {
+		e := fatRawEntry(fmt.Sprintf("%-8s%-3s", strings.ToUpper(base), strings.ToUpper(ext)), attr, cluster)
+		if name != strings.ToUpper(name) {
+			e[12] = fatLowerBase | fatLowerExt
+		}
+		binary.LittleEndian.PutUint32(e[28:], uint32(size))
+		return e
+	}
+
+	short := fmt.Sprintf("%-8s%-3s", strings.ToUpper(base[:min(6, len(base))])+"~1", strings.ToUpper(ext[:min(3, len(ext))]))
+	e := fatRawEntry(short, attr, cluster)
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+	sum := fatChecksum(e[:11])
+
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%fatLongNameChars != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%fatLongNameChars != 0 {
+		chars = append(chars, 0xffff)
+	}
+	var entries []byte
+	count := len(chars) / fatLongNameChars
+	for seq := count; seq >= 1; seq-- {
+		l := make([]byte, 32)
+		l[0] = byte(seq)
+		if seq == count {
+			l[0] |= fatLastLongEntry
+		}
+		l[11], l[13] = fatAttrLongName, sum
+		for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(l[off:], chars[(seq-1)*fatLongNameChars+j])
+		}
+		entries = append(entries, l...)
+	}
+	return append(entries, e...)
+}
+
+func TestFAT(t *testing.T) {
+	bootloader := strings.Repeat("MZ boot loader ", 100)
+	files := map[string]string{
+		"EFI/BOOT/BOOTX64.EFI":            bootloader,
+		"EFI/BOOT/grub.cfg":               "configfile $prefix/grub.cfg\n",
+		"EFI/opensuse/shim-sles.efi":      "shim",
+		"EFI/opensuse/MokManager.efi":     "",
+		"loader/entries/a long name.conf": "title Tumbleweed\n",
+	}
+	for _, bits := range []int{12, 16, 32} {
+		img := fatImage(t, bits, files)
+		fsys, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("FAT%d: Open() failed: %v", bits, err)
+		}
+		if f := fsys.(*tree).v.(*fatFS); f.bits != bits {
+			t.Errorf("FAT%d: detected FAT%d", bits, f.bits)
+		}
+
+		for name, want := range files {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil || string(got) != want {
+				t.Errorf("FAT%d: ReadFile(%s) = %d bytes, %v, want %d bytes", bits, name, len(got), err, len(want))
+			}
+		}
+
+		// Names are matched case-insensitively, and short names work too
+		for _, name := range []string{"efi/boot/bootx64.efi", "EFI/OPENSUSE/SHIM-S~1.EFI"} {
+			if _, err := fs.Stat(fsys, name); err != nil {
+				t.Errorf("FAT%d: Stat(%s) failed: %v", bits, name, err)
+			}
+		}
+
+		entries, err := fs.ReadDir(fsys, "EFI/opensuse")
+		if err != nil {
+			t.Fatalf("FAT%d: ReadDir() failed: %v", bits, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if strings.Join(names, ",") != "MokManager.efi,shim-sles.efi" {
+			t.Errorf("FAT%d: ReadDir() = %v", bits, names)
+		}
+
+		f, err := fsys.Open("EFI/BOOT/BOOTX64.EFI")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := f.(io.ReaderAt).ReadAt(buf, 510); err != nil || string(buf) != bootloader[510:514] {
+			t.Errorf("FAT%d: ReadAt() across clusters = %q, %v", bits, buf, err)
+		}
+		f.Close()
+
+		if _, err := fsys.Open("EFI/BOOT/BOOTAA64.EFI"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("FAT%d: Open() of a missing file = %v", bits, err)
+		}
+		if _, err := fsys.Open("EFI/BOOT/grub.cfg/x"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("FAT%d: Open() below a file = %v", bits, err)
+		}
+	}
+}
+
+func TestOpenUnknown(t *testing.T) {
+	for _, img := range [][]byte{nil, make([]byte, 4096)} {
+		if _, err := Open(bytes.NewReader(img), int64(len(img))); !errors.Is(err, ErrUnknown) {
+			t.Errorf("Open() = %v, want ErrUnknown", err)
+		}
+	}
+}
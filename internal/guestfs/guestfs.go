@@ -0,0 +1,359 @@
+// Package guestfs reads files from the filesystems of guest disks, without
+// mounting them or needing libguestfs.
+//
+// The filesystems are exposed as read-only io/fs file systems: paths are
+// slash-separated and relative to the root, e.g. "EFI/BOOT/BOOTX64.EFI",
+// and symbolic links are followed. FAT, ext2/3/4, XFS, Btrfs and ISO 9660
+// are supported, only as far as needed to find and read a few files.
+package guestfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrUnknown is returned by Open for volumes without a supported
+// filesystem.
+var ErrUnknown = errors.New("no supported filesystem found")
+
+// openers recognize and open the supported filesystems.
+var openers = []func(r io.ReaderAt, size int64) (fs.FS, error){
+	openExt,
+	openXFS,
+	openBtrfs,
+	openISO9660,
+	openFAT,
+}
+
+// Open opens the filesystem on the volume r of the given size.
+func Open(r io.ReaderAt, size int64) (fs.FS, error) {
+	for _, open := range openers {
+		fsys, err := open(r, size)
+		if !errors.Is(err, ErrUnknown) {
+			return fsys, err
+		}
+	}
+	return nil, ErrUnknown
+}
+
+// fileInfo describes a file of a guest filesystem.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return nil }
+
+// file is an open regular file. Besides reading sequentially, it supports
+// ReadAt and Seek, e.g. for debug/elf and debug/pe.
+type file struct {
+	*io.SectionReader
+	info *fileInfo
+}
+
+func newFile(content io.ReaderAt, info *fileInfo) *file {
+	return &file{SectionReader: io.NewSectionReader(content, 0, info.size), info: info}
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return nil }
+
+// dir is an open directory, whose entries were read when opening it.
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// volume is a filesystem whose files are found by walking its directories.
+type volume interface {
+	// root returns the root directory.
+	root() (*node, error)
+	// readDir returns the entries of a directory, but "." and "..".
+	readDir(dir *node) ([]*node, error)
+	// content returns the data of a regular file, or the target of a
+	// symbolic link.
+	content(n *node) (io.ReaderAt, error)
+}
+
+// node is a file of a volume.
+type node struct {
+	fileInfo
+	// alias is another name the file is found by, e.g. its FAT short name
+	alias string
+	// id identifies the file within its volume, e.g. its inode number, and
+	// tree the btrfs subvolume holding it
+	id   uint64
+	tree uint64
+}
+
+// maxSymlinks bounds the symbolic links followed to resolve a path, as
+// Linux does.
+const maxSymlinks = 40
+
+// tree serves a volume as an fs.FS, following symbolic links within the
+// volume.
+type tree struct {
+	v volume
+	// size is the size of the volume, which no file can exceed
+	size int64
+	// fold matches names case-insensitively
+	fold bool
+}
+
+// Open implements fs.FS.
+func (t *tree) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := t.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.IsDir() {
+		children, err := t.v.readDir(n)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		d := &dir{info: &n.fileInfo}
+		for _, c := range children {
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(&c.fileInfo))
+		}
+		return d, nil
+	}
+	// Callers like fs.ReadFile allocate as much as the size, which comes
+	// from the metadata of the volume, and may be corrupt
+	if n.size < 0 || n.size > t.size {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("file of %d bytes on a volume of %d bytes", n.size, t.size)}
+	}
+	content, err := t.v.content(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newFile(content, &n.fileInfo), nil
+}
+
+// resolve walks to the file at name, following symbolic links. Absolute
+// link targets are relative to the root of the volume.
+func (t *tree) resolve(name string) (*node, error) {
+	root, err := t.v.root()
+	if err != nil {
+		return nil, err
+	}
+	// The directories walked through, for ".." in link targets
+	stack := []*node{root}
+	elems := strings.Split(name, "/")
+	for links := 0; len(elems) > 0; {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		if !cur.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		child, err := t.lookup(cur, elem)
+		if err != nil {
+			return nil, err
+		}
+		if child.mode&fs.ModeSymlink == 0 {
+			stack = append(stack, child)
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return nil, errors.New("too many levels of symbolic links")
+		}
+		target, err := t.readLink(child)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(target, "/") {
+			stack = stack[:1]
+		}
+		elems = append(strings.Split(target, "/"), elems...)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// lookup returns the entry of dir named name.
+func (t *tree) lookup(dir *node, name string) (*node, error) {
+	children, err := t.v.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range children {
+		if c.name == name || (c.alias != "" && c.alias == name) {
+			return c, nil
+		}
+		if t.fold && (strings.EqualFold(c.name, name) || strings.EqualFold(c.alias, name)) {
+			return c, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// maxLinkSize bounds the targets of symbolic links, like PATH_MAX.
+const maxLinkSize = 4096
+
+// readLink returns the target of the symbolic link n.
+func (t *tree) readLink(n *node) (string, error) {
+	content, err := t.v.content(n)
+	if err != nil {
+		return "", err
+	}
+	if n.size > maxLinkSize {
+		return "", fmt.Errorf("symbolic link target of %d bytes", n.size)
+	}
+	target := make([]byte, n.size)
+	if err := readAt(content, target, 0); err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// unixMode converts the st_mode of a file to an fs.FileMode.
+func unixMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & 0xf000 {
+	case 0x4000:
+		m |= fs.ModeDir
+	case 0xa000:
+		m |= fs.ModeSymlink
+	case 0x2000:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x6000:
+		m |= fs.ModeDevice
+	case 0x1000:
+		m |= fs.ModeNamedPipe
+	case 0xc000:
+		m |= fs.ModeSocket
+	}
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// readAt reads exactly len(buf) bytes at off.
+func readAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// extent maps blocks of a file to the volume. Blocks not covered by an
+// extent, and blocks of unwritten extents, read as zeros.
+type extent struct {
+	// logical is the first block of the file, length the number of blocks
+	logical int64
+	length  int64
+	// physical is the byte offset of the data on the volume
+	physical  int64
+	unwritten bool
+}
+
+// checkExtents checks that the extents, of blocks of blockSize bytes, lie
+// within the volume of the given size.
+func checkExtents(extents []extent, blockSize, size int64) error {
+	for _, e := range extents {
+		if e.physical < 0 || e.length < 0 || e.length > size/blockSize || e.physical > size-e.length*blockSize {
+			return fmt.Errorf("extent of %d blocks at byte %d is past the end of the volume", e.length, e.physical)
+		}
+	}
+	return nil
+}
+
+// extentReader reads a file made of extents, sorted by logical block.
+type extentReader struct {
+	r         io.ReaderAt
+	blockSize int64
+	extents   []extent
+	size      int64
+}
+
+func (e *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= e.size {
+			return n, io.EOF
+		}
+		block := off / e.blockSize
+		// The extent holding block, or the data up to the next one is a hole
+		i := sort.Search(len(e.extents), func(i int) bool {
+			return e.extents[i].logical+e.extents[i].length > block
+		})
+		end := e.size
+		var ext *extent
+		if i < len(e.extents) {
+			if e.extents[i].logical <= block {
+				ext = &e.extents[i]
+				end = min(end, (ext.logical+ext.length)*e.blockSize)
+			} else {
+				end = min(end, e.extents[i].logical*e.blockSize)
+			}
+		}
+		chunk := p[n:min(len(p), n+int(end-off))]
+		if ext == nil || ext.unwritten {
+			clear(chunk)
+		} else if err := readAt(e.r, chunk, ext.physical+off-ext.logical*e.blockSize); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, nil
+}
@@ -0,0 +1,284 @@
+package guestfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ISO 9660 layout, with the Joliet and Rock Ridge extensions, see ECMA-119
+// and IEEE P1282
+const (
+	isoSectorSize       = 2048
+	isoDescriptorStart  = 16
+	isoMaxDescriptors   = 32
+	isoMagic            = "CD001"
+	isoRootRecordOffset = 156
+	isoMaxDirSize       = 16 << 20
+
+	isoDescriptorPrimary       = 1
+	isoDescriptorSupplementary = 2
+	isoDescriptorTerminator    = 255
+
+	isoFlagDirectory   = 0x02
+	isoFlagAssociated  = 0x04
+	isoFlagMultiExtent = 0x80
+
+	rrNameContinue = 0x01
+	rrLinkContinue = 0x01
+	rrLinkCurrent  = 0x02
+	rrLinkParent   = 0x04
+	rrLinkRoot     = 0x08
+)
+
+// isoFS is an ISO 9660 filesystem. Directories and files are identified by
+// the sector of their extent, symbolic links by the offset of their record.
+type isoFS struct {
+	r      io.ReaderAt
+	rootID uint64
+	// rootSize is the size of the root directory
+	rootSize int64
+	joliet   bool
+	// links holds the targets of the Rock Ridge symbolic links read
+	links map[uint64]string
+	// parents maps the directories read to the directory they were found
+	// in, to detect loops
+	parents map[uint64]uint64
+}
+
+// openISO9660 reads the volume descriptors of an ISO 9660 volume. Rock Ridge
+// names are used when the primary volume has them, Joliet names otherwise.
+func openISO9660(r io.ReaderAt, size int64) (fs.FS, error) {
+	var primary, joliet []byte
+	for i := int64(0); i < isoMaxDescriptors; i++ {
+		d := make([]byte, isoSectorSize)
+		if readAt(r, d, (isoDescriptorStart+i)*isoSectorSize) != nil || string(d[1:6]) != isoMagic {
+			break
+		}
+		switch d[0] {
+		case isoDescriptorPrimary:
+			primary = d
+		case isoDescriptorSupplementary:
+			// Joliet uses the UCS-2 escape sequences
+			if d[88] == '%' && d[89] == '/' && strings.ContainsRune("@CE", rune(d[90])) {
+				joliet = d
+			}
+		}
+		if d[0] == isoDescriptorTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, ErrUnknown
+	}
+	if blocks := int64(binary.LittleEndian.Uint32(primary[80:])); blocks*isoSectorSize > size {
+		return nil, fmt.Errorf("ISO 9660 filesystem of %d bytes on a volume of %d bytes", blocks*isoSectorSize, size)
+	}
+
+	f := &isoFS{r: r, links: map[uint64]string{}, parents: map[uint64]uint64{}}
+	f.setRoot(primary)
+	if joliet != nil {
+		// Rock Ridge is announced by the system use area of the first
+		// record of the root directory
+		first := make([]byte, 255)
+		if err := readAt(r, first, int64(f.rootID)*isoSectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read the ISO 9660 root directory: %w", err)
+		}
+		if _, ok := rrEntries(systemUse(first[:max(34, first[0])]))["SP"]; !ok {
+			f.setRoot(joliet)
+			f.joliet = true
+		}
+	}
+	return &tree{v: f, size: size, fold: true}, nil
+}
+
+// setRoot uses the root directory of a volume descriptor.
+func (f *isoFS) setRoot(d []byte) {
+	root := d[isoRootRecordOffset:]
+	f.rootID = uint64(binary.LittleEndian.Uint32(root[2:]))
+	f.rootSize = int64(binary.LittleEndian.Uint32(root[10:]))
+}
+
+func (f *isoFS) root() (*node, error) {
+	return &node{
+		fileInfo: fileInfo{name: ".", size: f.rootSize, mode: fs.ModeDir | 0o555},
+		id:       f.rootID,
+	}, nil
+}
+
+func (f *isoFS) readDir(dir *node) ([]*node, error) {
+	if dir.size > isoMaxDirSize {
+		return nil, fmt.Errorf("directory of %d bytes", dir.size)
+	}
+	start := int64(dir.id) * isoSectorSize
+	data := make([]byte, dir.size)
+	if err := readAt(f.r, data, start); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	var nodes []*node
+	for pos := 0; pos < len(data); {
+		length := int(data[pos])
+		if length == 0 {
+			// Records don't cross sectors, the rest of this one is unused
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if length < 34 || pos+length > len(data) || 33+int(data[pos+32]) > length {
+			return nil, fmt.Errorf("corrupt directory record in sector %d", dir.id)
+		}
+		r := data[pos : pos+length]
+		off := start + int64(pos)
+		pos += length
+		flags, nameLen := r[25], int(r[32])
+		id := r[33 : 33+nameLen]
+		// The "." and ".." records, and associated files
+		if (nameLen == 1 && id[0] <= 1) || flags&isoFlagAssociated != 0 {
+			continue
+		}
+
+		n := &node{
+			fileInfo: fileInfo{size: int64(le.Uint32(r[10:])), mode: 0o444, modTime: isoTime(r[18:25])},
+			id:       uint64(le.Uint32(r[2:])),
+		}
+		if flags&isoFlagDirectory != 0 {
+			n.mode = fs.ModeDir | 0o555
+			// A directory record pointing back to an ancestor would make
+			// walking the tree recurse forever
+			if f.isAncestor(n.id, dir.id) {
+				return nil, fmt.Errorf("directory loop in sector %d", dir.id)
+			}
+			f.parents[n.id] = dir.id
+		}
+		n.name = isoName(id)
+		if f.joliet {
+			n.name = jolietName(id)
+		} else if rr := rrEntries(systemUse(r)); len(rr) > 0 {
+			n.alias = n.name
+			if name := rr["NM"]; name != "" {
+				n.name = name
+			}
+			if rr["PX"] != "" {
+				n.mode = unixMode(le.Uint32([]byte(rr["PX"])))
+			}
+			if n.mode&fs.ModeSymlink != 0 {
+				f.links[uint64(off)] = rr["SL"]
+				n.id, n.size = uint64(off), int64(len(rr["SL"]))
+			}
+		}
+		if flags&isoFlagMultiExtent != 0 && !n.IsDir() {
+			// Files of 4 GiB and more continue in the next records, and
+			// are not needed
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// isAncestor reports whether the directory at sector id is the root, dir or
+// one of the directories dir was found in.
+func (f *isoFS) isAncestor(id, dir uint64) bool {
+	if id == f.rootID {
+		return true
+	}
+	for ok := true; ok; dir, ok = f.parents[dir] {
+		if id == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *isoFS) content(n *node) (io.ReaderAt, error) {
+	if n.mode&fs.ModeSymlink != 0 {
+		return strings.NewReader(f.links[n.id]), nil
+	}
+	return io.NewSectionReader(f.r, int64(n.id)*isoSectorSize, n.size), nil
+}
+
+// isoName strips the version of a file identifier, e.g. "README.TXT;1", and
+// the dot of identifiers without extension.
+func isoName(id []byte) string {
+	name, _, _ := strings.Cut(string(id), ";")
+	return strings.TrimSuffix(name, ".")
+}
+
+// jolietName decodes a Joliet file identifier, in UCS-2 big endian.
+func jolietName(id []byte) string {
+	chars := make([]uint16, len(id)/2)
+	for i := range chars {
+		chars[i] = binary.BigEndian.Uint16(id[2*i:])
+	}
+	return isoName([]byte(string(utf16.Decode(chars))))
+}
+
+// isoTime decodes the recording time of a directory record.
+func isoTime(b []byte) time.Time {
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// systemUse returns the system use area of a directory record, after its
+// file identifier and the padding to an even offset.
+func systemUse(r []byte) []byte {
+	nameLen := int(r[32])
+	return r[min(len(r), 33+nameLen+(nameLen+1)%2):]
+}
+
+// rrEntries returns the System Use Sharing Protocol entries of a system use
+// area which q2boot needs, keyed by signature: "SP" announcing Rock Ridge,
+// the "NM" name, the "PX" mode, and the "SL" symbolic link target decoded.
+// Continuation areas are not followed.
+func rrEntries(b []byte) map[string]string {
+	entries := map[string]string{}
+	var name, link strings.Builder
+	for len(b) >= 4 && int(b[2]) >= 4 && int(b[2]) <= len(b) {
+		sig, data := string(b[:2]), b[4:b[2]]
+		b = b[b[2]:]
+		switch sig {
+		case "ST":
+			return entries
+		case "SP":
+			entries[sig] = ""
+		case "NM":
+			if len(data) > 0 && data[0]&^rrNameContinue == 0 {
+				name.Write(data[1:])
+				entries[sig] = name.String()
+			}
+		case "PX":
+			if len(data) >= 4 {
+				entries[sig] = string(data[:4])
+			}
+		case "SL":
+			for comp := data[min(1, len(data)):]; len(comp) >= 2 && 2+int(comp[1]) <= len(comp); {
+				flags, content := comp[0], comp[2:2+comp[1]]
+				comp = comp[2+comp[1]:]
+				switch {
+				case flags&rrLinkRoot != 0:
+					link.WriteString("/")
+					continue
+				case flags&rrLinkCurrent != 0:
+					link.WriteString(".")
+				case flags&rrLinkParent != 0:
+					link.WriteString("..")
+				default:
+					link.Write(content)
+				}
+				if flags&rrLinkContinue == 0 {
+					link.WriteString("/")
+				}
+			}
+			target := link.String()
+			if len(target) > 1 {
+				target = strings.TrimSuffix(target, "/")
+			}
+			entries[sig] = target
+		}
+	}
+	return entries
+}
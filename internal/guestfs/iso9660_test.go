@@ -0,0 +1,125 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/iso9660"
+)
+
+func TestISO9660(t *testing.T) {
+	img := iso9660.New("SLE-16-DVD")
+	img.ModTime = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"boot/x86_64/loader/linux":  "kernel",
+		"boot/x86_64/loader/initrd": string(bytes.Repeat([]byte("initrd"), 1000)),
+		"media.1/products":          "/ SLES 16.0\n",
+		"EFI/BOOT/bootx64.efi":      "",
+	}
+	for name, data := range files {
+		if err := img.AddFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if !fsys.(*tree).v.(*isoFS).joliet {
+		t.Error("Joliet names are not used")
+	}
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s) = %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+		}
+	}
+	info, err := fs.Stat(fsys, "BOOT/X86_64")
+	if err != nil || !info.IsDir() || !info.ModTime().Equal(img.ModTime) {
+		t.Errorf("Stat(BOOT/X86_64) = %v, %v", info, err)
+	}
+	entries, err := fs.ReadDir(fsys, "boot/x86_64/loader")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "initrd" {
+		t.Errorf("ReadDir() = %v, %v", entries, err)
+	}
+}
+
+// susp encodes a System Use Sharing Protocol entry.
+func susp(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func TestRockRidgeEntries(t *testing.T) {
+	mode := make([]byte, 8)
+	binary.LittleEndian.PutUint32(mode, 0o120777)
+	var b []byte
+	b = append(b, susp("RR", 0x89)...)
+	b = append(b, susp("PX", mode...)...)
+	// A name in two entries, and a link target in two
+	b = append(b, susp("NM", append([]byte{rrNameContinue}, "initrd-"...)...)...)
+	b = append(b, susp("NM", append([]byte{0}, "6.4"...)...)...)
+	b = append(b, susp("SL", rrLinkContinue, rrLinkRoot, 0, 0, 3, 'u', 's', 'r')...)
+	b = append(b, susp("SL", 0, rrLinkParent, 0, rrLinkContinue, 2, 'l', 'i', 0, 2, 'b', '6')...)
+	b = append(b, susp("ST")...)
+	b = append(b, susp("NM", 0, 'x')...)
+
+	rr := rrEntries(b)
+	if rr["NM"] != "initrd-6.4" || rr["SL"] != "/usr/../lib6" || unixMode(binary.LittleEndian.Uint32([]byte(rr["PX"]))) != fs.ModeSymlink|0o777 {
+		t.Errorf("rrEntries() = %q", rr)
+	}
+	if _, ok := rr["SP"]; ok {
+		t.Error("rrEntries() found an SP entry")
+	}
+}
+
+func TestISO9660DirectoryLoop(t *testing.T) {
+	img := iso9660.New("LOOP")
+	if err := img.AddFile("a/b/file", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	iso := fsys.(*tree).v.(*isoFS)
+	root, _ := iso.root()
+	a, err := fsys.(*tree).lookup(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fsys.(*tree).lookup(a, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the record of b back to a
+	le, be := binary.LittleEndian, binary.BigEndian
+	dir := data[a.id*isoSectorSize:][:a.size]
+	for pos := 0; pos+34 <= len(dir) && dir[pos] != 0; pos += int(dir[pos]) {
+		if uint64(le.Uint32(dir[pos+2:])) == b.id {
+			le.PutUint32(dir[pos+2:], uint32(a.id))
+			be.PutUint32(dir[pos+6:], uint32(a.id))
+		}
+	}
+
+	fsys, err = Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	err = fs.WalkDir(fsys, ".", func(_ string, _ fs.DirEntry, err error) error { return err })
+	if err == nil {
+		t.Error("WalkDir() should fail on a directory pointing back to itself")
+	}
+}
@@ -0,0 +1,448 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sort"
+	"time"
+)
+
+// XFS layout, see the XFS Algorithms & Data Structures document
+const (
+	xfsMagic         = "XFSB"
+	xfsInodeMagic    = "IN"
+	xfsMaxBtreeDepth = 8
+	xfsMaxDirSize    = 64 << 20
+
+	xfsVersionNumMask = 0x000f
+	xfsFeatures2FType = 0x200
+
+	xfsIncompatFType   = 1 << 0
+	xfsIncompatNRExt64 = 1 << 5
+
+	xfsInodeFlags2BigTime = 1 << 3
+	xfsInodeFlags2NRExt64 = 1 << 4
+	xfsBigTimeEpochOffset = 1 << 31
+
+	xfsFormatLocal   = 1
+	xfsFormatExtents = 2
+	xfsFormatBtree   = 3
+
+	xfsInodeCoreSizeV2 = 100
+	xfsInodeCoreSizeV3 = 176
+	xfsExtentSize      = 16
+	xfsBtreeHeaderV4   = 24
+	xfsBtreeHeaderV5   = 72
+	xfsDirHeaderV4     = 16
+	xfsDirHeaderV5     = 64
+	xfsSymlinkHeaderV5 = 56
+	xfsDirUnusedTag    = 0xffff
+
+	// Directory data blocks live below this offset, leaf and free index
+	// blocks above it
+	xfsDirLeafOffset = 32 << 30
+)
+
+var (
+	xfsDirBlockMagics = []string{"XD2B", "XDB3"}
+	xfsDirDataMagics  = []string{"XD2D", "XDD3"}
+)
+
+// xfsFS is an XFS filesystem.
+type xfsFS struct {
+	r          io.ReaderAt
+	size       int64
+	blockSize  int64
+	dirBlock   int64
+	inodeSize  int64
+	rootIno    uint64
+	agBlocks   int64
+	agBlockLog uint
+	inoPerLog  uint
+	v5         bool
+	ftype      bool
+	nrext64    bool
+}
+
+// openXFS reads the superblock of an XFS volume.
+func openXFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	sb := make([]byte, 512)
+	if readAt(r, sb, 0) != nil || string(sb[:4]) != xfsMagic {
+		return nil, ErrUnknown
+	}
+	be := binary.BigEndian
+	f := &xfsFS{
+		r:          r,
+		size:       size,
+		blockSize:  int64(be.Uint32(sb[4:])),
+		rootIno:    be.Uint64(sb[56:]),
+		agBlocks:   int64(be.Uint32(sb[84:])),
+		inodeSize:  int64(be.Uint16(sb[104:])),
+		agBlockLog: uint(sb[124]),
+		inoPerLog:  uint(sb[123]),
+		v5:         be.Uint16(sb[100:])&xfsVersionNumMask == 5,
+	}
+	f.dirBlock = f.blockSize << sb[192]
+	if f.blockSize < 512 || f.blockSize > 65536 || (f.v5 && f.inodeSize < 512) || f.inodeSize < 256 ||
+		f.agBlocks == 0 || f.agBlockLog > 31 || f.inoPerLog > 8 || f.dirBlock > 65536 {
+		return nil, fmt.Errorf("invalid XFS superblock")
+	}
+	if blocks := int64(be.Uint64(sb[8:])); blocks*f.blockSize > size {
+		return nil, fmt.Errorf("XFS filesystem of %d bytes on a volume of %d bytes", blocks*f.blockSize, size)
+	}
+	if f.v5 {
+		incompat := be.Uint32(sb[216:])
+		f.ftype = incompat&xfsIncompatFType != 0
+		f.nrext64 = incompat&xfsIncompatNRExt64 != 0
+	} else {
+		f.ftype = be.Uint32(sb[200:])&xfsFeatures2FType != 0
+	}
+	return &tree{v: f, size: size}, nil
+}
+
+// blockOffset converts a filesystem block number, made of an allocation
+// group number and a block number within the group, to a byte offset.
+func (f *xfsFS) blockOffset(fsb uint64) int64 {
+	ag, block := int64(fsb>>f.agBlockLog), int64(fsb&(1<<f.agBlockLog-1))
+	return (ag*f.agBlocks + block) * f.blockSize
+}
+
+func (f *xfsFS) root() (*node, error) {
+	n, _, err := f.inode(f.rootIno)
+	if n != nil {
+		n.name = "."
+	}
+	return n, err
+}
+
+// xfsInode is an inode with its data fork.
+type xfsInode struct {
+	format   byte
+	extents  uint64
+	dataFork []byte
+}
+
+// inode reads inode ino.
+func (f *xfsFS) inode(ino uint64) (*node, *xfsInode, error) {
+	be := binary.BigEndian
+	inoLog := f.agBlockLog + f.inoPerLog
+	ag, agIno := int64(ino>>inoLog), ino&(1<<inoLog-1)
+	off := (ag*f.agBlocks+int64(agIno>>f.inoPerLog))*f.blockSize + int64(agIno&(1<<f.inoPerLog-1))*f.inodeSize
+
+	raw := make([]byte, f.inodeSize)
+	if err := readAt(f.r, raw, off); err != nil {
+		return nil, nil, fmt.Errorf("failed to read inode %d: %w", ino, err)
+	}
+	if string(raw[:2]) != xfsInodeMagic {
+		return nil, nil, fmt.Errorf("invalid inode %d", ino)
+	}
+
+	coreSize := int64(xfsInodeCoreSizeV2)
+	var flags2 uint64
+	if raw[4] >= 3 {
+		coreSize = xfsInodeCoreSizeV3
+		flags2 = be.Uint64(raw[120:])
+	}
+	forkSize := f.inodeSize - coreSize
+	if forkOff := int64(raw[82]); forkOff != 0 {
+		forkSize = min(forkSize, forkOff*8)
+	}
+	in := &xfsInode{
+		format:   raw[5],
+		extents:  uint64(be.Uint32(raw[76:])),
+		dataFork: raw[coreSize : coreSize+forkSize],
+	}
+	if f.nrext64 && flags2&xfsInodeFlags2NRExt64 != 0 {
+		in.extents = be.Uint64(raw[24:])
+	}
+
+	modTime := time.Unix(int64(int32(be.Uint32(raw[40:]))), int64(be.Uint32(raw[44:])))
+	if flags2&xfsInodeFlags2BigTime != 0 {
+		ns := be.Uint64(raw[40:])
+		modTime = time.Unix(int64(ns/1e9)-xfsBigTimeEpochOffset, int64(ns%1e9))
+	}
+	n := &node{
+		fileInfo: fileInfo{
+			size:    int64(be.Uint64(raw[56:])),
+			mode:    unixMode(uint32(be.Uint16(raw[2:]))),
+			modTime: modTime,
+		},
+		id: ino,
+	}
+	return n, in, nil
+}
+
+// extents returns the extents of the data fork of an inode in the extents
+// or btree format, sorted.
+func (f *xfsFS) extents(in *xfsInode) ([]extent, error) {
+	var extents []extent
+	switch in.format {
+	case xfsFormatExtents:
+		if in.extents*xfsExtentSize > uint64(len(in.dataFork)) {
+			return nil, fmt.Errorf("%d extents in a fork of %d bytes", in.extents, len(in.dataFork))
+		}
+		extents = f.unpackExtents(in.dataFork, int(in.extents))
+	case xfsFormatBtree:
+		// The root of the btree is in the inode, with a 4-byte header
+		b := in.dataFork
+		if len(b) < 4 {
+			return nil, fmt.Errorf("invalid btree root")
+		}
+		be := binary.BigEndian
+		level, recs := int(be.Uint16(b)), int(be.Uint16(b[2:]))
+		maxRecs := (len(b) - 4) / 16
+		if level == 0 || level > xfsMaxBtreeDepth || recs > maxRecs {
+			return nil, fmt.Errorf("invalid btree root")
+		}
+		for i := 0; i < recs; i++ {
+			ptr := be.Uint64(b[4+8*maxRecs+8*i:])
+			if err := f.btree(ptr, level-1, &extents); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported data fork format %d", in.format)
+	}
+	if err := checkExtents(extents, f.blockSize, f.size); err != nil {
+		return nil, err
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+	return extents, nil
+}
+
+// btree collects the extents of the block map btree block fsb, at level.
+func (f *xfsFS) btree(fsb uint64, level int, extents *[]extent) error {
+	b := make([]byte, f.blockSize)
+	if err := readAt(f.r, b, f.blockOffset(fsb)); err != nil {
+		return err
+	}
+	be := binary.BigEndian
+	header := xfsBtreeHeaderV4
+	if f.v5 {
+		header = xfsBtreeHeaderV5
+	}
+	if int(be.Uint16(b[4:])) != level {
+		return fmt.Errorf("invalid btree block %d", fsb)
+	}
+	recs := int(be.Uint16(b[6:]))
+	if level == 0 {
+		if header+recs*xfsExtentSize > len(b) {
+			return fmt.Errorf("invalid btree block %d", fsb)
+		}
+		*extents = append(*extents, f.unpackExtents(b[header:], recs)...)
+		return nil
+	}
+	maxRecs := (len(b) - header) / 16
+	if recs > maxRecs {
+		return fmt.Errorf("invalid btree block %d", fsb)
+	}
+	for i := 0; i < recs; i++ {
+		if err := f.btree(be.Uint64(b[header+8*maxRecs+8*i:]), level-1, extents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackExtents decodes packed 128-bit extent records: an unwritten flag,
+// then 54 bits of file offset, 52 bits of block number and 21 bits of
+// length.
+func (f *xfsFS) unpackExtents(b []byte, count int) []extent {
+	be := binary.BigEndian
+	extents := make([]extent, 0, count)
+	for i := 0; i < count; i++ {
+		l0, l1 := be.Uint64(b[16*i:]), be.Uint64(b[16*i+8:])
+		extents = append(extents, extent{
+			logical:   int64(l0&(1<<63-1)) >> 9,
+			length:    int64(l1 & (1<<21 - 1)),
+			physical:  f.blockOffset((l0&0x1ff)<<43 | l1>>21),
+			unwritten: l0>>63 != 0,
+		})
+	}
+	return extents
+}
+
+func (f *xfsFS) readDir(dir *node) ([]*node, error) {
+	_, in, err := f.inode(dir.id)
+	if err != nil {
+		return nil, err
+	}
+	var entries []xfsDirEntry
+	if in.format == xfsFormatLocal {
+		entries, err = f.shortformDir(in.dataFork)
+	} else {
+		entries, err = f.blockDir(in)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory inode %d: %w", dir.id, err)
+	}
+
+	var nodes []*node
+	for _, e := range entries {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		n, _, err := f.inode(e.ino)
+		if err != nil {
+			return nil, err
+		}
+		n.name = e.name
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+type xfsDirEntry struct {
+	name string
+	ino  uint64
+}
+
+// shortformDir parses a directory stored in its inode.
+func (f *xfsFS) shortformDir(b []byte) ([]xfsDirEntry, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("truncated")
+	}
+	// Inode numbers take 8 bytes if any of them needs more than 4
+	count, inoSize := int(b[0]), 4
+	if b[1] != 0 {
+		inoSize = 8
+	}
+	pos := 2 + inoSize
+	var entries []xfsDirEntry
+	for i := 0; i < count; i++ {
+		if pos+3 > len(b) {
+			return nil, fmt.Errorf("truncated")
+		}
+		nameLen := int(b[pos])
+		end := pos + 3 + nameLen + inoSize
+		if f.ftype {
+			end++
+		}
+		if end > len(b) {
+			return nil, fmt.Errorf("truncated")
+		}
+		e := xfsDirEntry{name: string(b[pos+3 : pos+3+nameLen])}
+		if inoSize == 8 {
+			e.ino = binary.BigEndian.Uint64(b[end-8:])
+		} else {
+			e.ino = uint64(binary.BigEndian.Uint32(b[end-4:]))
+		}
+		entries = append(entries, e)
+		pos = end
+	}
+	return entries, nil
+}
+
+// blockDir parses the data blocks of a directory stored in blocks.
+func (f *xfsFS) blockDir(in *xfsInode) ([]xfsDirEntry, error) {
+	extents, err := f.extents(in)
+	if err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	header := xfsDirHeaderV4
+	if f.v5 {
+		header = xfsDirHeaderV5
+	}
+
+	var entries []xfsDirEntry
+	read := int64(0)
+	for _, e := range extents {
+		if e.unwritten {
+			continue
+		}
+		for off := int64(0); off < e.length*f.blockSize; off += f.dirBlock {
+			if (e.logical*f.blockSize + off) >= xfsDirLeafOffset {
+				return entries, nil
+			}
+			if read += f.dirBlock; read > xfsMaxDirSize {
+				return nil, fmt.Errorf("directory larger than %d bytes", xfsMaxDirSize)
+			}
+			b := make([]byte, f.dirBlock)
+			if err := readAt(f.r, b, e.physical+off); err != nil {
+				return nil, err
+			}
+
+			end := len(b)
+			switch magic := string(b[:4]); {
+			case slices.Contains(xfsDirBlockMagics, magic):
+				// Single block directories end with their leaf entries
+				// and a tail counting them
+				end -= 8 + 8*int(be.Uint32(b[len(b)-8:]))
+			case slices.Contains(xfsDirDataMagics, magic):
+			default:
+				return nil, fmt.Errorf("invalid directory block magic %q", magic)
+			}
+			if end < header {
+				return nil, fmt.Errorf("invalid directory block")
+			}
+
+			for pos := header; pos+8 <= end; {
+				if be.Uint16(b[pos:]) == xfsDirUnusedTag {
+					length := int(be.Uint16(b[pos+2:]))
+					if length < 8 || length%8 != 0 {
+						return nil, fmt.Errorf("invalid unused directory entry")
+					}
+					pos += length
+					continue
+				}
+				nameLen := int(b[pos+8])
+				size := 8 + 1 + nameLen + 2
+				if f.ftype {
+					size++
+				}
+				size = (size + 7) &^ 7
+				if pos+size > end {
+					return nil, fmt.Errorf("directory entry past the end of its block")
+				}
+				entries = append(entries, xfsDirEntry{
+					name: string(b[pos+9 : pos+9+nameLen]),
+					ino:  be.Uint64(b[pos:]),
+				})
+				pos += size
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (f *xfsFS) content(n *node) (io.ReaderAt, error) {
+	_, in, err := f.inode(n.id)
+	if err != nil {
+		return nil, err
+	}
+	if in.format == xfsFormatLocal {
+		if n.size > int64(len(in.dataFork)) {
+			return nil, fmt.Errorf("inline data of %d bytes in a fork of %d bytes", n.size, len(in.dataFork))
+		}
+		return bytes.NewReader(in.dataFork[:n.size]), nil
+	}
+	extents, err := f.extents(in)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inode %d: %w", n.id, err)
+	}
+	data := &extentReader{r: f.r, blockSize: f.blockSize, extents: extents, size: n.size}
+	if n.mode&fs.ModeSymlink == 0 || !f.v5 {
+		return data, nil
+	}
+
+	// On v5 filesystems, each block of a symbolic link target starts with
+	// a header
+	if n.size > maxLinkSize {
+		return nil, fmt.Errorf("symbolic link target of %d bytes", n.size)
+	}
+	data.size = (n.size/(f.blockSize-xfsSymlinkHeaderV5) + 1) * f.blockSize
+	var target []byte
+	for off := int64(0); int64(len(target)) < n.size; off += f.blockSize {
+		b := make([]byte, f.blockSize)
+		if err := readAt(data, b, off); err != nil {
+			return nil, err
+		}
+		target = append(target, b[xfsSymlinkHeaderV5:]...)
+	}
+	return bytes.NewReader(target[:n.size]), nil
+}
@@ -0,0 +1,267 @@
+package guestfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// The test XFS volumes have two allocation groups of 256 4 KiB blocks.
+const (
+	xfsTestBlock     = 4096
+	xfsTestAGBlockLg = 8
+	xfsTestAGBlocks  = 1 << xfsTestAGBlockLg
+)
+
+// xfsBuilder lays out an XFS volume.
+type xfsBuilder struct {
+	img       []byte
+	v5        bool
+	inodeSize int
+	inoPerLog uint
+}
+
+func newXFSBuilder(v5 bool) *xfsBuilder {
+	b := &xfsBuilder{img: make([]byte, 2*xfsTestAGBlocks*xfsTestBlock), v5: v5, inodeSize: 256, inoPerLog: 4}
+	if v5 {
+		b.inodeSize, b.inoPerLog = 512, 3
+	}
+	be := binary.BigEndian
+	sb := b.img
+	copy(sb, xfsMagic)
+	be.PutUint32(sb[4:], xfsTestBlock)
+	be.PutUint64(sb[8:], 2*xfsTestAGBlocks)
+	be.PutUint64(sb[56:], b.ino(0, 4, 0))
+	be.PutUint32(sb[84:], xfsTestAGBlocks)
+	be.PutUint32(sb[88:], 2)
+	be.PutUint16(sb[104:], uint16(b.inodeSize))
+	sb[123], sb[124] = byte(b.inoPerLog), xfsTestAGBlockLg
+	be.PutUint16(sb[100:], 4)
+	if v5 {
+		be.PutUint16(sb[100:], 5)
+		be.PutUint32(sb[216:], xfsIncompatFType)
+	}
+	return b
+}
+
+// ino returns the number of inode index in block of allocation group ag.
+func (b *xfsBuilder) ino(ag, block, index uint64) uint64 {
+	return ag<<(xfsTestAGBlockLg+b.inoPerLog) | block<<b.inoPerLog | index
+}
+
+// fsb returns the filesystem block number of block of allocation group ag.
+func fsb(ag, block uint64) uint64 {
+	return ag<<xfsTestAGBlockLg | block
+}
+
+func (b *xfsBuilder) block(fsb uint64) []byte {
+	// Allocation groups are a power of two blocks, so they are contiguous
+	off := fsb * xfsTestBlock
+	return b.img[off : off+xfsTestBlock]
+}
+
+// inode writes an inode and returns its data fork.
+func (b *xfsBuilder) inode(ino uint64, mode uint16, format byte, size int) []byte {
+	be := binary.BigEndian
+	block := b.block(ino >> b.inoPerLog)
+	raw := block[int(ino&(1<<b.inoPerLog-1))*b.inodeSize:][:b.inodeSize]
+	copy(raw, xfsInodeMagic)
+	be.PutUint16(raw[2:], mode)
+	raw[4], raw[5] = 2, format
+	be.PutUint32(raw[40:], 1700000000)
+	be.PutUint64(raw[56:], uint64(size))
+	if b.v5 {
+		raw[4] = 3
+		return raw[xfsInodeCoreSizeV3:]
+	}
+	return raw[xfsInodeCoreSizeV2:]
+}
+
+// extents writes packed extent records, of file offset, block and length
+// triples, for an inode in the extents format.
+func (b *xfsBuilder) extents(ino uint64, dst []byte, exts [][3]uint64) {
+	be := binary.BigEndian
+	for i, e := range exts {
+		be.PutUint64(dst[16*i:], e[0]<<9|e[1]>>43)
+		be.PutUint64(dst[16*i+8:], e[1]<<21|e[2])
+	}
+	raw := b.block(ino >> b.inoPerLog)[int(ino&(1<<b.inoPerLog-1))*b.inodeSize:]
+	be.PutUint32(raw[76:], uint32(len(exts)))
+}
+
+type xfsTestEntry struct {
+	name  string
+	ino   uint64
+	ftype byte
+}
+
+// shortformDir encodes a directory stored in its inode.
+func (b *xfsBuilder) shortformDir(parent uint64, entries []xfsTestEntry) []byte {
+	be := binary.BigEndian
+	d := []byte{byte(len(entries)), 0, 0, 0, 0, 0}
+	be.PutUint32(d[2:], uint32(parent))
+	for _, e := range entries {
+		d = append(d, byte(len(e.name)), 0, 0)
+		d = append(d, e.name...)
+		if b.v5 {
+			d = append(d, e.ftype)
+		}
+		d = be.AppendUint32(d, uint32(e.ino))
+	}
+	return d
+}
+
+// dirBlock encodes a directory data block, in the single block format,
+// ending with leaf entries, if single is set.
+func (b *xfsBuilder) dirBlock(entries []xfsTestEntry, single bool) []byte {
+	be := binary.BigEndian
+	d := make([]byte, xfsTestBlock)
+	magic, pos := "XD2D", xfsDirHeaderV4
+	if single {
+		magic = "XD2B"
+	}
+	if b.v5 {
+		magic, pos = map[bool]string{false: "XDD3", true: "XDB3"}[single], xfsDirHeaderV5
+	}
+	copy(d, magic)
+	end := len(d)
+	if single {
+		// Leaf entries and tail, with made up hashes
+		end -= 8 + 8*len(entries)
+		be.PutUint32(d[len(d)-8:], uint32(len(entries)))
+	}
+	for _, e := range entries {
+		be.PutUint64(d[pos:], e.ino)
+		d[pos+8] = byte(len(e.name))
+		copy(d[pos+9:], e.name)
+		size := 8 + 1 + len(e.name) + 2
+		if b.v5 {
+			d[pos+9+len(e.name)] = e.ftype
+			size++
+		}
+		size = (size + 7) &^ 7
+		be.PutUint16(d[pos+size-2:], uint16(pos))
+		pos += size
+	}
+	// The free space is an unused entry
+	be.PutUint16(d[pos:], xfsDirUnusedTag)
+	be.PutUint16(d[pos+2:], uint16(end-pos))
+	return d
+}
+
+// xfsImage builds an XFS volume with:
+//
+//	/bin -> usr/bin             local symbolic link
+//	/etc/os-release -> ../usr/lib/os-release
+//	/usr/                       single block directory
+//	/usr/bin/                   leaf directory of two data blocks
+//	/usr/bin/bash               extents, over both allocation groups
+//	/usr/bin/sh -> bash
+//	/usr/lib/os-release         btree
+//	/usr/lib/link -> ././.../os-release, a remote symbolic link
+func xfsImage(v5 bool, bash, osRelease, linkTarget string) []byte {
+	b := newXFSBuilder(v5)
+	be := binary.BigEndian
+	const (
+		dirMode  = 0o040755
+		fileMode = 0o100755
+		linkMode = 0o120777
+	)
+	var (
+		root, etc, usr, usrBin, usrLib = b.ino(0, 4, 0), b.ino(0, 4, 1), b.ino(0, 4, 2), b.ino(0, 4, 3), b.ino(0, 4, 4)
+		bin, osRel, bashIno, sh, link  = b.ino(0, 5, 0), b.ino(0, 5, 1), b.ino(1, 4, 0), b.ino(1, 4, 1), b.ino(1, 4, 2)
+	)
+
+	rootDir := b.shortformDir(root, []xfsTestEntry{{"bin", bin, 7}, {"etc", etc, 2}, {"usr", usr, 2}})
+	copy(b.inode(root, dirMode, xfsFormatLocal, len(rootDir)), rootDir)
+	etcDir := b.shortformDir(root, []xfsTestEntry{{"os-release", b.ino(0, 5, 2), 7}})
+	copy(b.inode(etc, dirMode, xfsFormatLocal, len(etcDir)), etcDir)
+	target := "../usr/lib/os-release"
+	copy(b.inode(b.ino(0, 5, 2), linkMode, xfsFormatLocal, len(target)), target)
+	copy(b.inode(bin, linkMode, xfsFormatLocal, len("usr/bin")), "usr/bin")
+
+	copy(b.block(fsb(0, 20)), b.dirBlock([]xfsTestEntry{{".", usr, 2}, {"..", root, 2}, {"bin", usrBin, 2}, {"lib", usrLib, 2}}, true))
+	b.extents(usr, b.inode(usr, dirMode, xfsFormatExtents, xfsTestBlock), [][3]uint64{{0, fsb(0, 20), 1}})
+
+	// Two data blocks, and a leaf block that is not a data block
+	copy(b.block(fsb(0, 21)), b.dirBlock([]xfsTestEntry{{".", usrBin, 2}, {"..", usr, 2}, {"bash", bashIno, 1}}, false))
+	copy(b.block(fsb(0, 22)), b.dirBlock([]xfsTestEntry{{"sh", sh, 7}}, false))
+	copy(b.block(fsb(0, 23)), "leaf")
+	b.extents(usrBin, b.inode(usrBin, dirMode, xfsFormatExtents, 2*xfsTestBlock),
+		[][3]uint64{{0, fsb(0, 21), 2}, {xfsDirLeafOffset / xfsTestBlock, fsb(0, 23), 1}})
+
+	copy(b.block(fsb(0, 24)), b.dirBlock([]xfsTestEntry{{".", usrLib, 2}, {"..", usr, 2}, {"os-release", osRel, 1}, {"link", link, 7}}, true))
+	b.extents(usrLib, b.inode(usrLib, dirMode, xfsFormatExtents, xfsTestBlock), [][3]uint64{{0, fsb(0, 24), 1}})
+
+	// bash: its first block in group 1, a hole, then the rest in group 0
+	copy(b.block(fsb(1, 30)), bash[:xfsTestBlock])
+	copy(b.block(fsb(0, 40)), bash[2*xfsTestBlock:])
+	copy(b.block(fsb(0, 41)), bash[3*xfsTestBlock:])
+	b.extents(bashIno, b.inode(bashIno, fileMode, xfsFormatExtents, len(bash)),
+		[][3]uint64{{0, fsb(1, 30), 1}, {2, fsb(0, 40), 2}})
+	copy(b.inode(sh, linkMode, xfsFormatLocal, len("bash")), "bash")
+
+	// os-release: a btree whose root, in the inode, points to a leaf
+	fork := b.inode(osRel, 0o100644, xfsFormatBtree, len(osRelease))
+	maxRecs := (len(fork) - 4) / 16
+	be.PutUint16(fork[0:], 1)
+	be.PutUint16(fork[2:], 1)
+	be.PutUint64(fork[4+8*maxRecs:], fsb(1, 50))
+	leaf, header := b.block(fsb(1, 50)), xfsBtreeHeaderV4
+	copy(leaf, "BMAP")
+	if v5 {
+		copy(leaf, "BMA3")
+		header = xfsBtreeHeaderV5
+	}
+	be.PutUint16(leaf[6:], 1)
+	b.extents(osRel, leaf[header:], [][3]uint64{{0, fsb(1, 51), 1}})
+	copy(b.block(fsb(1, 51)), osRelease)
+
+	// The remote link target, after a header on v5
+	linkBlock := b.block(fsb(1, 60))
+	if v5 {
+		copy(linkBlock, "XSLM")
+		linkBlock = linkBlock[xfsSymlinkHeaderV5:]
+	}
+	copy(linkBlock, linkTarget)
+	b.extents(link, b.inode(link, linkMode, xfsFormatExtents, len(linkTarget)), [][3]uint64{{0, fsb(1, 60), 1}})
+	return b.img
+}
+
+func TestXFS(t *testing.T) {
+	bash := string(bytes.Repeat([]byte("\x7fELF bash "), 1500))
+	osRelease := "NAME=\"openSUSE Leap\"\nVERSION_ID=\"15.6\"\n"
+	linkTarget := strings.Repeat("./", 200) + "os-release"
+	// The hole between the first and third blocks of bash reads as zeros
+	wantBash := bash[:xfsTestBlock] + string(make([]byte, xfsTestBlock)) + bash[2*xfsTestBlock:]
+
+	for _, v5 := range []bool{false, true} {
+		img := xfsImage(v5, bash, osRelease, linkTarget)
+		fsys, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("v5 %t: Open() failed: %v", v5, err)
+		}
+		for name, want := range map[string]string{
+			"usr/bin/bash":       wantBash,
+			"bin/sh":             wantBash,
+			"usr/lib/os-release": osRelease,
+			"etc/os-release":     osRelease,
+			"usr/lib/link":       osRelease,
+		} {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil || string(got) != want {
+				t.Errorf("v5 %t: ReadFile(%s) = %d bytes, %v, want %d bytes", v5, name, len(got), err, len(want))
+			}
+		}
+
+		entries, err := fs.ReadDir(fsys, "usr/bin")
+		if err != nil || len(entries) != 2 || entries[0].Name() != "bash" || entries[1].Type() != fs.ModeSymlink {
+			t.Errorf("v5 %t: ReadDir(usr/bin) = %v, %v", v5, entries, err)
+		}
+		if _, err := fs.Stat(fsys, "usr/BIN"); err == nil {
+			t.Errorf("v5 %t: names matched case-insensitively", v5)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Package guid handles the GUIDs found in on-disk structures such as GPT
+// partition tables and VHDX metadata, which store them in the mixed-endian
+// layout of Microsoft GUIDs.
+package guid
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a GUID in its on-disk byte order: the first three fields are
+// little-endian, the last two are stored as is.
+type GUID [16]byte
+
+// Parse parses the textual form of a GUID, e.g.
+// "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", into its on-disk byte order.
+func Parse(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID '%s'", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID '%s': %w", s, err)
+	}
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParse is like Parse but panics on invalid input. It's meant for
+// well-known GUIDs declared as package variables.
+func MustParse(s string) GUID {
+	g, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// FromBytes returns the GUID stored at the start of b.
+func FromBytes(b []byte) GUID {
+	var g GUID
+	copy(g[:], b)
+	return g
+}
+
+// IsZero reports whether g is the all-zero GUID.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// String returns the textual form of g.
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]), binary.LittleEndian.Uint16(g[6:]), g[8:10], g[10:])
+}
@@ -0,0 +1,30 @@
+package guid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	const esp = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	g, err := Parse(esp)
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	onDisk := []byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}
+	if !bytes.Equal(g[:], onDisk) {
+		t.Errorf("Parse() = % X, want % X", g[:], onDisk)
+	}
+	if g != FromBytes(onDisk) || g.String() != esp {
+		t.Errorf("round trip gave %s", FromBytes(onDisk))
+	}
+	if lower, err := Parse("c12a7328-f81f-11d2-ba4b-00a0c93ec93b"); err != nil || lower != g {
+		t.Errorf("Parse() of lower case = %s, %v", lower, err)
+	}
+
+	for _, invalid := range []string{"", "C12A7328F81F11D2BA4B00A0C93EC93B", "C12A7328-F81F-11D2-BA4B-00A0C93EC93", "G12A7328-F81F-11D2-BA4B-00A0C93EC93B"} {
+		if _, err := Parse(invalid); err == nil {
+			t.Errorf("Parse(%q) succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// qcow2 features affecting how guest data is read
+const (
+	qcow2IncompatDataFile   = 1 << 2
+	qcow2IncompatExtendedL2 = 1 << 4
+
+	qcow2L1OffsetMask   = 0x00fffffffffffe00
+	qcow2L2OffsetMask   = 0x00fffffffffffe00
+	qcow2L2Compressed   = 1 << 62
+	qcow2L2Zero         = 1 << 0
+	qcow2Subclusters    = 32
+	qcow2CompressedUnit = 512
+
+	// maxCachedTables bounds the L2 tables kept in memory per image
+	maxCachedTables = 64
+)
+
+// Disk is the content of a disk image as the guest sees it. It reads raw
+// and qcow2 images, following qcow2 backing chains.
+type Disk struct {
+	info *Info
+	file *os.File
+	data io.ReaderAt
+	// backing is the image a qcow2 image is backed by, if any
+	backing *Disk
+}
+
+// Open opens the image at path for reading its content.
+func Open(path string) (*Disk, error) {
+	return openDisk(path, "", 0)
+}
+
+// openDisk opens the image at path, of the given format ("" to detect it),
+// as the depth-th image of a backing chain.
+func openDisk(path, format string, depth int) (*Disk, error) {
+	if depth >= MaxChainLength {
+		return nil, fmt.Errorf("backing chain of '%s' is longer than %d images", path, MaxChainLength)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatRaw {
+		info = &Info{Path: path, Format: FormatRaw, VirtualSize: info.FileSize, FileSize: info.FileSize}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Disk{info: info, file: f}
+	switch info.Format {
+	case FormatRaw:
+		d.data = f
+	case FormatQcow2:
+		q, err := newQcow2Reader(f, info)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot read qcow2 image '%s': %w", path, err)
+		}
+		d.data = q
+		if info.BackingFile != "" {
+			if d.backing, err = openDisk(info.BackingPath(), info.BackingFormat, depth+1); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to open the backing file of '%s': %w", path, err)
+			}
+			q.backing = d.backing
+		}
+	default:
+		f.Close()
+		return nil, fmt.Errorf("reading the content of %s images is not supported", info.Format)
+	}
+	return d, nil
+}
+
+// Info returns the description of the image.
+func (d *Disk) Info() *Info {
+	return d.info
+}
+
+// Size returns the size of the disk seen by the guest.
+func (d *Disk) Size() int64 {
+	return d.info.VirtualSize
+}
+
+// ReadAt reads the disk content at off. Reads past the end of the disk
+// return io.EOF.
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= d.Size() {
+		return 0, io.EOF
+	}
+	var err error
+	if remaining := d.Size() - off; int64(len(p)) > remaining {
+		p, err = p[:remaining], io.EOF
+	}
+	if rerr := readFull(d.data, p, off); rerr != nil {
+		return 0, rerr
+	}
+	return len(p), err
+}
+
+// Close closes the image and its backing images.
+func (d *Disk) Close() error {
+	if d.backing != nil {
+		d.backing.Close()
+	}
+	return d.file.Close()
+}
+
+// readFull reads len(p) bytes at off from r, treating data missing at the
+// end of r, such as the end of a raw backing file shorter than its overlay,
+// as zeros.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if err == io.EOF {
+		clear(p[n:])
+		return nil
+	}
+	return err
+}
+
+// qcow2Reader reads the guest data of a qcow2 image.
+type qcow2Reader struct {
+	f           io.ReaderAt
+	clusterBits uint
+	clusterSize int64
+	l2Entries   int64
+	extendedL2  bool
+	l1          []uint64
+	l2Cache     map[int64][]byte
+	backing     io.ReaderAt
+
+	// The last compressed cluster read, decompressed
+	compressedOffset int64
+	compressed       []byte
+}
+
+func newQcow2Reader(f io.ReaderAt, info *Info) (*qcow2Reader, error) {
+	h := make([]byte, qcow2V3HeaderSize+1)
+	if err := readAt(f, h[:qcow2V2HeaderSize], 0); err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	if info.Encrypted {
+		return nil, fmt.Errorf("the image is encrypted")
+	}
+	if info.Version == 3 {
+		if err := readAt(f, h[qcow2V2HeaderSize:qcow2V3HeaderSize], qcow2V2HeaderSize); err != nil {
+			return nil, err
+		}
+	}
+	incompatible := be.Uint64(h[72:])
+	if incompatible&qcow2IncompatDataFile != 0 {
+		return nil, fmt.Errorf("external data files are not supported")
+	}
+	if info.Version == 3 && be.Uint32(h[100:]) > qcow2V3HeaderSize {
+		if err := readAt(f, h[qcow2V3HeaderSize:], qcow2V3HeaderSize); err != nil {
+			return nil, err
+		}
+		if h[qcow2V3HeaderSize] != 0 {
+			return nil, fmt.Errorf("only zlib compression is supported")
+		}
+	}
+
+	q := &qcow2Reader{
+		f:                f,
+		clusterBits:      uint(be.Uint32(h[20:])),
+		clusterSize:      info.ClusterSize,
+		extendedL2:       incompatible&qcow2IncompatExtendedL2 != 0,
+		l2Cache:          map[int64][]byte{},
+		compressedOffset: -1,
+	}
+	entrySize := int64(8)
+	if q.extendedL2 {
+		entrySize = 16
+	}
+	q.l2Entries = q.clusterSize / entrySize
+
+	// The L1 table must cover the virtual size
+	if info.VirtualSize < 0 {
+		return nil, fmt.Errorf("invalid virtual size %d", uint64(info.VirtualSize))
+	}
+	l1Size := int64(be.Uint32(h[36:]))
+	span := q.clusterSize * q.l2Entries
+	need := info.VirtualSize / span
+	if info.VirtualSize%span != 0 {
+		need++
+	}
+	if l1Size < need {
+		return nil, fmt.Errorf("L1 table too small (%d entries, need %d)", l1Size, need)
+	}
+	if l1Size > 32<<20/8 {
+		return nil, fmt.Errorf("L1 table too large (%d entries)", l1Size)
+	}
+	raw := make([]byte, 8*l1Size)
+	if err := readAt(f, raw, int64(be.Uint64(h[40:]))); err != nil {
+		return nil, fmt.Errorf("failed to read the L1 table: %w", err)
+	}
+	q.l1 = make([]uint64, l1Size)
+	for i := range q.l1 {
+		q.l1[i] = be.Uint64(raw[8*i:])
+	}
+	return q, nil
+}
+
+// ReadAt reads guest data, one cluster at a time.
+func (q *qcow2Reader) ReadAt(p []byte, off int64) (int, error) {
+	done := 0
+	for done < len(p) {
+		inCluster := (off + int64(done)) & (q.clusterSize - 1)
+		n := min(int64(len(p)-done), q.clusterSize-inCluster)
+		if err := q.readCluster(p[done:done+int(n)], off+int64(done)); err != nil {
+			return done, err
+		}
+		done += int(n)
+	}
+	return done, nil
+}
+
+// readCluster reads p, which lies within a single cluster, at off.
+func (q *qcow2Reader) readCluster(p []byte, off int64) error {
+	inCluster := off & (q.clusterSize - 1)
+	l1Index := (off >> q.clusterBits) / q.l2Entries
+	l2Index := (off >> q.clusterBits) % q.l2Entries
+	if uint64(l1Index) >= uint64(len(q.l1)) {
+		return fmt.Errorf("offset %d is outside the L1 table", off)
+	}
+
+	l2Offset := int64(q.l1[l1Index] & qcow2L1OffsetMask)
+	if l2Offset == 0 {
+		return q.readBacking(p, off)
+	}
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return err
+	}
+	be := binary.BigEndian
+	var entry, bitmap uint64
+	if q.extendedL2 {
+		entry, bitmap = be.Uint64(table[16*l2Index:]), be.Uint64(table[16*l2Index+8:])
+	} else {
+		entry = be.Uint64(table[8*l2Index:])
+	}
+
+	if entry&qcow2L2Compressed != 0 {
+		data, err := q.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+		return nil
+	}
+
+	host := int64(entry & qcow2L2OffsetMask)
+	if !q.extendedL2 {
+		switch {
+		case entry&qcow2L2Zero != 0:
+			clear(p)
+			return nil
+		case host == 0:
+			return q.readBacking(p, off)
+		}
+		return readAt(q.f, p, host+inCluster)
+	}
+
+	// With extended L2 entries, each subcluster is allocated, zero or
+	// unallocated on its own
+	subSize := q.clusterSize / qcow2Subclusters
+	for len(p) > 0 {
+		sub := inCluster / subSize
+		n := min(int64(len(p)), subSize-inCluster%subSize)
+		var err error
+		switch {
+		case bitmap&(1<<sub) != 0:
+			err = readAt(q.f, p[:n], host+inCluster)
+		case bitmap&(1<<(sub+32)) != 0:
+			clear(p[:n])
+		default:
+			err = q.readBacking(p[:n], off)
+		}
+		if err != nil {
+			return err
+		}
+		p, off, inCluster = p[n:], off+n, inCluster+n
+	}
+	return nil
+}
+
+// readBacking reads unallocated data, which comes from the backing image or
+// reads as zeros.
+func (q *qcow2Reader) readBacking(p []byte, off int64) error {
+	if q.backing == nil {
+		clear(p)
+		return nil
+	}
+	return readFull(q.backing, p, off)
+}
+
+// l2Table returns the L2 table at off.
+func (q *qcow2Reader) l2Table(off int64) ([]byte, error) {
+	if table, ok := q.l2Cache[off]; ok {
+		return table, nil
+	}
+	table := make([]byte, q.clusterSize)
+	if err := readAt(q.f, table, off); err != nil {
+		return nil, fmt.Errorf("failed to read an L2 table: %w", err)
+	}
+	if len(q.l2Cache) >= maxCachedTables {
+		clear(q.l2Cache)
+	}
+	q.l2Cache[off] = table
+	return table, nil
+}
+
+// decompress returns the content of the compressed cluster described by an
+// L2 entry.
+func (q *qcow2Reader) decompress(entry uint64) ([]byte, error) {
+	// The entry holds the host offset in its low x bits, followed by the
+	// number of additional 512-byte sectors the compressed data spans
+	x := 62 - (q.clusterBits - 8)
+	host := int64(entry & (1<<x - 1))
+	sectors := int64(entry>>x) & (1<<(q.clusterBits-8) - 1)
+	if host == q.compressedOffset {
+		return q.compressed, nil
+	}
+
+	size := (sectors+1)*qcow2CompressedUnit - host%qcow2CompressedUnit
+	compressed := make([]byte, size)
+	// The compressed data may end before the last sector it is said to span
+	if err := readFull(q.f, compressed, host); err != nil {
+		return nil, err
+	}
+	data := make([]byte, q.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed)), data); err != nil {
+		return nil, fmt.Errorf("failed to decompress a cluster: %w", err)
+	}
+	q.compressedOffset, q.compressed = host, data
+	return data, nil
+}
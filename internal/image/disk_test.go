@@ -0,0 +1,193 @@
+package image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// Guest cluster kinds of the test qcow2 images
+const (
+	clusterData = iota
+	clusterZero
+	clusterCompressed
+	clusterUnallocated
+	clusterSubclusters // Extended L2 only: half data, half from the backing file
+)
+
+// testClusterBits makes the test qcow2 images use 512-byte clusters.
+const testClusterBits = 9
+
+// clusterContent is the guest data of allocated cluster i.
+func clusterContent(i int) []byte {
+	return bytes.Repeat([]byte{byte('A' + i)}, 1<<testClusterBits)
+}
+
+// qcow2DiskImage builds a qcow2 v3 image whose guest clusters are of the
+// given kinds, optionally with extended L2 entries and a backing file.
+func qcow2DiskImage(t *testing.T, kinds []int, extended bool, backing string) []byte {
+	t.Helper()
+	const cs = 1 << testClusterBits
+	be := binary.BigEndian
+	entrySize := 8
+	if extended {
+		entrySize = 16
+	}
+	if len(kinds) > cs/entrySize {
+		t.Fatal("too many clusters for a single L2 table")
+	}
+
+	// Cluster 0: header, 1: L1 table, 2: L2 table, 3...: data
+	img := make([]byte, 3*cs)
+	copy(img, "QFI\xfb")
+	be.PutUint32(img[4:], 3)
+	be.PutUint32(img[20:], testClusterBits)
+	be.PutUint64(img[24:], uint64(len(kinds)*cs))
+	be.PutUint32(img[36:], 1)
+	be.PutUint64(img[40:], cs)
+	if extended {
+		be.PutUint64(img[72:], qcow2IncompatExtendedL2)
+	}
+	be.PutUint32(img[96:], 4)
+	be.PutUint32(img[100:], qcow2V3HeaderSize)
+	if backing != "" {
+		off := qcow2V3HeaderSize + 8
+		be.PutUint64(img[8:], uint64(off))
+		be.PutUint32(img[16:], uint32(len(backing)))
+		copy(img[off:], backing)
+	}
+	be.PutUint64(img[cs:], 2*cs)
+
+	for i, kind := range kinds {
+		var entry, bitmap uint64
+		switch kind {
+		case clusterData, clusterSubclusters:
+			// Data clusters are aligned, unlike compressed data
+			img = append(img, make([]byte, (cs-len(img)%cs)%cs)...)
+			entry = uint64(len(img))
+			img = append(img, clusterContent(i)...)
+			bitmap = 0xffffffff
+			if kind == clusterSubclusters {
+				bitmap = 0x0000ffff
+			}
+		case clusterZero:
+			entry = qcow2L2Zero
+			bitmap = 0xffffffff << 32
+		case clusterCompressed:
+			var buf bytes.Buffer
+			w, _ := flate.NewWriter(&buf, flate.BestCompression)
+			w.Write(clusterContent(i))
+			w.Close()
+			// The host offset takes x = 62 - (clusterBits - 8) bits, followed
+			// by the number of additional sectors spanned
+			host, end := len(img), len(img)+buf.Len()
+			entry = qcow2L2Compressed | uint64(host) | uint64((end-1)/512-host/512)<<(62-(testClusterBits-8))
+			img = append(img, buf.Bytes()...)
+		}
+		be.PutUint64(img[2*cs+entrySize*i:], entry)
+		if extended && kind != clusterCompressed {
+			be.PutUint64(img[2*cs+entrySize*i+8:], bitmap)
+		}
+	}
+	return img
+}
+
+func TestDiskQcow2(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		dir := t.TempDir()
+		backing := bytes.Repeat([]byte{'b'}, 4<<testClusterBits)
+		writeImage(t, dir, "base.raw", backing)
+		kinds := []int{clusterData, clusterZero, clusterCompressed, clusterUnallocated, clusterData}
+		if extended {
+			kinds = append(kinds, clusterSubclusters)
+		}
+		path := writeImage(t, dir, "disk.qcow2", qcow2DiskImage(t, kinds, extended, "base.raw"))
+
+		d, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open() failed: %v", err)
+		}
+		defer d.Close()
+		if d.Size() != int64(len(kinds))<<testClusterBits {
+			t.Errorf("Size() = %d", d.Size())
+		}
+
+		// Read across all clusters at an unaligned offset
+		got := make([]byte, d.Size()-100)
+		if n, err := d.ReadAt(got, 100); n != len(got) || err != nil {
+			t.Fatalf("ReadAt() = %d, %v", n, err)
+		}
+		var want []byte
+		for i, kind := range kinds {
+			switch kind {
+			case clusterData, clusterCompressed:
+				want = append(want, clusterContent(i)...)
+			case clusterZero:
+				want = append(want, make([]byte, 1<<testClusterBits)...)
+			case clusterUnallocated:
+				want = append(want, backing[i<<testClusterBits:(i+1)<<testClusterBits]...)
+			case clusterSubclusters:
+				// The backing file is shorter than the overlay, so the
+				// unallocated half reads as zeros
+				half := 1 << testClusterBits / 2
+				want = append(want, clusterContent(i)[:half]...)
+				want = append(want, make([]byte, half)...)
+			}
+		}
+		for i := range got {
+			if got[i] != want[100+i] {
+				t.Errorf("extended L2 %t: ReadAt() differs at guest offset %d: %q, want %q", extended, 100+i, got[i], want[100+i])
+				break
+			}
+		}
+
+		if n, err := d.ReadAt(make([]byte, 10), d.Size()-4); n != 4 || err != io.EOF {
+			t.Errorf("ReadAt() past the end = %d, %v, want 4, EOF", n, err)
+		}
+	}
+}
+
+func TestDiskQcow2HugeVirtualSize(t *testing.T) {
+	// A single L1 entry cannot cover such a disk; computing the entries
+	// needed must not overflow and let the image through
+	img := qcow2DiskImage(t, []int{clusterData}, false, "")
+	binary.BigEndian.PutUint32(img[20:], 16)
+	binary.BigEndian.PutUint64(img[24:], 0x7fffffffffff0000)
+	path := writeImage(t, t.TempDir(), "disk.qcow2", img)
+
+	d, err := Open(path)
+	if err == nil {
+		defer d.Close()
+		_, err = d.ReadAt(make([]byte, 512), d.Size()-512)
+	}
+	if err == nil {
+		t.Error("a 1-entry L1 table was accepted for an 8 EiB disk")
+	}
+}
+
+func TestDiskRaw(t *testing.T) {
+	path := writeImage(t, t.TempDir(), "disk.img", []byte("raw disk content"))
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer d.Close()
+
+	buf := make([]byte, 7)
+	if _, err := d.ReadAt(buf, 4); err != nil || string(buf) != "disk co" {
+		t.Errorf("ReadAt() = %q, %v", buf, err)
+	}
+}
+
+func TestDiskUnsupported(t *testing.T) {
+	path := writeImage(t, t.TempDir(), "disk.vmdk", vmdkSparseImage(2048, "", false))
+	if _, err := Open(path); err == nil {
+		t.Error("Open() accepted a VMDK image")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.qcow2")); err == nil {
+		t.Error("Open() accepted a missing image")
+	}
+}
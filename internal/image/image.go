@@ -0,0 +1,229 @@
+// Package image inspects disk image files without qemu-img.
+//
+// It reads the headers of qcow2 (versions 2 and 3), VMDK, VHDX and VDI images
+// and reports their format, virtual size, cluster size, backing file,
+// internal snapshots and dirty or corrupt state. Files without a known header
+// are raw images. A few more formats QEMU supports are recognized by their
+// signature only, so that they are never mistaken for raw images.
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Image formats, named after the QEMU block drivers reading them
+const (
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+	FormatVMDK  = "vmdk"
+	FormatVHDX  = "vhdx"
+	FormatVDI   = "vdi"
+)
+
+// MaxChainLength bounds the backing chains followed by Chain.
+const MaxChainLength = 64
+
+// probeSize is the amount of data read to recognize a format.
+const probeSize = 512
+
+// ErrTruncated is returned when a header is cut short or points past the
+// end of the image.
+var ErrTruncated = errors.New("image is truncated")
+
+// Info describes a disk image.
+type Info struct {
+	Path   string
+	Format string
+	// Version is the version of the format, when it has several (qcow2, VMDK,
+	// VHDX, VDI)
+	Version int
+	// VirtualSize is the size of the disk seen by the guest, in bytes
+	VirtualSize int64
+	// FileSize is the size of the image on the host, in bytes
+	FileSize int64
+	// ClusterSize is the allocation unit of the format, in bytes (0 if it
+	// has none)
+	ClusterSize int64
+	// BackingFile is the image this one is an overlay of, as recorded in the
+	// image, i.e. possibly relative to its directory
+	BackingFile   string
+	BackingFormat string
+	Snapshots     []Snapshot
+	// Dirty reports an image that was not closed cleanly, e.g. with
+	// unflushed metadata or an unreplayed log
+	Dirty bool
+	// Corrupt reports an image its writer marked as corrupt
+	Corrupt   bool
+	Encrypted bool
+}
+
+// Snapshot is an internal snapshot of a qcow2 image.
+type Snapshot struct {
+	ID          string
+	Name        string
+	Date        time.Time
+	VMClock     time.Duration
+	VMStateSize int64
+}
+
+// BackingPath returns the backing file of the image resolved against the
+// image's directory, or "" if it has none.
+func (i *Info) BackingPath() string {
+	if i.BackingFile == "" || filepath.IsAbs(i.BackingFile) {
+		return i.BackingFile
+	}
+	return filepath.Join(filepath.Dir(i.Path), i.BackingFile)
+}
+
+// formatSignatures recognizes the formats QEMU supports beyond the ones
+// inspected here by the magic at the start of the image.
+var formatSignatures = []struct {
+	format string
+	magic  []byte
+}{
+	{"qcow", []byte("QFI\xfb\x00\x00\x00\x01")},
+	{"qed", []byte("QED\x00")},
+	{"vpc", []byte("conectix")},
+	{"luks", []byte("LUKS\xba\xbe")},
+	{"parallels", []byte("WithoutFreeSpace")},
+	{"parallels", []byte("WithouFreSpacExt")},
+	{"bochs", []byte("Bochs Virtual HD Image")},
+	{"cloop", []byte("#!/bin/sh\n#V2.0 Format")},
+}
+
+// Inspect reads the header of the image at path.
+func Inspect(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	head, err := readHead(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+
+	var info *Info
+	switch format := formatOf(head); format {
+	case FormatQcow2:
+		info, err = inspectQcow2(f, size)
+	case FormatVMDK:
+		info, err = inspectVMDK(f, size, head)
+	case FormatVHDX:
+		info, err = inspectVHDX(f)
+	case FormatVDI:
+		info, err = inspectVDI(f)
+	case FormatRaw:
+		info = &Info{Format: format, VirtualSize: size}
+	default:
+		info = &Info{Format: format}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s image '%s': %w", info.Format, path, err)
+	}
+	info.Path = path
+	info.FileSize = size
+	return info, nil
+}
+
+// DetectFormat returns the format of the image at path. Unlike Inspect, it
+// only looks at the signature of the format, so it succeeds for images with
+// an invalid header too, leaving QEMU to report the problem precisely.
+func DetectFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head, err := readHead(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	return formatOf(head), nil
+}
+
+// readHead reads the start of an image, used to recognize its format.
+func readHead(r io.ReaderAt) ([]byte, error) {
+	head := make([]byte, probeSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// formatOf recognizes the format of an image by its start.
+func formatOf(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, qcow2Magic) && len(head) >= 8 && head[7] >= 2:
+		return FormatQcow2
+	case bytes.HasPrefix(head, vmdkMagic), bytes.HasPrefix(head, vmdkDescriptorMagic):
+		return FormatVMDK
+	case bytes.HasPrefix(head, vhdxMagic):
+		return FormatVHDX
+	case len(head) >= vdiSignatureOffset+4 && bytes.Equal(head[vdiSignatureOffset:vdiSignatureOffset+4], vdiSignature):
+		return FormatVDI
+	}
+	for _, sig := range formatSignatures {
+		if bytes.HasPrefix(head, sig.magic) {
+			return sig.format
+		}
+	}
+	return FormatRaw
+}
+
+// Chain inspects the image at path and the images it is backed by, in that
+// order.
+func Chain(path string) ([]*Info, error) {
+	var chain []*Info
+	seen := map[string]bool{}
+	for path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return chain, err
+		}
+		if seen[abs] {
+			return chain, fmt.Errorf("backing chain of '%s' loops back to '%s'", chain[0].Path, path)
+		}
+		if len(chain) == MaxChainLength {
+			return chain, fmt.Errorf("backing chain of '%s' is longer than %d images", chain[0].Path, MaxChainLength)
+		}
+		seen[abs] = true
+
+		info, err := Inspect(path)
+		if err != nil {
+			return chain, err
+		}
+		chain = append(chain, info)
+		path = info.BackingPath()
+	}
+	return chain, nil
+}
+
+// readAt reads exactly len(buf) bytes at off, reporting short reads as
+// ErrTruncated.
+func readAt(r io.ReaderAt, buf []byte, off int64) error {
+	if off < 0 {
+		return ErrTruncated
+	}
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return ErrTruncated
+	}
+	return err
+}
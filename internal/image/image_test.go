@@ -0,0 +1,346 @@
+package image
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+)
+
+const gib = 1 << 30
+
+// writeImage writes data to a file in dir and returns its path.
+func writeImage(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// qcow2Image builds a qcow2 v3 image with 64 KiB clusters, an optional
+// backing file and the given snapshots.
+func qcow2Image(size uint64, backing, backingFormat string, incompatible uint64, snapshots []Snapshot) []byte {
+	be := binary.BigEndian
+	img := make([]byte, 3*65536)
+	copy(img, "QFI\xfb")
+	be.PutUint32(img[4:], 3)
+	be.PutUint32(img[20:], 16)
+	be.PutUint64(img[24:], size)
+	be.PutUint64(img[72:], incompatible)
+	be.PutUint32(img[96:], 4)
+	be.PutUint32(img[100:], qcow2V3HeaderSize)
+
+	off := qcow2V3HeaderSize
+	if backingFormat != "" {
+		be.PutUint32(img[off:], qcow2ExtBackingFormat)
+		be.PutUint32(img[off+4:], uint32(len(backingFormat)))
+		copy(img[off+8:], backingFormat)
+		off += 8 + (len(backingFormat)+7)&^7
+	}
+	off += 8 // End of extensions
+	if backing != "" {
+		be.PutUint64(img[8:], uint64(off))
+		be.PutUint32(img[16:], uint32(len(backing)))
+		copy(img[off:], backing)
+	}
+
+	if len(snapshots) > 0 {
+		be.PutUint32(img[60:], uint32(len(snapshots)))
+		be.PutUint64(img[64:], 65536)
+		off = 65536
+		for _, s := range snapshots {
+			const extraSize = 16
+			be.PutUint16(img[off+12:], uint16(len(s.ID)))
+			be.PutUint16(img[off+14:], uint16(len(s.Name)))
+			be.PutUint32(img[off+16:], uint32(s.Date.Unix()))
+			be.PutUint64(img[off+24:], uint64(s.VMClock))
+			be.PutUint32(img[off+36:], extraSize)
+			be.PutUint64(img[off+40:], uint64(s.VMStateSize))
+			n := copy(img[off+40+extraSize:], s.ID+s.Name)
+			off += (40 + extraSize + n + 7) &^ 7
+		}
+	}
+	return img
+}
+
+func TestInspectQcow2(t *testing.T) {
+	dir := t.TempDir()
+	snapshots := []Snapshot{
+		{ID: "1", Name: "installed", Date: time.Unix(1700000000, 0), VMClock: 90 * time.Second},
+		{ID: "2", Name: "configured", Date: time.Unix(1700003600, 0), VMStateSize: 1 << 33},
+	}
+	path := writeImage(t, dir, "overlay.qcow2", qcow2Image(20*gib, "base.raw", "raw", qcow2IncompatDirty, snapshots))
+
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatalf("Inspect() failed: %v", err)
+	}
+	if info.Format != FormatQcow2 || info.Version != 3 || info.VirtualSize != 20*gib || info.ClusterSize != 65536 {
+		t.Errorf("Inspect() = %+v", info)
+	}
+	if info.BackingFile != "base.raw" || info.BackingFormat != "raw" || info.BackingPath() != filepath.Join(dir, "base.raw") {
+		t.Errorf("backing file = %q (%q), resolved to %q", info.BackingFile, info.BackingFormat, info.BackingPath())
+	}
+	if !info.Dirty || info.Corrupt || info.Encrypted {
+		t.Errorf("dirty, corrupt, encrypted = %t, %t, %t, want only dirty", info.Dirty, info.Corrupt, info.Encrypted)
+	}
+	if len(info.Snapshots) != 2 {
+		t.Fatalf("Snapshots = %+v, want 2", info.Snapshots)
+	}
+	for i, s := range info.Snapshots {
+		want := snapshots[i]
+		if s.ID != want.ID || s.Name != want.Name || !s.Date.Equal(want.Date) || s.VMClock != want.VMClock || s.VMStateSize != want.VMStateSize {
+			t.Errorf("snapshot %d = %+v, want %+v", i, s, want)
+		}
+	}
+}
+
+func TestInspectQcow2Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	img := qcow2Image(gib, "", "", 0, nil)
+	binary.BigEndian.PutUint32(img[20:], 40)
+	if _, err := Inspect(writeImage(t, dir, "clusters.qcow2", img)); err == nil {
+		t.Error("Inspect() accepted an invalid cluster size")
+	}
+
+	img = qcow2Image(gib, strings.Repeat("x", 100), "", 0, nil)
+	if _, err := Inspect(writeImage(t, dir, "truncated.qcow2", img[:120])); err == nil {
+		t.Error("Inspect() accepted a backing file name past the end of the image")
+	}
+}
+
+// vmdkSparseImage builds a monolithic sparse VMDK with an embedded descriptor.
+func vmdkSparseImage(sectors uint64, descriptor string, unclean bool) []byte {
+	le := binary.LittleEndian
+	img := make([]byte, 4096)
+	copy(img, "KDMV")
+	le.PutUint32(img[4:], 1)
+	le.PutUint64(img[12:], sectors)
+	le.PutUint64(img[20:], 128) // 64 KiB grains
+	le.PutUint64(img[28:], 1)
+	le.PutUint64(img[36:], 6)
+	if unclean {
+		img[72] = 1
+	}
+	copy(img[512:], descriptor)
+	return img
+}
+
+func TestInspectVMDK(t *testing.T) {
+	dir := t.TempDir()
+	descriptor := `# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=12345678
+createType="monolithicSparse"
+parentFileNameHint="base.vmdk"
+
+# Extent description
+RW 20971520 SPARSE "child.vmdk"
+`
+	info, err := Inspect(writeImage(t, dir, "child.vmdk", vmdkSparseImage(20971520, descriptor, true)))
+	if err != nil {
+		t.Fatalf("Inspect() failed: %v", err)
+	}
+	if info.Format != FormatVMDK || info.VirtualSize != 10*gib || info.ClusterSize != 65536 || !info.Dirty {
+		t.Errorf("Inspect() = %+v", info)
+	}
+	if info.BackingFile != "base.vmdk" || info.BackingFormat != FormatVMDK {
+		t.Errorf("backing file = %q (%q), want base.vmdk", info.BackingFile, info.BackingFormat)
+	}
+
+	// Split images have a descriptor file of their own
+	split := `# Disk DescriptorFile
+version=1
+createType="twoGbMaxExtentSparse"
+
+RW 4192256 SPARSE "disk-s001.vmdk"
+RW 4192256 SPARSE "disk-s002.vmdk"
+`
+	info, err = Inspect(writeImage(t, dir, "disk.vmdk", []byte(split)))
+	if err != nil {
+		t.Fatalf("Inspect() of a descriptor file failed: %v", err)
+	}
+	if info.Format != FormatVMDK || info.VirtualSize != 2*4192256*512 || info.BackingFile != "" {
+		t.Errorf("Inspect() of a descriptor file = %+v", info)
+	}
+}
+
+// vhdxChecksum sets the CRC-32C of a VHDX structure.
+func vhdxChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// utf16le encodes s as UTF-16LE.
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// vhdxImage builds a VHDX image with 32 MiB blocks and an optional parent.
+func vhdxImage(size uint64, parent string) []byte {
+	const metadataOffset = 1 << 20
+	le := binary.LittleEndian
+	img := make([]byte, 2<<20)
+	copy(img, "vhdxfile")
+
+	// Two headers; the second one is current
+	for i, off := range vhdxHeaderOffsets {
+		h := img[off : off+vhdxHeaderSize]
+		copy(h, "head")
+		le.PutUint64(h[8:], uint64(i+1))
+		le.PutUint16(h[66:], 1)
+		vhdxChecksum(h)
+	}
+
+	regions := img[vhdxRegionTableOffsets[0] : vhdxRegionTableOffsets[0]+vhdxRegionTableSize]
+	copy(regions, "regi")
+	le.PutUint32(regions[8:], 1)
+	copy(regions[16:], vhdxMetadataRegion[:])
+	le.PutUint64(regions[32:], metadataOffset)
+	le.PutUint32(regions[40:], 1<<20)
+	vhdxChecksum(regions)
+
+	params := make([]byte, 8)
+	le.PutUint32(params, 32<<20)
+	diskSize := make([]byte, 8)
+	le.PutUint64(diskSize, size)
+	items := []struct {
+		id   guid.GUID
+		data []byte
+	}{{vhdxFileParameters, params}, {vhdxVirtualDiskSize, diskSize}}
+
+	if parent != "" {
+		le.PutUint32(params[4:], vhdxFileParamsHasParent)
+		key, value := utf16le("relative_path"), utf16le(parent)
+		locator := make([]byte, 32, 32+len(key)+len(value))
+		le.PutUint16(locator[18:], 1)
+		le.PutUint32(locator[20:], 32)
+		le.PutUint32(locator[24:], uint32(32+len(key)))
+		le.PutUint16(locator[28:], uint16(len(key)))
+		le.PutUint16(locator[30:], uint16(len(value)))
+		locator = append(append(locator, key...), value...)
+		items = append(items, struct {
+			id   guid.GUID
+			data []byte
+		}{vhdxParentLocator, locator})
+	}
+
+	table := img[metadataOffset:]
+	copy(table, "metadata")
+	le.PutUint16(table[10:], uint16(len(items)))
+	dataOff := vhdxMetadataSize
+	for i, item := range items {
+		e := table[32+32*i:]
+		copy(e, item.id[:])
+		le.PutUint32(e[16:], uint32(dataOff))
+		le.PutUint32(e[20:], uint32(len(item.data)))
+		copy(table[dataOff:], item.data)
+		dataOff += 4096
+	}
+	return img
+}
+
+func TestInspectVHDX(t *testing.T) {
+	dir := t.TempDir()
+	info, err := Inspect(writeImage(t, dir, "child.vhdx", vhdxImage(127*gib, `.\base.vhdx`)))
+	if err != nil {
+		t.Fatalf("Inspect() failed: %v", err)
+	}
+	if info.Format != FormatVHDX || info.Version != 1 || info.VirtualSize != 127*gib || info.ClusterSize != 32<<20 || info.Dirty {
+		t.Errorf("Inspect() = %+v", info)
+	}
+	if info.BackingFile != "./base.vhdx" || info.BackingPath() != filepath.Join(dir, "base.vhdx") {
+		t.Errorf("backing file = %q, resolved to %q", info.BackingFile, info.BackingPath())
+	}
+
+	// A corrupted table is rejected rather than misread
+	img := vhdxImage(gib, "")
+	img[vhdxRegionTableOffsets[0]+20] ^= 0xff
+	if _, err := Inspect(writeImage(t, dir, "corrupt.vhdx", img)); err == nil {
+		t.Error("Inspect() accepted a region table with a bad checksum")
+	}
+}
+
+func TestInspectVDI(t *testing.T) {
+	le := binary.LittleEndian
+	img := make([]byte, 4096)
+	copy(img, "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	copy(img[vdiSignatureOffset:], vdiSignature)
+	le.PutUint32(img[0x44:], 0x00010001)
+	le.PutUint32(img[0x4c:], 1)
+	le.PutUint64(img[0x170:], 8*gib)
+	le.PutUint32(img[0x178:], 1<<20)
+
+	info, err := Inspect(writeImage(t, t.TempDir(), "disk.vdi", img))
+	if err != nil {
+		t.Fatalf("Inspect() failed: %v", err)
+	}
+	if info.Format != FormatVDI || info.Version != 1 || info.VirtualSize != 8*gib || info.ClusterSize != 1<<20 {
+		t.Errorf("Inspect() = %+v", info)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{data: make([]byte, 1<<20), want: FormatRaw},
+		{data: nil, want: FormatRaw},
+		{data: qcow2Image(gib, "", "", 0, nil), want: FormatQcow2},
+		{data: []byte("QFI\xfb\x00\x00\x00\x01rest of a qcow header"), want: "qcow"},
+		{data: []byte("QED\x00 and more"), want: "qed"},
+		{data: []byte("conectix and a VHD footer"), want: "vpc"},
+	}
+
+	for i, tt := range tests {
+		got, err := DetectFormat(writeImage(t, dir, "disk"+string(rune('a'+i)), tt.data))
+		if err != nil || got != tt.want {
+			t.Errorf("DetectFormat() of image %d = %q, %v, want %q", i, got, err, tt.want)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "base.raw", make([]byte, 4096))
+	writeImage(t, dir, "middle.qcow2", qcow2Image(gib, "base.raw", "raw", 0, nil))
+	top := writeImage(t, dir, "top.qcow2", qcow2Image(gib, filepath.Join(dir, "middle.qcow2"), "qcow2", 0, nil))
+
+	chain, err := Chain(top)
+	if err != nil {
+		t.Fatalf("Chain() failed: %v", err)
+	}
+	var formats []string
+	for _, info := range chain {
+		formats = append(formats, filepath.Base(info.Path)+":"+info.Format)
+	}
+	if got := strings.Join(formats, " "); got != "top.qcow2:qcow2 middle.qcow2:qcow2 base.raw:raw" {
+		t.Errorf("Chain() = %s", got)
+	}
+
+	loop := writeImage(t, dir, "loop.qcow2", qcow2Image(gib, "loop.qcow2", "qcow2", 0, nil))
+	if _, err := Chain(loop); err == nil {
+		t.Error("Chain() followed a backing file loop")
+	}
+	missing := writeImage(t, dir, "orphan.qcow2", qcow2Image(gib, "gone.qcow2", "qcow2", 0, nil))
+	if chain, err := Chain(missing); err == nil || len(chain) != 1 {
+		t.Errorf("Chain() with a missing backing file = %d images, %v", len(chain), err)
+	}
+}
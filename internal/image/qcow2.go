@@ -0,0 +1,167 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// qcow2 header layout, see docs/interop/qcow2.txt in the QEMU sources
+const (
+	qcow2V2HeaderSize = 72
+	qcow2V3HeaderSize = 104
+	qcow2MaxName      = 1023 // Longest backing file name QEMU accepts
+	qcow2MaxSnapshots = 65536
+
+	qcow2IncompatDirty   = 1 << 0
+	qcow2IncompatCorrupt = 1 << 1
+
+	qcow2ExtEnd           = 0
+	qcow2ExtBackingFormat = 0xe2792aca
+)
+
+var qcow2Magic = []byte("QFI\xfb")
+
+// inspectQcow2 reads a qcow2 header, its extensions and snapshot table.
+func inspectQcow2(r io.ReaderAt, size int64) (*Info, error) {
+	info := &Info{Format: FormatQcow2}
+	h := make([]byte, qcow2V3HeaderSize)
+	if err := readAt(r, h[:qcow2V2HeaderSize], 0); err != nil {
+		return info, err
+	}
+	be := binary.BigEndian
+
+	info.Version = int(be.Uint32(h[4:]))
+	backingOffset := int64(be.Uint64(h[8:]))
+	backingSize := be.Uint32(h[16:])
+	clusterBits := be.Uint32(h[20:])
+	info.VirtualSize = int64(be.Uint64(h[24:]))
+	info.Encrypted = be.Uint32(h[32:]) != 0
+	nbSnapshots := be.Uint32(h[60:])
+	snapshotsOffset := int64(be.Uint64(h[64:]))
+
+	if info.Version > 3 {
+		return info, fmt.Errorf("unsupported version %d", info.Version)
+	}
+	if clusterBits < 9 || clusterBits > 21 {
+		return info, fmt.Errorf("invalid cluster size 2^%d", clusterBits)
+	}
+	info.ClusterSize = 1 << clusterBits
+
+	headerLength := int64(qcow2V2HeaderSize)
+	if info.Version == 3 {
+		if err := readAt(r, h[qcow2V2HeaderSize:], qcow2V2HeaderSize); err != nil {
+			return info, err
+		}
+		incompatible := be.Uint64(h[72:])
+		info.Dirty = incompatible&qcow2IncompatDirty != 0
+		info.Corrupt = incompatible&qcow2IncompatCorrupt != 0
+		headerLength = int64(be.Uint32(h[100:]))
+		if headerLength < qcow2V3HeaderSize {
+			return info, fmt.Errorf("invalid header length %d", headerLength)
+		}
+	}
+
+	if backingOffset != 0 {
+		if backingSize == 0 || backingSize > qcow2MaxName {
+			return info, fmt.Errorf("invalid backing file name length %d", backingSize)
+		}
+		name := make([]byte, backingSize)
+		if err := readAt(r, name, backingOffset); err != nil {
+			return info, err
+		}
+		info.BackingFile = string(name)
+	}
+
+	// Header extensions follow the header, up to the end of its cluster
+	limit := min(info.ClusterSize, size)
+	if backingOffset != 0 && backingOffset < limit {
+		limit = backingOffset
+	}
+	if err := readQcow2Extensions(r, info, headerLength, limit); err != nil {
+		return info, err
+	}
+
+	if nbSnapshots > qcow2MaxSnapshots {
+		return info, fmt.Errorf("too many snapshots (%d)", nbSnapshots)
+	}
+	snapshots, err := readQcow2Snapshots(r, snapshotsOffset, int(nbSnapshots))
+	if err != nil {
+		return info, fmt.Errorf("invalid snapshot table: %w", err)
+	}
+	info.Snapshots = snapshots
+	return info, nil
+}
+
+// readQcow2Extensions reads the header extensions between off and limit.
+func readQcow2Extensions(r io.ReaderAt, info *Info, off, limit int64) error {
+	hdr := make([]byte, 8)
+	for off+8 <= limit {
+		if err := readAt(r, hdr, off); err != nil {
+			return err
+		}
+		typ := binary.BigEndian.Uint32(hdr)
+		length := int64(binary.BigEndian.Uint32(hdr[4:]))
+		off += 8
+		if typ == qcow2ExtEnd {
+			return nil
+		}
+		if off+length > limit {
+			return fmt.Errorf("header extension %#x exceeds the header cluster", typ)
+		}
+		if typ == qcow2ExtBackingFormat {
+			name := make([]byte, length)
+			if err := readAt(r, name, off); err != nil {
+				return err
+			}
+			info.BackingFormat = string(bytes.TrimRight(name, "\x00"))
+		}
+		off += (length + 7) &^ 7
+	}
+	return nil
+}
+
+// readQcow2Snapshots reads count entries of the snapshot table at off.
+func readQcow2Snapshots(r io.ReaderAt, off int64, count int) ([]Snapshot, error) {
+	const fixedSize = 40
+	be := binary.BigEndian
+
+	var snapshots []Snapshot
+	entry := make([]byte, fixedSize)
+	for i := 0; i < count; i++ {
+		if err := readAt(r, entry, off); err != nil {
+			return nil, err
+		}
+		idSize := int64(be.Uint16(entry[12:]))
+		nameSize := int64(be.Uint16(entry[14:]))
+		s := Snapshot{
+			Date:        time.Unix(int64(be.Uint32(entry[16:])), int64(be.Uint32(entry[20:]))),
+			VMClock:     time.Duration(be.Uint64(entry[24:])),
+			VMStateSize: int64(be.Uint32(entry[32:])),
+		}
+		extraSize := int64(be.Uint32(entry[36:]))
+
+		// The extra data starts with the 64-bit VM state size
+		if extraSize >= 8 {
+			extra := make([]byte, 8)
+			if err := readAt(r, extra, off+fixedSize); err != nil {
+				return nil, err
+			}
+			s.VMStateSize = int64(be.Uint64(extra))
+		}
+
+		strs := make([]byte, idSize+nameSize)
+		if err := readAt(r, strs, off+fixedSize+extraSize); err != nil {
+			return nil, err
+		}
+		s.ID = string(strs[:idSize])
+		s.Name = string(strs[idSize:])
+		snapshots = append(snapshots, s)
+
+		// Entries are aligned to 8 bytes
+		off += (fixedSize + extraSize + idSize + nameSize + 7) &^ 7
+	}
+	return snapshots, nil
+}
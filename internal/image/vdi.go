@@ -0,0 +1,36 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// VDI header layout, see block/vdi.c in the QEMU sources
+const (
+	vdiSignatureOffset = 0x40
+	vdiHeaderSize      = 0x1c8
+)
+
+var vdiSignature = []byte{0x7f, 0x10, 0xda, 0xbe}
+
+// inspectVDI reads a VirtualBox VDI header. Differencing VDI images refer to
+// their parent by UUID rather than by path, so no backing file is reported
+// for them.
+func inspectVDI(r io.ReaderAt) (*Info, error) {
+	info := &Info{Format: FormatVDI}
+	h := make([]byte, vdiHeaderSize)
+	if err := readAt(r, h, 0); err != nil {
+		return info, err
+	}
+	le := binary.LittleEndian
+
+	version := le.Uint32(h[0x44:])
+	info.Version = int(version >> 16)
+	if info.Version != 1 {
+		return info, fmt.Errorf("unsupported version %d.%d", version>>16, version&0xffff)
+	}
+	info.VirtualSize = int64(le.Uint64(h[0x170:]))
+	info.ClusterSize = int64(le.Uint32(h[0x178:]))
+	return info, nil
+}
@@ -0,0 +1,192 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+)
+
+// VHDX layout, see Microsoft's VHDX Format Specification 1.0
+const (
+	vhdxHeaderSize      = 4096
+	vhdxRegionTableSize = 64 * 1024
+	vhdxMetadataSize    = 64 * 1024
+	vhdxMaxEntries      = 2047
+
+	vhdxFileParamsHasParent = 1 << 1
+)
+
+var (
+	vhdxMagic              = []byte("vhdxfile")
+	vhdxHeaderOffsets      = []int64{64 * 1024, 128 * 1024}
+	vhdxRegionTableOffsets = []int64{192 * 1024, 256 * 1024}
+	vhdxMetadataRegion     = guid.MustParse("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters     = guid.MustParse("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = guid.MustParse("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxParentLocator      = guid.MustParse("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	vhdxParentLocatorKeys  = []string{"relative_path", "absolute_win32_path", "volume_path"}
+)
+
+// castagnoli is the CRC-32C table VHDX checksums use.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// vhdxChecksumValid checks the CRC-32C of a VHDX structure, which covers the
+// structure with its checksum field at offset 4 zeroed.
+func vhdxChecksumValid(b []byte) bool {
+	want := binary.LittleEndian.Uint32(b[4:])
+	crc := crc32.Update(0, castagnoli, b[:4])
+	crc = crc32.Update(crc, castagnoli, make([]byte, 4))
+	crc = crc32.Update(crc, castagnoli, b[8:])
+	return crc == want
+}
+
+// inspectVHDX reads the current VHDX header and the metadata region.
+func inspectVHDX(r io.ReaderAt) (*Info, error) {
+	info := &Info{Format: FormatVHDX}
+	le := binary.LittleEndian
+
+	// Of the two headers, the valid one with the higher sequence number is
+	// current
+	var current []byte
+	for _, off := range vhdxHeaderOffsets {
+		h := make([]byte, vhdxHeaderSize)
+		if err := readAt(r, h, off); err != nil {
+			return info, err
+		}
+		if !bytes.HasPrefix(h, []byte("head")) || !vhdxChecksumValid(h) {
+			continue
+		}
+		if current == nil || le.Uint64(h[8:]) > le.Uint64(current[8:]) {
+			current = h
+		}
+	}
+	if current == nil {
+		return info, fmt.Errorf("no valid header")
+	}
+	info.Version = int(le.Uint16(current[66:]))
+	// A log that still has to be replayed means the image was not closed
+	// cleanly
+	info.Dirty = !guid.FromBytes(current[48:]).IsZero()
+
+	var regions []byte
+	for _, off := range vhdxRegionTableOffsets {
+		t := make([]byte, vhdxRegionTableSize)
+		if err := readAt(r, t, off); err != nil {
+			return info, err
+		}
+		if bytes.HasPrefix(t, []byte("regi")) && vhdxChecksumValid(t) {
+			regions = t
+			break
+		}
+	}
+	if regions == nil {
+		return info, fmt.Errorf("no valid region table")
+	}
+
+	count := min(int(le.Uint32(regions[8:])), vhdxMaxEntries)
+	for i := 0; i < count; i++ {
+		e := regions[16+32*i:]
+		if guid.FromBytes(e) == vhdxMetadataRegion {
+			return info, readVHDXMetadata(r, info, int64(le.Uint64(e[16:])))
+		}
+	}
+	return info, fmt.Errorf("no metadata region")
+}
+
+// readVHDXMetadata reads the metadata items of interest from the metadata
+// region at off.
+func readVHDXMetadata(r io.ReaderAt, info *Info, off int64) error {
+	le := binary.LittleEndian
+	table := make([]byte, vhdxMetadataSize)
+	if err := readAt(r, table, off); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(table, []byte("metadata")) {
+		return fmt.Errorf("invalid metadata table")
+	}
+
+	item := func(id guid.GUID) ([]byte, error) {
+		count := min(int(le.Uint16(table[10:])), vhdxMaxEntries)
+		for i := 0; i < count; i++ {
+			e := table[32+32*i:]
+			if guid.FromBytes(e) != id {
+				continue
+			}
+			data := make([]byte, le.Uint32(e[20:]))
+			if err := readAt(r, data, off+int64(le.Uint32(e[16:]))); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		return nil, nil
+	}
+
+	params, err := item(vhdxFileParameters)
+	if err != nil {
+		return err
+	}
+	if len(params) < 8 {
+		return fmt.Errorf("missing file parameters")
+	}
+	info.ClusterSize = int64(le.Uint32(params))
+
+	diskSize, err := item(vhdxVirtualDiskSize)
+	if err != nil {
+		return err
+	}
+	if len(diskSize) < 8 {
+		return fmt.Errorf("missing virtual disk size")
+	}
+	info.VirtualSize = int64(le.Uint64(diskSize))
+
+	if le.Uint32(params[4:])&vhdxFileParamsHasParent == 0 {
+		return nil
+	}
+	locator, err := item(vhdxParentLocator)
+	if err != nil {
+		return err
+	}
+	info.BackingFormat = FormatVHDX
+	info.BackingFile = vhdxParentPath(locator)
+	return nil
+}
+
+// vhdxParentPath returns the parent path recorded in a parent locator,
+// preferring a relative path.
+func vhdxParentPath(locator []byte) string {
+	if len(locator) < 20 {
+		return ""
+	}
+	le := binary.LittleEndian
+	utf16At := func(off uint32, length uint16) string {
+		end := int(off) + int(length)
+		if end > len(locator) || length%2 != 0 {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = le.Uint16(locator[int(off)+2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+
+	values := map[string]string{}
+	count := int(le.Uint16(locator[18:]))
+	for i := 0; i < count && 20+12*(i+1) <= len(locator); i++ {
+		e := locator[20+12*i:]
+		key := utf16At(le.Uint32(e), le.Uint16(e[8:]))
+		values[key] = utf16At(le.Uint32(e[4:]), le.Uint16(e[10:]))
+	}
+	for _, key := range vhdxParentLocatorKeys {
+		if path := values[key]; path != "" {
+			return strings.ReplaceAll(path, `\`, "/")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// VMDK sparse extent header layout, see VMware's Virtual Disk Format 5.0
+const (
+	vmdkHeaderSize    = 77
+	vmdkSectorSize    = 512
+	vmdkMaxDescriptor = 1 << 20
+)
+
+var (
+	vmdkMagic           = []byte("KDMV")
+	vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+)
+
+// inspectVMDK reads a VMDK image, which is either a sparse extent with an
+// embedded descriptor or a descriptor file referring to separate extents.
+func inspectVMDK(r io.ReaderAt, size int64, head []byte) (*Info, error) {
+	info := &Info{Format: FormatVMDK}
+
+	descriptor := head
+	if bytes.HasPrefix(head, vmdkMagic) {
+		h := make([]byte, vmdkHeaderSize)
+		if err := readAt(r, h, 0); err != nil {
+			return info, err
+		}
+		le := binary.LittleEndian
+		info.Version = int(le.Uint32(h[4:]))
+		info.VirtualSize = int64(le.Uint64(h[12:])) * vmdkSectorSize
+		info.ClusterSize = int64(le.Uint64(h[20:])) * vmdkSectorSize
+		descOffset := int64(le.Uint64(h[28:])) * vmdkSectorSize
+		descSize := int64(le.Uint64(h[36:])) * vmdkSectorSize
+		info.Dirty = h[72] != 0
+
+		descriptor = nil
+		if descOffset != 0 && descSize > 0 {
+			if descSize > vmdkMaxDescriptor {
+				return info, fmt.Errorf("descriptor too large (%d bytes)", descSize)
+			}
+			descriptor = make([]byte, descSize)
+			if err := readAt(r, descriptor, descOffset); err != nil {
+				return info, err
+			}
+		}
+	} else {
+		// A descriptor file: read it whole
+		if size > vmdkMaxDescriptor {
+			return info, fmt.Errorf("descriptor too large (%d bytes)", size)
+		}
+		descriptor = make([]byte, size)
+		if err := readAt(r, descriptor, 0); err != nil {
+			return info, err
+		}
+	}
+
+	capacity, err := parseVMDKDescriptor(info, descriptor)
+	if err != nil {
+		return info, err
+	}
+	if info.VirtualSize == 0 {
+		info.VirtualSize = capacity
+	}
+	return info, nil
+}
+
+// parseVMDKDescriptor reads the parent file name from a VMDK descriptor and
+// returns the capacity of its extents, in bytes.
+func parseVMDKDescriptor(info *Info, descriptor []byte) (int64, error) {
+	var capacity int64
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(descriptor, "\x00")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			key = strings.TrimSpace(key)
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if key == "parentFileNameHint" {
+				info.BackingFile = value
+				info.BackingFormat = FormatVMDK
+			}
+			continue
+		}
+
+		// Extent lines look like: RW 41943040 SPARSE "disk-s001.vmdk"
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && (fields[0] == "RW" || fields[0] == "RDONLY" || fields[0] == "NOACCESS") {
+			sectors, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid extent line '%s'", line)
+			}
+			capacity += sectors * vmdkSectorSize
+		}
+	}
+	return capacity, scanner.Err()
+}
@@ -0,0 +1,452 @@
+// Package iso9660 writes small ISO 9660 images with Joliet extensions, such
+// as the cloud-init seed volumes q2boot attaches to guests as CD-ROMs.
+//
+// Images are built in memory. The primary volume uses ISO 9660 level 2 names
+// (upper case, at most 31 characters) for old readers; the Joliet volume keeps
+// the original file names, which is what Linux guests see.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Image layout constants
+const (
+	SectorSize        = 2048
+	systemAreaSectors = 16
+	maxJolietNameLen  = 64 // In UCS-2 characters
+	maxLevel2NameLen  = 31
+	applicationID     = "Q2BOOT"
+)
+
+// Volume descriptor types
+const (
+	descriptorPrimary       = 1
+	descriptorSupplementary = 2
+	descriptorTerminator    = 255
+)
+
+// jolietEscape selects UCS-2 level 3 in the supplementary volume descriptor.
+var jolietEscape = []byte{0x25, 0x2f, 0x45}
+
+// Image is an ISO 9660 image under construction.
+type Image struct {
+	// VolumeID is the volume label, e.g. "cidata"
+	VolumeID string
+	// ModTime is recorded for every file and directory (default: now)
+	ModTime time.Time
+
+	root *node
+}
+
+// node is a file or directory of the image.
+type node struct {
+	name     string
+	dir      bool
+	data     []byte
+	parent   *node
+	children []*node
+}
+
+// New creates an empty image with the given volume label.
+func New(volumeID string) *Image {
+	return &Image{VolumeID: volumeID, root: &node{dir: true}}
+}
+
+// AddFile adds a file to the image. Slashes in name create directories, e.g.
+// "combustion/script".
+func (img *Image) AddFile(name string, data []byte) error {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	dir := img.root
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid file name '%s'", name)
+		}
+		if len(utf16.Encode([]rune(part))) > maxJolietNameLen-2 {
+			return fmt.Errorf("file name '%s' is too long (max %d characters per component)", name, maxJolietNameLen-2)
+		}
+
+		last := i == len(parts)-1
+		child := dir.child(part)
+		switch {
+		case child == nil && last:
+			dir.children = append(dir.children, &node{name: part, data: data, parent: dir})
+		case child == nil:
+			child = &node{name: part, dir: true, parent: dir}
+			dir.children = append(dir.children, child)
+			dir = child
+		case last || !child.dir:
+			return fmt.Errorf("file '%s' already exists", name)
+		default:
+			dir = child
+		}
+	}
+	return nil
+}
+
+// child returns the child of n with the given name, or nil.
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// tree is one of the two directory hierarchies of the image: the primary
+// one with ISO 9660 names and the Joliet one.
+type tree struct {
+	joliet bool
+	dirs   []*node          // In path table order
+	number map[*node]uint16 // Path table numbers of dirs
+	loc    map[*node]uint32
+	size   map[*node]uint32
+
+	pathTableSize uint32
+	lPathTable    uint32
+	mPathTable    uint32
+}
+
+// WriteTo writes the image to w.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	data, err := img.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// Bytes returns the image.
+func (img *Image) Bytes() ([]byte, error) {
+	if img.ModTime.IsZero() {
+		img.ModTime = time.Now()
+	}
+	trees := []*tree{img.newTree(false), img.newTree(true)}
+
+	// Lay out the volume descriptors, the path tables, the directories of
+	// both trees and finally the file data shared by them.
+	sector := uint32(systemAreaSectors + 3)
+	for _, t := range trees {
+		t.pathTableSize = uint32(len(t.pathTable(binary.LittleEndian)))
+		n := sectors(t.pathTableSize)
+		t.lPathTable, t.mPathTable = sector, sector+n
+		sector += 2 * n
+	}
+	for _, t := range trees {
+		for _, d := range t.dirs {
+			t.size[d] = uint32(len(img.directory(t, d)))
+			t.loc[d] = sector
+			sector += sectors(t.size[d])
+		}
+	}
+	fileLoc := make(map[*node]uint32)
+	img.walk(img.root, func(n *node) {
+		if !n.dir && len(n.data) > 0 {
+			fileLoc[n] = sector
+			sector += sectors(uint32(len(n.data)))
+		}
+	})
+	for _, t := range trees {
+		for n, loc := range fileLoc {
+			t.loc[n] = loc
+			t.size[n] = uint32(len(n.data))
+		}
+	}
+
+	out := make([]byte, int(sector)*SectorSize)
+	at := func(s uint32) []byte { return out[int(s)*SectorSize:] }
+
+	copy(at(systemAreaSectors), img.volumeDescriptor(trees[0], descriptorPrimary, sector))
+	copy(at(systemAreaSectors+1), img.volumeDescriptor(trees[1], descriptorSupplementary, sector))
+	copy(at(systemAreaSectors+2), []byte{descriptorTerminator, 'C', 'D', '0', '0', '1', 1})
+	for _, t := range trees {
+		copy(at(t.lPathTable), t.pathTable(binary.LittleEndian))
+		copy(at(t.mPathTable), t.pathTable(binary.BigEndian))
+		for _, d := range t.dirs {
+			copy(at(t.loc[d]), img.directory(t, d))
+		}
+	}
+	for n, loc := range fileLoc {
+		copy(at(loc), n.data)
+	}
+	return out, nil
+}
+
+// newTree orders the directories of one hierarchy for its path table:
+// breadth first, with the children of each directory sorted by identifier.
+func (img *Image) newTree(joliet bool) *tree {
+	t := &tree{
+		joliet: joliet,
+		number: make(map[*node]uint16),
+		loc:    make(map[*node]uint32),
+		size:   make(map[*node]uint32),
+	}
+	queue := []*node{img.root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		t.dirs = append(t.dirs, d)
+		t.number[d] = uint16(len(t.dirs))
+		for _, c := range t.sorted(d) {
+			if c.dir {
+				queue = append(queue, c)
+			}
+		}
+	}
+	return t
+}
+
+// sorted returns the children of d sorted by their identifiers in t.
+func (t *tree) sorted(d *node) []*node {
+	children := append([]*node(nil), d.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(t.identifier(children[i]), t.identifier(children[j])) < 0
+	})
+	return children
+}
+
+// identifier returns the file identifier of n in t.
+func (t *tree) identifier(n *node) []byte {
+	if n.parent == nil {
+		return []byte{0}
+	}
+	name := n.name
+	if t.joliet {
+		if !n.dir {
+			name += ";1"
+		}
+		return ucs2(name)
+	}
+	return []byte(level2Name(n))
+}
+
+// level2Name maps the name of n to ISO 9660 d-characters, e.g. "meta-data"
+// becomes "META_DATA.;1".
+func level2Name(n *node) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			default:
+				return '_'
+			}
+		}, s)
+	}
+	if n.dir {
+		name := clean(n.name)
+		if len(name) > maxLevel2NameLen {
+			name = name[:maxLevel2NameLen]
+		}
+		return name
+	}
+
+	base, ext := n.name, ""
+	if i := strings.LastIndex(n.name, "."); i > 0 {
+		base, ext = n.name[:i], n.name[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(base)+len(ext)+1 > maxLevel2NameLen {
+		if len(ext) > 3 {
+			ext = ext[:3]
+		}
+		base = base[:maxLevel2NameLen-len(ext)-1]
+	}
+	return base + "." + ext + ";1"
+}
+
+// walk calls fn for n and all its descendants in insertion order.
+func (img *Image) walk(n *node, fn func(*node)) {
+	fn(n)
+	for _, c := range n.children {
+		img.walk(c, fn)
+	}
+}
+
+// directory returns the extent of directory d in t. Records never cross a
+// sector boundary, so the extent is padded to whole sectors.
+func (img *Image) directory(t *tree, d *node) []byte {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	records := [][]byte{
+		img.record(t, d, []byte{0}),
+		img.record(t, parent, []byte{1}),
+	}
+	for _, c := range t.sorted(d) {
+		records = append(records, img.record(t, c, t.identifier(c)))
+	}
+
+	var buf []byte
+	for _, r := range records {
+		if used := len(buf) % SectorSize; used+len(r) > SectorSize {
+			buf = append(buf, make([]byte, SectorSize-used)...)
+		}
+		buf = append(buf, r...)
+	}
+	return pad(buf)
+}
+
+// record returns the directory record of n with the given identifier.
+func (img *Image) record(t *tree, n *node, identifier []byte) []byte {
+	length := 33 + len(identifier)
+	if len(identifier)%2 == 0 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBoth32(r[2:], t.loc[n])
+	putBoth32(r[10:], t.size[n])
+	copy(r[18:25], recordingTime(img.ModTime))
+	if n.dir {
+		r[25] = 0x02
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(identifier))
+	copy(r[33:], identifier)
+	return r
+}
+
+// pathTable returns the path table of t in the given byte order.
+func (t *tree) pathTable(order binary.ByteOrder) []byte {
+	var buf []byte
+	for _, d := range t.dirs {
+		identifier := t.identifier(d)
+		parent := d.parent
+		if parent == nil {
+			parent = d
+		}
+		r := make([]byte, 8+len(identifier)+len(identifier)%2)
+		r[0] = byte(len(identifier))
+		order.PutUint32(r[2:], t.loc[d])
+		order.PutUint16(r[6:], t.number[parent])
+		copy(r[8:], identifier)
+		buf = append(buf, r...)
+	}
+	return buf
+}
+
+// volumeDescriptor returns the primary or supplementary (Joliet) volume
+// descriptor of an image of the given size in sectors.
+func (img *Image) volumeDescriptor(t *tree, kind byte, size uint32) []byte {
+	d := make([]byte, SectorSize)
+	d[0] = kind
+	copy(d[1:6], "CD001")
+	d[6] = 1
+
+	text := func(field []byte, s string) {
+		if t.joliet {
+			padUCS2(field, s)
+		} else {
+			padASCII(field, s)
+		}
+	}
+	text(d[8:40], "")
+	text(d[40:72], img.VolumeID)
+	putBoth32(d[80:], size)
+	if t.joliet {
+		copy(d[88:], jolietEscape)
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], SectorSize)
+	putBoth32(d[132:], t.pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], t.lPathTable)
+	binary.BigEndian.PutUint32(d[148:], t.mPathTable)
+	copy(d[156:190], img.record(t, img.root, []byte{0}))
+	text(d[190:318], "")
+	text(d[318:446], "")
+	text(d[446:574], "")
+	text(d[574:702], applicationID)
+	text(d[702:739], "")
+	text(d[739:776], "")
+	text(d[776:813], "")
+	copy(d[813:830], descriptorTime(img.ModTime))
+	copy(d[830:847], descriptorTime(img.ModTime))
+	copy(d[847:864], descriptorTime(time.Time{}))
+	copy(d[864:881], descriptorTime(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+// recordingTime encodes t for a directory record.
+func recordingTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{
+		byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0,
+	}
+}
+
+// descriptorTime encodes t for a volume descriptor; the zero time is
+// encoded as "not specified".
+func descriptorTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+// ucs2 encodes s as big endian UCS-2, as used by Joliet.
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// padASCII fills field with s, padded with spaces.
+func padASCII(field []byte, s string) {
+	n := copy(field, s)
+	for i := n; i < len(field); i++ {
+		field[i] = ' '
+	}
+}
+
+// padUCS2 fills field with s in UCS-2, padded with UCS-2 spaces.
+func padUCS2(field []byte, s string) {
+	n := copy(field, ucs2(s))
+	n -= n % 2
+	for i := n; i+1 < len(field); i += 2 {
+		field[i], field[i+1] = 0, ' '
+	}
+}
+
+// putBoth16 stores v in both byte orders, little endian first.
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// putBoth32 stores v in both byte orders, little endian first.
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// sectors returns the number of sectors needed for size bytes.
+func sectors(size uint32) uint32 {
+	return (size + SectorSize - 1) / SectorSize
+}
+
+// pad pads b to whole sectors.
+func pad(b []byte) []byte {
+	if rest := len(b) % SectorSize; rest != 0 {
+		b = append(b, make([]byte, SectorSize-rest)...)
+	}
+	return b
+}
@@ -0,0 +1,150 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// readTree lists the files of the hierarchy described by the volume
+// descriptor in the given sector, mapping paths to contents.
+func readTree(t *testing.T, img []byte, descriptor int) map[string]string {
+	t.Helper()
+	vd := img[descriptor*SectorSize:]
+	if string(vd[1:6]) != "CD001" {
+		t.Fatalf("sector %d is not a volume descriptor", descriptor)
+	}
+	joliet := vd[0] == descriptorSupplementary
+
+	files := make(map[string]string)
+	var walk func(loc, size uint32, prefix string)
+	walk = func(loc, size uint32, prefix string) {
+		extent := img[loc*SectorSize : loc*SectorSize+size]
+		for off := 0; off < len(extent); {
+			length := int(extent[off])
+			if length == 0 {
+				off = (off/SectorSize + 1) * SectorSize
+				continue
+			}
+			r := extent[off : off+length]
+			off += length
+
+			id := r[33 : 33+int(r[32])]
+			if len(id) == 1 && id[0] <= 1 {
+				continue
+			}
+			name := string(id)
+			if joliet {
+				units := make([]uint16, len(id)/2)
+				for i := range units {
+					units[i] = binary.BigEndian.Uint16(id[2*i:])
+				}
+				name = string(utf16.Decode(units))
+			}
+			name = strings.TrimSuffix(name, ";1")
+
+			childLoc := binary.LittleEndian.Uint32(r[2:])
+			childSize := binary.LittleEndian.Uint32(r[10:])
+			if r[25]&0x02 != 0 {
+				walk(childLoc, childSize, prefix+name+"/")
+			} else {
+				files[prefix+name] = string(img[childLoc*SectorSize : childLoc*SectorSize+childSize])
+			}
+		}
+	}
+	root := vd[156:190]
+	walk(binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]), "")
+	return files
+}
+
+func TestImage(t *testing.T) {
+	img := New("cidata")
+	img.ModTime = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{
+		"user-data":         "#cloud-config\nhostname: test\n",
+		"meta-data":         "instance-id: iid-test\n",
+		"combustion/script": strings.Repeat("echo hello\n", 500),
+		"empty":             "",
+	}
+	for name, data := range files {
+		if err := img.AddFile(name, []byte(data)); err != nil {
+			t.Fatalf("AddFile(%q) failed: %v", name, err)
+		}
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+	if len(data)%SectorSize != 0 {
+		t.Errorf("image size %d is not a multiple of the sector size", len(data))
+	}
+
+	if got := string(data[16*SectorSize+40 : 16*SectorSize+46]); got != "cidata" {
+		t.Errorf("volume label = %q, want %q", got, "cidata")
+	}
+	if !bytes.Equal(data[17*SectorSize+88:17*SectorSize+91], jolietEscape) {
+		t.Error("supplementary volume descriptor is not a Joliet descriptor")
+	}
+	if data[18*SectorSize] != descriptorTerminator {
+		t.Error("volume descriptor set is not terminated")
+	}
+
+	joliet := readTree(t, data, 17)
+	for name, want := range files {
+		if got, ok := joliet[name]; !ok || got != want {
+			t.Errorf("Joliet file %q = %q (found %t), want %q", name, got, ok, want)
+		}
+	}
+	if len(joliet) != len(files) {
+		t.Errorf("Joliet tree has %d files, want %d: %v", len(joliet), len(files), joliet)
+	}
+
+	primary := readTree(t, data, 16)
+	if got := primary["USER_DATA."]; got != files["user-data"] {
+		t.Errorf("primary file USER_DATA. = %q, want %q", got, files["user-data"])
+	}
+	if _, ok := primary["COMBUSTION/SCRIPT."]; !ok {
+		t.Errorf("primary tree lacks COMBUSTION/SCRIPT.: %v", primary)
+	}
+}
+
+func TestImageManyFiles(t *testing.T) {
+	// Enough directory records to span several sectors.
+	img := New("many")
+	for i := 0; i < 100; i++ {
+		name := strings.Repeat("x", 40) + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if err := img.AddFile("dir/"+name, []byte(name)); err != nil {
+			t.Fatalf("AddFile() failed: %v", err)
+		}
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() failed: %v", err)
+	}
+
+	files := readTree(t, data, 17)
+	if len(files) != 100 {
+		t.Fatalf("Joliet tree has %d files, want 100", len(files))
+	}
+	for path, content := range files {
+		if !strings.HasSuffix(path, content) {
+			t.Errorf("file %q has content %q", path, content)
+		}
+	}
+}
+
+func TestAddFileErrors(t *testing.T) {
+	img := New("test")
+	if err := img.AddFile("dir/file", nil); err != nil {
+		t.Fatalf("AddFile() failed: %v", err)
+	}
+
+	for _, name := range []string{"dir/file", "dir", "dir/file/sub", "a//b", "../x", strings.Repeat("n", 63)} {
+		if err := img.AddFile(name, nil); err == nil {
+			t.Errorf("AddFile(%q) succeeded, want an error", name)
+		}
+	}
+}
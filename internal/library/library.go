@@ -0,0 +1,201 @@
+// Package library keeps linked clones of disk images, together with the
+// configuration they boot with, so that they can be started by name.
+//
+// Each VM of the library lives in $XDG_DATA_HOME/q2boot/vms/<name>, holding
+// disk.qcow2, a qcow2 image backed by the image the VM was cloned from, and
+// vm.json, which records the base image and the VM's configuration. A VM of
+// the library can itself be the base of further clones; it cannot be removed
+// while they exist.
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/xdg"
+)
+
+// Library directory constants
+const (
+	DirName         = "vms"
+	DiskName        = "disk.qcow2"
+	ConfigName      = "vm.json"
+	DirPermissions  = 0700
+	FilePermissions = 0600
+)
+
+// ErrNotFound is returned when the library has no VM with a name.
+var ErrNotFound = errors.New("no such VM in the library")
+
+// Dir returns the directory holding the library. It's a variable so tests
+// can redirect it.
+var Dir = func() string {
+	return filepath.Join(xdg.DataHome(), DirName)
+}
+
+// VM is a linked clone in the library.
+type VM struct {
+	Name       string           `json:"name"`
+	Base       string           `json:"base"`
+	BaseFormat string           `json:"base_format"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Config     *config.VMConfig `json:"config"`
+}
+
+// Dir returns the directory of the VM.
+func (v *VM) Dir() string {
+	return filepath.Join(Dir(), v.Name)
+}
+
+// DiskPath returns the disk image of the VM.
+func (v *VM) DiskPath() string {
+	return filepath.Join(v.Dir(), DiskName)
+}
+
+// save writes the VM's description.
+func (v *VM) save() error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(v.Dir(), ConfigName), data, FilePermissions); err != nil {
+		return fmt.Errorf("failed to save VM '%s': %w", v.Name, err)
+	}
+	return nil
+}
+
+// Load reads the named VM. It returns ErrNotFound if the library has none.
+func Load(name string) (*VM, error) {
+	if err := state.ValidateName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(Dir(), name, ConfigName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: '%s'", ErrNotFound, name)
+		}
+		return nil, err
+	}
+	var v VM
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid VM '%s': %w", name, err)
+	}
+	if v.Config == nil {
+		return nil, fmt.Errorf("invalid VM '%s': no configuration", name)
+	}
+	v.Name = name
+	v.Config.Name = name
+	v.Config.DiskPath = v.DiskPath()
+	return &v, nil
+}
+
+// List returns all VMs of the library, sorted by name.
+func List() ([]*VM, error) {
+	entries, err := os.ReadDir(Dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read library directory: %w", err)
+	}
+
+	var vms []*VM
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		v, err := Load(entry.Name())
+		if err != nil {
+			continue
+		}
+		vms = append(vms, v)
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+	return vms, nil
+}
+
+// Create clones base as the named VM, which boots with cfg. The clone is a
+// qcow2 image backed by base, so base must not change afterwards.
+func Create(name, base string, cfg *config.VMConfig) (*VM, error) {
+	if err := state.ValidateName(name); err != nil {
+		return nil, err
+	}
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return nil, err
+	}
+	format, err := qemuimg.Format(base)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(Dir(), DirPermissions); err != nil {
+		return nil, fmt.Errorf("failed to create library directory: %w", err)
+	}
+	v := &VM{Name: name, Base: base, BaseFormat: format}
+	if err := os.Mkdir(v.Dir(), DirPermissions); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("the library already has a VM named '%s'", name)
+		}
+		return nil, fmt.Errorf("failed to create VM directory: %w", err)
+	}
+
+	c := *cfg
+	c.Name = name
+	c.DiskPath = v.DiskPath()
+	v.Config = &c
+	v.CreatedAt = time.Now()
+	if err := qemuimg.CreateBacked(v.DiskPath(), v.Base, v.BaseFormat); err != nil {
+		os.RemoveAll(v.Dir())
+		return nil, err
+	}
+	if err := v.save(); err != nil {
+		os.RemoveAll(v.Dir())
+		return nil, err
+	}
+	return v, nil
+}
+
+// ClonesOf returns the VMs of the library backed by the image at path.
+func ClonesOf(path string) ([]*VM, error) {
+	vms, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var clones []*VM
+	for _, v := range vms {
+		if v.Base == path {
+			clones = append(clones, v)
+		}
+	}
+	return clones, nil
+}
+
+// Remove deletes the VM and its disk. It refuses to while other VMs of the
+// library are clones of it.
+func (v *VM) Remove() error {
+	clones, err := ClonesOf(v.DiskPath())
+	if err != nil {
+		return err
+	}
+	if len(clones) > 0 {
+		var names []string
+		for _, clone := range clones {
+			names = append(names, clone.Name)
+		}
+		return fmt.Errorf("VM '%s' is the base of %s; remove them first", v.Name, strings.Join(names, ", "))
+	}
+	if err := os.RemoveAll(v.Dir()); err != nil {
+		return fmt.Errorf("failed to remove VM '%s': %w", v.Name, err)
+	}
+	return nil
+}
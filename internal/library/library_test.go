@@ -0,0 +1,101 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+)
+
+// setup redirects the library directory and mocks qemu-img, returning the
+// recorded qemu-img invocations and a base image.
+func setup(t *testing.T) (*[][]string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	originalDir, originalRun := Dir, qemuimg.Run
+	t.Cleanup(func() { Dir, qemuimg.Run = originalDir, originalRun })
+
+	var calls [][]string
+	Dir = func() string { return filepath.Join(dir, DirName) }
+	qemuimg.Run = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		switch args[0] {
+		case "info":
+			return []byte(`{"format": "qcow2"}`), nil
+		case "create":
+			return nil, os.WriteFile(args[len(args)-1], []byte("QFI\xfb"), FilePermissions)
+		}
+		return nil, errors.New("unexpected qemu-img command")
+	}
+
+	base := filepath.Join(dir, "sle16.qcow2")
+	if err := os.WriteFile(base, []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &calls, base
+}
+
+func TestCreateAndLoad(t *testing.T) {
+	calls, base := setup(t)
+
+	cfg := config.DefaultConfig()
+	cfg.Arch = "aarch64"
+	cfg.Forwards = []string{"8080-80"}
+	v, err := Create("web", base, cfg)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	want := []string{"create", "-q", "-f", "qcow2", "-F", "qcow2", "-b", base, v.DiskPath()}
+	if last := (*calls)[len(*calls)-1]; !slices.Equal(last, want) {
+		t.Errorf("qemu-img %v, want %v", last, want)
+	}
+	if cfg.Name != "" || cfg.DiskPath != "" {
+		t.Error("Create() modified the configuration it was given")
+	}
+
+	loaded, err := Load("web")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	c := loaded.Config
+	if loaded.Base != base || c.Arch != "aarch64" || c.Name != "web" || c.DiskPath != v.DiskPath() || !slices.Equal(c.Forwards, cfg.Forwards) {
+		t.Errorf("Load() = %+v with config %+v", loaded, c)
+	}
+
+	if _, err := Create("web", base, cfg); err == nil {
+		t.Error("Create() replaced an existing VM")
+	}
+	if _, err := Load("db"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load() of a missing VM error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRemoveRefusesBaseOfClones(t *testing.T) {
+	_, base := setup(t)
+
+	web, err := Create("web", base, config.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webTest, err := Create("web-test", web.DiskPath(), config.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := web.Remove(); err == nil {
+		t.Fatal("Remove() deleted the base of a clone")
+	}
+	if err := webTest.Remove(); err != nil {
+		t.Fatalf("Remove() of the clone failed: %v", err)
+	}
+	if err := web.Remove(); err != nil {
+		t.Fatalf("Remove() without clones failed: %v", err)
+	}
+	if vms, err := List(); err != nil || len(vms) != 0 {
+		t.Errorf("List() after removing everything = %v, %v", vms, err)
+	}
+}
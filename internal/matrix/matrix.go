@@ -0,0 +1,291 @@
+// Package matrix boots a list of images concurrently within a CPU and RAM
+// budget, e.g. to validate a release across architectures.
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilmanzo/q2boot/internal/smoke"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// Image is an image to boot, with its resources and readiness checks.
+type Image struct {
+	Disk        string        `yaml:"disk"`
+	Name        string        `yaml:"name,omitempty"`
+	Arch        string        `yaml:"arch,omitempty"`
+	CPU         int           `yaml:"cpu,omitempty"`
+	RAMGb       int           `yaml:"ram_gb,omitempty"`
+	WaitFor     string        `yaml:"wait_for,omitempty"`
+	WaitSSH     *bool         `yaml:"wait_ssh,omitempty"`
+	WaitTimeout int           `yaml:"wait_timeout,omitempty"`
+	Expect      string        `yaml:"expect,omitempty"`
+	Via         string        `yaml:"via,omitempty"`
+	Checks      []smoke.Check `yaml:"checks,omitempty"`
+}
+
+// File is the format of a matrix file:
+//
+//	defaults:
+//	  ram_gb: 4
+//	  wait_ssh: true
+//	  checks:
+//	    - run: systemctl is-system-running --wait
+//	images:
+//	  - disk: sle16-x86_64.qcow2
+//	  - disk: sle16-s390x.qcow2
+//	    wait_timeout: 900
+type File struct {
+	Defaults Image   `yaml:"defaults"`
+	Images   []Image `yaml:"images"`
+}
+
+// Load reads a matrix file. Defaults are applied to every image, relative
+// paths are resolved against the file's directory and every image gets a
+// unique name.
+func Load(path string) ([]Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read matrix: %w", err)
+	}
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid matrix file '%s': %w", path, err)
+	}
+	if len(file.Images) == 0 {
+		return nil, fmt.Errorf("matrix file '%s' lists no images", path)
+	}
+
+	baseDir := filepath.Dir(path)
+	names := make(map[string]bool)
+	images := make([]Image, 0, len(file.Images))
+	for i, img := range file.Images {
+		img = img.withDefaults(file.Defaults)
+		if img.Disk == "" {
+			return nil, fmt.Errorf("image %d has no disk", i+1)
+		}
+		img.Disk = resolvePath(baseDir, img.Disk)
+		if img.Expect != "" {
+			img.Expect = resolvePath(baseDir, img.Expect)
+		}
+
+		if img.Name == "" {
+			img.Name = state.NameFromDisk(img.Disk)
+		}
+		if err := state.ValidateName(img.Name); err != nil {
+			return nil, fmt.Errorf("image %d: %w", i+1, err)
+		}
+		base := img.Name
+		for n := 2; names[img.Name]; n++ {
+			img.Name = fmt.Sprintf("%s-%d", base, n)
+		}
+		names[img.Name] = true
+
+		if len(img.Checks) > 0 {
+			suite := smoke.Suite{Via: img.Via, Checks: img.Checks}
+			if err := suite.Validate(); err != nil {
+				return nil, fmt.Errorf("image '%s': %w", img.Name, err)
+			}
+			img.Via, img.Checks = suite.Via, suite.Checks
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// withDefaults fills the fields of img that are not set from defaults.
+func (img Image) withDefaults(defaults Image) Image {
+	if img.Arch == "" {
+		img.Arch = defaults.Arch
+	}
+	if img.CPU == 0 {
+		img.CPU = defaults.CPU
+	}
+	if img.RAMGb == 0 {
+		img.RAMGb = defaults.RAMGb
+	}
+	if img.WaitFor == "" {
+		img.WaitFor = defaults.WaitFor
+	}
+	if img.WaitSSH == nil {
+		img.WaitSSH = defaults.WaitSSH
+	}
+	if img.WaitTimeout == 0 {
+		img.WaitTimeout = defaults.WaitTimeout
+	}
+	if img.Expect == "" {
+		img.Expect = defaults.Expect
+	}
+	if img.Via == "" {
+		img.Via = defaults.Via
+	}
+	if img.Checks == nil {
+		img.Checks = defaults.Checks
+	}
+	return img
+}
+
+// resolvePath makes a relative path relative to dir. URLs are left alone.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) || isURL(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Budget limits the CPUs and RAM used by the VMs running at the same time.
+type Budget struct {
+	CPU   int // 0 means unlimited
+	RAMGb int // 0 means unlimited
+
+	mu      sync.Mutex
+	usedCPU int
+	usedRAM int
+	changed chan struct{} // closed and replaced whenever resources are released
+}
+
+// NewBudget creates a budget; zero values mean unlimited.
+func NewBudget(cpu, ramGb int) *Budget {
+	return &Budget{CPU: cpu, RAMGb: ramGb, changed: make(chan struct{})}
+}
+
+// Fits reports whether a VM with the given resources can ever run within
+// the budget.
+func (b *Budget) Fits(cpu, ramGb int) error {
+	if b.CPU > 0 && cpu > b.CPU {
+		return fmt.Errorf("needs %d CPUs, but the budget is %d", cpu, b.CPU)
+	}
+	if b.RAMGb > 0 && ramGb > b.RAMGb {
+		return fmt.Errorf("needs %d GB of RAM, but the budget is %d GB", ramGb, b.RAMGb)
+	}
+	return nil
+}
+
+// Acquire waits until the resources are available and reserves them.
+func (b *Budget) Acquire(ctx context.Context, cpu, ramGb int) error {
+	if err := b.Fits(cpu, ramGb); err != nil {
+		return err
+	}
+	for {
+		b.mu.Lock()
+		if (b.CPU == 0 || b.usedCPU+cpu <= b.CPU) && (b.RAMGb == 0 || b.usedRAM+ramGb <= b.RAMGb) {
+			b.usedCPU += cpu
+			b.usedRAM += ramGb
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns resources reserved with Acquire.
+func (b *Budget) Release(cpu, ramGb int) {
+	b.mu.Lock()
+	b.usedCPU -= cpu
+	b.usedRAM -= ramGb
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// BootFunc boots an image, runs its checks, shuts it down and reports the outcome.
+type BootFunc func(ctx context.Context, img Image) *smoke.Report
+
+// Run boots all images concurrently, as far as the budget allows, and
+// returns their reports in the order of images.
+func Run(ctx context.Context, images []Image, budget *Budget, boot BootFunc) []*smoke.Report {
+	reports := make([]*smoke.Report, len(images))
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func(i int, img Image) {
+			defer wg.Done()
+			if err := budget.Acquire(ctx, img.CPU, img.RAMGb); err != nil {
+				reports[i] = notBooted(img, err)
+				return
+			}
+			defer budget.Release(img.CPU, img.RAMGb)
+			if err := ctx.Err(); err != nil {
+				reports[i] = notBooted(img, err)
+				return
+			}
+			reports[i] = boot(ctx, img)
+		}(i, img)
+	}
+	wg.Wait()
+	return reports
+}
+
+// notBooted reports an image that could not be started at all.
+func notBooted(img Image, err error) *smoke.Report {
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("interrupted before it could start")
+	}
+	return &smoke.Report{
+		Name:      img.Name,
+		Image:     img.Disk,
+		Arch:      img.Arch,
+		StartedAt: time.Now(),
+		BootError: err.Error(),
+		Checks:    smoke.SkipChecks(img.Checks, "VM did not boot"),
+	}
+}
+
+// WriteTable writes a pass/fail table of the reports.
+func WriteTable(w io.Writer, reports []*smoke.Report) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tARCH\tBOOT\tCHECKS\tRESULT")
+	for _, r := range reports {
+		boot := "-"
+		if r.Booted {
+			boot = r.BootDuration.Round(time.Second).String()
+		}
+		checks := "-"
+		if len(r.Checks) > 0 {
+			checks = fmt.Sprintf("%d/%d", len(r.Checks)-r.Failures()-skipped(r), len(r.Checks))
+		}
+		result := "PASS"
+		switch {
+		case !r.Booted:
+			// Boot errors may include QEMU's output; the first line is enough here
+			result = "FAIL: " + strings.SplitN(r.BootError, "\n", 2)[0]
+		case !r.Passed():
+			result = fmt.Sprintf("FAIL: %d checks failed", r.Failures())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Arch, boot, checks, result)
+	}
+	return tw.Flush()
+}
+
+// skipped counts the checks of r that did not run.
+func skipped(r *smoke.Report) int {
+	n := 0
+	for _, check := range r.Checks {
+		if check.Skipped {
+			n++
+		}
+	}
+	return n
+}
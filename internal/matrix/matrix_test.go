@@ -0,0 +1,168 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/smoke"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.yaml")
+	os.WriteFile(path, []byte(`
+defaults:
+  ram_gb: 4
+  wait_ssh: true
+  checks:
+    - run: systemctl is-system-running --wait
+images:
+  - disk: images/sle16-x86_64.qcow2
+  - disk: /abs/sle16-x86_64.qcow2
+    arch: x86_64
+    wait_ssh: false
+    checks: []
+  - disk: https://example.com/sle16-s390x.qcow2
+    name: s390x
+    cpu: 4
+`), 0644)
+
+	images, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if len(images) != 3 {
+		t.Fatalf("Load() returned %d images, want 3", len(images))
+	}
+
+	first := images[0]
+	if first.Disk != filepath.Join(dir, "images/sle16-x86_64.qcow2") {
+		t.Errorf("relative disk path not resolved: %s", first.Disk)
+	}
+	if first.RAMGb != 4 || first.WaitSSH == nil || !*first.WaitSSH || len(first.Checks) != 1 {
+		t.Errorf("defaults not applied: %+v", first)
+	}
+	if first.Via != smoke.ViaSSH {
+		t.Errorf("checks should default to SSH, got %q", first.Via)
+	}
+
+	second := images[1]
+	if second.Name != "sle16-x86_64-2" {
+		t.Errorf("duplicate names should get a suffix, got %s", second.Name)
+	}
+	if second.WaitSSH == nil || *second.WaitSSH || len(second.Checks) != 0 {
+		t.Errorf("image settings should override defaults: %+v", second)
+	}
+
+	third := images[2]
+	if third.Disk != "https://example.com/sle16-s390x.qcow2" || third.Name != "s390x" || third.CPU != 4 {
+		t.Errorf("unexpected image: %+v", third)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no images", `images: []`},
+		{"missing disk", "images:\n  - name: nodisk"},
+		{"invalid name", "images:\n  - disk: a.qcow2\n    name: ../a"},
+		{"invalid checks", "images:\n  - disk: a.qcow2\n    via: telnet\n    checks:\n      - run: 'true'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "images.yaml")
+			os.WriteFile(path, []byte(tt.content), 0644)
+			if _, err := Load(path); err == nil {
+				t.Error("Load() should fail")
+			}
+		})
+	}
+}
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(4, 8)
+	ctx := context.Background()
+
+	if err := budget.Fits(8, 2); err == nil {
+		t.Error("Fits() should reject a VM larger than the budget")
+	}
+	if err := budget.Acquire(ctx, 2, 4); err != nil {
+		t.Fatalf("Acquire() failed: %v", err)
+	}
+	if err := budget.Acquire(ctx, 2, 4); err != nil {
+		t.Fatalf("Acquire() failed: %v", err)
+	}
+
+	// The budget is exhausted: the next VM waits for a release
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := budget.Acquire(timeoutCtx, 1, 1); err == nil {
+		t.Fatal("Acquire() should block while the budget is exhausted")
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- budget.Acquire(ctx, 2, 2) }()
+	budget.Release(2, 4)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Acquire() failed after Release(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Acquire() did not proceed after Release()")
+	}
+}
+
+func TestRunRespectsBudget(t *testing.T) {
+	images := []Image{
+		{Name: "a", CPU: 2, RAMGb: 2},
+		{Name: "b", CPU: 2, RAMGb: 2},
+		{Name: "c", CPU: 2, RAMGb: 2},
+		{Name: "too-big", CPU: 8, RAMGb: 2},
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	boot := func(ctx context.Context, img Image) *smoke.Report {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return &smoke.Report{Name: img.Name, Booted: true}
+	}
+
+	reports := Run(context.Background(), images, NewBudget(4, 0), boot)
+	if maxRunning != 2 {
+		t.Errorf("%d VMs ran at once, want 2 with a budget of 4 CPUs", maxRunning)
+	}
+	for i, r := range reports[:3] {
+		if r.Name != images[i].Name || !r.Passed() {
+			t.Errorf("report %d = %+v, want a pass for %s", i, r, images[i].Name)
+		}
+	}
+	if reports[3].Booted || !strings.Contains(reports[3].BootError, "budget") {
+		t.Errorf("oversized image should fail with a budget error: %+v", reports[3])
+	}
+
+	var buf bytes.Buffer
+	WriteTable(&buf, reports)
+	if !strings.Contains(buf.String(), "too-big") || !strings.Contains(buf.String(), "PASS") {
+		t.Errorf("unexpected table:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,272 @@
+// Package overlay manages named qcow2 overlays on top of base images.
+//
+// An overlay keeps the changes a VM makes to its disk without touching the
+// base image, and survives across boots, unlike -snapshot. Overlays live in
+// $XDG_DATA_HOME/q2boot/overlays as <name>.qcow2, next to a <name>.json
+// sidecar recording the base image. Several overlays can share one base, as
+// long as the base itself does not change; committing an overlay into its
+// base invalidates the others.
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+	"github.com/ilmanzo/q2boot/internal/xdg"
+)
+
+// Overlay directory constants
+const (
+	DirName         = "overlays"
+	ImageExt        = ".qcow2"
+	SidecarExt      = ".json"
+	DirPermissions  = 0700
+	FilePermissions = 0600
+	MaxNameLength   = 64
+)
+
+// ErrNotFound is returned when no overlay exists with a name.
+var ErrNotFound = errors.New("no such overlay")
+
+// validName matches the names accepted for overlays.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Dir returns the directory holding the overlays. It's a variable so tests
+// can redirect it.
+var Dir = func() string {
+	return filepath.Join(xdg.DataHome(), DirName)
+}
+
+// Overlay is a named overlay and the base image it was created on.
+type Overlay struct {
+	Name       string    `json:"name"`
+	Base       string    `json:"base"`
+	BaseFormat string    `json:"base_format"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// BaseSize and BaseModTime identify the state of the base image the
+	// overlay is consistent with.
+	BaseSize    int64     `json:"base_size"`
+	BaseModTime time.Time `json:"base_mod_time"`
+}
+
+// ValidateName checks that name can be used as an overlay name.
+func ValidateName(name string) error {
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("overlay name '%s' is too long (max %d characters)", name, MaxNameLength)
+	}
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid overlay name '%s': use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// Path returns the overlay image file.
+func (o *Overlay) Path() string {
+	return filepath.Join(Dir(), o.Name+ImageExt)
+}
+
+// sidecarPath returns the file describing the overlay.
+func (o *Overlay) sidecarPath() string {
+	return filepath.Join(Dir(), o.Name+SidecarExt)
+}
+
+// Size returns the size of the overlay image on the host, i.e. the amount
+// of changes it holds.
+func (o *Overlay) Size() int64 {
+	info, err := os.Stat(o.Path())
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// BaseChanged reports whether the base image changed, or vanished, since
+// the overlay was created, which makes the overlay's view of the disk
+// inconsistent.
+func (o *Overlay) BaseChanged() bool {
+	info, err := os.Stat(o.Base)
+	if err != nil {
+		return true
+	}
+	return info.Size() != o.BaseSize || !info.ModTime().Equal(o.BaseModTime)
+}
+
+// stampBase records the current state of the base image.
+func (o *Overlay) stampBase() error {
+	info, err := os.Stat(o.Base)
+	if err != nil {
+		return fmt.Errorf("base image of overlay '%s': %w", o.Name, err)
+	}
+	o.BaseSize = info.Size()
+	o.BaseModTime = info.ModTime()
+	return nil
+}
+
+// save writes the sidecar.
+func (o *Overlay) save() error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.sidecarPath(), data, FilePermissions); err != nil {
+		return fmt.Errorf("failed to save overlay '%s': %w", o.Name, err)
+	}
+	return nil
+}
+
+// Load reads the named overlay. It returns ErrNotFound if there is none.
+func Load(name string) (*Overlay, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(Dir(), name+SidecarExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: '%s'", ErrNotFound, name)
+		}
+		return nil, err
+	}
+	var o Overlay
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("invalid overlay '%s': %w", name, err)
+	}
+	o.Name = name
+	return &o, nil
+}
+
+// List returns all overlays, sorted by name.
+func List() ([]*Overlay, error) {
+	entries, err := os.ReadDir(Dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read overlay directory: %w", err)
+	}
+
+	var overlays []*Overlay
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), SidecarExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		o, err := Load(name)
+		if err != nil {
+			continue
+		}
+		overlays = append(overlays, o)
+	}
+	sort.Slice(overlays, func(i, j int) bool { return overlays[i].Name < overlays[j].Name })
+	return overlays, nil
+}
+
+// Create creates the named overlay on top of base.
+func Create(name, base string) (*Overlay, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return nil, err
+	}
+	format, err := qemuimg.Format(base)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(Dir(), DirPermissions); err != nil {
+		return nil, fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	o := &Overlay{Name: name, Base: base, BaseFormat: format}
+	if err := o.create(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// create (re)creates an empty overlay image and its sidecar.
+func (o *Overlay) create() error {
+	if err := o.stampBase(); err != nil {
+		return err
+	}
+	if err := qemuimg.CreateBacked(o.Path(), o.Base, o.BaseFormat); err != nil {
+		return err
+	}
+	o.CreatedAt = time.Now()
+	return o.save()
+}
+
+// Open returns the named overlay of base, creating it if it doesn't exist
+// yet. An existing overlay must have been created on the same base image.
+func Open(name, base string) (o *Overlay, created bool, err error) {
+	o, err = Load(name)
+	if errors.Is(err, ErrNotFound) {
+		o, err = Create(name, base)
+		return o, err == nil, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	abs, err := filepath.Abs(base)
+	if err != nil {
+		return nil, false, err
+	}
+	if abs != o.Base {
+		return nil, false, fmt.Errorf("overlay '%s' belongs to base image %s, not %s", name, o.Base, abs)
+	}
+	return o, false, nil
+}
+
+// SharingBase returns the other overlays on the same base image.
+func (o *Overlay) SharingBase() ([]*Overlay, error) {
+	overlays, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var others []*Overlay
+	for _, other := range overlays {
+		if other.Name != o.Name && other.Base == o.Base {
+			others = append(others, other)
+		}
+	}
+	return others, nil
+}
+
+// Commit writes the changes of the overlay into its base image and empties
+// the overlay.
+func (o *Overlay) Commit() error {
+	if err := qemuimg.Commit(o.Path()); err != nil {
+		return err
+	}
+	// The overlay is consistent with the base it was committed into.
+	if err := o.stampBase(); err != nil {
+		return err
+	}
+	return o.save()
+}
+
+// Reset throws the changes of the overlay away, keeping the overlay.
+func (o *Overlay) Reset() error {
+	return o.create()
+}
+
+// Discard deletes the overlay.
+func (o *Overlay) Discard() error {
+	if err := os.Remove(o.Path()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete overlay '%s': %w", o.Name, err)
+	}
+	if err := os.Remove(o.sidecarPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete overlay '%s': %w", o.Name, err)
+	}
+	return nil
+}
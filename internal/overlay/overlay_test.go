@@ -0,0 +1,147 @@
+package overlay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/qemuimg"
+)
+
+// fakeQemuImg records the qemu-img invocations and mimics their effect on
+// the files.
+type fakeQemuImg struct {
+	calls [][]string
+}
+
+func (f *fakeQemuImg) run(args ...string) ([]byte, error) {
+	f.calls = append(f.calls, args)
+	switch args[0] {
+	case "info":
+		return []byte(`{"format": "raw", "virtual-size": 1048576}`), nil
+	case "create":
+		return nil, os.WriteFile(args[len(args)-1], []byte("QFI\xfb"), 0600)
+	case "commit":
+		// The base changes; make sure its modification time does too.
+		o, err := Load(strings.TrimSuffix(filepath.Base(args[len(args)-1]), ImageExt))
+		if err != nil {
+			return nil, err
+		}
+		later := time.Now().Add(time.Second)
+		if err := os.WriteFile(o.Base, []byte("committed"), 0644); err != nil {
+			return nil, err
+		}
+		return nil, os.Chtimes(o.Base, later, later)
+	}
+	return nil, errors.New("unexpected qemu-img command")
+}
+
+// setup redirects the overlay directory and mocks qemu-img, returning the
+// fake and a base image.
+func setup(t *testing.T) (*fakeQemuImg, string) {
+	t.Helper()
+	dir := t.TempDir()
+	originalDir, originalRun := Dir, qemuimg.Run
+	t.Cleanup(func() { Dir, qemuimg.Run = originalDir, originalRun })
+
+	fake := &fakeQemuImg{}
+	Dir = func() string { return filepath.Join(dir, DirName) }
+	qemuimg.Run = fake.run
+
+	base := filepath.Join(dir, "base.img")
+	if err := os.WriteFile(base, []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fake, base
+}
+
+func TestOpen(t *testing.T) {
+	fake, base := setup(t)
+
+	o, created, err := Open("alice", base)
+	if err != nil || !created {
+		t.Fatalf("Open() = %v, %t, %v, want a new overlay", o, created, err)
+	}
+	want := []string{"create", "-q", "-f", "qcow2", "-F", "raw", "-b", base, o.Path()}
+	if last := fake.calls[len(fake.calls)-1]; !slices.Equal(last, want) {
+		t.Errorf("qemu-img %v, want %v", last, want)
+	}
+	if _, err := os.Stat(o.Path()); err != nil {
+		t.Errorf("overlay image was not created: %v", err)
+	}
+
+	again, created, err := Open("alice", base)
+	if err != nil || created || again.Base != base || again.BaseFormat != "raw" {
+		t.Errorf("Open() of an existing overlay = %+v, %t, %v", again, created, err)
+	}
+
+	other := filepath.Join(filepath.Dir(base), "other.img")
+	if _, _, err := Open("alice", other); err == nil {
+		t.Error("Open() accepted an existing overlay with another base image")
+	}
+	if _, _, err := Open("../alice", base); err == nil {
+		t.Error("Open() accepted an invalid name")
+	}
+}
+
+func TestListAndDiscard(t *testing.T) {
+	_, base := setup(t)
+
+	for _, name := range []string{"bob", "alice"} {
+		if _, err := Create(name, base); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	overlays, err := List()
+	if err != nil || len(overlays) != 2 || overlays[0].Name != "alice" || overlays[1].Name != "bob" {
+		t.Fatalf("List() = %v, %v, want alice and bob", overlays, err)
+	}
+
+	if err := overlays[0].Discard(); err != nil {
+		t.Fatalf("Discard() failed: %v", err)
+	}
+	if _, err := Load("alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load() after Discard() error = %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(overlays[0].Path()); !os.IsNotExist(err) {
+		t.Error("Discard() left the overlay image behind")
+	}
+}
+
+func TestCommitInvalidatesSiblings(t *testing.T) {
+	_, base := setup(t)
+
+	alice, err := Create("alice", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Create("bob", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siblings, err := alice.SharingBase()
+	if err != nil || len(siblings) != 1 || siblings[0].Name != "bob" {
+		t.Errorf("SharingBase() = %v, %v, want bob", siblings, err)
+	}
+
+	if err := alice.Commit(); err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+	if alice, _ = Load("alice"); alice.BaseChanged() {
+		t.Error("committed overlay reports a changed base")
+	}
+	if bob, _ = Load("bob"); !bob.BaseChanged() {
+		t.Error("sibling overlay does not report the changed base")
+	}
+
+	if err := bob.Reset(); err != nil {
+		t.Fatalf("Reset() failed: %v", err)
+	}
+	if bob, _ = Load("bob"); bob.BaseChanged() {
+		t.Error("reset overlay still reports a changed base")
+	}
+}
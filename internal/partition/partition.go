@@ -0,0 +1,292 @@
+// Package partition reads the GPT or MBR partition table of a disk.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+)
+
+// Partition table schemes
+const (
+	SchemeGPT = "gpt"
+	SchemeMBR = "mbr"
+)
+
+// GPT layout, see the UEFI specification, chapter 5
+const (
+	gptHeaderMinSize  = 92
+	gptEntryMinSize   = 128
+	gptMaxEntries     = 1024
+	gptMaxEntrySize   = 4096
+	gptEntryNameSize  = 72
+	gptNameOffset     = 56
+	gptTypeOffset     = 0
+	gptGUIDOffset     = 16
+	gptFirstLBAOffset = 32
+	gptLastLBAOffset  = 40
+)
+
+// MBR layout. Extended partitions hold a chain of extended boot records,
+// each describing one logical partition.
+const (
+	mbrSectorSize      = 512
+	mbrEntriesOffset   = 446
+	mbrEntrySize       = 16
+	mbrEntries         = 4
+	mbrMaxLogical      = 128
+	mbrTypeProtective  = 0xee
+	mbrTypeESP         = 0xef
+	mbrFirstLogicalIdx = 5
+)
+
+// mbrExtendedTypes are the MBR types of extended partitions.
+var mbrExtendedTypes = []byte{0x05, 0x0f, 0x85}
+
+// SectorSizes are the logical sector sizes a GPT is looked for with.
+var SectorSizes = []int64{512, 4096}
+
+var gptSignature = []byte("EFI PART")
+
+// ESPType is the GPT type of EFI System Partitions.
+var ESPType = guid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+
+// ErrNoTable is returned when a disk has no partition table.
+var ErrNoTable = errors.New("no partition table found")
+
+// Table is the partition table of a disk.
+type Table struct {
+	Scheme     string
+	SectorSize int64
+	Partitions []Partition
+}
+
+// Partition is an entry of a partition table.
+type Partition struct {
+	// Index is the 1-based position of the entry in the table, matching the
+	// partition numbers of Linux device names
+	Index int
+	// Type, GUID and Name are set for GPT partitions
+	Type guid.GUID
+	GUID guid.GUID
+	Name string
+	// MBRType is the system ID of MBR partitions
+	MBRType byte
+	// Start and Size are in bytes
+	Start int64
+	Size  int64
+}
+
+// Read reads the partition table of the disk r of the given size: a GPT, or
+// else an MBR.
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	gptErr := ErrNoTable
+	for _, sectorSize := range SectorSizes {
+		t, err := readGPT(r, size, sectorSize)
+		if err == nil {
+			return t, nil
+		}
+		if !errors.Is(err, ErrNoTable) && errors.Is(gptErr, ErrNoTable) {
+			gptErr = err
+		}
+	}
+
+	t, err := readMBR(r, size)
+	if errors.Is(err, ErrNoTable) {
+		// A damaged GPT is more telling than its protective MBR
+		return nil, gptErr
+	}
+	return t, err
+}
+
+// Section returns a reader of the content of p on the disk r.
+func (p Partition) Section(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, p.Start, p.Size)
+}
+
+// IsESP reports whether p is an EFI System Partition.
+func (p Partition) IsESP() bool {
+	return p.Type == ESPType || p.MBRType == mbrTypeESP
+}
+
+// readGPT reads a GPT using the given sector size, falling back to the
+// backup header at the end of the disk when the primary one is damaged.
+func readGPT(r io.ReaderAt, size, sectorSize int64) (*Table, error) {
+	t, err := readGPTAt(r, size, sectorSize, 1)
+	if err == nil || errors.Is(err, ErrNoTable) {
+		return t, err
+	}
+	if backup, berr := readGPTAt(r, size, sectorSize, size/sectorSize-1); berr == nil {
+		return backup, nil
+	}
+	return nil, err
+}
+
+// readGPTAt reads the GPT whose header is at the given LBA.
+func readGPTAt(r io.ReaderAt, size, sectorSize, lba int64) (*Table, error) {
+	le := binary.LittleEndian
+	h := make([]byte, sectorSize)
+	if lba < 1 || !readFull(r, h, lba*sectorSize) || !bytes.HasPrefix(h, gptSignature) {
+		return nil, ErrNoTable
+	}
+	headerSize := int64(le.Uint32(h[12:]))
+	if headerSize < gptHeaderMinSize || headerSize > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+	if !checksumValid(h[:headerSize], 16) {
+		return nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+
+	entriesLBA := int64(le.Uint64(h[72:]))
+	count := int64(le.Uint32(h[80:]))
+	entrySize := int64(le.Uint32(h[84:]))
+	if count > gptMaxEntries || entrySize < gptEntryMinSize || entrySize > gptMaxEntrySize || entrySize%8 != 0 {
+		return nil, fmt.Errorf("invalid GPT entry array (%d entries of %d bytes)", count, entrySize)
+	}
+	entries := make([]byte, count*entrySize)
+	if !readFull(r, entries, entriesLBA*sectorSize) {
+		return nil, fmt.Errorf("GPT entry array is past the end of the disk")
+	}
+	if crc32.ChecksumIEEE(entries) != le.Uint32(h[88:]) {
+		return nil, fmt.Errorf("GPT entry array checksum mismatch")
+	}
+
+	t := &Table{Scheme: SchemeGPT, SectorSize: sectorSize}
+	for i := int64(0); i < count; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		typ := guid.FromBytes(e[gptTypeOffset:])
+		if typ.IsZero() {
+			continue
+		}
+		first, last := int64(le.Uint64(e[gptFirstLBAOffset:])), int64(le.Uint64(e[gptLastLBAOffset:]))
+		if first < 0 || last < first || (last+1)*sectorSize > size {
+			return nil, fmt.Errorf("GPT partition %d lies outside the disk", i+1)
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Index: int(i) + 1,
+			Type:  typ,
+			GUID:  guid.FromBytes(e[gptGUIDOffset:]),
+			Name:  utf16Name(e[gptNameOffset : gptNameOffset+gptEntryNameSize]),
+			Start: first * sectorSize,
+			Size:  (last - first + 1) * sectorSize,
+		})
+	}
+	return t, nil
+}
+
+// readMBR reads an MBR and the logical partitions of its extended partition.
+// A protective MBR, which stands for a GPT, is reported as ErrNoTable.
+func readMBR(r io.ReaderAt, size int64) (*Table, error) {
+	entries, err := readBootRecord(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{Scheme: SchemeMBR, SectorSize: mbrSectorSize}
+	var extended int64
+	for i, e := range entries {
+		switch {
+		case e.MBRType == 0:
+			continue
+		case e.MBRType == mbrTypeProtective:
+			return nil, ErrNoTable
+		case slices.Contains(mbrExtendedTypes, e.MBRType):
+			extended = e.Start
+			continue
+		}
+		e.Index = i + 1
+		t.Partitions = append(t.Partitions, e)
+	}
+
+	// Each extended boot record holds a logical partition, relative to the
+	// record, and the next record, relative to the extended partition
+	for ebr, index := extended, mbrFirstLogicalIdx; ebr != 0; index++ {
+		if index-mbrFirstLogicalIdx == mbrMaxLogical {
+			return nil, fmt.Errorf("too many logical partitions")
+		}
+		entries, err := readBootRecord(r, ebr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended boot record at %d: %w", ebr, err)
+		}
+		if logical := entries[0]; logical.MBRType != 0 {
+			logical.Index = index
+			logical.Start += ebr
+			t.Partitions = append(t.Partitions, logical)
+		}
+		ebr = 0
+		if next := entries[1]; next.MBRType != 0 {
+			ebr = extended + next.Start
+		}
+	}
+
+	for _, p := range t.Partitions {
+		if p.Start+p.Size > size {
+			return nil, fmt.Errorf("MBR partition %d lies outside the disk", p.Index)
+		}
+	}
+	return t, nil
+}
+
+// readBootRecord reads the four entries of the MBR or extended boot record
+// at off, with their Start and Size in bytes, relative to off.
+func readBootRecord(r io.ReaderAt, off int64) ([]Partition, error) {
+	sector := make([]byte, mbrSectorSize)
+	if !readFull(r, sector, off) || sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil, ErrNoTable
+	}
+	le := binary.LittleEndian
+	var entries []Partition
+	for i := 0; i < mbrEntries; i++ {
+		e := sector[mbrEntriesOffset+mbrEntrySize*i:]
+		// The boot indicator tells an MBR from the boot sector of an
+		// unpartitioned FAT volume, which has the same signature
+		if e[0] != 0 && e[0] != 0x80 {
+			return nil, ErrNoTable
+		}
+		p := Partition{
+			MBRType: e[4],
+			Start:   int64(le.Uint32(e[8:])) * mbrSectorSize,
+			Size:    int64(le.Uint32(e[12:])) * mbrSectorSize,
+		}
+		if p.MBRType != 0 && (p.Start == 0 || p.Size == 0) {
+			return nil, ErrNoTable
+		}
+		entries = append(entries, p)
+	}
+	return entries, nil
+}
+
+// checksumValid checks the CRC-32 of a structure, which covers the structure
+// with its checksum field at crcOffset zeroed.
+func checksumValid(b []byte, crcOffset int) bool {
+	want := binary.LittleEndian.Uint32(b[crcOffset:])
+	crc := crc32.Update(0, crc32.IEEETable, b[:crcOffset])
+	crc = crc32.Update(crc, crc32.IEEETable, make([]byte, 4))
+	crc = crc32.Update(crc, crc32.IEEETable, b[crcOffset+4:])
+	return crc == want
+}
+
+// utf16Name decodes a NUL-padded UTF-16LE partition name.
+func utf16Name(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+}
+
+// readFull reads len(buf) bytes at off, reporting whether they were all read.
+func readFull(r io.ReaderAt, buf []byte, off int64) bool {
+	if off < 0 {
+		return false
+	}
+	n, _ := r.ReadAt(buf, off)
+	return n == len(buf)
+}
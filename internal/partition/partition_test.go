@@ -0,0 +1,193 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/ilmanzo/q2boot/internal/guid"
+)
+
+var (
+	espType  = guid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	rootType = guid.MustParse("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+)
+
+// gptDisk builds a disk of the given number of sectors with a GPT holding
+// parts, whose Start and Size are in sectors here. The backup header is
+// written too.
+func gptDisk(sectorSize, sectors int64, parts []Partition) []byte {
+	le := binary.LittleEndian
+	disk := make([]byte, sectorSize*sectors)
+
+	const count, entrySize = 128, 128
+	entries := make([]byte, count*entrySize)
+	for _, p := range parts {
+		e := entries[(p.Index-1)*entrySize:]
+		copy(e[0:], p.Type[:])
+		copy(e[16:], p.GUID[:])
+		le.PutUint64(e[32:], uint64(p.Start))
+		le.PutUint64(e[40:], uint64(p.Start+p.Size-1))
+		for i, u := range utf16.Encode([]rune(p.Name)) {
+			le.PutUint16(e[56+2*i:], u)
+		}
+	}
+	entrySectors := int64(len(entries)) / sectorSize
+
+	header := func(lba, entriesLBA int64) {
+		h := disk[lba*sectorSize : lba*sectorSize+92]
+		copy(h, "EFI PART")
+		le.PutUint32(h[8:], 0x00010000)
+		le.PutUint32(h[12:], 92)
+		le.PutUint64(h[24:], uint64(lba))
+		le.PutUint64(h[72:], uint64(entriesLBA))
+		le.PutUint32(h[80:], count)
+		le.PutUint32(h[84:], entrySize)
+		le.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		le.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+		copy(disk[entriesLBA*sectorSize:], entries)
+	}
+	header(1, 2)
+	header(sectors-1, sectors-1-entrySectors)
+	return disk
+}
+
+func TestReadGPT(t *testing.T) {
+	for _, sectorSize := range SectorSizes {
+		parts := []Partition{
+			{Index: 1, Type: espType, Name: "EFI System", Start: 40, Size: 10},
+			{Index: 3, Type: rootType, Name: "root-x86-64", Start: 50, Size: 20},
+		}
+		disk := gptDisk(sectorSize, 128, parts)
+
+		table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+		if err != nil {
+			t.Fatalf("sector size %d: Read() failed: %v", sectorSize, err)
+		}
+		if table.Scheme != SchemeGPT || table.SectorSize != sectorSize {
+			t.Errorf("Read() = %s table with %d-byte sectors, want gpt with %d", table.Scheme, table.SectorSize, sectorSize)
+		}
+		if len(table.Partitions) != len(parts) {
+			t.Fatalf("Read() found %d partitions, want %d", len(table.Partitions), len(parts))
+		}
+		for i, p := range table.Partitions {
+			want := parts[i]
+			want.Start *= sectorSize
+			want.Size *= sectorSize
+			if p != want {
+				t.Errorf("partition %d = %+v, want %+v", i, p, want)
+			}
+		}
+	}
+}
+
+func TestReadGPTBackup(t *testing.T) {
+	disk := gptDisk(512, 128, []Partition{{Index: 1, Type: rootType, Start: 40, Size: 10}})
+	// Damage the primary header
+	disk[512+30]++
+
+	table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatalf("Read() failed: %v", err)
+	}
+	if len(table.Partitions) != 1 || table.Partitions[0].Type != rootType {
+		t.Errorf("Read() = %+v", table.Partitions)
+	}
+
+	// Damage the backup header too
+	disk[len(disk)-512+30]++
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); err == nil || errors.Is(err, ErrNoTable) {
+		t.Errorf("Read() of a damaged GPT = %v, want a checksum error", err)
+	}
+}
+
+func TestReadNoTable(t *testing.T) {
+	disk := make([]byte, 64*512)
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); !errors.Is(err, ErrNoTable) {
+		t.Errorf("Read() = %v, want ErrNoTable", err)
+	}
+	if _, err := Read(bytes.NewReader(nil), 0); !errors.Is(err, ErrNoTable) {
+		t.Errorf("Read() of an empty disk = %v, want ErrNoTable", err)
+	}
+}
+
+func TestReadGPTOutsideDisk(t *testing.T) {
+	disk := gptDisk(512, 128, []Partition{{Index: 1, Type: rootType, Start: 40, Size: 200}})
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); err == nil {
+		t.Error("Read() accepted a partition past the end of the disk")
+	}
+}
+
+// mbrEntry writes an MBR partition entry of the boot record at sector.
+func mbrEntry(disk []byte, sector int64, i int, typ byte, start, sectors uint32) {
+	le := binary.LittleEndian
+	b := disk[sector*512:]
+	e := b[446+16*i:]
+	e[4] = typ
+	le.PutUint32(e[8:], start)
+	le.PutUint32(e[12:], sectors)
+	b[510], b[511] = 0x55, 0xaa
+}
+
+func TestReadMBR(t *testing.T) {
+	disk := make([]byte, 256*512)
+	mbrEntry(disk, 0, 0, 0xef, 8, 32)
+	mbrEntry(disk, 0, 1, 0x05, 100, 100)
+	// Two logical partitions in the extended partition
+	mbrEntry(disk, 100, 0, 0x83, 2, 20)
+	mbrEntry(disk, 100, 1, 0x05, 40, 60)
+	mbrEntry(disk, 140, 0, 0x82, 2, 30)
+
+	table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatalf("Read() failed: %v", err)
+	}
+	want := []Partition{
+		{Index: 1, MBRType: 0xef, Start: 8 * 512, Size: 32 * 512},
+		{Index: 5, MBRType: 0x83, Start: 102 * 512, Size: 20 * 512},
+		{Index: 6, MBRType: 0x82, Start: 142 * 512, Size: 30 * 512},
+	}
+	if table.Scheme != SchemeMBR || len(table.Partitions) != len(want) {
+		t.Fatalf("Read() = %s table with %+v", table.Scheme, table.Partitions)
+	}
+	for i, p := range table.Partitions {
+		if p != want[i] {
+			t.Errorf("partition %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+	if !table.Partitions[0].IsESP() || table.Partitions[1].IsESP() {
+		t.Error("IsESP() doesn't match the ESP type")
+	}
+}
+
+func TestReadMBRProtective(t *testing.T) {
+	disk := gptDisk(512, 128, []Partition{{Index: 1, Type: espType, Start: 40, Size: 10}})
+	mbrEntry(disk, 0, 0, 0xee, 1, 127)
+
+	table, err := Read(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil || table.Scheme != SchemeGPT || !table.Partitions[0].IsESP() {
+		t.Fatalf("Read() = %+v, %v, want the GPT", table, err)
+	}
+
+	// Without the GPT, a protective MBR alone is no partition table
+	clear(disk[512:])
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); !errors.Is(err, ErrNoTable) {
+		t.Errorf("Read() = %v, want ErrNoTable", err)
+	}
+}
+
+func TestReadMBRFATBootSector(t *testing.T) {
+	// The boot sector of an unpartitioned FAT volume has the MBR signature
+	disk := make([]byte, 64*512)
+	copy(disk, "\xeb\x3c\x90mkfs.fat")
+	for i := 62; i < 510; i++ {
+		disk[i] = byte(i)
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	if _, err := Read(bytes.NewReader(disk), int64(len(disk))); !errors.Is(err, ErrNoTable) {
+		t.Errorf("Read() = %v, want ErrNoTable", err)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !unix
+
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lock file constants for platforms without flock
+const (
+	lockRetryInterval = 50 * time.Millisecond
+	lockStaleAfter    = 30 * time.Second
+)
+
+// lockFile creates path exclusively, waiting while another process holds it.
+// A lock file older than lockStaleAfter is assumed to be left over by a
+// process that died while holding it.
+func lockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, FilePermissions)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to inspect lock file: %w", err)
+		}
+		if err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
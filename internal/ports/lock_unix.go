@@ -0,0 +1,25 @@
+//go:build unix
+
+package ports
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on path, blocking until it is available.
+// The lock is released by the returned function, or when the process exits.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, FilePermissions)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
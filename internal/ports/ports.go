@@ -0,0 +1,157 @@
+// Package ports hands out free local TCP ports for the forwards of q2boot VMs.
+//
+// Probing a port and QEMU binding it are two separate steps, so two q2boot
+// invocations started at the same time could both pick the same port.
+// Allocations are therefore recorded in a reservation file in the runtime
+// directory, which is only read and written while holding an exclusive lock
+// on a lock file next to it. A reservation lasts as long as the process that
+// made it: by the time it exits, QEMU has either bound the port or is gone.
+package ports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/state"
+	"github.com/ilmanzo/q2boot/internal/xdg"
+)
+
+// Allocation constants
+const (
+	DirPermissions       = 0700
+	FilePermissions      = 0600
+	LockFileName         = "ports.lock"
+	ReservationsFileName = "ports.json"
+	MaxScan              = 1000 // Number of ports tried above the first one
+)
+
+// Dir returns the directory holding the lock and reservation files.
+var Dir = xdg.RuntimeDir
+
+// Available reports whether port can currently be bound on localhost.
+var Available = func(port uint16) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// Reservation records a port handed out to a q2boot process.
+type Reservation struct {
+	Port       uint16    `json:"port"`
+	PID        int       `json:"pid"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+// Allocate returns the first free port at or above first that is not reserved
+// by another running q2boot process, and reserves it for the current process.
+// Ports listed in skip, e.g. ones the VM already uses, are never returned.
+func Allocate(first uint16, skip ...uint16) (uint16, error) {
+	var port uint16
+	err := withReservations(func(reservations map[uint16]Reservation) error {
+		for i := 0; i <= MaxScan && int(first)+i <= 65535; i++ {
+			candidate := first + uint16(i)
+			if _, taken := reservations[candidate]; taken || slices.Contains(skip, candidate) || !Available(candidate) {
+				continue
+			}
+			reservations[candidate] = Reservation{Port: candidate, PID: os.Getpid(), ReservedAt: time.Now()}
+			port = candidate
+			return nil
+		}
+		return fmt.Errorf("no free port found between %d and %d", first, int(first)+MaxScan)
+	})
+	return port, err
+}
+
+// Release drops the reservation of port made by the current process, so the
+// port can be handed out again once the VM using it is gone.
+func Release(port uint16) error {
+	return withReservations(func(reservations map[uint16]Reservation) error {
+		if r, ok := reservations[port]; ok && r.PID == os.Getpid() {
+			delete(reservations, port)
+		}
+		return nil
+	})
+}
+
+// withReservations locks the reservation file and calls fn with the live
+// reservations. Reservations of processes that have exited are dropped; the
+// map is written back if fn succeeds.
+func withReservations(fn func(map[uint16]Reservation) error) error {
+	dir := Dir()
+	if err := os.MkdirAll(dir, DirPermissions); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	unlock, err := lockFile(filepath.Join(dir, LockFileName))
+	if err != nil {
+		return fmt.Errorf("failed to lock port reservations: %w", err)
+	}
+	defer unlock()
+
+	path := filepath.Join(dir, ReservationsFileName)
+	reservations, err := load(path)
+	if err != nil {
+		return err
+	}
+	for port, r := range reservations {
+		if !state.ProcessAlive(r.PID) {
+			delete(reservations, port)
+		}
+	}
+
+	if err := fn(reservations); err != nil {
+		return err
+	}
+	return save(path, reservations)
+}
+
+// load reads the reservation file, which may not exist yet.
+func load(path string) (map[uint16]Reservation, error) {
+	reservations := make(map[uint16]Reservation)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reservations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read port reservations: %w", err)
+	}
+
+	var list []Reservation
+	if err := json.Unmarshal(data, &list); err != nil {
+		// A corrupt file only loses stale reservations; start over.
+		return reservations, nil
+	}
+	for _, r := range list {
+		reservations[r.Port] = r
+	}
+	return reservations, nil
+}
+
+// save writes the reservations sorted by port.
+func save(path string, reservations map[uint16]Reservation) error {
+	list := make([]Reservation, 0, len(reservations))
+	for _, r := range reservations {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, FilePermissions); err != nil {
+		return fmt.Errorf("failed to write port reservations: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
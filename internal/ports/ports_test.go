@@ -0,0 +1,132 @@
+package ports
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupDir points the reservation files at a fresh temporary directory and
+// treats every port as free unless listed in busy.
+func setupDir(t *testing.T, busy ...uint16) string {
+	t.Helper()
+	dir := t.TempDir()
+	origDir, origAvailable := Dir, Available
+	Dir = func() string { return dir }
+	Available = func(port uint16) bool {
+		for _, b := range busy {
+			if port == b {
+				return false
+			}
+		}
+		return true
+	}
+	t.Cleanup(func() { Dir, Available = origDir, origAvailable })
+	return dir
+}
+
+func TestAllocateSkipsBusyPorts(t *testing.T) {
+	setupDir(t, 2222, 2223)
+
+	port, err := Allocate(2222)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if port != 2224 {
+		t.Errorf("Allocate() = %d, want 2224", port)
+	}
+}
+
+func TestAllocateSkipsListedPorts(t *testing.T) {
+	setupDir(t)
+
+	port, err := Allocate(2222, 2222, 2224)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if port != 2223 {
+		t.Errorf("Allocate() = %d, want 2223", port)
+	}
+}
+
+func TestAllocateSkipsReservedPorts(t *testing.T) {
+	setupDir(t)
+
+	var wg sync.WaitGroup
+	got := make(chan uint16, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, err := Allocate(2222)
+			if err != nil {
+				t.Errorf("Allocate() failed: %v", err)
+				return
+			}
+			got <- port
+		}()
+	}
+	wg.Wait()
+	close(got)
+
+	seen := make(map[uint16]bool)
+	for port := range got {
+		if seen[port] {
+			t.Errorf("port %d was allocated twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+func TestAllocateReclaimsDeadReservations(t *testing.T) {
+	dir := setupDir(t)
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run 'true': %v", err)
+	}
+	data, _ := json.Marshal([]Reservation{{Port: 2222, PID: cmd.Process.Pid, ReservedAt: time.Now()}})
+	if err := os.WriteFile(filepath.Join(dir, ReservationsFileName), data, FilePermissions); err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := Allocate(2222)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if port != 2222 {
+		t.Errorf("Allocate() = %d, want the reclaimed port 2222", port)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	setupDir(t)
+
+	first, err := Allocate(2222)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if err := Release(first); err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+	again, err := Allocate(2222)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if again != first {
+		t.Errorf("Allocate() after Release() = %d, want %d", again, first)
+	}
+}
+
+func TestAllocateNoFreePort(t *testing.T) {
+	setupDir(t)
+	Available = func(uint16) bool { return false }
+
+	if _, err := Allocate(2222); err == nil {
+		t.Error("Allocate() succeeded although no port is free")
+	}
+}
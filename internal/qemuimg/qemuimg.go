@@ -0,0 +1,57 @@
+// Package qemuimg wraps the qemu-img invocations used to manage images
+// backed by other images.
+package qemuimg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Binary is the qemu-img tool.
+const Binary = "qemu-img"
+
+// Run runs qemu-img and returns its standard output. It's a variable so
+// tests can mock it.
+var Run = func(args ...string) ([]byte, error) {
+	cmd := exec.Command(Binary, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s %s failed: %w: %s", Binary, args[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s %s failed: %w", Binary, args[0], err)
+	}
+	return out, nil
+}
+
+// Format returns the image format of the image at path.
+func Format(path string) (string, error) {
+	out, err := Run("info", "--output=json", path)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil || info.Format == "" {
+		return "", fmt.Errorf("failed to determine the format of '%s'", path)
+	}
+	return info.Format, nil
+}
+
+// CreateBacked creates an empty qcow2 image at path backed by base, whose
+// format is baseFormat.
+func CreateBacked(path, base, baseFormat string) error {
+	_, err := Run("create", "-q", "-f", "qcow2", "-F", baseFormat, "-b", base, path)
+	return err
+}
+
+// Commit writes the changes of the image at path into its backing image.
+func Commit(path string) error {
+	_, err := Run("commit", "-q", path)
+	return err
+}
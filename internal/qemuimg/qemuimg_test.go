@@ -0,0 +1,41 @@
+package qemuimg
+
+import (
+	"slices"
+	"testing"
+)
+
+func mockRun(t *testing.T, out string) *[][]string {
+	t.Helper()
+	original := Run
+	t.Cleanup(func() { Run = original })
+	var calls [][]string
+	Run = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return []byte(out), nil
+	}
+	return &calls
+}
+
+func TestFormat(t *testing.T) {
+	mockRun(t, `{"virtual-size": 21474836480, "filename": "disk.qcow2", "format": "qcow2"}`)
+	if format, err := Format("disk.qcow2"); err != nil || format != "qcow2" {
+		t.Errorf("Format() = %q, %v, want qcow2", format, err)
+	}
+
+	mockRun(t, `{}`)
+	if _, err := Format("disk.qcow2"); err == nil {
+		t.Error("Format() accepted qemu-img output without a format")
+	}
+}
+
+func TestCreateBacked(t *testing.T) {
+	calls := mockRun(t, "")
+	if err := CreateBacked("/tmp/clone.qcow2", "/srv/base.img", "raw"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"create", "-q", "-f", "qcow2", "-F", "raw", "-b", "/srv/base.img", "/tmp/clone.qcow2"}
+	if len(*calls) != 1 || !slices.Equal((*calls)[0], want) {
+		t.Errorf("qemu-img %v, want %v", *calls, want)
+	}
+}
@@ -0,0 +1,408 @@
+// Package qga implements a client for the QEMU guest agent (qemu-ga).
+//
+// The agent runs inside the guest and talks JSON over a virtio-serial port,
+// which QEMU exposes on the host as a unix socket. Unlike QMP there is no
+// greeting, and a new connection may find responses meant for a previous
+// client in the stream, so the client synchronizes with guest-sync-delimited
+// first. Commands are executed one at a time.
+package qga
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ChannelName is the virtio-serial port name the agent listens on.
+const ChannelName = "org.qemu.guest_agent.0"
+
+// DefaultDialTimeout is the time Dial waits for the agent to answer.
+const DefaultDialTimeout = 5 * time.Second
+
+// execPollInterval is how often Run checks whether a command has exited.
+const execPollInterval = 100 * time.Millisecond
+
+// syncDelimiter resets the agent's parser and precedes the response to
+// guest-sync-delimited.
+const syncDelimiter = 0xFF
+
+// Shutdown modes of guest-shutdown
+const (
+	ShutdownPowerdown = "powerdown"
+	ShutdownReboot    = "reboot"
+	ShutdownHalt      = "halt"
+)
+
+// ErrNotResponding is returned by Dial when the agent does not answer,
+// usually because qemu-guest-agent is not running in the guest.
+var ErrNotResponding = errors.New("qga: guest agent is not responding")
+
+// Error is an error response returned by the agent for a failed command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qga: %s: %s", e.Class, e.Desc)
+}
+
+// command is a request sent to the agent.
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+// response is a reply from the agent.
+type response struct {
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// Client is a guest agent connection. It is not safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// Dial connects to the guest agent socket and synchronizes with the agent.
+func Dial(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent socket '%s': %w", socketPath, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := NewClient(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient synchronizes with the agent over an established connection. The
+// client takes ownership of conn.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	// The delimiter resets the agent's parser, in case a previous client
+	// left a partial command behind.
+	id := rand.Int63n(1 << 31)
+	data, err := json.Marshal(command{Execute: "guest-sync-delimited", Arguments: map[string]int64{"id": id}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{syncDelimiter}, append(data, '\n')...)); err != nil {
+		return nil, fmt.Errorf("failed to synchronize with guest agent: %w", err)
+	}
+
+	// Skip anything meant for previous clients up to the delimiter, then
+	// responses up to the one carrying our ID.
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadBytes(syncDelimiter); err != nil {
+		return nil, syncError(err)
+	}
+	dec := json.NewDecoder(reader)
+	for {
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			return nil, syncError(err)
+		}
+		var got int64
+		if resp.Error == nil && json.Unmarshal(resp.Return, &got) == nil && got == id {
+			break
+		}
+	}
+	return &Client{conn: conn, dec: dec}, nil
+}
+
+// syncError wraps an error hit while synchronizing.
+func syncError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrNotResponding
+	}
+	return fmt.Errorf("failed to synchronize with guest agent: %w", err)
+}
+
+// interruptOnDone makes blocked reads and writes on conn fail once ctx is
+// done. The returned function stops that.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// Close closes the connection to the agent.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// send writes a command to the agent.
+func (c *Client) send(name string, args any) error {
+	data, err := json.Marshal(command{Execute: name, Arguments: args})
+	if err != nil {
+		return fmt.Errorf("failed to encode guest agent command '%s': %w", name, err)
+	}
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to send guest agent command '%s': %w", name, err)
+	}
+	return nil
+}
+
+// Execute runs an agent command with optional arguments and decodes the
+// return value into result, which may be nil.
+func (c *Client) Execute(ctx context.Context, name string, args any, result any) error {
+	stop := interruptOnDone(ctx, c.conn)
+	defer stop()
+
+	if err := c.send(name, args); err != nil {
+		return err
+	}
+	var resp response
+	if err := c.dec.Decode(&resp); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to read guest agent response for '%s': %w", name, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && len(resp.Return) > 0 {
+		if err := json.Unmarshal(resp.Return, result); err != nil {
+			return fmt.Errorf("failed to decode guest agent response for '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Ping checks that the agent is responsive.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Execute(ctx, "guest-ping", nil, nil)
+}
+
+// Shutdown asks the agent to shut the guest down in the given mode. The
+// agent does not reply on success, so only sending the command can fail.
+func (c *Client) Shutdown(ctx context.Context, mode string) error {
+	stop := interruptOnDone(ctx, c.conn)
+	defer stop()
+	return c.send("guest-shutdown", map[string]string{"mode": mode})
+}
+
+// execArgs are the arguments of guest-exec.
+type execArgs struct {
+	Path          string   `json:"path"`
+	Arg           []string `json:"arg,omitempty"`
+	InputData     []byte   `json:"input-data,omitempty"` // base64 encoded by encoding/json
+	CaptureOutput bool     `json:"capture-output"`
+}
+
+// Exec starts a program in the guest, capturing its output, and returns its
+// PID. The agent looks path up in the guest's PATH.
+func (c *Client) Exec(ctx context.Context, path string, args []string, input []byte) (int, error) {
+	var result struct {
+		PID int `json:"pid"`
+	}
+	err := c.Execute(ctx, "guest-exec", execArgs{Path: path, Arg: args, InputData: input, CaptureOutput: true}, &result)
+	return result.PID, err
+}
+
+// ExecStatus is the state of a program started with Exec.
+type ExecStatus struct {
+	Exited   bool
+	ExitCode int
+	Signal   int // Set instead of ExitCode if the program was killed
+	Stdout   []byte
+	Stderr   []byte
+
+	// StdoutTruncated and StderrTruncated report that the agent dropped
+	// output beyond its capture limit.
+	StdoutTruncated bool
+	StderrTruncated bool
+}
+
+// ExecStatus returns the state of the program with the given PID. The
+// output is collected by the agent until the program exits and returned once.
+func (c *Client) ExecStatus(ctx context.Context, pid int) (*ExecStatus, error) {
+	var result struct {
+		Exited       bool   `json:"exited"`
+		ExitCode     int    `json:"exitcode"`
+		Signal       int    `json:"signal"`
+		OutData      string `json:"out-data"`
+		ErrData      string `json:"err-data"`
+		OutTruncated bool   `json:"out-truncated"`
+		ErrTruncated bool   `json:"err-truncated"`
+	}
+	if err := c.Execute(ctx, "guest-exec-status", map[string]int{"pid": pid}, &result); err != nil {
+		return nil, err
+	}
+
+	status := &ExecStatus{
+		Exited:          result.Exited,
+		ExitCode:        result.ExitCode,
+		Signal:          result.Signal,
+		StdoutTruncated: result.OutTruncated,
+		StderrTruncated: result.ErrTruncated,
+	}
+	var err error
+	if status.Stdout, err = base64.StdEncoding.DecodeString(result.OutData); err != nil {
+		return nil, fmt.Errorf("invalid output from guest agent: %w", err)
+	}
+	if status.Stderr, err = base64.StdEncoding.DecodeString(result.ErrData); err != nil {
+		return nil, fmt.Errorf("invalid output from guest agent: %w", err)
+	}
+	return status, nil
+}
+
+// Run runs a program in the guest and waits for it to exit.
+func (c *Client) Run(ctx context.Context, path string, args []string, input []byte) (*ExecStatus, error) {
+	pid, err := c.Exec(ctx, path, args, input)
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(execPollInterval)
+	defer ticker.Stop()
+	for {
+		status, err := c.ExecStatus(ctx, pid)
+		if err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// FileOpen opens a file in the guest with an fopen mode such as "r" or "w"
+// and returns its handle.
+func (c *Client) FileOpen(ctx context.Context, path, mode string) (int, error) {
+	var handle int
+	err := c.Execute(ctx, "guest-file-open", map[string]string{"path": path, "mode": mode}, &handle)
+	return handle, err
+}
+
+// FileRead reads up to count bytes from an open file. eof reports that the
+// end of the file was reached.
+func (c *Client) FileRead(ctx context.Context, handle, count int) (data []byte, eof bool, err error) {
+	var result struct {
+		Count  int    `json:"count"`
+		BufB64 string `json:"buf-b64"`
+		EOF    bool   `json:"eof"`
+	}
+	if err := c.Execute(ctx, "guest-file-read", map[string]int{"handle": handle, "count": count}, &result); err != nil {
+		return nil, false, err
+	}
+	if data, err = base64.StdEncoding.DecodeString(result.BufB64); err != nil {
+		return nil, false, fmt.Errorf("invalid file data from guest agent: %w", err)
+	}
+	return data, result.EOF, nil
+}
+
+// FileWrite writes data to an open file and returns the number of bytes written.
+func (c *Client) FileWrite(ctx context.Context, handle int, data []byte) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	args := map[string]any{"handle": handle, "buf-b64": base64.StdEncoding.EncodeToString(data)}
+	err := c.Execute(ctx, "guest-file-write", args, &result)
+	return result.Count, err
+}
+
+// FileClose closes an open file.
+func (c *Client) FileClose(ctx context.Context, handle int) error {
+	return c.Execute(ctx, "guest-file-close", map[string]int{"handle": handle}, nil)
+}
+
+// fileChunkSize is the size of the reads ReadFile makes. The agent limits
+// the size of a single read to a few MB.
+const fileChunkSize = 1 << 20
+
+// ReadFile reads a whole file from the guest.
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	handle, err := c.FileOpen(ctx, path, "r")
+	if err != nil {
+		return nil, err
+	}
+	defer c.FileClose(ctx, handle)
+
+	var data []byte
+	for {
+		chunk, eof, err := c.FileRead(ctx, handle, fileChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if eof || len(chunk) == 0 {
+			return data, nil
+		}
+	}
+}
+
+// WriteFile writes data to a file in the guest, replacing its content.
+func (c *Client) WriteFile(ctx context.Context, path string, data []byte) error {
+	handle, err := c.FileOpen(ctx, path, "w")
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), fileChunkSize)]
+		n, err := c.FileWrite(ctx, handle, chunk)
+		if err != nil {
+			c.FileClose(ctx, handle)
+			return err
+		}
+		if n == 0 {
+			c.FileClose(ctx, handle)
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return c.FileClose(ctx, handle)
+}
+
+// IPAddress is an address of a guest network interface.
+type IPAddress struct {
+	Type    string `json:"ip-address-type"` // "ipv4" or "ipv6"
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+func (a IPAddress) String() string {
+	return fmt.Sprintf("%s/%d", a.Address, a.Prefix)
+}
+
+// Interface is a guest network interface.
+type Interface struct {
+	Name            string      `json:"name"`
+	HardwareAddress string      `json:"hardware-address"`
+	IPAddresses     []IPAddress `json:"ip-addresses"`
+}
+
+// NetworkInterfaces returns the guest's network interfaces.
+func (c *Client) NetworkInterfaces(ctx context.Context) ([]Interface, error) {
+	var interfaces []Interface
+	if err := c.Execute(ctx, "guest-network-get-interfaces", nil, &interfaces); err != nil {
+		return nil, err
+	}
+	return interfaces, nil
+}
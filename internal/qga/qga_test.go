@@ -0,0 +1,207 @@
+package qga
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeAgent is a minimal guest agent used to exercise the client.
+type fakeAgent struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	t      *testing.T
+}
+
+func (f *fakeAgent) send(v string) {
+	if _, err := f.conn.Write([]byte(v)); err != nil {
+		f.t.Errorf("fake agent write failed: %v", err)
+	}
+}
+
+func (f *fakeAgent) recv() map[string]any {
+	line, err := f.reader.ReadBytes('\n')
+	if err != nil {
+		f.t.Errorf("fake agent read failed: %v", err)
+		return nil
+	}
+	var cmd map[string]any
+	if err := json.Unmarshal(line, &cmd); err != nil {
+		f.t.Errorf("fake agent got invalid JSON %q: %v", line, err)
+	}
+	return cmd
+}
+
+// sync answers guest-sync-delimited after a stale response meant for a
+// previous client.
+func (f *fakeAgent) sync() {
+	if b, err := f.reader.ReadByte(); err != nil || b != syncDelimiter {
+		f.t.Errorf("expected the sync delimiter first, got %#x (%v)", b, err)
+	}
+	cmd := f.recv()
+	if cmd["execute"] != "guest-sync-delimited" {
+		f.t.Errorf("expected guest-sync-delimited, got %v", cmd)
+		return
+	}
+	id := cmd["arguments"].(map[string]any)["id"].(float64)
+	f.send(`{"return": {"pid": 1}}` + "\n")
+	f.send(fmt.Sprintf("\xff{\"return\": 12345}\n{\"return\": %d}\n", int64(id)))
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeAgent) {
+	clientConn, agentConn := net.Pipe()
+	agent := &fakeAgent{conn: agentConn, reader: bufio.NewReader(agentConn), t: t}
+	go agent.sync()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, clientConn)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		agentConn.Close()
+	})
+	return client, agent
+}
+
+func TestSync(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		if cmd := agent.recv(); cmd["execute"] != "guest-ping" {
+			t.Errorf("expected guest-ping, got %v", cmd)
+		}
+		agent.send(`{"return": {}}` + "\n")
+	}()
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() after sync failed: %v", err)
+	}
+}
+
+func TestSyncNotResponding(t *testing.T) {
+	clientConn, agentConn := net.Pipe()
+	defer agentConn.Close()
+	go func() {
+		// Swallow the sync request without answering.
+		buf := make([]byte, 256)
+		for {
+			if _, err := agentConn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := NewClient(ctx, clientConn); !errors.Is(err, ErrNotResponding) {
+		t.Errorf("NewClient() error = %v, want ErrNotResponding", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		cmd := agent.recv()
+		args, _ := cmd["arguments"].(map[string]any)
+		if cmd["execute"] != "guest-exec" || args["path"] != "uname" || args["capture-output"] != true {
+			t.Errorf("unexpected guest-exec request: %v", cmd)
+		}
+		if input := args["input-data"]; input != "aGk=" {
+			t.Errorf("input-data = %v, want base64 of 'hi'", input)
+		}
+		agent.send(`{"return": {"pid": 42}}` + "\n")
+
+		agent.recv()
+		agent.send(`{"return": {"exited": false}}` + "\n")
+		if cmd := agent.recv(); cmd["arguments"].(map[string]any)["pid"] != float64(42) {
+			t.Errorf("guest-exec-status for the wrong PID: %v", cmd)
+		}
+		agent.send(`{"return": {"exited": true, "exitcode": 3, "out-data": "TGludXgK", "err-data": "b29wcwo="}}` + "\n")
+	}()
+
+	status, err := client.Run(context.Background(), "uname", []string{"-s"}, []byte("hi"))
+	if err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	if !status.Exited || status.ExitCode != 3 || string(status.Stdout) != "Linux\n" || string(status.Stderr) != "oops\n" {
+		t.Errorf("Run() = %+v", status)
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		agent.recv()
+		agent.send(`{"error": {"class": "GenericError", "desc": "Guest agent command failed"}}` + "\n")
+	}()
+	_, err := client.Exec(context.Background(), "/missing", nil, nil)
+	var qgaErr *Error
+	if !errors.As(err, &qgaErr) || qgaErr.Class != "GenericError" {
+		t.Errorf("Exec() error = %v, want a GenericError", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		if cmd := agent.recv(); cmd["execute"] != "guest-file-open" {
+			t.Errorf("expected guest-file-open, got %v", cmd)
+		}
+		agent.send(`{"return": 1000}` + "\n")
+		agent.recv()
+		agent.send(`{"return": {"count": 3, "buf-b64": "SElE", "eof": false}}` + "\n")
+		agent.recv()
+		agent.send(`{"return": {"count": 1, "buf-b64": "Cg==", "eof": true}}` + "\n")
+		if cmd := agent.recv(); cmd["execute"] != "guest-file-close" {
+			t.Errorf("expected guest-file-close, got %v", cmd)
+		}
+		agent.send(`{"return": {}}` + "\n")
+	}()
+
+	data, err := client.ReadFile(context.Background(), "/etc/hostname")
+	if err != nil || string(data) != "HID\n" {
+		t.Errorf("ReadFile() = %q, %v", data, err)
+	}
+}
+
+func TestNetworkInterfaces(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		agent.recv()
+		agent.send(`{"return": [{"name": "eth0", "hardware-address": "52:54:00:12:34:56",
+			"ip-addresses": [{"ip-address-type": "ipv4", "ip-address": "10.0.2.15", "prefix": 24}]}]}` + "\n")
+	}()
+
+	interfaces, err := client.NetworkInterfaces(context.Background())
+	if err != nil {
+		t.Fatalf("NetworkInterfaces() failed: %v", err)
+	}
+	if len(interfaces) != 1 || interfaces[0].Name != "eth0" || interfaces[0].IPAddresses[0].String() != "10.0.2.15/24" {
+		t.Errorf("NetworkInterfaces() = %+v", interfaces)
+	}
+}
+
+func TestShutdownDoesNotWait(t *testing.T) {
+	client, agent := newTestClient(t)
+
+	go func() {
+		cmd := agent.recv()
+		if cmd["execute"] != "guest-shutdown" || cmd["arguments"].(map[string]any)["mode"] != ShutdownPowerdown {
+			t.Errorf("unexpected shutdown request: %v", cmd)
+		}
+	}()
+	if err := client.Shutdown(context.Background(), ShutdownPowerdown); err != nil {
+		t.Errorf("Shutdown() failed: %v", err)
+	}
+}
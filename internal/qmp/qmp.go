@@ -0,0 +1,337 @@
+// Package qmp implements a client for the QEMU Machine Protocol (QMP).
+//
+// QMP is a JSON based protocol exposed by QEMU on a socket. A client receives
+// a greeting, negotiates capabilities and can then execute commands and
+// receive asynchronous events such as SHUTDOWN or GUEST_PANICKED.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Asynchronous event names emitted by QEMU that q2boot cares about.
+const (
+	EventShutdown      = "SHUTDOWN"
+	EventPowerdown     = "POWERDOWN"
+	EventReset         = "RESET"
+	EventStop          = "STOP"
+	EventResume        = "RESUME"
+	EventGuestPanicked = "GUEST_PANICKED"
+)
+
+// DefaultDialTimeout is the time Dial waits for the socket and the greeting.
+const DefaultDialTimeout = 5 * time.Second
+
+// eventBufferSize is the number of events buffered before new ones are dropped.
+const eventBufferSize = 64
+
+// ErrClosed is returned when a command is executed on a closed client.
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Error is a QMP error response returned by QEMU for a failed command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+// Timestamp is the time at which QEMU emitted an event.
+type Timestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
+}
+
+// Time converts the timestamp to a time.Time.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(t.Seconds, t.Microseconds*int64(time.Microsecond))
+}
+
+// Event is an asynchronous notification sent by QEMU.
+type Event struct {
+	Name      string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp Timestamp       `json:"timestamp"`
+}
+
+// Version describes the QEMU version announced in the greeting.
+type Version struct {
+	QEMU struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	} `json:"qemu"`
+	Package string `json:"package"`
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.QEMU.Major, v.QEMU.Minor, v.QEMU.Micro)
+}
+
+// greeting is the first message sent by QEMU on a new connection.
+type greeting struct {
+	QMP struct {
+		Version      Version  `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// command is a request sent to QEMU.
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        uint64 `json:"id"`
+}
+
+// message is any message received from QEMU: a response or an event.
+type message struct {
+	Return    json.RawMessage `json:"return,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+	ID        *uint64         `json:"id,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp Timestamp       `json:"timestamp"`
+}
+
+// Client is a QMP connection. It is safe for concurrent use; commands are
+// serialized since QMP processes one command at a time.
+type Client struct {
+	conn    net.Conn
+	version Version
+
+	cmdMu  sync.Mutex // serializes commands
+	nextID uint64
+
+	respMu  sync.Mutex
+	pending map[uint64]chan message
+
+	events chan Event
+	done   chan struct{}
+	err    error // set before done is closed
+}
+
+// Dial connects to a QMP unix socket and performs the capabilities handshake.
+func Dial(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP socket '%s': %w", socketPath, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// NewClient performs the QMP handshake over an established connection and
+// starts delivering events. The client takes ownership of conn.
+func NewClient(conn net.Conn) (*Client, error) {
+	reader := bufio.NewReader(conn)
+	dec := json.NewDecoder(reader)
+
+	var g greeting
+	if err := dec.Decode(&g); err != nil {
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(command{Execute: "qmp_capabilities"}); err != nil {
+		return nil, fmt.Errorf("failed to negotiate QMP capabilities: %w", err)
+	}
+	// Events are not emitted before capabilities negotiation completes,
+	// so the next message must be the response.
+	var resp message
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read QMP capabilities response: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	c := &Client{
+		conn:    conn,
+		version: g.QMP.Version,
+		nextID:  1,
+		pending: make(map[uint64]chan message),
+		events:  make(chan Event, eventBufferSize),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop(dec)
+	return c, nil
+}
+
+// Version returns the QEMU version reported during the handshake.
+func (c *Client) Version() Version {
+	return c.version
+}
+
+// Events returns the channel on which asynchronous events are delivered.
+// The channel is closed when the connection terminates. Events are dropped
+// if the channel buffer is full.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done returns a channel that is closed when the connection terminates,
+// typically because QEMU exited.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection to QEMU.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// readLoop dispatches responses to waiting commands and events to the
+// events channel until the connection fails.
+func (c *Client) readLoop(dec *json.Decoder) {
+	var err error
+	for {
+		var msg message
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+
+		if msg.Event != "" {
+			select {
+			case c.events <- Event{Name: msg.Event, Data: msg.Data, Timestamp: msg.Timestamp}:
+			default:
+			}
+			continue
+		}
+
+		if msg.ID == nil {
+			continue
+		}
+		c.respMu.Lock()
+		ch, ok := c.pending[*msg.ID]
+		delete(c.pending, *msg.ID)
+		c.respMu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+
+	c.err = err
+	close(c.done)
+	close(c.events)
+}
+
+// Execute runs a QMP command with optional arguments and decodes the return
+// value into result, which may be nil.
+func (c *Client) Execute(ctx context.Context, name string, args any, result any) error {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	id := c.nextID
+	c.nextID++
+	ch := make(chan message, 1)
+
+	c.respMu.Lock()
+	c.pending[id] = ch
+	c.respMu.Unlock()
+	defer func() {
+		c.respMu.Lock()
+		delete(c.pending, id)
+		c.respMu.Unlock()
+	}()
+
+	data, err := json.Marshal(command{Execute: name, Arguments: args, ID: id})
+	if err != nil {
+		return fmt.Errorf("failed to encode QMP command '%s': %w", name, err)
+	}
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to send QMP command '%s': %w", name, err)
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil && len(msg.Return) > 0 {
+			if err := json.Unmarshal(msg.Return, result); err != nil {
+				return fmt.Errorf("failed to decode QMP response for '%s': %w", name, err)
+			}
+		}
+		return nil
+	case <-c.done:
+		// "quit" legitimately closes the connection before or right after
+		// the response is delivered.
+		if name == "quit" {
+			return nil
+		}
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StatusInfo is the result of the query-status command.
+type StatusInfo struct {
+	Running    bool   `json:"running"`
+	Singlestep bool   `json:"singlestep"`
+	Status     string `json:"status"`
+}
+
+// QueryStatus returns the run state of the VM.
+func (c *Client) QueryStatus(ctx context.Context) (*StatusInfo, error) {
+	var info StatusInfo
+	if err := c.Execute(ctx, "query-status", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SystemPowerdown requests an ACPI powerdown of the guest.
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	return c.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+// SystemReset resets the guest.
+func (c *Client) SystemReset(ctx context.Context) error {
+	return c.Execute(ctx, "system_reset", nil, nil)
+}
+
+// Stop pauses guest execution.
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Cont resumes guest execution.
+func (c *Client) Cont(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
+
+// Quit terminates QEMU immediately.
+func (c *Client) Quit(ctx context.Context) error {
+	return c.Execute(ctx, "quit", nil, nil)
+}
+
+// HumanMonitorCommand runs a HMP command through QMP and returns its output.
+func (c *Client) HumanMonitorCommand(ctx context.Context, cmdline string) (string, error) {
+	var out string
+	args := map[string]string{"command-line": cmdline}
+	if err := c.Execute(ctx, "human-monitor-command", args, &out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
@@ -0,0 +1,195 @@
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeQEMU is a minimal QMP server used to exercise the client.
+type fakeQEMU struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	t       *testing.T
+}
+
+func newFakeQEMU(t *testing.T, conn net.Conn) *fakeQEMU {
+	return &fakeQEMU{conn: conn, scanner: bufio.NewScanner(conn), t: t}
+}
+
+func (f *fakeQEMU) send(v string) {
+	if _, err := f.conn.Write([]byte(v + "\n")); err != nil {
+		f.t.Errorf("fake QEMU write failed: %v", err)
+	}
+}
+
+func (f *fakeQEMU) recv() map[string]any {
+	if !f.scanner.Scan() {
+		f.t.Errorf("fake QEMU read failed: %v", f.scanner.Err())
+		return nil
+	}
+	var cmd map[string]any
+	if err := json.Unmarshal(f.scanner.Bytes(), &cmd); err != nil {
+		f.t.Errorf("fake QEMU got invalid JSON %q: %v", f.scanner.Text(), err)
+	}
+	return cmd
+}
+
+func (f *fakeQEMU) handshake() {
+	f.send(`{"QMP": {"version": {"qemu": {"micro": 1, "minor": 2, "major": 8}, "package": ""}, "capabilities": []}}`)
+	if cmd := f.recv(); cmd["execute"] != "qmp_capabilities" {
+		f.t.Errorf("expected qmp_capabilities, got %v", cmd)
+	}
+	f.send(`{"return": {}}`)
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeQEMU) {
+	clientConn, serverConn := net.Pipe()
+	server := newFakeQEMU(t, serverConn)
+	go server.handshake()
+
+	client, err := NewClient(clientConn)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return client, server
+}
+
+func TestHandshake(t *testing.T) {
+	client, _ := newTestClient(t)
+	if got := client.Version().String(); got != "8.2.1" {
+		t.Errorf("Version() = %s, want 8.2.1", got)
+	}
+}
+
+func TestExecuteQueryStatus(t *testing.T) {
+	client, server := newTestClient(t)
+
+	go func() {
+		cmd := server.recv()
+		if cmd["execute"] != "query-status" {
+			t.Errorf("expected query-status, got %v", cmd["execute"])
+		}
+		// An event may arrive before the response.
+		server.send(`{"event": "RESUME", "timestamp": {"seconds": 1, "microseconds": 2}}`)
+		server.send(`{"return": {"status": "running", "singlestep": false, "running": true}, "id": ` + jsonNumber(cmd["id"]) + `}`)
+	}()
+
+	status, err := client.QueryStatus(context.Background())
+	if err != nil {
+		t.Fatalf("QueryStatus() failed: %v", err)
+	}
+	if !status.Running || status.Status != "running" {
+		t.Errorf("QueryStatus() = %+v, want running", status)
+	}
+
+	select {
+	case ev := <-client.Events():
+		if ev.Name != EventResume {
+			t.Errorf("expected RESUME event, got %s", ev.Name)
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for RESUME event")
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	client, server := newTestClient(t)
+
+	go func() {
+		cmd := server.recv()
+		server.send(`{"error": {"class": "CommandNotFound", "desc": "The command foo has not been found"}, "id": ` + jsonNumber(cmd["id"]) + `}`)
+	}()
+
+	err := client.Execute(context.Background(), "foo", nil, nil)
+	var qmpErr *Error
+	if !errors.As(err, &qmpErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if qmpErr.Class != "CommandNotFound" {
+		t.Errorf("expected class CommandNotFound, got %s", qmpErr.Class)
+	}
+}
+
+func TestEventsDelivered(t *testing.T) {
+	client, server := newTestClient(t)
+
+	go func() {
+		server.send(`{"event": "SHUTDOWN", "data": {"guest": true, "reason": "guest-shutdown"}, "timestamp": {"seconds": 10, "microseconds": 0}}`)
+		server.send(`{"event": "GUEST_PANICKED", "data": {"action": "pause"}, "timestamp": {"seconds": 11, "microseconds": 0}}`)
+	}()
+
+	for _, want := range []string{EventShutdown, EventGuestPanicked} {
+		select {
+		case ev := <-client.Events():
+			if ev.Name != want {
+				t.Errorf("expected %s event, got %s", want, ev.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", want)
+		}
+	}
+}
+
+func TestQuitToleratesClosedConnection(t *testing.T) {
+	client, server := newTestClient(t)
+
+	go func() {
+		server.recv()
+		server.conn.Close()
+	}()
+
+	if err := client.Quit(context.Background()); err != nil {
+		t.Errorf("Quit() should not fail when QEMU closes the connection, got %v", err)
+	}
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Error("Done() was not closed after the connection terminated")
+	}
+	if err := client.SystemPowerdown(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after disconnect, got %v", err)
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on unix socket: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		newFakeQEMU(t, conn).handshake()
+	}()
+
+	client, err := Dial(socketPath, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	client.Close()
+
+	if _, err := Dial(filepath.Join(t.TempDir(), "missing.sock"), time.Second); err == nil {
+		t.Error("Dial() should fail for a missing socket")
+	}
+}
+
+func jsonNumber(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
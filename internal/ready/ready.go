@@ -0,0 +1,179 @@
+// Package ready detects when a booting VM has become usable, either because
+// its serial console printed an expected pattern or because the forwarded SSH
+// port answers with an SSH banner.
+package ready
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Probe timing constants
+const (
+	PollInterval     = 500 * time.Millisecond
+	SSHProbeInterval = 2 * time.Second
+	sshBannerTimeout = 5 * time.Second
+	// maxBufferSize bounds the console output kept for pattern matching.
+	maxBufferSize = 64 * 1024
+)
+
+// Condition describes when a VM is considered ready. All configured probes
+// must succeed.
+type Condition struct {
+	// Pattern is matched against the serial console output in LogFile.
+	Pattern *regexp.Regexp
+	LogFile string
+
+	// SSHAddr is a host:port that must answer with an SSH banner.
+	SSHAddr string
+}
+
+// Enabled reports whether the condition has any probe configured.
+func (c Condition) Enabled() bool {
+	return c.Pattern != nil || c.SSHAddr != ""
+}
+
+// String describes the condition for messages.
+func (c Condition) String() string {
+	var parts []string
+	if c.Pattern != nil {
+		parts = append(parts, fmt.Sprintf("serial output matching %q", c.Pattern.String()))
+	}
+	if c.SSHAddr != "" {
+		parts = append(parts, fmt.Sprintf("SSH on %s", c.SSHAddr))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Wait blocks until every probe in c succeeds or ctx is done.
+func Wait(ctx context.Context, c Condition) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	var probes []func(context.Context) error
+	if c.Pattern != nil {
+		probes = append(probes, func(ctx context.Context) error {
+			return WaitForPattern(ctx, c.LogFile, c.Pattern)
+		})
+	}
+	if c.SSHAddr != "" {
+		probes = append(probes, func(ctx context.Context) error {
+			return WaitForSSH(ctx, c.SSHAddr)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(probes))
+	for _, probe := range probes {
+		go func(probe func(context.Context) error) {
+			errs <- probe(ctx)
+		}(probe)
+	}
+
+	for range probes {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForPattern follows the file at path, like `tail -f`, until its content
+// matches re. The file may not exist yet and may be truncated while waiting.
+func WaitForPattern(ctx context.Context, path string, re *regexp.Regexp) error {
+	var buf []byte
+	var offset int64
+	chunk := make([]byte, 32*1024)
+
+	for {
+		if f, err := os.Open(path); err == nil {
+			if info, err := f.Stat(); err == nil && info.Size() < offset {
+				// The file was truncated (e.g. QEMU recreated the log)
+				offset, buf = 0, nil
+			}
+			f.Seek(offset, io.SeekStart)
+			for {
+				n, err := f.Read(chunk)
+				if n > 0 {
+					offset += int64(n)
+					buf = append(buf, chunk[:n]...)
+					if re.Match(buf) {
+						f.Close()
+						return nil
+					}
+					if len(buf) > maxBufferSize {
+						buf = buf[len(buf)-maxBufferSize/2:]
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+			f.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("serial output in '%s' did not match %q: %w", path, re.String(), context.Cause(ctx))
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// WaitForSSH waits until addr accepts a TCP connection and sends an SSH
+// protocol banner. Checking the banner matters because QEMU user networking
+// accepts forwarded connections even before the guest's sshd is listening.
+func WaitForSSH(ctx context.Context, addr string) error {
+	var lastErr error
+	for {
+		if lastErr = probeSSH(ctx, addr); lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("SSH on %s did not become ready (%v): %w", addr, lastErr, context.Cause(ctx))
+		case <-time.After(SSHProbeInterval):
+		}
+	}
+}
+
+// probeSSH performs a single SSH banner exchange with addr.
+func probeSSH(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: sshBannerTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sshBannerTimeout))
+	// Identify ourselves first, as the protocol allows either side to start.
+	if _, err := conn.Write([]byte("SSH-2.0-q2boot\r\n")); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("connection closed before SSH banner")
+			}
+			return err
+		}
+		// Servers may send other lines before the banner (RFC 4253, 4.2)
+	}
+}
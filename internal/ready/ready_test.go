@@ -0,0 +1,110 @@
+package ready
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestWaitForPattern(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "serial.log")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(logFile, []byte("Booting the kernel.\r\n"), 0644)
+		time.Sleep(100 * time.Millisecond)
+		f, _ := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+		f.WriteString("Welcome to openSUSE\r\n\r\nlocalhost login: ")
+		f.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForPattern(ctx, logFile, regexp.MustCompile(`login:`)); err != nil {
+		t.Fatalf("WaitForPattern() failed: %v", err)
+	}
+}
+
+func TestWaitForPatternTimeout(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "serial.log")
+	os.WriteFile(logFile, []byte("Kernel panic - not syncing\n"), 0644)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := WaitForPattern(ctx, logFile, regexp.MustCompile(`login:`)); err == nil {
+		t.Fatal("WaitForPattern() should fail when the pattern never appears")
+	}
+}
+
+// listenSSH starts a fake server; if banner is empty, connections are closed
+// immediately, like QEMU's port forwarding before sshd runs.
+func listenSSH(t *testing.T, banner string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestWaitForSSH(t *testing.T) {
+	addr := listenSSH(t, "SSH-2.0-OpenSSH_9.6\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForSSH(ctx, addr); err != nil {
+		t.Fatalf("WaitForSSH() failed: %v", err)
+	}
+}
+
+func TestWaitForSSHRequiresBanner(t *testing.T) {
+	addr := listenSSH(t, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := WaitForSSH(ctx, addr); err == nil {
+		t.Fatal("WaitForSSH() should fail when no SSH banner is sent")
+	}
+}
+
+func TestWaitAllProbes(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "serial.log")
+	os.WriteFile(logFile, []byte("localhost login: "), 0644)
+
+	cond := Condition{
+		Pattern: regexp.MustCompile(`login:`),
+		LogFile: logFile,
+		SSHAddr: listenSSH(t, "SSH-2.0-OpenSSH_9.6\r\n"),
+	}
+	if !cond.Enabled() {
+		t.Fatal("Enabled() should be true when probes are configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Wait(ctx, cond); err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+
+	if (Condition{}).Enabled() {
+		t.Error("Enabled() should be false for an empty condition")
+	}
+}
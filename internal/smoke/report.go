@@ -0,0 +1,237 @@
+package smoke
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Report is the outcome of a smoke test run.
+type Report struct {
+	Name      string
+	Image     string
+	Arch      string
+	StartedAt time.Time
+	Duration  time.Duration
+
+	Booted       bool
+	BootDuration time.Duration
+	BootError    string
+
+	Checks []CheckResult
+}
+
+// Passed reports whether the VM booted and every check passed.
+func (r *Report) Passed() bool {
+	return r.Booted && r.Failures() == 0
+}
+
+// Failures returns the number of checks that ran and failed.
+func (r *Report) Failures() int {
+	failures := 0
+	for _, check := range r.Checks {
+		if !check.Passed && !check.Skipped {
+			failures++
+		}
+	}
+	return failures
+}
+
+// jsonCheck and jsonReport define the JSON summary format.
+type jsonCheck struct {
+	Name            string  `json:"name"`
+	Command         string  `json:"command"`
+	Passed          bool    `json:"passed"`
+	Skipped         bool    `json:"skipped,omitempty"`
+	ExitCode        int     `json:"exit_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Output          string  `json:"output"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type jsonReport struct {
+	Name                string      `json:"name"`
+	Image               string      `json:"image"`
+	Arch                string      `json:"arch"`
+	Passed              bool        `json:"passed"`
+	StartedAt           time.Time   `json:"started_at"`
+	DurationSeconds     float64     `json:"duration_seconds"`
+	Booted              bool        `json:"booted"`
+	BootDurationSeconds float64     `json:"boot_duration_seconds"`
+	BootError           string      `json:"boot_error,omitempty"`
+	Checks              []jsonCheck `json:"checks"`
+}
+
+// summary converts the report to its JSON form.
+func (r *Report) summary() jsonReport {
+	summary := jsonReport{
+		Name:                r.Name,
+		Image:               r.Image,
+		Arch:                r.Arch,
+		Passed:              r.Passed(),
+		StartedAt:           r.StartedAt,
+		DurationSeconds:     r.Duration.Seconds(),
+		Booted:              r.Booted,
+		BootDurationSeconds: r.BootDuration.Seconds(),
+		BootError:           r.BootError,
+		Checks:              []jsonCheck{},
+	}
+	for _, check := range r.Checks {
+		summary.Checks = append(summary.Checks, jsonCheck{
+			Name:            check.Name,
+			Command:         check.Command,
+			Passed:          check.Passed,
+			Skipped:         check.Skipped,
+			ExitCode:        check.ExitCode,
+			DurationSeconds: check.Duration.Seconds(),
+			Output:          check.Output,
+			Error:           check.Error,
+		})
+	}
+	return summary
+}
+
+// WriteJSON writes the JSON summary of the report.
+func (r *Report) WriteJSON(w io.Writer) error {
+	return writeJSON(w, r.summary())
+}
+
+// WriteJSONReports writes the JSON summaries of several reports as an array.
+func WriteJSONReports(w io.Writer, reports []*Report) error {
+	summaries := make([]jsonReport, 0, len(reports))
+	for _, r := range reports {
+		summaries = append(summaries, r.summary())
+	}
+	return writeJSON(w, summaries)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// JUnit XML elements, as understood by common CI systems
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitSeconds formats a duration the way JUnit expects it.
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the report as JUnit XML. Booting the VM is reported as
+// a test case of its own; if it failed, the checks are reported as skipped.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	return WriteJUnitReports(w, []*Report{r})
+}
+
+// WriteJUnitReports writes several reports as JUnit XML, one test suite each.
+func WriteJUnitReports(w io.Writer, reports []*Report) error {
+	suites := junitTestSuites{Name: "q2boot"}
+	var total time.Duration
+	for _, r := range reports {
+		suite := r.junitSuite()
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Skipped += suite.Skipped
+		total += r.Duration
+	}
+	suites.Time = junitSeconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// junitSuite converts the report to a JUnit test suite.
+func (r *Report) junitSuite() junitTestSuite {
+	classname := "q2boot." + r.Name
+	suite := junitTestSuite{
+		Name:      classname,
+		Time:      junitSeconds(r.Duration),
+		Timestamp: r.StartedAt.UTC().Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{Name: "image", Value: r.Image},
+			{Name: "arch", Value: r.Arch},
+		},
+	}
+
+	boot := junitTestCase{Name: "boot", Classname: classname, Time: junitSeconds(r.BootDuration)}
+	if !r.Booted {
+		boot.Failure = &junitFailure{Message: "VM did not boot", Text: r.BootError}
+		suite.Failures++
+	}
+	suite.Cases = append(suite.Cases, boot)
+
+	for _, check := range r.Checks {
+		testCase := junitTestCase{
+			Name:      check.Name,
+			Classname: classname,
+			Time:      junitSeconds(check.Duration),
+			SystemOut: check.Output,
+		}
+		switch {
+		case check.Skipped:
+			testCase.Skipped = &junitSkipped{Message: check.Error}
+			suite.Skipped++
+		case !check.Passed:
+			testCase.Failure = &junitFailure{Message: check.Error, Text: check.Output}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
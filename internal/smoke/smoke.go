@@ -0,0 +1,215 @@
+// Package smoke runs shell checks against a booted VM, over SSH or on its
+// serial console, and reports the results as JUnit XML and JSON.
+package smoke
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilmanzo/q2boot/internal/expect"
+	"github.com/ilmanzo/q2boot/internal/ssh"
+)
+
+// DefaultCheckTimeout is how long a check may run unless it sets its own timeout.
+const DefaultCheckTimeout = 5 * time.Minute
+
+// Ways of running checks in the guest
+const (
+	ViaSSH    = "ssh"
+	ViaSerial = "serial"
+)
+
+// Check is a shell command that must exit with status 0 in the guest.
+type Check struct {
+	Name    string        `yaml:"name,omitempty"`
+	Run     string        `yaml:"run"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Suite is a list of checks and the way they are run.
+type Suite struct {
+	Via    string  `yaml:"via,omitempty"`
+	Checks []Check `yaml:"checks"`
+}
+
+// LoadSuite reads a suite from a YAML file:
+//
+//	via: ssh
+//	checks:
+//	  - name: system is running
+//	    run: systemctl is-system-running --wait
+//	  - run: zypper --non-interactive refresh
+//	    timeout: 10m
+func LoadSuite(path string) (*Suite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checks: %w", err)
+	}
+	var suite Suite
+	if err := yaml.Unmarshal(data, &suite); err != nil {
+		return nil, fmt.Errorf("invalid checks file '%s': %w", path, err)
+	}
+	return &suite, nil
+}
+
+// Validate checks the suite and fills in defaults.
+func (s *Suite) Validate() error {
+	if s.Via == "" {
+		s.Via = ViaSSH
+	}
+	if s.Via != ViaSSH && s.Via != ViaSerial {
+		return fmt.Errorf("checks must run via '%s' or '%s', got '%s'", ViaSSH, ViaSerial, s.Via)
+	}
+	if len(s.Checks) == 0 {
+		return errors.New("no checks to run")
+	}
+	for i := range s.Checks {
+		check := &s.Checks[i]
+		if strings.TrimSpace(check.Run) == "" {
+			return fmt.Errorf("check %d has no command", i+1)
+		}
+		if check.Name == "" {
+			check.Name = check.Run
+		}
+		if check.Timeout <= 0 {
+			check.Timeout = DefaultCheckTimeout
+		}
+	}
+	return nil
+}
+
+// Runner executes a shell command in the guest.
+type Runner interface {
+	// Run returns the command's combined output and exit status. An error
+	// means the command could not be run at all.
+	Run(ctx context.Context, command string) (output string, exitCode int, err error)
+}
+
+// SSHRunner runs commands with the OpenSSH client.
+type SSHRunner struct {
+	Target ssh.Target
+}
+
+// Run implements Runner.
+func (r *SSHRunner) Run(ctx context.Context, command string) (string, int, error) {
+	cmd := r.Target.Command(ctx, command)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return string(output), -1, err
+		}
+		if ctx.Err() != nil {
+			return string(output), -1, fmt.Errorf("timed out")
+		}
+		// ssh itself exits with 255 when it cannot connect or authenticate
+		if exitErr.ExitCode() == 255 {
+			return string(output), -1, fmt.Errorf("ssh failed: %s", strings.TrimSpace(string(output)))
+		}
+		return string(output), exitErr.ExitCode(), nil
+	}
+	return string(output), 0, nil
+}
+
+// SerialRunner runs commands on a shell that is logged in on the serial
+// console. The output is delimited by markers echoed around the command.
+type SerialRunner struct {
+	Session *expect.Session
+	seq     int
+}
+
+// Run implements Runner.
+func (r *SerialRunner) Run(ctx context.Context, command string) (string, int, error) {
+	r.seq++
+	marker := fmt.Sprintf("Q2BOOT_CHECK_%d", r.seq)
+	// The echoed command line never matches the patterns below: the begin
+	// marker is preceded by "echo" and the end marker by an unexpanded "$?".
+	begin := regexp.MustCompile(`(?m)^` + marker + `_BEGIN\r?$`)
+	end := regexp.MustCompile(marker + `_END:(\d+)`)
+
+	line := fmt.Sprintf("echo %s_BEGIN; %s; echo %s_END:$?\r", marker, command, marker)
+	if err := r.Session.Send(line); err != nil {
+		return "", -1, err
+	}
+
+	timeout := DefaultCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, _, err := r.Session.Expect(ctx, begin, timeout); err != nil {
+		return "", -1, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	output, match, err := r.Session.Expect(ctx, end, timeout)
+	if err != nil {
+		return "", -1, err
+	}
+
+	status, _ := strconv.Atoi(match[1])
+	output = strings.ReplaceAll(output, "\r", "")
+	return strings.TrimPrefix(output, "\n"), status, nil
+}
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Name     string
+	Command  string
+	Passed   bool
+	ExitCode int
+	Output   string
+	Duration time.Duration
+	Skipped  bool
+	Error    string // why the check failed or was skipped
+}
+
+// RunChecks runs checks in order and reports progress to log.
+func RunChecks(ctx context.Context, runner Runner, checks []Check, log io.Writer) []CheckResult {
+	results := make([]CheckResult, 0, len(checks))
+	for i, check := range checks {
+		fmt.Fprintf(log, "[%d/%d] %s\n", i+1, len(checks), check.Name)
+
+		checkCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+		start := time.Now()
+		output, exitCode, err := runner.Run(checkCtx, check.Run)
+		cancel()
+
+		result := CheckResult{
+			Name:     check.Name,
+			Command:  check.Run,
+			ExitCode: exitCode,
+			Output:   output,
+			Duration: time.Since(start),
+		}
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case exitCode != 0:
+			result.Error = fmt.Sprintf("exited with status %d", exitCode)
+		default:
+			result.Passed = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// SkipChecks reports checks that were not run, e.g. because the VM did not boot.
+func SkipChecks(checks []Check, reason string) []CheckResult {
+	results := make([]CheckResult, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, CheckResult{Name: check.Name, Command: check.Run, Skipped: true, Error: reason})
+	}
+	return results
+}
@@ -0,0 +1,242 @@
+package smoke
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/expect"
+)
+
+// fakeRunner returns canned results keyed by command.
+type fakeRunner map[string]struct {
+	output string
+	status int
+	err    error
+}
+
+func (f fakeRunner) Run(ctx context.Context, command string) (string, int, error) {
+	result := f[command]
+	return result.output, result.status, result.err
+}
+
+func TestLoadSuite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checks.yaml")
+	os.WriteFile(path, []byte(`
+via: serial
+checks:
+  - name: system is running
+    run: systemctl is-system-running
+  - run: uname -r
+    timeout: 30s
+`), 0644)
+
+	suite, err := LoadSuite(path)
+	if err != nil {
+		t.Fatalf("LoadSuite() failed: %v", err)
+	}
+	if err := suite.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %v", err)
+	}
+	if suite.Via != ViaSerial || len(suite.Checks) != 2 {
+		t.Fatalf("LoadSuite() = %+v", suite)
+	}
+	if suite.Checks[0].Timeout != DefaultCheckTimeout || suite.Checks[1].Timeout != 30*time.Second {
+		t.Errorf("unexpected timeouts: %v, %v", suite.Checks[0].Timeout, suite.Checks[1].Timeout)
+	}
+	if suite.Checks[1].Name != "uname -r" {
+		t.Errorf("unnamed check should be named after its command, got %q", suite.Checks[1].Name)
+	}
+}
+
+func TestSuiteValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite Suite
+	}{
+		{"no checks", Suite{}},
+		{"unknown transport", Suite{Via: "telnet", Checks: []Check{{Run: "true"}}}},
+		{"empty command", Suite{Checks: []Check{{Name: "nothing", Run: " "}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.suite.Validate(); err == nil {
+				t.Error("Validate() should fail")
+			}
+		})
+	}
+}
+
+func TestRunChecks(t *testing.T) {
+	runner := fakeRunner{
+		"true":        {output: "", status: 0},
+		"false":       {output: "oops\n", status: 1},
+		"unreachable": {status: -1, err: errors.New("ssh failed")},
+	}
+	checks := []Check{
+		{Name: "ok", Run: "true", Timeout: time.Second},
+		{Name: "fails", Run: "false", Timeout: time.Second},
+		{Name: "error", Run: "unreachable", Timeout: time.Second},
+	}
+
+	var log bytes.Buffer
+	results := RunChecks(context.Background(), runner, checks, &log)
+	if len(results) != 3 {
+		t.Fatalf("RunChecks() returned %d results, want 3", len(results))
+	}
+	if !results[0].Passed {
+		t.Errorf("check 'ok' should pass: %+v", results[0])
+	}
+	if results[1].Passed || results[1].ExitCode != 1 || results[1].Error == "" {
+		t.Errorf("check 'fails' should fail with status 1: %+v", results[1])
+	}
+	if results[2].Passed || results[2].Error != "ssh failed" {
+		t.Errorf("check 'error' should report the runner error: %+v", results[2])
+	}
+	if !strings.Contains(log.String(), "[2/3] fails") {
+		t.Errorf("unexpected progress log:\n%s", log.String())
+	}
+}
+
+// fakeShell emulates a logged-in shell on a serial console: it echoes each
+// command line and prints the output of the commands it knows.
+func fakeShell(t *testing.T, conn net.Conn) {
+	t.Helper()
+	reader := bufio.NewReader(conn)
+	markers := regexp.MustCompile(`^echo (\S+_BEGIN); (.*); echo (\S+_END):\$\?$`)
+	for {
+		line, err := reader.ReadString('\r')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r")
+		fmt.Fprintf(conn, "%s\r\n", line) // echo
+		m := markers.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		status := 0
+		output := ""
+		switch m[2] {
+		case "uname -r":
+			output = "6.4.0-150600.23-default\r\n"
+		case "false":
+			status = 1
+		}
+		fmt.Fprintf(conn, "%s\r\n%s%s:%d\r\nlocalhost:~ # ", m[1], output, m[3], status)
+	}
+}
+
+func TestSerialRunner(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeShell(t, server)
+	defer server.Close()
+
+	session := expect.NewSession(client, nil)
+	defer session.Close()
+	runner := &SerialRunner{Session: session}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, status, err := runner.Run(ctx, "uname -r")
+	if err != nil || status != 0 || output != "6.4.0-150600.23-default\n" {
+		t.Errorf("Run(uname -r) = %q, %d, %v", output, status, err)
+	}
+	output, status, err = runner.Run(ctx, "false")
+	if err != nil || status != 1 || output != "" {
+		t.Errorf("Run(false) = %q, %d, %v", output, status, err)
+	}
+}
+
+func testReport() *Report {
+	return &Report{
+		Name:         "sle16",
+		Image:        "/images/sle16.qcow2",
+		Arch:         "x86_64",
+		StartedAt:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Duration:     42 * time.Second,
+		Booted:       true,
+		BootDuration: 30 * time.Second,
+		Checks: []CheckResult{
+			{Name: "kernel", Command: "uname -r", Passed: true, Output: "6.4.0\n", Duration: time.Second},
+			{Name: "failed units", Command: "systemctl --failed --quiet", ExitCode: 1, Error: "exited with status 1", Output: "foo.service\n"},
+		},
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteJUnit(&buf); err != nil {
+		t.Fatalf("WriteJUnit() failed: %v", err)
+	}
+
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("WriteJUnit() produced invalid XML: %v\n%s", err, buf.String())
+	}
+	if suites.Tests != 3 || suites.Failures != 1 {
+		t.Errorf("testsuites tests=%d failures=%d, want 3 and 1", suites.Tests, suites.Failures)
+	}
+	cases := suites.Suites[0].Cases
+	if cases[0].Name != "boot" || cases[0].Time != "30.000" || cases[0].Failure != nil {
+		t.Errorf("unexpected boot test case: %+v", cases[0])
+	}
+	if cases[2].Failure == nil || cases[2].Failure.Message != "exited with status 1" {
+		t.Errorf("failed check should have a failure element: %+v", cases[2])
+	}
+	if cases[1].Classname != "q2boot.sle16" {
+		t.Errorf("classname = %s, want q2boot.sle16", cases[1].Classname)
+	}
+}
+
+func TestWriteJUnitBootFailure(t *testing.T) {
+	report := testReport()
+	report.Booted = false
+	report.BootError = "timed out waiting for SSH"
+	report.Checks = SkipChecks([]Check{{Name: "kernel", Run: "uname -r"}}, "VM did not boot")
+
+	var buf bytes.Buffer
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatalf("WriteJUnit() failed: %v", err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("WriteJUnit() produced invalid XML: %v", err)
+	}
+	if suites.Failures != 1 || suites.Skipped != 1 {
+		t.Errorf("failures=%d skipped=%d, want 1 and 1", suites.Failures, suites.Skipped)
+	}
+	if report.Passed() {
+		t.Error("Passed() should be false when the VM did not boot")
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON() failed: %v", err)
+	}
+
+	var summary jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatalf("WriteJSON() produced invalid JSON: %v", err)
+	}
+	if summary.Passed || summary.BootDurationSeconds != 30 || len(summary.Checks) != 2 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if summary.Checks[1].ExitCode != 1 || summary.Checks[1].Passed {
+		t.Errorf("unexpected check summary: %+v", summary.Checks[1])
+	}
+}
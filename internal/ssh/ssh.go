@@ -0,0 +1,119 @@
+// Package ssh builds OpenSSH client invocations for guests reached through
+// QEMU's forwarded SSH port.
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Binary is the OpenSSH client used to reach guests.
+const Binary = "ssh"
+
+// CopyBinary is the OpenSSH file copy client.
+const CopyBinary = "scp"
+
+// DefaultUser is the login used when none is configured.
+const DefaultUser = "root"
+
+// PublicKeySuffix is the extension of OpenSSH public key files.
+const PublicKeySuffix = ".pub"
+
+// KeyFiles returns the private and public key files of the key at path, which
+// may name either of them, e.g. "~/.ssh/id_ed25519" or "~/.ssh/id_ed25519.pub".
+func KeyFiles(path string) (private, public string) {
+	if path == "" {
+		return "", ""
+	}
+	if strings.HasSuffix(path, PublicKeySuffix) {
+		return strings.TrimSuffix(path, PublicKeySuffix), path
+	}
+	return path, path + PublicKeySuffix
+}
+
+// Target is an SSH server in a guest.
+type Target struct {
+	Host    string
+	Port    uint16
+	User    string
+	KeyFile string // optional private key (-i)
+
+	// KnownHostsFile records the guest's host key. If empty, host keys are
+	// not checked at all, since snapshot-booted guests often regenerate them.
+	KnownHostsFile string
+
+	// BatchMode disables password prompts, for non-interactive use.
+	BatchMode bool
+}
+
+// Options returns the ssh options selecting the key, host key handling and
+// batch mode, without the port and destination.
+func (t Target) Options() []string {
+	opts := []string{"-o", "LogLevel=ERROR"}
+	if t.KnownHostsFile != "" {
+		opts = append(opts,
+			"-o", "StrictHostKeyChecking=accept-new",
+			"-o", "UserKnownHostsFile="+t.KnownHostsFile)
+	} else {
+		opts = append(opts,
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null")
+	}
+	if t.BatchMode {
+		opts = append(opts, "-o", "BatchMode=yes")
+	}
+	if t.KeyFile != "" {
+		opts = append(opts, "-i", t.KeyFile, "-o", "IdentitiesOnly=yes")
+	}
+	return opts
+}
+
+// Destination returns user@host.
+func (t Target) Destination() string {
+	user := t.User
+	if user == "" {
+		user = DefaultUser
+	}
+	return fmt.Sprintf("%s@%s", user, t.Host)
+}
+
+// Remote returns the scp operand naming path on the target, user@host:path.
+func (t Target) Remote(path string) string {
+	return t.Destination() + ":" + path
+}
+
+// CopyArgs returns the scp arguments that copy sources to dest, where remote
+// operands are built with Remote.
+func (t Target) CopyArgs(recursive bool, sources []string, dest string) []string {
+	args := append(t.Options(), "-P", strconv.Itoa(int(t.Port)))
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, "--")
+	args = append(args, sources...)
+	return append(args, dest)
+}
+
+// CopyCommand returns an scp command copying sources to dest.
+func (t Target) CopyCommand(ctx context.Context, recursive bool, sources []string, dest string) *exec.Cmd {
+	return exec.CommandContext(ctx, CopyBinary, t.CopyArgs(recursive, sources, dest)...)
+}
+
+// Args returns the ssh arguments that run remoteCommand on the target, or
+// open a login shell if it is empty.
+func (t Target) Args(remoteCommand ...string) []string {
+	args := append(t.Options(), "-p", strconv.Itoa(int(t.Port)), t.Destination())
+	if len(remoteCommand) > 0 {
+		args = append(args, "--")
+		args = append(args, remoteCommand...)
+	}
+	return args
+}
+
+// Command returns an ssh command running remoteCommand on the target.
+func (t Target) Command(ctx context.Context, remoteCommand ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, Binary, t.Args(remoteCommand...)...)
+}
@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArgs(t *testing.T) {
+	target := Target{Host: "127.0.0.1", Port: 2222, KeyFile: "/keys/id_ed25519", BatchMode: true}
+	args := target.Args("uname", "-r")
+	joined := strings.Join(args, " ")
+
+	for _, want := range []string{
+		"-p 2222",
+		"-i /keys/id_ed25519",
+		"BatchMode=yes",
+		"UserKnownHostsFile=/dev/null",
+		"root@127.0.0.1 -- uname -r",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Args() = %q, missing %q", joined, want)
+		}
+	}
+}
+
+func TestArgsKnownHosts(t *testing.T) {
+	target := Target{Host: "127.0.0.1", Port: 2222, User: "tester", KnownHostsFile: "/run/vm/known_hosts"}
+	args := target.Args()
+
+	if !slices.Contains(args, "UserKnownHostsFile=/run/vm/known_hosts") {
+		t.Errorf("Args() = %q, want the known_hosts file", args)
+	}
+	if slices.Contains(args, "BatchMode=yes") || slices.Contains(args, "--") {
+		t.Errorf("Args() = %q, want an interactive login", args)
+	}
+	if args[len(args)-1] != "tester@127.0.0.1" {
+		t.Errorf("Args() should end with the destination, got %q", args)
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	tests := []struct {
+		path, private, public string
+	}{
+		{"/home/u/.ssh/id_ed25519", "/home/u/.ssh/id_ed25519", "/home/u/.ssh/id_ed25519.pub"},
+		{"/home/u/.ssh/id_ed25519.pub", "/home/u/.ssh/id_ed25519", "/home/u/.ssh/id_ed25519.pub"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		private, public := KeyFiles(tt.path)
+		if private != tt.private || public != tt.public {
+			t.Errorf("KeyFiles(%q) = %q, %q, want %q, %q", tt.path, private, public, tt.private, tt.public)
+		}
+	}
+}
+
+func TestCopyArgs(t *testing.T) {
+	target := Target{Host: "127.0.0.1", Port: 2223, User: "tester", KnownHostsFile: "/run/vm/known_hosts"}
+	args := target.CopyArgs(true, []string{"a.txt", "dir"}, target.Remote("/tmp/"))
+	joined := strings.Join(args, " ")
+
+	for _, want := range []string{
+		"-P 2223",
+		"UserKnownHostsFile=/run/vm/known_hosts",
+		"-r -- a.txt dir tester@127.0.0.1:/tmp/",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("CopyArgs() = %q, missing %q", joined, want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package state records the VMs launched by q2boot so that later invocations
+// can find, inspect and stop them.
+//
+// Each running VM owns a directory below the runtime directory
+// ($XDG_RUNTIME_DIR/q2boot/<name>/) containing its state record and sockets.
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/xdg"
+)
+
+// State directory constants
+const (
+	DirPermissions  = 0700 // Sockets and records are private to the user
+	RecordFileName  = "state.json"
+	KnownHostsName  = "known_hosts"
+	MaxNameLength   = 48 // Keeps socket paths below the unix socket path limit
+	DefaultBaseName = "vm"
+)
+
+// ErrNotFound is returned when no record exists for a VM name.
+var ErrNotFound = errors.New("no such VM")
+
+// validName matches the names accepted for VM instances.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Record describes a VM launched by q2boot.
+type Record struct {
+	Name          string           `json:"name"`
+	PID           int              `json:"pid"`
+	Arch          string           `json:"arch"`
+	DiskPath      string           `json:"disk_path"`
+	QMPSocket     string           `json:"qmp_socket"`
+	ConsoleSocket string           `json:"console_socket,omitempty"`
+	AgentSocket   string           `json:"agent_socket,omitempty"`
+	SSHPort       uint16           `json:"ssh_port"`
+	MonitorPort   uint16           `json:"monitor_port,omitempty"`
+	VirtiofsdPIDs []int            `json:"virtiofsd_pids,omitempty"`
+	StartedAt     time.Time        `json:"started_at"`
+	Config        *config.VMConfig `json:"config,omitempty"`
+}
+
+// Dir returns the base directory holding all VM state directories.
+var Dir = xdg.RuntimeDir
+
+// VMDir returns the state directory of the named VM.
+func VMDir(name string) string {
+	return filepath.Join(Dir(), name)
+}
+
+// KnownHostsFile returns the file recording the SSH host keys of the named
+// VM. It's removed with the VM's state, so host keys of throwaway guests never
+// reach ~/.ssh/known_hosts, nor clash when a port is reused.
+func KnownHostsFile(name string) string {
+	return filepath.Join(VMDir(name), KnownHostsName)
+}
+
+// ValidateName checks that name can be used as a VM name.
+func ValidateName(name string) error {
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("VM name '%s' is too long (max %d characters)", name, MaxNameLength)
+	}
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid VM name '%s': use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// NameFromDisk derives a VM name from a disk image path, e.g.
+// "/images/sle-16.0-x86_64.qcow2" becomes "sle-16.0-x86_64".
+func NameFromDisk(diskPath string) string {
+	base := filepath.Base(diskPath)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	var b strings.Builder
+	for _, r := range base {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	name := strings.Trim(b.String(), ".-_")
+	if len(name) > MaxNameLength {
+		name = name[:MaxNameLength]
+	}
+	if name == "" {
+		name = DefaultBaseName
+	}
+	return name
+}
+
+// UniqueName returns base, or base with a numeric suffix, such that no live
+// VM uses the name.
+func UniqueName(base string) string {
+	name := base
+	for i := 2; ; i++ {
+		if rec, err := Load(name); err != nil || !rec.Alive() {
+			return name
+		}
+		suffix := fmt.Sprintf("-%d", i)
+		if len(base)+len(suffix) > MaxNameLength {
+			base = base[:MaxNameLength-len(suffix)]
+		}
+		name = base + suffix
+	}
+}
+
+// Create prepares the state directory for a new VM. It fails if a live VM
+// already uses the name and removes any stale leftovers otherwise.
+func Create(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	if rec, err := Load(name); err == nil && rec.Alive() {
+		return "", fmt.Errorf("a VM named '%s' is already running (PID %d)", name, rec.PID)
+	}
+
+	dir := VMDir(name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to clean up stale state for '%s': %w", name, err)
+	}
+	if err := os.MkdirAll(dir, DirPermissions); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Save atomically writes the record into the VM's state directory.
+func Save(rec *Record) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state for '%s': %w", rec.Name, err)
+	}
+
+	dir := VMDir(rec.Name)
+	if err := os.MkdirAll(dir, DirPermissions); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, RecordFileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state for '%s': %w", rec.Name, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state for '%s': %w", rec.Name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state for '%s': %w", rec.Name, err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, RecordFileName))
+}
+
+// Load reads the record of the named VM. It returns ErrNotFound if there is
+// no record, regardless of whether the VM is still alive.
+func Load(name string) (*Record, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(VMDir(name), RecordFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: '%s'", ErrNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to read state for '%s': %w", name, err)
+	}
+
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("corrupt state for '%s': %w", name, err)
+	}
+	return &rec, nil
+}
+
+// Remove deletes the state directory of the named VM.
+func Remove(name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(VMDir(name))
+}
+
+// List returns the records of all live VMs sorted by name. Records of VMs
+// whose process is gone are removed.
+func List() ([]*Record, error) {
+	entries, err := os.ReadDir(Dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read state directory: %w", err)
+	}
+
+	var records []*Record
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rec, err := Load(entry.Name())
+		if err != nil {
+			// Directories without a record belong to VMs that are still
+			// starting up, or to crashed launches; leave them alone.
+			continue
+		}
+		if !rec.Alive() {
+			Remove(rec.Name)
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// Alive reports whether the VM process recorded in rec is still running. A
+// process that merely reused the PID doesn't count, so that it's never
+// signalled in place of the VM.
+func (r *Record) Alive() bool {
+	return ProcessRuns(r.PID, r.QMPSocket)
+}
+
+// Uptime returns how long the VM has been running.
+func (r *Record) Uptime() time.Duration {
+	return time.Since(r.StartedAt).Round(time.Second)
+}
+
+// ProcessAlive reports whether a process with the given PID exists.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// procDir is where the command lines of processes are read.
+const procDir = "/proc"
+
+// ProcessRuns reports whether a process with the given PID exists and one of
+// its arguments contains marker, e.g. the QMP socket of a VM, which tells
+// the process q2boot started from one that reused its PID. Without /proc,
+// the PID is all there is to go by.
+func ProcessRuns(pid int, marker string) bool {
+	if !ProcessAlive(pid) {
+		return false
+	}
+	if marker == "" {
+		return true
+	}
+	cmdline, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		_, statErr := os.Stat(filepath.Join(procDir, "self"))
+		return os.IsNotExist(statErr)
+	}
+	return bytes.Contains(cmdline, []byte(marker))
+}
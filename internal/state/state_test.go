@@ -0,0 +1,205 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+)
+
+// setupStateDir points the runtime directory at a fresh temporary directory.
+func setupStateDir(t *testing.T) {
+	t.Helper()
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+}
+
+// deadPID returns the PID of a process that has already exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run 'true': %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestNameFromDisk(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/images/sle-16.0-x86_64.qcow2", "sle-16.0-x86_64"},
+		{"disk.img", "disk"},
+		{"/tmp/sle-16.0-s390x-135.5-textmode@s390x-kvm.qcow2", "sle-16.0-s390x-135.5-textmode-s390x-kvm"},
+		{"/tmp/my disk (copy).raw", "my-disk--copy"},
+		{"/tmp/@@@.qcow2", DefaultBaseName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := NameFromDisk(tt.path)
+			if got != tt.want {
+				t.Errorf("NameFromDisk(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+			if err := ValidateName(got); err != nil {
+				t.Errorf("NameFromDisk(%q) returned an invalid name: %v", tt.path, err)
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"myvm", false},
+		{"sle-16.0_x86", false},
+		{"", true},
+		{"../etc", true},
+		{"-leading-dash", true},
+		{"with/slash", true},
+		{"a-very-long-name-that-exceeds-the-maximum-allowed-length", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateName(tt.name); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSaveLoadRemove(t *testing.T) {
+	setupStateDir(t)
+
+	if _, err := Create("myvm"); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	rec := &Record{
+		Name:      "myvm",
+		PID:       os.Getpid(),
+		Arch:      "x86_64",
+		DiskPath:  "/tmp/disk.qcow2",
+		QMPSocket: filepath.Join(VMDir("myvm"), "qmp.sock"),
+		SSHPort:   2222,
+		StartedAt: time.Now(),
+		Config:    config.DefaultConfig(),
+	}
+	if err := Save(rec); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	loaded, err := Load("myvm")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if loaded.PID != rec.PID || loaded.SSHPort != rec.SSHPort || loaded.QMPSocket != rec.QMPSocket {
+		t.Errorf("Load() = %+v, want %+v", loaded, rec)
+	}
+	if loaded.Config == nil || loaded.Config.CPU != config.DefaultCPU {
+		t.Errorf("Load() did not restore the config: %+v", loaded.Config)
+	}
+
+	if err := Remove("myvm"); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if _, err := Load("myvm"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after Remove(), got %v", err)
+	}
+}
+
+func TestCreateRejectsRunningVM(t *testing.T) {
+	setupStateDir(t)
+
+	if err := Save(&Record{Name: "busy", PID: os.Getpid()}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if _, err := Create("busy"); err == nil {
+		t.Error("Create() should fail when a live VM uses the name")
+	}
+
+	if err := Save(&Record{Name: "stale", PID: deadPID(t)}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if _, err := Create("stale"); err != nil {
+		t.Errorf("Create() should replace a stale record, got %v", err)
+	}
+	if _, err := Load("stale"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Create() should have removed the stale record, got %v", err)
+	}
+}
+
+func TestListRemovesStaleRecords(t *testing.T) {
+	setupStateDir(t)
+
+	if records, err := List(); err != nil || len(records) != 0 {
+		t.Fatalf("List() on empty state = %v, %v; want no records", records, err)
+	}
+
+	if err := Save(&Record{Name: "b-alive", PID: os.Getpid()}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if err := Save(&Record{Name: "a-alive", PID: os.Getpid()}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if err := Save(&Record{Name: "dead", PID: deadPID(t)}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	records, err := List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Name != "a-alive" || records[1].Name != "b-alive" {
+		t.Errorf("List() returned unexpected records: %+v", records)
+	}
+	if _, err := os.Stat(VMDir("dead")); !os.IsNotExist(err) {
+		t.Error("List() should remove the state directory of dead VMs")
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	setupStateDir(t)
+
+	if got := UniqueName("vm"); got != "vm" {
+		t.Errorf("UniqueName() = %s, want vm", got)
+	}
+
+	if err := Save(&Record{Name: "vm", PID: os.Getpid()}); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	if got := UniqueName("vm"); got != "vm-2" {
+		t.Errorf("UniqueName() = %s, want vm-2", got)
+	}
+}
+
+func TestAliveChecksCommandLine(t *testing.T) {
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("no /proc on this system")
+	}
+
+	// The test binary stands in for QEMU: it's alive, and only a marker in
+	// its command line tells it apart from a process that reused the PID
+	if !(&Record{PID: os.Getpid(), QMPSocket: os.Args[0]}).Alive() {
+		t.Error("Alive() = false for a process running with the recorded socket")
+	}
+	if (&Record{PID: os.Getpid(), QMPSocket: "/run/q2boot/gone/qmp.sock"}).Alive() {
+		t.Error("Alive() = true for a process that reused the PID of the VM")
+	}
+}
+
+func TestLoadRejectsInvalidNames(t *testing.T) {
+	setupStateDir(t)
+
+	for _, name := range []string{"../escape", "a/b", ".."} {
+		if _, err := Load(name); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Load(%q) error = %v, want an invalid name error", name, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"os"
 )
@@ -74,7 +75,7 @@ func (vm *AARCH64VM) GetArchArgs() []string {
 func (vm *AARCH64VM) GetDiskArgs() []string {
 	return []string{
 		"-drive",
-		fmt.Sprintf("file=%s,if=none,id=disk0,cache=none,aio=native,discard=unmap", vm.DiskPath),
+		fmt.Sprintf("%s,if=none,id=disk0,cache=none,aio=native,discard=unmap", vm.driveFile()),
 		"-device",
 		fmt.Sprintf("virtio-blk-pci,drive=disk0,num-queues=%d", vm.CPU),
 	}
@@ -84,7 +85,7 @@ func (vm *AARCH64VM) GetDiskArgs() []string {
 func (vm *AARCH64VM) GetNetworkArgs() []string {
 	return []string{
 		"-netdev",
-		fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", vm.SSHPort),
+		vm.userNetdev("net0"),
 		"-device",
 		"virtio-net-pci,netdev=net0,mq=on",
 	}
@@ -117,3 +118,8 @@ func (vm *AARCH64VM) Validate() error {
 func (vm *AARCH64VM) Run() error {
 	return vm.run(vm)
 }
+
+// Start boots the VM in the background and satisfies the VM interface.
+func (vm *AARCH64VM) Start(ctx context.Context) (*Instance, error) {
+	return vm.startBackground(ctx, vm)
+}
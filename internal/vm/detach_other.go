@@ -0,0 +1,12 @@
+//go:build !unix
+
+package vm
+
+import "os/exec"
+
+// setDetached is a no-op on platforms without sessions; the process is
+// simply started without a terminal attached.
+func setDetached(cmd *exec.Cmd) {}
+
+// setProcessGroup is a no-op on platforms without process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package vm
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setDetached makes cmd run in a new session, detached from the controlling
+// terminal, so it survives the terminal being closed.
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// setProcessGroup makes cmd run in a new process group, so that signals
+// generated by the terminal, such as SIGINT on Ctrl-C, don't reach it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,293 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/expect"
+	"github.com/ilmanzo/q2boot/internal/ports"
+	"github.com/ilmanzo/q2boot/internal/ready"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// Startup constants for detached VMs
+const (
+	DetachStartTimeout  = 10 * time.Second
+	startupPollInterval = 100 * time.Millisecond
+)
+
+// Instance is a running QEMU process started by q2boot.
+type Instance struct {
+	Name   string
+	Dir    string
+	Record *state.Record
+
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	exitErr error // set before exited is closed
+}
+
+// start launches QEMU for vm and registers it in the runtime state directory,
+// so that other q2boot invocations can find it.
+func (v *BaseVM) start(vm VM) (*Instance, error) {
+	name := v.Name
+	if name == "" {
+		name = state.UniqueName(state.NameFromDisk(v.DiskPath))
+	}
+	dir, err := state.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.QMPSocket == "" {
+		v.QMPSocket = filepath.Join(dir, QMPSocketName)
+	}
+	if v.serialOnSocket() {
+		v.ConsoleSocket = filepath.Join(dir, ConsoleSocketName)
+	}
+	if v.GuestAgent {
+		v.AgentSocket = filepath.Join(dir, AgentSocketName)
+	}
+
+	seedArgs, err := v.seedArgs(vm, dir)
+	if err != nil {
+		state.Remove(name)
+		return nil, err
+	}
+	shareArgs, daemons, err := v.startShares(vm, dir)
+	if err != nil {
+		state.Remove(name)
+		return nil, err
+	}
+	args := v.buildArgs(vm, append(seedArgs, shareArgs...))
+	cmd := exec.Command(vm.QEMUBinary(), args...)
+	if v.Detach {
+		// Run QEMU in its own session so closing the terminal doesn't kill it.
+		logFile, err := os.Create(filepath.Join(dir, QEMULogName))
+		if err != nil {
+			stopAll(daemons)
+			state.Remove(name)
+			return nil, fmt.Errorf("failed to create QEMU log file: %w", err)
+		}
+		defer logFile.Close()
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		setDetached(cmd)
+	} else {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		// Unless QEMU uses the terminal, keep Ctrl-C in it from killing QEMU
+		// so that q2boot can power the VM down gracefully.
+		if !usesTerminal(args) {
+			setProcessGroup(cmd)
+		}
+	}
+
+	if err := startQEMU(cmd, v.Confirm, v.guestSummary()); err != nil {
+		stopAll(daemons)
+		state.Remove(name)
+		return nil, err
+	}
+
+	inst := &Instance{Name: name, Dir: dir, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		inst.exitErr = cmd.Wait()
+		// virtiofsd normally quits with QEMU, but not if QEMU failed
+		// before connecting to it.
+		stopAll(daemons)
+		close(inst.exited)
+	}()
+
+	diskPath, err := filepath.Abs(v.DiskPath)
+	if err != nil {
+		diskPath = v.DiskPath
+	}
+	inst.Record = &state.Record{
+		Name:          name,
+		PID:           cmd.Process.Pid,
+		Arch:          v.Arch,
+		DiskPath:      diskPath,
+		QMPSocket:     v.QMPSocket,
+		ConsoleSocket: v.ConsoleSocket,
+		AgentSocket:   v.AgentSocket,
+		SSHPort:       v.SSHPort,
+		MonitorPort:   v.MonitorPort,
+		VirtiofsdPIDs: daemonPIDs(daemons),
+		StartedAt:     time.Now(),
+		Config:        v.cfg,
+	}
+	if err := state.Save(inst.Record); err != nil {
+		fmt.Println("Warning: failed to record VM state", "error", err)
+	}
+	fmt.Println("VM started", "name", name, "pid", inst.Record.PID)
+
+	return inst, nil
+}
+
+// daemonPIDs returns the PIDs of the virtiofsd processes.
+func daemonPIDs(daemons []*virtiofsd) []int {
+	var pids []int
+	for _, d := range daemons {
+		pids = append(pids, d.cmd.Process.Pid)
+	}
+	return pids
+}
+
+// Exited returns a channel that is closed when QEMU exits.
+func (i *Instance) Exited() <-chan struct{} {
+	return i.exited
+}
+
+// Wait waits for QEMU to exit and removes the VM's state record.
+func (i *Instance) Wait() error {
+	<-i.exited
+	state.Remove(i.Name)
+
+	if err := i.exitErr; err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			fmt.Println("QEMU exited with error", "status", exitError.ExitCode())
+			return fmt.Errorf("QEMU exited with status %d", exitError.ExitCode())
+		}
+		return fmt.Errorf("failed to wait for QEMU: %w", err)
+	}
+	return nil
+}
+
+// WaitStarted waits until QEMU has created its QMP socket, which means it got
+// past argument parsing and device setup. It fails if QEMU exits first.
+func (i *Instance) WaitStarted(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(i.Record.QMPSocket); err == nil {
+			return nil
+		}
+		select {
+		case <-i.exited:
+			err := i.Wait()
+			if err == nil {
+				err = fmt.Errorf("QEMU exited during startup")
+			}
+			if output := i.log(); output != "" {
+				return fmt.Errorf("%w:\n%s", err, output)
+			}
+			return err
+		case <-deadline:
+			return fmt.Errorf("QEMU did not start within %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// log returns the output QEMU wrote to its log file, if any.
+func (i *Instance) log() string {
+	data, err := os.ReadFile(filepath.Join(i.Dir, QEMULogName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.ToValidUTF8(data, nil)))
+}
+
+// startBackground starts the VM detached from the terminal and returns once
+// QEMU is up, after running the expect script and waiting for the readiness
+// probes if they are configured. A VM that fails to start, or either of
+// them, is stopped, and its ports are released.
+func (v *BaseVM) startBackground(ctx context.Context, vm VM) (*Instance, error) {
+	cond, err := v.prepareReadyCondition()
+	if err != nil {
+		return nil, err
+	}
+	var script *expect.Script
+	if v.ExpectScript != "" {
+		if script, err = expect.Load(v.ExpectScript); err != nil {
+			return nil, err
+		}
+	}
+
+	v.Detach = true
+	inst, err := v.start(vm)
+	if err != nil {
+		v.releasePorts()
+		return nil, err
+	}
+	inst, err = v.awaitBackground(ctx, inst, script, cond)
+	if err != nil {
+		v.releasePorts()
+		return nil, err
+	}
+	return inst, nil
+}
+
+// awaitBackground waits for the detached VM inst to start, then runs the
+// expect script and waits for the readiness probes, if any. It stops the VM
+// if any of them fails.
+func (v *BaseVM) awaitBackground(ctx context.Context, inst *Instance, script *expect.Script, cond ready.Condition) (*Instance, error) {
+	if err := inst.WaitStarted(DetachStartTimeout); err != nil {
+		return nil, inst.abort(err)
+	}
+
+	if script != nil {
+		fmt.Printf("Running expect script on VM '%s'...\n", inst.Name)
+		if err := inst.RunScript(ctx, script, nil, os.Stdout); err != nil {
+			return nil, inst.abort(err)
+		}
+	}
+	if cond.Enabled() {
+		fmt.Printf("Waiting for %s...\n", cond)
+		if err := inst.WaitReady(ctx, cond, v.WaitTimeout); err != nil {
+			return nil, inst.abort(err)
+		}
+		fmt.Printf("VM '%s' is ready.\n", inst.Name)
+	}
+	return inst, nil
+}
+
+// runDetached starts the VM in the background and tells the user how to
+// reach it.
+func (v *BaseVM) runDetached(vm VM) error {
+	inst, err := v.startBackground(context.Background(), vm)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("VM '%s' is running in the background (PID %d).\n", inst.Name, inst.Record.PID)
+	fmt.Printf("  Attach to its console: q2boot console %s\n", inst.Name)
+	fmt.Printf("  Stop it:               q2boot stop %s\n", inst.Name)
+	return nil
+}
+
+// abort stops a VM that failed to come up as requested, removes its state
+// directory and returns err.
+func (i *Instance) abort(err error) error {
+	select {
+	case <-i.exited:
+	default:
+		if !errors.Is(err, errQEMUExited) {
+			fmt.Printf("%v, stopping it\n", err)
+			i.Shutdown(0, nil)
+		}
+	}
+	i.Wait()
+	return err
+}
+
+// releasePorts drops the reservations of the ports of a VM that failed to
+// start, for processes that go on running, e.g. to boot other VMs. Ports
+// this process didn't reserve are left alone.
+func (v *BaseVM) releasePorts() {
+	for _, port := range []uint16{v.SSHPort, v.MonitorPort} {
+		if port != 0 {
+			ports.Release(port)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package vm
 
-import "github.com/ilmanzo/q2boot/internal/config"
+import (
+	"context"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+)
 
 // MockVM is a mock implementation of the VM interface for testing.
 type MockVM struct {
 	*BaseVM
 	RunFunc              func() error
+	StartFunc            func(ctx context.Context) (*Instance, error)
 	ValidateFunc         func() error
 	GetGraphicalArgsFunc func() []string
 }
@@ -58,6 +63,14 @@ func (m *MockVM) Run() error {
 	return nil
 }
 
+// Start is a mock implementation of the Start method.
+func (m *MockVM) Start(ctx context.Context) (*Instance, error) {
+	if m.StartFunc != nil {
+		return m.StartFunc(ctx)
+	}
+	return nil, nil
+}
+
 // Validate is a mock implementation of the Validate method.
 func (m *MockVM) Validate() error {
 	if m.ValidateFunc != nil {
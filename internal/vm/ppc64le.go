@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -22,25 +23,31 @@ func (vm *PPC64LEVM) QEMUBinary() string {
 }
 
 // GetArchArgs returns architecture-specific arguments for ppc64le
+// Older guests get an older CPU model (see osProfiles)
 func (vm *PPC64LEVM) GetArchArgs() []string {
-	return []string{"-M", "pseries", "-cpu", "power10"}
+	return []string{"-M", "pseries", "-cpu", vm.cpuModel("power10")}
 }
 
 // GetDiskArgs returns disk-specific arguments for ppc64le
 func (vm *PPC64LEVM) GetDiskArgs() []string {
 	return []string{
 		"-drive",
-		fmt.Sprintf("file=%s,id=disk0,if=none,cache=none,aio=native,discard=unmap", vm.DiskPath),
+		fmt.Sprintf("%s,id=disk0,if=none,cache=none,aio=native,discard=unmap", vm.driveFile()),
 		"-device",
 		fmt.Sprintf("virtio-blk-pci,drive=disk0,id=dr0,bootindex=1,num-queues=%d", vm.CPU),
 	}
 }
 
+// SupportsFwCfg reports false, as the pseries machine has no fw_cfg device
+func (vm *PPC64LEVM) SupportsFwCfg() bool {
+	return false
+}
+
 // GetNetworkArgs returns network-specific arguments for ppc64le
 func (vm *PPC64LEVM) GetNetworkArgs() []string {
 	return []string{
 		"-netdev",
-		fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", vm.SSHPort),
+		vm.userNetdev("net0"),
 		"-device",
 		"virtio-net-pci,netdev=net0,mq=on",
 	}
@@ -72,3 +79,8 @@ func (vm *PPC64LEVM) Validate() error {
 func (vm *PPC64LEVM) Run() error {
 	return vm.run(vm)
 }
+
+// Start boots the VM in the background and satisfies the VM interface.
+func (vm *PPC64LEVM) Start(ctx context.Context) (*Instance, error) {
+	return vm.startBackground(ctx, vm)
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ilmanzo/q2boot/internal/detector"
+)
+
+// osProfile tunes the VM for a guest operating system that needs it.
+type osProfile struct {
+	arch string
+	// ids are the os-release IDs the profile applies to, and before, if
+	// set, limits it to the versions older than this one
+	ids    []string
+	before string
+	// cpu replaces the default CPU model, and cpuFeatures are added to it
+	cpu         string
+	cpuFeatures string
+	// reason tells what the profile is for, shown with --confirm
+	reason string
+}
+
+// osProfiles are the known guest operating systems needing tuning.
+var osProfiles = []osProfile{
+	{
+		arch:   "ppc64le",
+		ids:    []string{"sles", "sled", "sles_sap"},
+		before: "15.4",
+		cpu:    "power9",
+		reason: "SLE before 15 SP4 doesn't support POWER10",
+	},
+	{
+		arch:        "x86_64",
+		ids:         []string{detector.OSWindows},
+		cpuFeatures: "hv-relaxed,hv-vapic,hv-spinlocks=0x1fff,hv-vpindex,hv-runtime,hv-time,hv-synic,hv-stimer,hv-frequencies,hv-reset",
+		reason:      "Hyper-V enlightenments for Windows",
+	},
+}
+
+// OSMatters reports whether the guest operating system of a VM of the given
+// architecture makes a difference: whether a profile may tune it, or it's
+// shown for confirmation. Detecting it can be skipped otherwise.
+func OSMatters(arch string, confirm bool) bool {
+	if confirm {
+		return true
+	}
+	for _, p := range osProfiles {
+		if p.arch == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// osProfile returns the profile of the guest operating system, or nil if it
+// needs none or is unknown.
+func (v *BaseVM) osProfile() *osProfile {
+	if v.OS == nil {
+		return nil
+	}
+	for i, p := range osProfiles {
+		if p.arch != v.Arch || !slices.Contains(p.ids, v.OS.ID) {
+			continue
+		}
+		if p.before != "" && (v.OS.Version == "" || !versionBefore(v.OS.Version, p.before)) {
+			continue
+		}
+		return &osProfiles[i]
+	}
+	return nil
+}
+
+// cpuModel returns the value of -cpu: model, unless the profile of the
+// guest operating system changes it.
+func (v *BaseVM) cpuModel(model string) string {
+	p := v.osProfile()
+	if p == nil {
+		return model
+	}
+	if p.cpu != "" {
+		model = p.cpu
+	}
+	if p.cpuFeatures != "" {
+		model += "," + p.cpuFeatures
+	}
+	return model
+}
+
+// guestSummary describes the guest operating system and its profile, or
+// returns "" if it's unknown.
+func (v *BaseVM) guestSummary() string {
+	if v.OS == nil {
+		return ""
+	}
+	if p := v.osProfile(); p != nil {
+		return v.OS.String() + ", tuned: " + p.reason
+	}
+	return v.OS.String()
+}
+
+// versionBefore reports whether the dotted version a, e.g. "15.3", is older
+// than b. Parts that aren't numbers count as 0.
+func versionBefore(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
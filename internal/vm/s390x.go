@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -33,17 +34,27 @@ func (vm *S390XVM) GetArchArgs() []string {
 func (vm *S390XVM) GetDiskArgs() []string {
 	return []string{
 		"-drive",
-		fmt.Sprintf("file=%s,id=disk1,if=none,cache=none,aio=native,discard=unmap", vm.DiskPath),
+		fmt.Sprintf("%s,id=disk1,if=none,cache=none,aio=native,discard=unmap", vm.driveFile()),
 		"-device",
 		fmt.Sprintf("virtio-blk-ccw,drive=disk1,id=dr1,bootindex=1,num-queues=%d", vm.CPU),
 	}
 }
 
+// VirtioTransport returns the channel I/O transport used on s390x
+func (vm *S390XVM) VirtioTransport() string {
+	return VirtioTransportCCW
+}
+
+// SupportsFwCfg reports false, as the s390-ccw-virtio machine has no fw_cfg device
+func (vm *S390XVM) SupportsFwCfg() bool {
+	return false
+}
+
 // GetNetworkArgs returns s390x-specific network arguments
 func (vm *S390XVM) GetNetworkArgs() []string {
 	return []string{
 		"-netdev",
-		fmt.Sprintf("user,id=net1,hostfwd=tcp::%d-:22", vm.SSHPort),
+		vm.userNetdev("net1"),
 		"-device",
 		"virtio-net-ccw,netdev=net1,mq=on",
 	}
@@ -79,3 +90,8 @@ func (vm *S390XVM) Validate() error {
 func (vm *S390XVM) Run() error {
 	return vm.run(vm)
 }
+
+// Start boots the VM in the background and satisfies the VM interface.
+func (vm *S390XVM) Start(ctx context.Context) (*Instance, error) {
+	return vm.startBackground(ctx, vm)
+}
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/console"
+	"github.com/ilmanzo/q2boot/internal/expect"
+)
+
+// errStopRequested is sent by the foreground console when the user asks to
+// shut the VM down.
+var errStopRequested = errors.New("stop requested")
+
+// RunScript runs an expect script on the VM's serial console. Console output
+// is copied to out and progress is written to log; either may be nil.
+func (i *Instance) RunScript(ctx context.Context, script *expect.Script, out, log io.Writer) error {
+	conn, err := i.DialConsole()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-i.exited:
+			cancel(errQEMUExited)
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := script.Run(ctx, conn, out, log); err != nil {
+		if errors.Is(context.Cause(ctx), errQEMUExited) {
+			return fmt.Errorf("expect script on VM '%s' failed: %w", i.Name, errQEMUExited)
+		}
+		return fmt.Errorf("expect script on VM '%s' failed: %w", i.Name, err)
+	}
+	if log != nil {
+		fmt.Fprintf(log, "Expect script on VM '%s' completed\n", i.Name)
+	}
+	return nil
+}
+
+// DialConsole connects to the serial console socket of a VM started in the
+// background, waiting for QEMU to create it.
+func (i *Instance) DialConsole() (net.Conn, error) {
+	deadline := time.Now().Add(DetachStartTimeout)
+	for {
+		conn, err := console.Dial(i.Record.ConsoleSocket, startupPollInterval)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		select {
+		case <-i.exited:
+			return nil, errQEMUExited
+		case <-time.After(startupPollInterval):
+		}
+	}
+}
+
+// attachConsole connects the terminal to the serial console of a foreground
+// VM after its expect script ran, and returns when QEMU closes the console.
+// It reports true if the user pressed the escape key to stop the VM.
+func (i *Instance) attachConsole() bool {
+	conn, err := i.DialConsole()
+	if err != nil {
+		return false
+	}
+
+	// Without a terminal (e.g. stdin is /dev/null) nobody can type, so just
+	// show the console until QEMU exits.
+	restore, err := console.MakeRaw()
+	if !console.IsTerminal(os.Stdin) || err != nil {
+		io.Copy(os.Stdout, conn)
+		conn.Close()
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Console attached. Press %s to shut down VM '%s'.\r\n", console.EscapeKeyName, i.Name)
+	err = console.Attach(conn, os.Stdin, os.Stdout)
+	restore()
+	return errors.Is(err, console.ErrDetached)
+}
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ilmanzo/q2boot/internal/cloudinit"
+	"github.com/ilmanzo/q2boot/internal/configdrive"
+	"github.com/ilmanzo/q2boot/internal/ssh"
+)
+
+// Seed constants
+const (
+	CloudInitSeedName = "cidata.iso"
+	SCSIControllerID  = "scsi0"
+	CloudInitDriveID  = "cidata"
+	ConfigDriveName   = "config.iso"
+	ConfigDriveID     = "configdrive"
+)
+
+// cdrom is a read-only ISO image attached to the guest.
+type cdrom struct {
+	id   string
+	path string
+}
+
+// cloudInitSeed returns the cloud-init seed configured for the VM.
+func (v *BaseVM) cloudInitSeed() (*cloudinit.Seed, error) {
+	seed := &cloudinit.Seed{UserDataFile: v.CloudInit, Hostname: v.Hostname}
+	if v.SSHKey != "" {
+		_, public := ssh.KeyFiles(v.SSHKey)
+		key, err := cloudinit.ReadPublicKey(public)
+		if err != nil {
+			return nil, err
+		}
+		seed.SSHKeys = append(seed.SSHKeys, key)
+	}
+	return seed, nil
+}
+
+// seedArgs writes the first-boot configuration seeds of the VM to its state
+// directory dir and returns the QEMU arguments passing them to the guest.
+func (v *BaseVM) seedArgs(vm VM, dir string) ([]string, error) {
+	var cdroms []cdrom
+
+	seed, err := v.cloudInitSeed()
+	if err != nil {
+		return nil, err
+	}
+	if seed.Enabled() {
+		path := filepath.Join(dir, CloudInitSeedName)
+		if err := seed.WriteISO(path); err != nil {
+			return nil, err
+		}
+		cdroms = append(cdroms, cdrom{id: CloudInitDriveID, path: path})
+	}
+
+	// Ignition and Combustion read fw_cfg where the machine has it, and a
+	// labelled config drive otherwise.
+	var fwCfgArgs []string
+	drive := &configdrive.Drive{IgnitionFile: v.Ignition, CombustionFile: v.Combustion}
+	switch {
+	case !drive.Enabled():
+	case vm.SupportsFwCfg():
+		if fwCfgArgs, err = drive.FwCfgArgs(); err != nil {
+			return nil, err
+		}
+	default:
+		path := filepath.Join(dir, ConfigDriveName)
+		if err := drive.WriteISO(path); err != nil {
+			return nil, err
+		}
+		cdroms = append(cdroms, cdrom{id: ConfigDriveID, path: path})
+	}
+
+	return append(cdromArgs(vm.VirtioTransport(), cdroms), fwCfgArgs...), nil
+}
+
+// cdromArgs returns the arguments attaching the ISO images as SCSI CD-ROMs on
+// a virtio-scsi controller with the given transport.
+func cdromArgs(transport string, cdroms []cdrom) []string {
+	if len(cdroms) == 0 {
+		return nil
+	}
+	args := []string{"-device", fmt.Sprintf("virtio-scsi-%s,id=%s", transport, SCSIControllerID)}
+	for _, cd := range cdroms {
+		args = append(args,
+			"-drive", fmt.Sprintf("file=%s,if=none,id=%s,media=cdrom,readonly=on,format=raw", cd.path, cd.id),
+			"-device", fmt.Sprintf("scsi-cd,drive=%s,bus=%s.0", cd.id, SCSIControllerID))
+	}
+	return args
+}
@@ -0,0 +1,128 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+)
+
+func TestSeedArgs(t *testing.T) {
+	keyDir := t.TempDir()
+	key := filepath.Join(keyDir, "id_ed25519")
+	if err := os.WriteFile(key+".pub", []byte("ssh-ed25519 AAAAC3Nza test@host\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		vm         VM
+		cfg        func(*config.VMConfig)
+		wantDevice string
+	}{
+		{"no seed", NewX86_64VM(), func(c *config.VMConfig) {}, ""},
+		{"ssh key on x86_64", NewX86_64VM(), func(c *config.VMConfig) { c.SSHKey = key }, "virtio-scsi-pci,id=scsi0"},
+		{"hostname on aarch64", NewAARCH64VM(), func(c *config.VMConfig) { c.Hostname = "web1" }, "virtio-scsi-pci,id=scsi0"},
+		{"private key path on s390x", NewS390XVM(), func(c *config.VMConfig) { c.SSHKey = key + ".pub" }, "virtio-scsi-ccw,id=scsi0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			tt.cfg(cfg)
+			tt.vm.Configure(cfg)
+			dir := t.TempDir()
+
+			seeder := tt.vm.(interface {
+				seedArgs(VM, string) ([]string, error)
+			})
+			args, err := seeder.seedArgs(tt.vm, dir)
+			if err != nil {
+				t.Fatalf("seedArgs() failed: %v", err)
+			}
+
+			seedPath := filepath.Join(dir, CloudInitSeedName)
+			if tt.wantDevice == "" {
+				if len(args) != 0 {
+					t.Errorf("seedArgs() = %v, want no arguments", args)
+				}
+				if _, err := os.Stat(seedPath); err == nil {
+					t.Error("seed was written although nothing was configured")
+				}
+				return
+			}
+
+			if !slices.Contains(args, tt.wantDevice) {
+				t.Errorf("seedArgs() = %v, want device %s", args, tt.wantDevice)
+			}
+			wantDrive := "file=" + seedPath + ",if=none,id=cidata,media=cdrom,readonly=on,format=raw"
+			if !slices.Contains(args, wantDrive) || !slices.Contains(args, "scsi-cd,drive=cidata,bus=scsi0.0") {
+				t.Errorf("seedArgs() = %v, want the seed attached as a SCSI CD-ROM", args)
+			}
+			data, err := os.ReadFile(seedPath)
+			if err != nil {
+				t.Fatalf("seed was not written: %v", err)
+			}
+			if cfg.SSHKey != "" && !strings.Contains(string(data), "ssh-ed25519 AAAAC3Nza test@host") {
+				t.Error("seed does not contain the SSH key")
+			}
+		})
+	}
+}
+
+func TestSeedArgsIgnition(t *testing.T) {
+	ignition := filepath.Join(t.TempDir(), "config.ign")
+	if err := os.WriteFile(ignition, []byte(`{"ignition": {"version": "3.4.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfig()
+	cfg.Ignition = ignition
+
+	// x86_64 has fw_cfg, so no config drive is needed
+	x86 := NewX86_64VM()
+	x86.Configure(cfg)
+	dir := t.TempDir()
+	args, err := x86.seedArgs(x86, dir)
+	if err != nil {
+		t.Fatalf("seedArgs() failed: %v", err)
+	}
+	want := []string{"-fw_cfg", "name=opt/com.coreos/config,file=" + ignition}
+	if !slices.Equal(args, want) {
+		t.Errorf("x86_64 seedArgs() = %v, want %v", args, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ConfigDriveName)); err == nil {
+		t.Error("config drive was written although fw_cfg is used")
+	}
+
+	// ppc64le has no fw_cfg and gets a labelled config drive instead
+	ppc := NewPPC64LEVM()
+	ppc.Configure(cfg)
+	dir = t.TempDir()
+	if args, err = ppc.seedArgs(ppc, dir); err != nil {
+		t.Fatalf("seedArgs() failed: %v", err)
+	}
+	drivePath := filepath.Join(dir, ConfigDriveName)
+	if !slices.Contains(args, "file="+drivePath+",if=none,id=configdrive,media=cdrom,readonly=on,format=raw") {
+		t.Errorf("ppc64le seedArgs() = %v, want the config drive attached", args)
+	}
+	if slices.Contains(args, "-fw_cfg") {
+		t.Errorf("ppc64le seedArgs() = %v, want no fw_cfg", args)
+	}
+	if _, err := os.Stat(drivePath); err != nil {
+		t.Errorf("config drive was not written: %v", err)
+	}
+}
+
+func TestSeedArgsMissingKey(t *testing.T) {
+	vm := NewX86_64VM()
+	cfg := config.DefaultConfig()
+	cfg.SSHKey = filepath.Join(t.TempDir(), "missing")
+	vm.Configure(cfg)
+
+	if _, err := vm.seedArgs(vm, t.TempDir()); err == nil {
+		t.Error("seedArgs() succeeded with a missing SSH key")
+	}
+}
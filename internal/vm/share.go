@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// Shared folder constants
+const (
+	VirtiofsdBinary    = "virtiofsd"
+	VirtiofsdLogName   = "virtiofsd.log"
+	SharedMemoryID     = "mem"
+	ShareSocketPattern = "virtiofs-%d.sock"
+	ShareDeviceID      = "fs%d"
+)
+
+// virtiofsdPaths are where distributions install virtiofsd outside of PATH.
+var virtiofsdPaths = []string{
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+}
+
+// FindVirtiofsd returns the path of virtiofsd, or "" if it is not installed.
+// It's a variable so tests can mock it.
+var FindVirtiofsd = func() string {
+	if path, err := exec.LookPath(VirtiofsdBinary); err == nil {
+		return path
+	}
+	for _, path := range virtiofsdPaths {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// virtiofsd is a virtiofsd process serving one shared folder.
+type virtiofsd struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// stop kills virtiofsd, unless it already exited, and waits for it.
+func (d *virtiofsd) stop() {
+	d.cmd.Process.Kill()
+	<-d.exited
+}
+
+// stopAll stops the given virtiofsd processes.
+func stopAll(daemons []*virtiofsd) {
+	for _, d := range daemons {
+		d.stop()
+	}
+}
+
+// startShares prepares the shared folders of the VM. With virtiofsd, one is
+// started per folder, with their sockets in the state directory dir; without
+// it, the folders are shared via 9p. It returns the QEMU arguments and the
+// virtiofsd processes, which the caller must stop once QEMU exits.
+func (v *BaseVM) startShares(vm VM, dir string) ([]string, []*virtiofsd, error) {
+	if len(v.Shares) == 0 {
+		return nil, nil, nil
+	}
+	shares, err := absShares(v.Shares)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	binary := FindVirtiofsd()
+	if binary == "" {
+		fmt.Println("virtiofsd not found, sharing folders via 9p")
+		return ninePArgs(vm.VirtioTransport(), shares), nil, nil
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, VirtiofsdLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create virtiofsd log file: %w", err)
+	}
+	defer logFile.Close()
+
+	var daemons []*virtiofsd
+	var sockets []string
+	for i, share := range shares {
+		socket := filepath.Join(dir, fmt.Sprintf(ShareSocketPattern, i))
+		d, err := v.startVirtiofsd(binary, socket, share, logFile)
+		if err != nil {
+			stopAll(daemons)
+			return nil, nil, err
+		}
+		daemons = append(daemons, d)
+		sockets = append(sockets, socket)
+	}
+	return virtiofsArgs(vm.VirtioTransport(), v.RAM, shares, sockets), daemons, nil
+}
+
+// absShares returns the shares with absolute host paths, as virtiofsd and
+// QEMU may run in another directory.
+func absShares(shares []config.Share) ([]config.Share, error) {
+	abs := make([]config.Share, len(shares))
+	for i, share := range shares {
+		path, err := filepath.Abs(share.HostPath)
+		if err != nil {
+			return nil, err
+		}
+		abs[i] = config.Share{HostPath: path, Tag: share.Tag}
+	}
+	return abs, nil
+}
+
+// startVirtiofsd starts virtiofsd serving share on socket and waits until
+// the socket exists.
+func (v *BaseVM) startVirtiofsd(binary, socket string, share config.Share, logFile *os.File) (*virtiofsd, error) {
+	args := []string{"--socket-path=" + socket, "--shared-dir=" + share.HostPath, "--cache=auto"}
+	if os.Geteuid() != 0 {
+		// The namespace sandbox needs privileges an ordinary user lacks.
+		args = append(args, "--sandbox=none")
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if v.Detach {
+		setDetached(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start virtiofsd: %w", err)
+	}
+
+	d := &virtiofsd{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(d.exited)
+	}()
+
+	deadline := time.After(DetachStartTimeout)
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			return d, nil
+		}
+		select {
+		case <-d.exited:
+			return nil, fmt.Errorf("virtiofsd exited while starting to share '%s' (see %s)", share.HostPath, logFile.Name())
+		case <-deadline:
+			d.stop()
+			return nil, fmt.Errorf("virtiofsd did not start within %s", DetachStartTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// virtiofsArgs returns the arguments attaching the shares served by
+// virtiofsd on the given sockets. vhost-user devices need the guest memory
+// to be shared with virtiofsd, so it's backed by a memfd of ramGB.
+func virtiofsArgs(transport string, ramGB int, shares []config.Share, sockets []string) []string {
+	args := []string{
+		"-object", fmt.Sprintf("memory-backend-memfd,id=%s,size=%dG,share=on", SharedMemoryID, ramGB),
+		"-machine", "memory-backend=" + SharedMemoryID,
+	}
+	for i, share := range shares {
+		id := fmt.Sprintf(ShareDeviceID, i)
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=%s,path=%s", id, sockets[i]),
+			"-device", fmt.Sprintf("vhost-user-fs-%s,chardev=%s,tag=%s", transport, id, share.Tag))
+	}
+	return args
+}
+
+// ninePArgs returns the arguments sharing the folders via 9p, which QEMU
+// serves itself.
+func ninePArgs(transport string, shares []config.Share) []string {
+	var args []string
+	for i, share := range shares {
+		id := fmt.Sprintf(ShareDeviceID, i)
+		args = append(args,
+			"-fsdev", fmt.Sprintf("local,id=%s,path=%s,security_model=mapped-xattr", id, share.HostPath),
+			"-device", fmt.Sprintf("virtio-9p-%s,fsdev=%s,mount_tag=%s", transport, id, share.Tag))
+	}
+	return args
+}
+
+// killProcesses kills the processes that are still alive with an argument
+// containing marker, e.g. the virtiofsd processes of a detached VM, whose
+// sockets are in its state directory.
+func killProcesses(pids []int, marker string) {
+	for _, pid := range pids {
+		if !state.ProcessRuns(pid, marker) {
+			continue
+		}
+		if proc, err := os.FindProcess(pid); err == nil {
+			proc.Kill()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/ilmanzo/q2boot/internal/config"
+)
+
+// fakeVirtiofsd creates its --socket-path, like virtiofsd, and waits.
+const fakeVirtiofsd = `#!/bin/sh
+for arg; do
+	case "$arg" in --socket-path=*) : > "${arg#--socket-path=}" ;; esac
+done
+exec sleep 60
+`
+
+func TestStartSharesNineP(t *testing.T) {
+	original := FindVirtiofsd
+	defer func() { FindVirtiofsd = original }()
+	FindVirtiofsd = func() string { return "" }
+
+	share := t.TempDir()
+	vm := NewS390XVM()
+	vm.Configure(&config.VMConfig{CPU: 2, RAMGb: 2, Shares: []string{share + ":src"}})
+
+	args, daemons, err := vm.startShares(vm, t.TempDir())
+	if err != nil {
+		t.Fatalf("startShares() failed: %v", err)
+	}
+	if len(daemons) != 0 {
+		t.Errorf("startShares() started %d virtiofsd processes, want none", len(daemons))
+	}
+	want := []string{
+		"-fsdev", "local,id=fs0,path=" + share + ",security_model=mapped-xattr",
+		"-device", "virtio-9p-ccw,fsdev=fs0,mount_tag=src",
+	}
+	if !slices.Equal(args, want) {
+		t.Errorf("startShares() = %v, want %v", args, want)
+	}
+}
+
+func TestStartSharesVirtiofs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("virtiofsd is only available on Linux")
+	}
+	binary := filepath.Join(t.TempDir(), "virtiofsd")
+	if err := os.WriteFile(binary, []byte(fakeVirtiofsd), 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := FindVirtiofsd
+	defer func() { FindVirtiofsd = original }()
+	FindVirtiofsd = func() string { return binary }
+
+	share := t.TempDir()
+	dir := t.TempDir()
+	vm := NewX86_64VM()
+	vm.Configure(&config.VMConfig{CPU: 2, RAMGb: 4, Shares: []string{share + ":hostsrc"}})
+
+	args, daemons, err := vm.startShares(vm, dir)
+	if err != nil {
+		t.Fatalf("startShares() failed: %v", err)
+	}
+	if len(daemons) != 1 {
+		t.Fatalf("startShares() started %d virtiofsd processes, want 1", len(daemons))
+	}
+	socket := filepath.Join(dir, "virtiofs-0.sock")
+	want := []string{
+		"-object", "memory-backend-memfd,id=mem,size=4G,share=on",
+		"-machine", "memory-backend=mem",
+		"-chardev", "socket,id=fs0,path=" + socket,
+		"-device", "vhost-user-fs-pci,chardev=fs0,tag=hostsrc",
+	}
+	if !slices.Equal(args, want) {
+		t.Errorf("startShares() = %v, want %v", args, want)
+	}
+
+	stopAll(daemons)
+	select {
+	case <-daemons[0].exited:
+	default:
+		t.Error("virtiofsd is still running after stopAll()")
+	}
+}
+
+func TestStartSharesVirtiofsdFails(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("virtiofsd is only available on Linux")
+	}
+	binary := filepath.Join(t.TempDir(), "virtiofsd")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	original := FindVirtiofsd
+	defer func() { FindVirtiofsd = original }()
+	FindVirtiofsd = func() string { return binary }
+
+	vm := NewX86_64VM()
+	vm.Configure(&config.VMConfig{CPU: 2, RAMGb: 2, Shares: []string{t.TempDir()}})
+	if _, _, err := vm.startShares(vm, t.TempDir()); err == nil {
+		t.Error("startShares() succeeded although virtiofsd exited")
+	}
+}
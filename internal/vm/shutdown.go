@@ -0,0 +1,229 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/qmp"
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// Shutdown timing constants
+const (
+	DefaultShutdownTimeout = 60 * time.Second // Grace period for an ACPI powerdown
+	QuitTimeout            = 10 * time.Second // Time QEMU gets to exit after "quit"
+	KillTimeout            = 5 * time.Second  // Time the kernel gets to reap QEMU after SIGKILL
+	qmpTimeout             = 5 * time.Second
+	exitPollInterval       = 200 * time.Millisecond
+)
+
+// ShutdownStage identifies the step of a graceful shutdown that stopped the VM.
+type ShutdownStage int
+
+const (
+	// StagePowerdown means the guest powered off after an ACPI powerdown request.
+	StagePowerdown ShutdownStage = iota
+	// StageQuit means QEMU was told to quit, without the guest shutting down.
+	StageQuit
+	// StageKill means QEMU had to be killed with SIGKILL.
+	StageKill
+)
+
+func (s ShutdownStage) String() string {
+	switch s {
+	case StagePowerdown:
+		return "ACPI powerdown"
+	case StageQuit:
+		return "QEMU quit"
+	case StageKill:
+		return "SIGKILL"
+	default:
+		return "unknown"
+	}
+}
+
+// shutdownTarget abstracts a QEMU process that can be shut down, either one
+// started by this process or one found through its state record.
+type shutdownTarget struct {
+	qmpSocket string
+	pid       int
+	// waitExit waits up to timeout for QEMU to exit and reports whether it did.
+	// It returns early with false if hurry fires.
+	waitExit func(timeout time.Duration, hurry <-chan os.Signal) bool
+	// owned reports whether pid still belongs to QEMU, before it's signalled.
+	// It's nil for processes started by this one, which can't be reused.
+	owned func() bool
+}
+
+// Shutdown stops the VM gracefully. It requests an ACPI powerdown and waits up
+// to grace for the guest to power off, then tells QEMU to quit, and finally
+// kills it. A signal received on hurry skips to the next stage. It returns the
+// stage that actually stopped the VM.
+func (i *Instance) Shutdown(grace time.Duration, hurry <-chan os.Signal) (ShutdownStage, error) {
+	target := shutdownTarget{
+		qmpSocket: i.Record.QMPSocket,
+		pid:       i.Record.PID,
+		waitExit: func(timeout time.Duration, hurry <-chan os.Signal) bool {
+			select {
+			case <-i.exited:
+				return true
+			case <-hurry:
+				return false
+			case <-time.After(timeout):
+				return false
+			}
+		},
+	}
+	return target.shutdown(grace, hurry)
+}
+
+// ShutdownRecord stops a VM started by another q2boot process, using the same
+// escalation as Instance.Shutdown. If force is set, the powerdown stage is
+// skipped.
+func ShutdownRecord(rec *state.Record, grace time.Duration, force bool) (ShutdownStage, error) {
+	target := shutdownTarget{
+		qmpSocket: rec.QMPSocket,
+		pid:       rec.PID,
+		waitExit: func(timeout time.Duration, hurry <-chan os.Signal) bool {
+			deadline := time.Now().Add(timeout)
+			for rec.Alive() {
+				if time.Now().After(deadline) {
+					return false
+				}
+				time.Sleep(exitPollInterval)
+			}
+			return true
+		},
+		owned: rec.Alive,
+	}
+	if force {
+		grace = 0
+	}
+	stage, err := target.shutdown(grace, nil)
+	if err == nil {
+		// The virtiofsd processes were started by the q2boot process that
+		// detached, so nobody else cleans them up.
+		killProcesses(rec.VirtiofsdPIDs, state.VMDir(rec.Name))
+	}
+	return stage, err
+}
+
+func (t shutdownTarget) shutdown(grace time.Duration, hurry <-chan os.Signal) (ShutdownStage, error) {
+	client, err := qmp.Dial(t.qmpSocket, qmpTimeout)
+	if err != nil {
+		fmt.Println("QMP is not available, skipping ACPI powerdown", "error", err)
+	} else {
+		defer client.Close()
+	}
+
+	// Stage 1: ask the guest to power off
+	if client != nil && grace > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), qmpTimeout)
+		err := client.SystemPowerdown(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("ACPI powerdown request failed", "error", err)
+		} else {
+			fmt.Printf("Requested ACPI powerdown, waiting up to %s for the guest to power off...\n", grace)
+			if t.waitExit(grace, hurry) {
+				return StagePowerdown, nil
+			}
+		}
+	}
+
+	// Stage 2: tell QEMU to quit, or send SIGTERM if QMP is not available
+	if client != nil {
+		if grace > 0 {
+			fmt.Println("Guest did not power off, telling QEMU to quit")
+		} else {
+			fmt.Println("Telling QEMU to quit")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), qmpTimeout)
+		err = client.Quit(ctx)
+		cancel()
+	} else if t.owned != nil && !t.owned() {
+		// QEMU is gone, and its PID may belong to another process by now
+		return StageQuit, nil
+	} else {
+		fmt.Println("Sending SIGTERM to QEMU", "pid", t.pid)
+		err = signalProcess(t.pid, syscall.SIGTERM)
+	}
+	if err != nil {
+		fmt.Println("Failed to quit QEMU", "error", err)
+	} else if t.waitExit(QuitTimeout, hurry) {
+		return StageQuit, nil
+	}
+
+	// Stage 3: kill QEMU
+	if t.owned != nil && !t.owned() {
+		return StageQuit, nil
+	}
+	fmt.Println("QEMU did not quit, killing it", "pid", t.pid)
+	if err := signalProcess(t.pid, syscall.SIGKILL); err != nil {
+		return StageKill, fmt.Errorf("failed to kill QEMU (PID %d): %w", t.pid, err)
+	}
+	if !t.waitExit(KillTimeout, nil) {
+		return StageKill, fmt.Errorf("QEMU (PID %d) is still running after SIGKILL", t.pid)
+	}
+	return StageKill, nil
+}
+
+// signalProcess sends sig to the process with the given PID.
+func signalProcess(pid int, sig os.Signal) error {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+// waitWithSignals waits for QEMU to exit. If q2boot receives SIGINT, SIGTERM
+// or SIGHUP meanwhile, the VM is shut down gracefully instead of being left
+// running or killed hard; further signals skip to the next shutdown stage.
+// Errors received on stop come from helpers watching the VM: errStopRequested
+// shuts it down like a signal, while any other error (e.g. the VM never became
+// ready) makes QEMU quit right away and is returned.
+func (i *Instance) waitWithSignals(grace time.Duration, stop <-chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var reason error
+	select {
+	case <-i.exited:
+		return i.Wait()
+	case sig := <-signals:
+		fmt.Printf("\nReceived %s, shutting down VM '%s'...\n", sig, i.Name)
+	case reason = <-stop:
+		switch {
+		case errors.Is(reason, errQEMUExited):
+			return i.Wait()
+		case errors.Is(reason, errStopRequested):
+			fmt.Printf("\nShutting down VM '%s'...\n", i.Name)
+			reason = nil
+		default:
+			fmt.Printf("\r\n%v, stopping it...\r\n", reason)
+			grace = 0
+		}
+	}
+
+	stage, err := i.Shutdown(grace, signals)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VM '%s' stopped by %s.\n", i.Name, stage)
+	if reason != nil {
+		i.Wait()
+		return reason
+	}
+	if stage == StageKill {
+		i.Wait()
+		return fmt.Errorf("VM '%s' did not shut down cleanly and was killed", i.Name)
+	}
+	return i.Wait()
+}
@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/state"
+)
+
+// fakeQMPServer serves a minimal QMP endpoint. onCommand is called for each
+// executed command and the server replies with an empty return.
+func fakeQMPServer(t *testing.T, onCommand func(name string)) string {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprintln(conn, `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}, "package": ""}, "capabilities": []}}`)
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					var cmd struct {
+						Execute string          `json:"execute"`
+						ID      json.RawMessage `json:"id"`
+					}
+					json.Unmarshal(scanner.Bytes(), &cmd)
+					if cmd.Execute != "qmp_capabilities" {
+						onCommand(cmd.Execute)
+					}
+					fmt.Fprintf(conn, "{\"return\": {}, \"id\": %s}\n", cmd.ID)
+				}
+			}(conn)
+		}
+	}()
+	return socketPath
+}
+
+// fakeTarget returns a shutdown target whose process "exits" when exited is closed.
+func fakeTarget(socketPath string, exited chan struct{}) shutdownTarget {
+	return shutdownTarget{
+		qmpSocket: socketPath,
+		pid:       -1,
+		waitExit: func(timeout time.Duration, hurry <-chan os.Signal) bool {
+			select {
+			case <-exited:
+				return true
+			case <-hurry:
+				return false
+			case <-time.After(timeout):
+				return false
+			}
+		},
+	}
+}
+
+func TestShutdownByPowerdown(t *testing.T) {
+	exited := make(chan struct{})
+	socketPath := fakeQMPServer(t, func(name string) {
+		if name == "system_powerdown" {
+			close(exited)
+		}
+	})
+
+	stage, err := fakeTarget(socketPath, exited).shutdown(time.Second, nil)
+	if err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+	if stage != StagePowerdown {
+		t.Errorf("shutdown() stage = %s, want %s", stage, StagePowerdown)
+	}
+}
+
+func TestShutdownFallsBackToQuit(t *testing.T) {
+	exited := make(chan struct{})
+	var commands []string
+	socketPath := fakeQMPServer(t, func(name string) {
+		commands = append(commands, name)
+		if name == "quit" {
+			close(exited)
+		}
+	})
+
+	stage, err := fakeTarget(socketPath, exited).shutdown(50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+	if stage != StageQuit {
+		t.Errorf("shutdown() stage = %s, want %s", stage, StageQuit)
+	}
+	if len(commands) != 2 || commands[0] != "system_powerdown" || commands[1] != "quit" {
+		t.Errorf("expected system_powerdown then quit, got %v", commands)
+	}
+}
+
+func TestShutdownSignalSkipsPowerdown(t *testing.T) {
+	exited := make(chan struct{})
+	socketPath := fakeQMPServer(t, func(name string) {
+		if name == "quit" {
+			close(exited)
+		}
+	})
+
+	// A second signal must not wait for the full grace period.
+	hurry := make(chan os.Signal, 1)
+	hurry <- os.Interrupt
+
+	start := time.Now()
+	stage, err := fakeTarget(socketPath, exited).shutdown(time.Minute, hurry)
+	if err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+	if stage != StageQuit {
+		t.Errorf("shutdown() stage = %s, want %s", stage, StageQuit)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("shutdown() took %s despite a second signal", elapsed)
+	}
+}
+
+func TestShutdownStageString(t *testing.T) {
+	tests := map[ShutdownStage]string{
+		StagePowerdown: "ACPI powerdown",
+		StageQuit:      "QEMU quit",
+		StageKill:      "SIGKILL",
+	}
+	for stage, want := range tests {
+		if got := stage.String(); got != want {
+			t.Errorf("ShutdownStage(%d).String() = %s, want %s", stage, got, want)
+		}
+	}
+}
+
+func TestAbortStopsQEMUThatDidNotStart(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	dir, err := state.Create("stuck")
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// A QEMU that never creates its QMP socket
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot run 'sleep': %v", err)
+	}
+	inst := &Instance{Name: "stuck", Dir: dir, cmd: cmd, exited: make(chan struct{})}
+	inst.Record = &state.Record{Name: "stuck", PID: cmd.Process.Pid, QMPSocket: filepath.Join(dir, QMPSocketName)}
+	go func() {
+		inst.exitErr = cmd.Wait()
+		close(inst.exited)
+	}()
+
+	err = inst.WaitStarted(200 * time.Millisecond)
+	if err == nil {
+		t.Fatal("WaitStarted() should time out")
+	}
+	if got := inst.abort(err); got != err {
+		t.Errorf("abort() = %v, want %v", got, err)
+	}
+	select {
+	case <-inst.Exited():
+	default:
+		t.Error("abort() left QEMU running")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("abort() left the state directory behind: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -8,8 +9,14 @@ import (
 	"os/exec"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/detector"
+	"github.com/ilmanzo/q2boot/internal/expect"
+	"github.com/ilmanzo/q2boot/internal/image"
+	"github.com/ilmanzo/q2boot/internal/qga"
 )
 
 // VM configuration constants
@@ -22,11 +29,19 @@ const (
 	LocalhostAddress     = "127.0.0.1"
 	TCPNetworkProtocol   = "tcp"
 	MonitorProtocol      = "telnet"
+	QMPSocketName        = "qmp.sock"
+	ConsoleSocketName    = "console.sock"
+	AgentSocketName      = "qga.sock"
+	AgentChardevID       = "qga0"
+	QEMULogName          = "qemu.log"
+	DisplayModeNone      = "none"
 	AudioDeviceID        = "snd0"
 	AudioDeviceType      = "none"
 	SnapshotArgument     = "-snapshot"
 	SerialConsoleStdio   = "stdio"
 	DisplayModeGraphical = "curses"
+	VirtioTransportPCI   = "pci"
+	VirtioTransportCCW   = "ccw"
 )
 
 var logger *log.Logger
@@ -51,6 +66,15 @@ type VM interface {
 	// GetNonGraphicalDisplayArgs returns display arguments for non-graphical mode
 	GetNonGraphicalDisplayArgs() []string
 
+	// SupportsFwCfg reports whether the machine offers QEMU's fw_cfg
+	// interface, which Ignition and Combustion can read their config from
+	SupportsFwCfg() bool
+
+	// VirtioTransport returns the transport of virtio devices added next to
+	// the disk and network, e.g. the controller of a seed CD-ROM: "pci", or
+	// "ccw" on s390x
+	VirtioTransport() string
+
 	// Configure sets up the VM with the provided configuration
 	Configure(cfg *config.VMConfig)
 
@@ -59,21 +83,80 @@ type VM interface {
 
 	Validate() error
 	Run() error
+
+	// Start boots the VM in the background, like --detach, and returns once
+	// it is up and ready, or when ctx is cancelled. The caller is responsible
+	// for shutting it down.
+	Start(ctx context.Context) (*Instance, error)
 }
 
 // BaseVM provides common functionality for all VM implementations
 type BaseVM struct {
-	DiskPath      string
+	DiskPath string
+	// DiskFormat is the format of the disk image, given to QEMU so that it
+	// doesn't probe it ("" lets QEMU probe)
+	DiskFormat    string
 	CPU           int
 	RAM           int
 	Graphical     bool
 	NoSnapshot    bool
 	Confirm       bool
+	Detach        bool
 	SSHPort       uint16
 	MonitorPort   uint16
 	LogFile       string
 	FirmwarePath  string
+	Name          string
+	Arch          string
+	QMPSocket     string
+	ConsoleSocket string
 	ExtraQemuArgs []string
+
+	// OS is the guest operating system, if it was identified; some need
+	// tuning (see osProfiles)
+	OS *detector.OSInfo
+
+	// GuestAgent adds a virtio-serial channel for the QEMU guest agent,
+	// served on AgentSocket (see package qga)
+	GuestAgent  bool
+	AgentSocket string
+
+	// Forwards are forwarded to the guest in addition to the SSH port
+	Forwards []config.Forward
+
+	// Shares are host folders shared with the guest via virtiofs, or 9p
+	// when virtiofsd is not installed
+	Shares []config.Share
+
+	// ShutdownTimeout is how long the guest gets to power off after an ACPI
+	// powerdown request before QEMU is told to quit
+	ShutdownTimeout time.Duration
+
+	// WaitFor is a regular expression the serial console output must match,
+	// and WaitSSH requires the forwarded SSH port to answer, before the VM is
+	// reported ready. WaitTimeout bounds the wait (0 means no limit).
+	WaitFor     string
+	WaitSSH     bool
+	WaitTimeout time.Duration
+
+	// ExpectScript is the path of an expect script run on the serial console
+	// once QEMU is up (see package expect)
+	ExpectScript string
+
+	// CloudInit is a cloud-init user-data file, SSHKey a public key (or the
+	// private key next to it) and Hostname the guest's hostname. Any of them
+	// attaches a cloud-init seed CD-ROM (see package cloudinit).
+	CloudInit string
+	SSHKey    string
+	Hostname  string
+
+	// Ignition is an Ignition config and Combustion a Combustion script,
+	// passed via fw_cfg or on a config drive (see package configdrive)
+	Ignition   string
+	Combustion string
+
+	// cfg is the configuration the VM was configured with, kept for its state record
+	cfg *config.VMConfig
 }
 
 // NewBaseVM creates a new BaseVM with default settings
@@ -87,6 +170,8 @@ func NewBaseVM() *BaseVM {
 		Graphical:   false,
 		NoSnapshot:  false,
 		Confirm:     false,
+
+		ShutdownTimeout: DefaultShutdownTimeout,
 	}
 }
 
@@ -100,15 +185,44 @@ func (v *BaseVM) Configure(cfg *config.VMConfig) {
 	v.Graphical = cfg.Graphical
 	v.NoSnapshot = cfg.WriteMode
 	v.Confirm = cfg.Confirm
+	v.Detach = cfg.Detach
 	if cfg.DiskPath != "" {
-		v.DiskPath = cfg.DiskPath
+		v.SetDiskPath(cfg.DiskPath)
 	}
+	v.Name = cfg.Name
+	v.Arch = cfg.Arch
+	v.QMPSocket = cfg.QMPSocket
+	v.GuestAgent = cfg.GuestAgent
 	v.ExtraQemuArgs = cfg.ExtraQemuArgs
+	v.OS = cfg.OS
+	v.Forwards, _ = cfg.PortForwards() // Checked by cfg.Validate
+	v.Shares, _ = cfg.SharedFolders()  // Checked by cfg.Validate
+	v.ShutdownTimeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	v.WaitFor = cfg.WaitFor
+	v.WaitSSH = cfg.WaitSSH
+	v.WaitTimeout = time.Duration(cfg.WaitTimeout) * time.Second
+	v.ExpectScript = cfg.ExpectScript
+	v.CloudInit = cfg.CloudInit
+	v.SSHKey = cfg.SSHKey
+	v.Hostname = cfg.Hostname
+	v.Ignition = cfg.Ignition
+	v.Combustion = cfg.Combustion
+	v.cfg = cfg
 }
 
-// SetDiskPath sets the disk image path
+// SetDiskPath sets the disk image path and detects its format
 func (v *BaseVM) SetDiskPath(path string) {
 	v.DiskPath = path
+	v.DiskFormat, _ = image.DetectFormat(path)
+}
+
+// driveFile returns the file and format options of the disk drive. Naming
+// the format stops QEMU from probing it, and from warning about raw images.
+func (v *BaseVM) driveFile() string {
+	if v.DiskFormat == "" {
+		return "file=" + v.DiskPath
+	}
+	return fmt.Sprintf("file=%s,format=%s", v.DiskPath, v.DiskFormat)
 }
 
 // GetNonGraphicalDisplayArgs returns display arguments for non-graphical mode
@@ -117,6 +231,18 @@ func (v *BaseVM) GetNonGraphicalDisplayArgs() []string {
 	return []string{"-display", DisplayModeGraphical}
 }
 
+// SupportsFwCfg reports whether the machine offers fw_cfg.
+// Default implementation assumes it does
+func (v *BaseVM) SupportsFwCfg() bool {
+	return true
+}
+
+// VirtioTransport returns the transport of additional virtio devices.
+// Default implementation uses PCI
+func (v *BaseVM) VirtioTransport() string {
+	return VirtioTransportPCI
+}
+
 // GetInstallationInstructions returns architecture-specific installation instructions for a QEMU binary
 func GetInstallationInstructions(binary string) string {
 	var ubuntuPkg, suseArch, archPkg string
@@ -162,14 +288,48 @@ func IsPortAvailable(port uint16) bool {
 	return true
 }
 
+// ValidateForwardsAvailable checks if the host ports of the port forwards are available
+func ValidateForwardsAvailable(forwards []config.Forward) error {
+	for _, f := range forwards {
+		addr := f.HostAddress()
+		var err error
+		if f.Proto == config.ForwardUDP {
+			var conn net.PacketConn
+			if conn, err = net.ListenPacket(f.Proto, addr); err == nil {
+				conn.Close()
+			}
+		} else {
+			var listener net.Listener
+			if listener, err = net.Listen(f.Proto, addr); err == nil {
+				listener.Close()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("host port of forward '%s' is not available: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// userNetdev returns the -netdev value of a user-mode network with the given
+// id, forwarding the SSH port and the port forwards to the guest.
+func (v *BaseVM) userNetdev(id string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "user,id=%s,hostfwd=tcp::%d-:22", id, v.SSHPort)
+	for _, f := range v.Forwards {
+		fmt.Fprintf(&b, ",hostfwd=%s:%s-:%d", f.Proto, f.HostAddress(), f.GuestPort)
+	}
+	return b.String()
+}
+
 // ValidatePortsAvailable checks if the required ports (SSH and monitor) are available
 func ValidatePortsAvailable(sshPort, monitorPort uint16) error {
 	if !IsPortAvailable(sshPort) {
-		return fmt.Errorf("SSH port %d is already in use. Please choose a different port using --ssh-port", sshPort)
+		return fmt.Errorf("SSH port %d is already in use. Please choose a different port using --ssh-port (or --ssh-port auto)", sshPort)
 	}
 
 	if monitorPort > 0 && !IsPortAvailable(monitorPort) {
-		return fmt.Errorf("monitor port %d is already in use. Please choose a different port using --monitor-port", monitorPort)
+		return fmt.Errorf("monitor port %d is already in use. Please choose a different port using --monitor-port (or --monitor-port auto)", monitorPort)
 	}
 
 	return nil
@@ -186,6 +346,9 @@ func (v *BaseVM) Validate(vm VM) error {
 	if err := ValidatePortsAvailable(v.SSHPort, v.MonitorPort); err != nil {
 		return err
 	}
+	if err := ValidateForwardsAvailable(v.Forwards); err != nil {
+		return err
+	}
 
 	// 3. Validate disk path
 	if v.DiskPath == "" {
@@ -213,6 +376,11 @@ func (v *BaseVM) buildArgs(vm VM, extraArgs []string) []string {
 	// Add network arguments
 	args = append(args, vm.GetNetworkArgs()...)
 
+	// Add the guest agent channel
+	if v.AgentSocket != "" {
+		args = append(args, agentArgs(vm.VirtioTransport(), v.AgentSocket)...)
+	}
+
 	// Add any extra arguments (e.g., for cloud-init)
 	if extraArgs != nil {
 		args = append(args, extraArgs...)
@@ -227,7 +395,14 @@ func (v *BaseVM) buildArgs(vm VM, extraArgs []string) []string {
 	args = append(args, "-audiodev", fmt.Sprintf("%s,id=%s", AudioDeviceType, AudioDeviceID))
 
 	// Handle display mode
-	if v.Graphical {
+	if v.serialOnSocket() {
+		// The serial console is served on a unix socket instead of the
+		// terminal (see below), so no display is needed at all.
+		args = append(args, "-display", DisplayModeNone)
+		if !v.NoSnapshot {
+			args = append(args, SnapshotArgument)
+		}
+	} else if v.Graphical {
 		graphicalArgs := vm.GetGraphicalArgs()
 		args = append(args, graphicalArgs...)
 		// If graphical mode is implemented via -nographic (e.g., for s390x),
@@ -249,7 +424,7 @@ func (v *BaseVM) buildArgs(vm VM, extraArgs []string) []string {
 		if !slices.Contains(args, "mon:stdio") {
 			args = append(args, "-monitor", fmt.Sprintf("%s:%s:%d,server,nowait", MonitorProtocol, LocalhostAddress, v.MonitorPort))
 		}
-	} else if !v.Graphical {
+	} else if !v.Graphical || v.serialOnSocket() {
 		// For console modes, disable the interactive monitor on stdio by default
 		// unless it's already handled (e.g. for s390x).
 		if !slices.Contains(args, "-monitor") && !slices.Contains(args, "mon:stdio") {
@@ -258,8 +433,20 @@ func (v *BaseVM) buildArgs(vm VM, extraArgs []string) []string {
 	}
 	// For graphical modes, the default monitor is usually in the GUI window, which is fine.
 
-	// Add logging arguments
-	if v.LogFile != "" {
+	// Expose QMP for programmatic control (shutdown, status, events)
+	if v.QMPSocket != "" {
+		args = append(args, "-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", v.QMPSocket))
+	}
+
+	// Add serial console and logging arguments
+	if v.serialOnSocket() {
+		chardev := fmt.Sprintf("socket,id=char0,path=%s,server=on,wait=off", v.ConsoleSocket)
+		if v.LogFile != "" {
+			chardev += fmt.Sprintf(",logfile=%s", v.LogFile)
+		}
+		args = append(args, "-chardev", chardev)
+		args = append(args, "-serial", "chardev:char0")
+	} else if v.LogFile != "" {
 		args = append(args, "-chardev", fmt.Sprintf("stdio,mux=on,id=char0,logfile=%s,signal=off", v.LogFile))
 		args = append(args, "-mon", "chardev=char0,mode=readline")
 		args = append(args, "-serial", "chardev:char0")
@@ -268,38 +455,107 @@ func (v *BaseVM) buildArgs(vm VM, extraArgs []string) []string {
 	return args
 }
 
+// agentArgs returns the arguments adding a virtio-serial port for the guest
+// agent, served on a unix socket, with a controller of the given transport.
+func agentArgs(transport, socket string) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", AgentChardevID, socket),
+		"-device", "virtio-serial-" + transport,
+		"-device", fmt.Sprintf("virtserialport,chardev=%s,name=%s", AgentChardevID, qga.ChannelName),
+	}
+}
+
+// usesTerminal reports whether QEMU run with args uses the terminal, for
+// the serial console or the monitor. -nographic puts both on it by default.
+func usesTerminal(args []string) bool {
+	for _, arg := range args {
+		if arg == "-nographic" || arg == SerialConsoleStdio || arg == "mon:stdio" || strings.HasPrefix(arg, "stdio,") {
+			return true
+		}
+	}
+	return false
+}
+
+// serialOnSocket reports whether the serial console is served on a unix
+// socket rather than on the terminal: for detached VMs, and when an expect
+// script has to drive it.
+func (v *BaseVM) serialOnSocket() bool {
+	return v.Detach || v.ExpectScript != ""
+}
+
 // run is a helper to execute the VM, containing logic common to all architectures.
 func (v *BaseVM) run(vm VM) error {
-	args := v.buildArgs(vm, nil)
-	return RunVM(vm.QEMUBinary(), args, v.Confirm)
+	if v.Detach {
+		return v.runDetached(vm)
+	}
+
+	cond, err := v.prepareReadyCondition()
+	if err != nil {
+		return err
+	}
+	var script *expect.Script
+	if v.ExpectScript != "" {
+		if script, err = expect.Load(v.ExpectScript); err != nil {
+			return err
+		}
+	}
+
+	inst, err := v.start(vm)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan error, 2)
+	if cond.Enabled() {
+		// The guest console may own the terminal (in raw mode), so readiness
+		// is reported on stderr with explicit carriage returns.
+		go func() {
+			if err := inst.WaitReady(context.Background(), cond, v.WaitTimeout); err != nil {
+				stop <- err
+				return
+			}
+			fmt.Fprintf(os.Stderr, "\r\nq2boot: VM '%s' is ready\r\n", inst.Name)
+		}()
+	}
+	if script != nil {
+		// Run the script, then hand the console over to the user
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := inst.RunScript(context.Background(), script, os.Stdout, os.Stderr); err != nil {
+				stop <- err
+				return
+			}
+			if inst.attachConsole() {
+				stop <- errStopRequested
+			}
+		}()
+	}
+
+	err = inst.waitWithSignals(v.ShutdownTimeout, stop)
+	wg.Wait() // make sure the terminal settings are restored
+	return err
 }
 
-// RunVM executes the VM with the given binary and arguments.
-// The cleanup function is optional and will be called if the VM exits.
-func RunVM(binary string, args []string, confirm bool) error {
+// startQEMU prints the QEMU command line and starts it. If confirm is set,
+// it waits for the user to press Enter first.
+func startQEMU(cmd *exec.Cmd, confirm bool, guest string) error {
 	fmt.Println("Starting QEMU with the following command:")
-	fmt.Println("Command", "binary", binary, "args", strings.Join(args, " "))
+	fmt.Println("Command", "binary", cmd.Args[0], "args", strings.Join(cmd.Args[1:], " "))
 
 	if confirm {
+		if guest != "" {
+			fmt.Println("Guest operating system", "os", guest)
+		}
 		fmt.Print("Press Enter to continue...")
 		var input string
 		fmt.Scanln(&input)
 	}
 
-	cmd := exec.Command(binary, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			fmt.Println("QEMU exited with error", "status", exitError.ExitCode())
-			return fmt.Errorf("QEMU exited with status %d", exitError.ExitCode())
-		}
+	if err := cmd.Start(); err != nil {
 		fmt.Println("Failed to start QEMU", "error", err)
 		return fmt.Errorf("failed to start QEMU: %w", err)
 	}
-
 	return nil
 }
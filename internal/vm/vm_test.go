@@ -2,11 +2,14 @@ package vm
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
 
 	"github.com/ilmanzo/q2boot/internal/config"
+	"github.com/ilmanzo/q2boot/internal/detector"
 )
 
 func TestNewBaseVM(t *testing.T) {
@@ -236,6 +239,29 @@ func TestS390XVM(t *testing.T) {
 	}
 }
 
+func TestGetNetworkArgsWithForwards(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.SSHPort = 2223
+	cfg.Forwards = []string{"8080-80", "udp:127.0.0.1:5353-53", "[::1]:8443-443"}
+
+	tests := []struct {
+		vm   VM
+		want string
+	}{
+		{NewX86_64VM(), "user,id=net0,hostfwd=tcp::2223-:22,hostfwd=tcp::8080-:80,hostfwd=udp:127.0.0.1:5353-:53,hostfwd=tcp:[::1]:8443-:443"},
+		{NewAARCH64VM(), "user,id=net0,hostfwd=tcp::2223-:22,hostfwd=tcp::8080-:80,hostfwd=udp:127.0.0.1:5353-:53,hostfwd=tcp:[::1]:8443-:443"},
+		{NewPPC64LEVM(), "user,id=net0,hostfwd=tcp::2223-:22,hostfwd=tcp::8080-:80,hostfwd=udp:127.0.0.1:5353-:53,hostfwd=tcp:[::1]:8443-:443"},
+		{NewS390XVM(), "user,id=net1,hostfwd=tcp::2223-:22,hostfwd=tcp::8080-:80,hostfwd=udp:127.0.0.1:5353-:53,hostfwd=tcp:[::1]:8443-:443"},
+	}
+	for _, tt := range tests {
+		tt.vm.Configure(cfg)
+		args := tt.vm.GetNetworkArgs()
+		if len(args) < 2 || args[0] != "-netdev" || args[1] != tt.want {
+			t.Errorf("%s: GetNetworkArgs() = %v, want -netdev %s", tt.vm.QEMUBinary(), args, tt.want)
+		}
+	}
+}
+
 func TestValidateQEMUBinary(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -573,6 +599,42 @@ func TestBuildArgs(t *testing.T) {
 			wantArgs:    []string{"-monitor", "telnet:127.0.0.1:9999,server,nowait"},
 			notWantArgs: []string{},
 		},
+		{
+			name: "with QMP socket",
+			setupVM: func(vm *MockVM) {
+				vm.QMPSocket = "/tmp/q2boot/qmp.sock"
+			},
+			wantArgs:    []string{"-qmp", "unix:/tmp/q2boot/qmp.sock,server=on,wait=off"},
+			notWantArgs: []string{},
+		},
+		{
+			name: "detached mode",
+			setupVM: func(vm *MockVM) {
+				vm.Detach = true
+				vm.ConsoleSocket = "/tmp/q2boot/console.sock"
+				vm.LogFile = "serial.log"
+			},
+			wantArgs: []string{
+				"-display", "none", "-snapshot", "-monitor", "none",
+				"-chardev", "socket,id=char0,path=/tmp/q2boot/console.sock,server=on,wait=off,logfile=serial.log",
+				"-serial", "chardev:char0",
+			},
+			notWantArgs: []string{"mock-headless", "stdio,mux=on,id=char0,logfile=serial.log,signal=off"},
+		},
+		{
+			name: "expect script in foreground",
+			setupVM: func(vm *MockVM) {
+				vm.ExpectScript = "login.yaml"
+				vm.ConsoleSocket = "/tmp/q2boot/console.sock"
+				vm.LogFile = "serial.log"
+			},
+			wantArgs: []string{
+				"-display", "none", "-snapshot",
+				"-chardev", "socket,id=char0,path=/tmp/q2boot/console.sock,server=on,wait=off,logfile=serial.log",
+				"-serial", "chardev:char0",
+			},
+			notWantArgs: []string{"mock-headless", "stdio,mux=on,id=char0,logfile=serial.log,signal=off"},
+		},
 		{
 			name: "common args present",
 			setupVM: func(vm *MockVM) {
@@ -637,3 +699,126 @@ func TestBuildArgsWithExtraArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestUsesTerminal(t *testing.T) {
+	tests := []struct {
+		name      string
+		graphical bool
+		logFile   string
+		want      bool
+	}{
+		{"serial console", false, "", true},
+		{"serial console with log", false, "serial.log", true},
+		{"graphical with log", true, "serial.log", true},
+		{"graphical", true, "", false},
+	}
+	for _, tt := range tests {
+		x86 := NewX86_64VM()
+		x86.Graphical, x86.LogFile = tt.graphical, tt.logFile
+		if got := usesTerminal(x86.buildArgs(x86, nil)); got != tt.want {
+			t.Errorf("%s: usesTerminal() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildArgsGuestAgent(t *testing.T) {
+	x86 := NewX86_64VM()
+	if args := x86.buildArgs(x86, nil); slices.Contains(args, "virtio-serial-pci") {
+		t.Errorf("buildArgs() added a guest agent channel without --guest-agent: %v", args)
+	}
+
+	s390x := NewS390XVM()
+	tests := []struct {
+		vm         VM
+		base       *BaseVM
+		wantDevice string
+	}{
+		{x86, x86.BaseVM, "virtio-serial-pci"},
+		{s390x, s390x.BaseVM, "virtio-serial-ccw"},
+	}
+	for _, tt := range tests {
+		tt.base.AgentSocket = "/run/vm/qga.sock"
+		args := tt.base.buildArgs(tt.vm, nil)
+		for _, want := range []string{
+			"socket,id=qga0,path=/run/vm/qga.sock,server=on,wait=off",
+			tt.wantDevice,
+			"virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		} {
+			if !slices.Contains(args, want) {
+				t.Errorf("%s: buildArgs() = %v, missing %s", tt.vm.QEMUBinary(), args, want)
+			}
+		}
+	}
+}
+
+func TestDiskArgsFormat(t *testing.T) {
+	dir := t.TempDir()
+	qcow2 := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(qcow2, []byte("QFI\xfb\x00\x00\x00\x03"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(raw, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		disk string
+		want string
+	}{
+		// A truncated qcow2 header still names the format
+		{qcow2, "file=" + qcow2 + ",format=qcow2,"},
+		{raw, "file=" + raw + ",format=raw,"},
+		// Missing images are left to QEMU to report
+		{filepath.Join(dir, "missing.qcow2"), "file=" + filepath.Join(dir, "missing.qcow2") + ",if=none"},
+	}
+	for _, tt := range tests {
+		x86 := NewX86_64VM()
+		x86.SetDiskPath(tt.disk)
+		if drive := x86.GetDiskArgs()[1]; !strings.HasPrefix(drive, tt.want) {
+			t.Errorf("GetDiskArgs() drive = %s, want prefix %s", drive, tt.want)
+		}
+	}
+}
+
+func TestOSProfiles(t *testing.T) {
+	tests := []struct {
+		name string
+		vm   VM
+		arch string
+		os   *detector.OSInfo
+		want string
+	}{
+		{"unknown OS", NewPPC64LEVM(), "ppc64le", nil, "power10"},
+		{"SLE 15 SP3", NewPPC64LEVM(), "ppc64le", &detector.OSInfo{ID: "sles", Version: "15.3"}, "power9"},
+		{"SLE 12 SP5", NewPPC64LEVM(), "ppc64le", &detector.OSInfo{ID: "sles", Version: "12.5"}, "power9"},
+		{"SLE 15 SP6", NewPPC64LEVM(), "ppc64le", &detector.OSInfo{ID: "sles", Version: "15.6"}, "power10"},
+		{"SLE 16", NewPPC64LEVM(), "ppc64le", &detector.OSInfo{ID: "sles", Version: "16.0"}, "power10"},
+		{"Tumbleweed", NewPPC64LEVM(), "ppc64le", &detector.OSInfo{ID: "opensuse-tumbleweed", Version: "20250601"}, "power10"},
+		{"Windows", NewX86_64VM(), "x86_64", &detector.OSInfo{ID: detector.OSWindows}, "host,hv-relaxed,"},
+		{"Linux on x86_64", NewX86_64VM(), "x86_64", &detector.OSInfo{ID: "sles", Version: "15.3"}, "host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.vm.Configure(&config.VMConfig{Arch: tt.arch, OS: tt.os})
+			args := tt.vm.GetArchArgs()
+			i := slices.Index(args, "-cpu")
+			// Wanted models ending with a comma are followed by features
+			if i < 0 || !(args[i+1] == tt.want || strings.HasSuffix(tt.want, ",") && strings.HasPrefix(args[i+1], tt.want)) {
+				t.Errorf("GetArchArgs() = %v, want -cpu %s", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuestSummary(t *testing.T) {
+	v := NewBaseVM()
+	if got := v.guestSummary(); got != "" {
+		t.Errorf("guestSummary() = %q without an OS", got)
+	}
+	v.Arch = "ppc64le"
+	v.OS = &detector.OSInfo{ID: "sles", Name: "SUSE Linux Enterprise Server 15 SP2", Version: "15.2"}
+	if got := v.guestSummary(); got != "SUSE Linux Enterprise Server 15 SP2, tuned: SLE before 15 SP4 doesn't support POWER10" {
+		t.Errorf("guestSummary() = %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/ilmanzo/q2boot/internal/ready"
+)
+
+// errQEMUExited is the cause reported when QEMU exits before the VM is ready.
+var errQEMUExited = errors.New("QEMU exited")
+
+// readyCondition builds the readiness condition from the --wait-for and
+// --wait-ssh settings.
+func (v *BaseVM) readyCondition() (ready.Condition, error) {
+	var cond ready.Condition
+	if v.WaitFor != "" {
+		re, err := regexp.Compile(v.WaitFor)
+		if err != nil {
+			return cond, fmt.Errorf("invalid --wait-for pattern: %w", err)
+		}
+		if v.LogFile == "" {
+			return cond, fmt.Errorf("--wait-for needs a serial log file (--log-file)")
+		}
+		cond.Pattern = re
+		cond.LogFile = v.LogFile
+	}
+	if v.WaitSSH {
+		cond.SSHAddr = net.JoinHostPort(LocalhostAddress, strconv.Itoa(int(v.SSHPort)))
+	}
+	return cond, nil
+}
+
+// WaitReady waits until cond is met. It fails if QEMU exits first, if ctx
+// is cancelled or if timeout expires; a zero timeout waits indefinitely.
+func (i *Instance) WaitReady(ctx context.Context, cond ready.Condition, timeout time.Duration) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timed out after %s", timeout))
+		defer cancelTimeout()
+	}
+
+	go func() {
+		select {
+		case <-i.exited:
+			cancel(errQEMUExited)
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := ready.Wait(ctx, cond); err != nil {
+		return fmt.Errorf("VM '%s' did not become ready: %w", i.Name, err)
+	}
+	return nil
+}
+
+// prepareReadyCondition validates the readiness settings before QEMU starts.
+// The serial log is removed so that output from a previous boot, which QEMU
+// only truncates once it starts, cannot satisfy the pattern.
+func (v *BaseVM) prepareReadyCondition() (ready.Condition, error) {
+	cond, err := v.readyCondition()
+	if err != nil {
+		return cond, err
+	}
+	if cond.Pattern != nil {
+		if err := os.Remove(cond.LogFile); err != nil && !os.IsNotExist(err) {
+			return cond, fmt.Errorf("failed to remove old serial log: %w", err)
+		}
+	}
+	return cond, nil
+}
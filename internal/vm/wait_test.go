@@ -0,0 +1,66 @@
+package vm
+
+import "testing"
+
+func TestReadyCondition(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(v *BaseVM)
+		wantEnabled bool
+		wantSSHAddr string
+		wantErr     bool
+	}{
+		{
+			name:        "no probes",
+			setup:       func(v *BaseVM) {},
+			wantEnabled: false,
+		},
+		{
+			name:        "serial pattern",
+			setup:       func(v *BaseVM) { v.WaitFor = "login:" },
+			wantEnabled: true,
+		},
+		{
+			name: "ssh probe on forwarded port",
+			setup: func(v *BaseVM) {
+				v.WaitSSH = true
+				v.SSHPort = 2345
+			},
+			wantEnabled: true,
+			wantSSHAddr: "127.0.0.1:2345",
+		},
+		{
+			name:    "invalid pattern",
+			setup:   func(v *BaseVM) { v.WaitFor = "login[" },
+			wantErr: true,
+		},
+		{
+			name: "pattern without log file",
+			setup: func(v *BaseVM) {
+				v.WaitFor = "login:"
+				v.LogFile = ""
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewBaseVM()
+			tt.setup(v)
+			cond, err := v.readyCondition()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readyCondition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cond.Enabled() != tt.wantEnabled {
+				t.Errorf("Enabled() = %v, want %v", cond.Enabled(), tt.wantEnabled)
+			}
+			if cond.SSHAddr != tt.wantSSHAddr {
+				t.Errorf("SSHAddr = %q, want %q", cond.SSHAddr, tt.wantSSHAddr)
+			}
+		})
+	}
+}
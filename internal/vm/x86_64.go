@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -22,15 +23,16 @@ func (vm *X86_64VM) QEMUBinary() string {
 }
 
 // GetArchArgs returns architecture-specific arguments for x86_64
+// Windows guests get the Hyper-V enlightenments (see osProfiles)
 func (vm *X86_64VM) GetArchArgs() []string {
-	return []string{"-M", "q35", "-enable-kvm", "-cpu", "host"}
+	return []string{"-M", "q35", "-enable-kvm", "-cpu", vm.cpuModel("host")}
 }
 
 // GetDiskArgs returns disk-specific arguments for x86_64
 func (vm *X86_64VM) GetDiskArgs() []string {
 	return []string{
 		"-drive",
-		fmt.Sprintf("file=%s,if=none,id=disk0,cache=none,aio=native,discard=unmap", vm.DiskPath),
+		fmt.Sprintf("%s,if=none,id=disk0,cache=none,aio=native,discard=unmap", vm.driveFile()),
 		"-device",
 		fmt.Sprintf("virtio-blk-pci,drive=disk0,num-queues=%d", vm.CPU),
 	}
@@ -40,7 +42,7 @@ func (vm *X86_64VM) GetDiskArgs() []string {
 func (vm *X86_64VM) GetNetworkArgs() []string {
 	return []string{
 		"-netdev",
-		fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", vm.SSHPort),
+		vm.userNetdev("net0"),
 		"-device",
 		"virtio-net-pci,netdev=net0,mq=on",
 	}
@@ -71,3 +73,8 @@ func (vm *X86_64VM) Validate() error {
 func (vm *X86_64VM) Run() error {
 	return vm.run(vm)
 }
+
+// Start boots the VM in the background and satisfies the VM interface.
+func (vm *X86_64VM) Start(ctx context.Context) (*Instance, error) {
+	return vm.startBackground(ctx, vm)
+}
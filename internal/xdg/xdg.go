@@ -0,0 +1,49 @@
+// Package xdg resolves the per-user directories used by q2boot, following the
+// XDG Base Directory specification.
+package xdg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AppName is the directory name used below each base directory.
+const AppName = "q2boot"
+
+// RuntimeDir returns the directory holding runtime files such as sockets and
+// VM state records: $XDG_RUNTIME_DIR/q2boot. When XDG_RUNTIME_DIR is not set
+// (e.g. on macOS), a per-user directory in the system temp dir is used.
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, AppName)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", AppName, os.Getuid()))
+}
+
+// DataHome returns the directory holding user data such as overlays:
+// $XDG_DATA_HOME/q2boot, or ~/.local/share/q2boot when it is not set.
+func DataHome() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, AppName)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d-data", AppName, os.Getuid()))
+	}
+	return filepath.Join(home, ".local", "share", AppName)
+}
+
+// CacheHome returns the directory holding cached data that can be recomputed,
+// such as detection results: $XDG_CACHE_HOME/q2boot, or ~/.cache/q2boot when
+// it is not set.
+func CacheHome() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, AppName)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d-cache", AppName, os.Getuid()))
+	}
+	return filepath.Join(home, ".cache", AppName)
+}
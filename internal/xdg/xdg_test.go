@@ -0,0 +1,57 @@
+package xdg
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeDir(t *testing.T) {
+	t.Run("uses XDG_RUNTIME_DIR", func(t *testing.T) {
+		t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+		if got := RuntimeDir(); got != filepath.Join("/run/user/1000", AppName) {
+			t.Errorf("RuntimeDir() = %s, want /run/user/1000/%s", got, AppName)
+		}
+	})
+
+	t.Run("falls back to temp dir", func(t *testing.T) {
+		t.Setenv("XDG_RUNTIME_DIR", "")
+		if got := RuntimeDir(); !strings.Contains(filepath.Base(got), AppName+"-") {
+			t.Errorf("RuntimeDir() = %s, want a per-user %s directory", got, AppName)
+		}
+	})
+}
+
+func TestDataHome(t *testing.T) {
+	t.Run("uses XDG_DATA_HOME", func(t *testing.T) {
+		t.Setenv("XDG_DATA_HOME", "/data")
+		if got := DataHome(); got != filepath.Join("/data", AppName) {
+			t.Errorf("DataHome() = %s, want /data/%s", got, AppName)
+		}
+	})
+
+	t.Run("falls back to ~/.local/share", func(t *testing.T) {
+		t.Setenv("XDG_DATA_HOME", "")
+		t.Setenv("HOME", "/home/tester")
+		if got := DataHome(); got != filepath.Join("/home/tester", ".local", "share", AppName) {
+			t.Errorf("DataHome() = %s, want /home/tester/.local/share/%s", got, AppName)
+		}
+	})
+}
+
+func TestCacheHome(t *testing.T) {
+	t.Run("uses XDG_CACHE_HOME", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", "/cache")
+		if got := CacheHome(); got != filepath.Join("/cache", AppName) {
+			t.Errorf("CacheHome() = %s, want /cache/%s", got, AppName)
+		}
+	})
+
+	t.Run("falls back to ~/.cache", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", "")
+		t.Setenv("HOME", "/home/tester")
+		if got := CacheHome(); got != filepath.Join("/home/tester", ".cache", AppName) {
+			t.Errorf("CacheHome() = %s, want /home/tester/.cache/%s", got, AppName)
+		}
+	})
+}